@@ -8,8 +8,10 @@ import (
 	"appengine/memcache"
 	"appengine/runtime"
 	"appengine/urlfetch"
+	"config"
 	"controller"
 	"dataproviders"
+	_ "dataproviders/all"
 	"encoding/json"
 	"io"
 	"logger"
@@ -27,35 +29,19 @@ type staticPlants struct {
 	plants map[string]plantdata.PlantData
 }
 
-// Load up an example plant
-var plantmap = map[string]plantdata.PlantData {
-	"jbr": plantdata.PlantData{PlantKey: "jbr", 
-	                           Name: "Klarinetvej 25",
-	                           DataProvider: dataproviders.FJY,
-	                           InitiateData: dataproviders.InitiateData{PlantKey: "jbr"}},
-//	"peterlarsen": plantdata.PlantData{PlantKey: "peterlarsen", 
-//	                           Name: "Guldnældevænget 35",
-//	                           DataProvider: dataproviders.SunnyPortal,
-//	                           InitiateData: dataproviders.InitiateData{"peterlarsen", "jesper@jbr.dk", "cidaxura", "3", ""}},
-//	"kaup": plantdata.PlantData{PlantKey: "kaup", 
-//	                           Name: "Pandebjergvej",
-//	                           DataProvider: dataproviders.SunnyPortal,
-//	                           InitiateData: dataproviders.InitiateData{"kaup", "jesper@jbr.dk", "cidaxura", "2",""}},
-//	"gldv33": plantdata.PlantData{PlantKey: "gldv33", 
-//	                           Name: "Guldnældevænget 33",
-//	                           DataProvider: dataproviders.SunnyPortal,
-//	                           InitiateData: dataproviders.InitiateData{"gldv33", "jesper@jbr.dk", "cidaxura", "1", ""}},
-	"janbang": plantdata.PlantData{PlantKey: "janbang", 
-	                           Name: "Fuglehaven",
-	                           DataProvider: dataproviders.Danfoss,
-	                           InitiateData: dataproviders.InitiateData{"janbang", "anonym", "anonym", "", "5.103.131.3"}},
-	"lysningen": plantdata.PlantData{PlantKey: "lysningen", 
-	                           Name: "Janniks anlæg",
-	                           DataProvider: dataproviders.Suntrol,
-	                           InitiateData: dataproviders.InitiateData{PlantKey: "lysningen", PlantNo: "7982"}},
-}
+// Plants are loaded from the config file deployed with the app
+var plantmap = loadPlants("plants.json")
 var plants = staticPlants{plantmap}
 
+func loadPlants(path string) map[string]plantdata.PlantData {
+	plants, err := config.Load(path)
+	if err != nil {
+		log.Failf("Could not load plants: %s", err.Error())
+		return map[string]plantdata.PlantData{}
+	}
+	return plants
+}
+
 // Locker for ctrlr as only one should be online at a time
 var ctrlrlock = sync.RWMutex{}
 
@@ -107,7 +93,9 @@ var ctrlrfunc = func(c appengine.Context) {
 						c.Errorf("Could not set memcache for %s, to %s due to", plantkey, pv.ToJson(), err.Error())
 					}
 				},
-				StatsStore{c})
+				StatsStore{c},
+				nil,
+				nil)
 			ctrlr = &newctrlr
 			// Unlock so others will se the controller
 			ctrlrlock.Unlock()
@@ -229,6 +217,11 @@ func (s StatsStore) LoadStats(plantkey string) dataproviders.PlantStats {
 	stats := dataproviders.PlantStats{}
 	if err := json.Unmarshal([]byte(ds.Json), &stats); err != nil {
 		s.c.Infof("Could not umarshal plantstats for %s from datastore due to %s", plantkey, err.Error())
+		return dataproviders.PlantStats{}
+	}
+	// Entries from before the schema was versioned are put back as the current version on SaveStats
+	if stats.SchemaVersion < dataproviders.SchemaVersion {
+		s.c.Infof("Migrating plantstats for %s to schema version %d", plantkey, dataproviders.SchemaVersion)
 	}
 	//s.c.Debugf("Loaded stats for %s, as %s", plantkey, ds.Json)
 	return stats
@@ -0,0 +1,238 @@
+// Package config loads the plants from a json config file
+package config
+
+import (
+	"dataproviders"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"plantdata"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A plant as written in the config file
+type PlantConfig struct {
+	PlantKey  string
+	Name      string
+	Latitude  string
+	Longitude string
+	// Name of the dataprovider, eg. sunnyportal
+	Provider     string
+	CellData     plantdata.CellData
+	InverterData plantdata.InverterData
+	// PlantKey is set from the plant, and may be left out
+	InitiateData dataproviders.InitiateData
+	// Upload to pvoutput.org, if set
+	PvOutput *plantdata.PvOutputData `json:",omitempty"`
+	// For a plant with more than one inverter, instead of Provider and InitiateData
+	Inverters []InverterConfig `json:",omitempty"`
+}
+
+// An inverter of a plant with more than one
+type InverterConfig struct {
+	// Unique within the plant
+	Key      string
+	Provider string
+	// PlantKey is set from the plant and the key, and may be left out
+	InitiateData dataproviders.InitiateData
+}
+
+type File struct {
+	Plants []PlantConfig
+}
+
+// Load and validate the plants in the config file at path
+func Load(path string) (map[string]plantdata.PlantData, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	plants, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return plants, nil
+}
+
+// Parse and validate the plants in a config file
+func Parse(b []byte) (map[string]plantdata.PlantData, error) {
+	f := File{}
+	err := json.Unmarshal(b, &f)
+	if err != nil {
+		return nil, err
+	}
+	err = f.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return f.PlantData(), nil
+}
+
+// Validate all plants. All errors found are reported at once
+func (f *File) Validate() error {
+	errs := []string{}
+	seen := map[string]bool{}
+	for i, p := range f.Plants {
+		fail := func(format string, v ...interface{}) {
+			errs = append(errs, fmt.Sprintf("plant %d (%s): ", i+1, p.PlantKey)+fmt.Sprintf(format, v...))
+		}
+		if p.PlantKey == "" {
+			fail("PlantKey is missing")
+		} else if strings.ContainsAny(p.PlantKey, keyChars) {
+			fail("PlantKey must not contain any of / ? # , . or space")
+		}
+		if seen[p.PlantKey] {
+			fail("PlantKey is used by more than one plant")
+		}
+		seen[p.PlantKey] = true
+		if p.InitiateData.PlantKey != "" && p.InitiateData.PlantKey != p.PlantKey {
+			fail("InitiateData.PlantKey %s differs from PlantKey", p.InitiateData.PlantKey)
+		}
+		for _, coord := range []string{p.Latitude, p.Longitude} {
+			if _, err := strconv.ParseFloat(coord, 64); coord != "" && err != nil {
+				fail("Bad coordinate %s", coord)
+			}
+		}
+		if len(p.Inverters) > 0 {
+			if p.Provider != "" {
+				fail("Provider must not be given with Inverters")
+			}
+			inverters := map[string]bool{}
+			for _, inv := range p.Inverters {
+				if inv.Key == "" {
+					fail("Inverter key is missing")
+				} else if strings.ContainsAny(inv.Key, keyChars) {
+					fail("Inverter key %s must not contain any of / ? # , . or space", inv.Key)
+				}
+				if inverters[inv.Key] {
+					fail("Inverter key %s is used by more than one inverter", inv.Key)
+				}
+				inverters[inv.Key] = true
+				if err := validateProvider(inv.Provider, &inv.InitiateData); err != nil {
+					fail("inverter %s: %s", inv.Key, err.Error())
+				}
+			}
+		} else if err := validateProvider(p.Provider, &p.InitiateData); err != nil {
+			fail("%s", err.Error())
+		}
+		if p.PvOutput != nil {
+			if p.PvOutput.ApiKey == "" {
+				fail("PvOutput.ApiKey is required")
+			}
+			if _, err := strconv.ParseUint(p.PvOutput.SystemId, 10, 32); err != nil {
+				fail("PvOutput.SystemId must be a number, was '%s'", p.PvOutput.SystemId)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Invalid plant config:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// Characters not allowed in plantkeys and inverter keys
+const keyChars = "/?#,. "
+
+func validateProvider(provider string, initiateData *dataproviders.InitiateData) error {
+	r, ok := dataproviders.Lookup(provider)
+	if !ok {
+		return fmt.Errorf("Unknown provider '%s', known providers are %s",
+			provider, strings.Join(dataproviders.Names(), ", "))
+	}
+	if err := r.Validate(initiateData); err != nil {
+		return err
+	}
+	_, err := dataproviders.RetryPolicy{}.WithOptions(initiateData.Options)
+	return err
+}
+
+// The plants as plantdata, by plantkey
+func (f *File) PlantData() map[string]plantdata.PlantData {
+	plants := map[string]plantdata.PlantData{}
+	for _, p := range f.Plants {
+		initiateData := p.InitiateData
+		initiateData.PlantKey = p.PlantKey
+		var inverters []plantdata.InverterSource
+		for _, inv := range p.Inverters {
+			i := plantdata.InverterSource{Key: inv.Key, DataProvider: inv.Provider, InitiateData: inv.InitiateData}
+			i.InitiateData.PlantKey = dataproviders.SubKey(p.PlantKey, inv.Key)
+			inverters = append(inverters, i)
+		}
+		plants[p.PlantKey] = plantdata.PlantData{PlantKey: p.PlantKey,
+			Name:         p.Name,
+			Latitide:     p.Latitude,
+			Longitude:    p.Longitude,
+			CellData:     p.CellData,
+			InverterData: p.InverterData,
+			InitiateData: initiateData,
+			DataProvider: p.Provider,
+			PvOutput:     p.PvOutput,
+			Inverters:    inverters}
+	}
+	return plants
+}
+
+// The config of the plant
+func FromPlantData(p *plantdata.PlantData) PlantConfig {
+	initiateData := p.InitiateData
+	// Is set from the plant on load
+	initiateData.PlantKey = ""
+	var inverters []InverterConfig
+	for _, inv := range p.Inverters {
+		i := InverterConfig{Key: inv.Key, Provider: inv.DataProvider, InitiateData: inv.InitiateData}
+		i.InitiateData.PlantKey = ""
+		inverters = append(inverters, i)
+	}
+	return PlantConfig{PlantKey: p.PlantKey,
+		Name:         p.Name,
+		Latitude:     p.Latitide,
+		Longitude:    p.Longitude,
+		Provider:     p.DataProvider,
+		CellData:     p.CellData,
+		InverterData: p.InverterData,
+		InitiateData: initiateData,
+		PvOutput:     p.PvOutput,
+		Inverters:    inverters}
+}
+
+// A config file with the plants, sorted by plantkey
+func NewFile(plants map[string]plantdata.PlantData) File {
+	f := File{Plants: []PlantConfig{}}
+	for _, p := range plants {
+		f.Plants = append(f.Plants, FromPlantData(&p))
+	}
+	sort.Slice(f.Plants, func(i, j int) bool { return f.Plants[i].PlantKey < f.Plants[j].PlantKey })
+	return f
+}
+
+// Save the config file to path.
+// The file is replaced in one go, so a crash will not leave half a file behind.
+func (f *File) Save(path string) error {
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	// The file holds provider credentials
+	if err = tmp.Chmod(0600); err == nil {
+		_, err = tmp.Write(append(b, '\n'))
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"dataproviders"
+	_ "dataproviders/all"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+/*
+To run test export GOPATH=/Users/jbr/github/local/solarcompare
+then
+go test -test.v config
+*/
+
+func Test_load_example(t *testing.T) {
+	plants, err := Load("../plants.example.json")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	p, ok := plants["janbang"]
+	if !ok {
+		t.Fatal("Plant janbang not loaded")
+	}
+	if p.DataProvider != "danfoss" || p.InitiateData.Address != "192.168.1.10" {
+		t.Errorf("Plant janbang loaded wrong, %v", p)
+	}
+	// PlantKey is copied into the InitiateData
+	if p.InitiateData.PlantKey != "janbang" {
+		t.Errorf("InitiateData.PlantKey should be janbang was %s", p.InitiateData.PlantKey)
+	}
+	// Each inverter gets its sub key
+	farm := plants["farm"]
+	if len(farm.Inverters) != 2 || farm.Inverters[1].InitiateData.PlantKey != "farm.roof" {
+		t.Errorf("Inverters of farm loaded wrong, %v", farm.Inverters)
+	}
+}
+
+func Test_validate(t *testing.T) {
+	_, err := Parse([]byte(`{"Plants": [
+		{"PlantKey": "a", "Provider": "nosuchprovider"},
+		{"PlantKey": "b", "Provider": "kostal", "InitiateData": {"UserName": "u", "Password": "p"}},
+		{"PlantKey": "b", "Provider": "jfy", "Latitude": "north"},
+		{"Provider": "jfy"},
+		{"PlantKey": "c", "Provider": "jfy", "PvOutput": {"SystemId": "s1"}},
+		{"PlantKey": "d", "Provider": "jfy", "Inverters": [{"Key": "x", "Provider": "jfy"}]},
+		{"PlantKey": "e", "Inverters": [{"Key": "x.y", "Provider": "jfy"}, {"Key": "x.y", "Provider": "kostal"}, {"Provider": "jfy"}]},
+		{"PlantKey": "f", "Provider": "jfy", "InitiateData": {"Options": {"retry.backoff": "soon"}}},
+		{"PlantKey": "g", "Provider": "generic", "InitiateData": {"Address": "http://logger/data.json",
+			"Options": {"PowerAc": "$.data[", "EnergyTotal": "$.etotal"}}},
+		{"PlantKey": "h", "Provider": "generic", "InitiateData": {"Address": "http://logger/data.json",
+			"Options": {"PowerAc": "$.pac", "PowerAc.scale": "kilo"}}},
+		{"PlantKey": "i", "Provider": "mqtt", "InitiateData": {"Address": "broker",
+			"Options": {"PowerAc": "inverter/+/pac"}}},
+		{"PlantKey": "j", "Provider": "generic", "InitiateData": {"Address": "http://logger/data.json",
+			"Options": {"PowerAc": "$.pac", "interval": "often"}}},
+		{"PlantKey": "k", "Provider": "generic", "InitiateData": {"Address": "http://logger/data.json",
+			"Options": {"PowerAc": "$.pac", "PowerAc.scale": "0.001", "interval": "10"}}}
+	]}`))
+	if err == nil {
+		t.Fatal("Expected validation to fail")
+	}
+	for _, expected := range []string{
+		"plant 1 (a): Unknown provider 'nosuchprovider'",
+		"plant 2 (b): Field Address is required",
+		"plant 3 (b): PlantKey is used by more than one plant",
+		"plant 3 (b): Bad coordinate north",
+		"plant 4 (): PlantKey is missing",
+		"plant 5 (c): PvOutput.ApiKey is required",
+		"plant 5 (c): PvOutput.SystemId must be a number",
+		"plant 6 (d): Provider must not be given with Inverters",
+		"plant 7 (e): Inverter key x.y must not contain",
+		"plant 7 (e): Inverter key x.y is used by more than one inverter",
+		"plant 7 (e): inverter x.y: Field UserName is required",
+		"plant 7 (e): Inverter key is missing",
+		"plant 8 (f): Option retry.backoff must be a positive duration",
+		"plant 9 (g): Bad path for PowerAc",
+		"plant 10 (h): Bad scale for PowerAc: kilo",
+		"plant 11 (i): Bad topic 'inverter/+/pac' for PowerAc",
+		"plant 12 (j): Bad interval often",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected error to contain '%s', was:\n%s", expected, err.Error())
+		}
+	}
+	if strings.Contains(err.Error(), "plant 13") {
+		t.Errorf("Expected a valid generic plant to pass, was:\n%s", err.Error())
+	}
+}
+
+func Test_missing_file(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "config")
+	defer os.RemoveAll(dir)
+	_, err := Load(dir + "/plants.json")
+	if err == nil {
+		t.Error("Expected error on missing file")
+	}
+}
+
+func Test_known_providers(t *testing.T) {
+	for _, name := range []string{"jfy", "sunnyportal", "suntrol", "danfoss", "kostal", "fronius", "sunspec", "webconnect", "solaredge", "enphase", "generic", "mqtt", "ingest"} {
+		if _, ok := dataproviders.Lookup(name); !ok {
+			t.Errorf("Provider %s is not registered", name)
+		}
+	}
+}
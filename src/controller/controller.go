@@ -8,9 +8,13 @@ package controller
 // so we need to be threadsafe. The live map must be syncronized.
 
 import (
+	"context"
 	"dataproviders"
 	"dataproviders/dispatcher"
+	"fmt"
 	"plantdata"
+	"reflect"
+	"secrets"
 	"sync"
 	"logger"
 )
@@ -22,21 +26,31 @@ var lock = sync.RWMutex{}
 
 // The map where the live dataproviders are kept
 type Controller struct {
-	live map[string]string
+	live map[string]dataproviders.DataProvider
+	// The latest provider of each plant that is no longer live, to tell how it ended
+	ended map[string]dataproviders.DataProvider
 	newClient dispatcher.NewClient
 	pvStore dataproviders.PvStore
 	statsStore dataproviders.PlantStatsStore
+	historyStore dataproviders.HistoryStore
+	// Opens the credentials of a plant, when its provider is started
+	keyring *secrets.Keyring
 }
 
 // Create a new controller
 // Only one for entire app
 func NewController(newClient dispatcher.NewClient, 
                    pvStore dataproviders.PvStore,
-                   statsStore dataproviders.PlantStatsStore) Controller {
-	c := Controller{map[string]string{}, 
+                   statsStore dataproviders.PlantStatsStore,
+                   historyStore dataproviders.HistoryStore,
+                   keyring *secrets.Keyring) Controller {
+	c := Controller{map[string]dataproviders.DataProvider{}, 
+	                map[string]dataproviders.DataProvider{},
 	                newClient, 
 	                pvStore,
-	                statsStore}
+	                statsStore,
+	                historyStore,
+	                keyring}
 	//go printStatus(&c)
 	return c
 }
@@ -98,30 +112,233 @@ func (c *Controller) Provider(plantdata *plantdata.PlantData) (err error) {
 //
 //}
 
+// Get the live provider for the plantkey, if any
+func (c *Controller) Live(plantKey string) (provider dataproviders.DataProvider, ok bool) {
+	lock.RLock()
+	provider, ok = c.live[plantKey]
+	lock.RUnlock()
+	return
+}
+
+// List the plantkeys of all live providers
+func (c *Controller) LivePlants() []string {
+	lock.RLock()
+	defer lock.RUnlock()
+	keys := make([]string, 0, len(c.live))
+	for k := range c.live {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Stop the live provider for the plantkey and wait for it to terminate.
+// Does nothing if the plant is not live.
+func (c *Controller) Stop(ctx context.Context, plantKey string) error {
+	lock.Lock()
+	provider, ok := c.live[plantKey]
+	delete(c.live, plantKey)
+	if ok {
+		c.ended[plantKey] = provider
+	}
+	lock.Unlock()
+	if !ok {
+		return nil
+	}
+	log.Infof("Stopping provider for plant %s", plantKey)
+	return provider.Stop(ctx)
+}
+
+// Restart the provider for the plant, eg. when its plantdata has changed
+func (c *Controller) Restart(ctx context.Context, plantdata *plantdata.PlantData) error {
+	err := c.Stop(ctx, plantdata.PlantKey)
+	if err != nil {
+		return err
+	}
+	return c.Provider(plantdata)
+}
+
+// Tell the controller that a plant has been changed from old to plant.
+// If plant is nil the plant was removed, and its live provider is stopped.
+// The live provider is restarted if the provider, its InitiateData or the inverters changed,
+// any other change leaves it running.
+func (c *Controller) PlantChanged(ctx context.Context, old *plantdata.PlantData, plant *plantdata.PlantData) error {
+	if old == nil {
+		return nil
+	}
+	if plant == nil {
+		err := c.Stop(ctx, old.PlantKey)
+		lock.Lock()
+		delete(c.ended, old.PlantKey)
+		lock.Unlock()
+		return err
+	}
+	if c.sameSource(old, plant) {
+		return nil
+	}
+	if _, ok := c.Live(plant.PlantKey); !ok {
+		return nil
+	}
+	log.Infof("Provider for plant %s changed, restarting it", plant.PlantKey)
+	return c.Restart(ctx, plant)
+}
+
+// The InitiateData of the plant, or of its inverter with the key, with the credentials opened,
+// eg. to authorize a request before the provider is started
+func (c *Controller) InitiateData(plant *plantdata.PlantData, inverterkey string) (dataproviders.InitiateData, error) {
+	if inverterkey == "" {
+		return c.keyring.OpenInitiateData(plant.InitiateData)
+	}
+	for _, inv := range plant.Inverters {
+		if inv.Key == inverterkey {
+			return c.keyring.OpenInitiateData(inv.InitiateData)
+		}
+	}
+	return dataproviders.InitiateData{}, fmt.Errorf("Plant %s has no inverter %s", plant.PlantKey, inverterkey)
+}
+
+// Whether the plants have the same provider, InitiateData and inverters.
+// The InitiateData is compared opened, as a stored plant has its credentials
+// sealed, with a new nonce each time they are sealed
+func (c *Controller) sameSource(old *plantdata.PlantData, plant *plantdata.PlantData) bool {
+	if old.DataProvider != plant.DataProvider || len(old.Inverters) != len(plant.Inverters) {
+		return false
+	}
+	same := func(a dataproviders.InitiateData, b dataproviders.InitiateData) bool {
+		a, aerr := c.keyring.OpenInitiateData(a)
+		b, berr := c.keyring.OpenInitiateData(b)
+		return aerr == nil && berr == nil && reflect.DeepEqual(a, b)
+	}
+	if !same(old.InitiateData, plant.InitiateData) {
+		return false
+	}
+	for i, inv := range plant.Inverters {
+		o := old.Inverters[i]
+		if o.Key != inv.Key || o.DataProvider != inv.DataProvider || !same(o.InitiateData, inv.InitiateData) {
+			return false
+		}
+	}
+	return true
+}
+
 func (c *Controller) startNewProvider(plantdata *plantdata.PlantData) error {
 	json, _ := plantdata.ToJson()
 	log.Infof("Starting new dataprovider for plant %s", json)
 
-	err := dispatcher.Provider(plantdata.DataProvider,
-		plantdata.InitiateData,
+	plantKey := plantdata.PlantKey
+	var provider dataproviders.DataProvider
+	var err error
+	if len(plantdata.Inverters) > 0 {
+		provider, err = c.newAggregate(plantdata, func() {
+			c.providerTerminated(plantKey, provider)
+		})
+		if err != nil {
+			return err
+		}
+		if err = provider.Start(); err != nil {
+			return err
+		}
+		c.live[plantKey] = provider
+		return nil
+	}
+	initiateData, err := c.keyring.OpenInitiateData(plantdata.InitiateData)
+	if err != nil {
+		return err
+	}
+	provider, err = dispatcher.Provider(plantdata.DataProvider,
+		initiateData,
 		func() {
-			c.providerTerminated(plantdata.PlantKey)
+			c.providerTerminated(plantKey, provider)
 		}, 
 		c.newClient,
 		c.pvStore,
-		c.statsStore)
+		c.statsStore,
+		c.historyStore)
 	if err != nil {
 		return err
 	}
-	//Just adding plantkey to value as we dont have anything real to add
-	c.live[plantdata.PlantKey] = plantdata.PlantKey 
+	err = provider.Start()
+	if err != nil {
+		return err
+	}
+	c.live[plantKey] = provider
 	return nil
 
 }
 
-func (c *Controller) providerTerminated(plantKey string) {
+// An aggregate of the inverters of the plant, with a provider for each
+func (c *Controller) newAggregate(plant *plantdata.PlantData,
+	term dataproviders.TerminateCallback) (*dataproviders.Aggregate, error) {
+	inverters := map[string]plantdata.InverterSource{}
+	keys := []string{}
+	for _, inv := range plant.Inverters {
+		inverters[inv.Key] = inv
+		keys = append(keys, inv.Key)
+	}
+	return dataproviders.NewAggregate(plant.PlantKey,
+		keys,
+		func(key string, term dataproviders.TerminateCallback, pvStore dataproviders.PvStore) (dataproviders.DataProvider, error) {
+			initiateData, err := c.keyring.OpenInitiateData(inverters[key].InitiateData)
+			if err != nil {
+				return nil, err
+			}
+			return dispatcher.Provider(inverters[key].DataProvider,
+				initiateData,
+				term,
+				c.newClient,
+				pvStore,
+				c.statsStore,
+				c.historyStore)
+		},
+		term,
+		c.pvStore,
+		c.statsStore,
+		c.historyStore)
+}
+
+func (c *Controller) providerTerminated(plantKey string, provider dataproviders.DataProvider) {
 	log.Infof("Controller, plantkey %s gone offline", plantKey)
 	lock.Lock()
-	delete(c.live, plantKey)
+	// Only remove it, if it has not been replaced by a new provider allready
+	if c.live[plantKey] == provider {
+		delete(c.live, plantKey)
+		c.ended[plantKey] = provider
+	}
 	lock.Unlock()
+	if err := provider.LastError(); err != nil {
+		log.Infof("Provider for plant %s ended with the error: %s", plantKey, err.Error())
+	}
+}
+
+// The status of the provider of a plant, or of an inverter
+type PlantStatus struct {
+	PlantKey string
+	Provider string `json:",omitempty"`
+	dataproviders.Health
+	Inverters []PlantStatus `json:",omitempty"`
+}
+
+// The status of the live provider of the plant, or else of the latest one.
+// Idle if no provider has been started for the plant.
+func (c *Controller) Status(plantKey string) PlantStatus {
+	lock.RLock()
+	provider, ok := c.live[plantKey]
+	if !ok {
+		provider, ok = c.ended[plantKey]
+	}
+	lock.RUnlock()
+	if !ok {
+		return PlantStatus{PlantKey: plantKey, Health: dataproviders.Health{State: dataproviders.Idle}}
+	}
+	return status(plantKey, provider)
+}
+
+func status(plantKey string, provider dataproviders.DataProvider) PlantStatus {
+	s := PlantStatus{PlantKey: plantKey, Provider: provider.Name(), Health: provider.Health()}
+	if aggregate, ok := provider.(*dataproviders.Aggregate); ok {
+		for _, k := range aggregate.Inverters() {
+			inverter, _ := aggregate.Inverter(k)
+			s.Inverters = append(s.Inverters, status(dataproviders.SubKey(plantKey, k), inverter))
+		}
+	}
+	return s
 }
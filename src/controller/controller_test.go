@@ -0,0 +1,271 @@
+package controller
+
+import (
+	"context"
+	"dataproviders"
+	"net/http"
+	"plantdata"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+To run test export GOPATH=/Users/jbr/github/local/solarcompare
+then
+go test -test.v controller
+*/
+
+type testStore struct {
+	lock sync.Mutex
+	pv   map[string]dataproviders.PvData
+}
+
+func (s *testStore) Set(plantkey string, pv *dataproviders.PvData) {
+	s.lock.Lock()
+	s.pv[plantkey] = *pv
+	s.lock.Unlock()
+}
+
+func (s *testStore) Get(plantkey string) dataproviders.PvData {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.pv[plantkey]
+}
+
+type testStatsStore struct{}
+
+func (s testStatsStore) LoadStats(plantkey string) dataproviders.PlantStats {
+	return dataproviders.PlantStats{}
+}
+func (s testStatsStore) SaveStats(plantkey string, pv *dataproviders.PvData) {}
+
+// A provider that stores the power and energy given in its options once,
+// updated age seconds ago, and then waits until it is stopped
+type testProvider struct {
+	dataproviders.Lifecycle
+	initiateData dataproviders.InitiateData
+	term         dataproviders.TerminateCallback
+	pvStore      dataproviders.PvStore
+}
+
+func (p *testProvider) Name() string {
+	return "Test"
+}
+
+func (p *testProvider) Capabilities() dataproviders.Capabilities {
+	return dataproviders.Capabilities{PowerAc: true}
+}
+
+func (p *testProvider) Start() error {
+	return p.Launch(func() {
+		defer p.term()
+		option := func(key string) float64 {
+			f, _ := strconv.ParseFloat(p.initiateData.Options[key], 64)
+			return f
+		}
+		t := time.Now().Add(-time.Duration(option("age")) * time.Second)
+		pv := dataproviders.PvData{LatestUpdate: &t,
+			PowerAc:     dataproviders.Watt(option("power")),
+			EnergyToday: dataproviders.WattHour(option("today")),
+			EnergyTotal: dataproviders.KiloWattHour(option("total"))}
+		p.pvStore.Set(p.initiateData.PlantKey, &pv)
+		p.SetState(dataproviders.Online)
+		<-p.Stopping()
+	})
+}
+
+func init() {
+	dataproviders.Register("test",
+		func(initiateData dataproviders.InitiateData,
+			term dataproviders.TerminateCallback,
+			client *http.Client,
+			pvStore dataproviders.PvStore,
+			statsStore dataproviders.PlantStatsStore,
+			historyStore dataproviders.HistoryStore) (dataproviders.DataProvider, error) {
+			return &testProvider{initiateData: initiateData, term: term, pvStore: pvStore}, nil
+		},
+		dataproviders.ConfigSchema{})
+}
+
+// A provider that polls a plant rejecting its password, the first
+// failures times if set in the options, else every time
+type failingProvider struct {
+	testProvider
+}
+
+func (p *failingProvider) Start() error {
+	return p.Launch(func() {
+		failures, err := strconv.Atoi(p.initiateData.Options["failures"])
+		if err != nil {
+			failures = -1
+		}
+		terminate, _ := time.ParseDuration(p.initiateData.Options["terminate"])
+		update := func(i *dataproviders.InitiateData, pv *dataproviders.PvData) error {
+			if failures == 0 {
+				return nil
+			}
+			failures--
+			return dataproviders.NewLoginError("Wrong password for %s", i.UserName)
+		}
+		dataproviders.RunUpdates(&p.Lifecycle, &p.initiateData, update, update,
+			10*time.Millisecond, time.Hour, terminate, p.term,
+			dataproviders.DefaultRetryPolicy(2), testStatsStore{}, p.pvStore, nil)
+	})
+}
+
+func init() {
+	dataproviders.Register("testfailing",
+		func(initiateData dataproviders.InitiateData,
+			term dataproviders.TerminateCallback,
+			client *http.Client,
+			pvStore dataproviders.PvStore,
+			statsStore dataproviders.PlantStatsStore,
+			historyStore dataproviders.HistoryStore) (dataproviders.DataProvider, error) {
+			return &failingProvider{testProvider{initiateData: initiateData, term: term, pvStore: pvStore}}, nil
+		},
+		dataproviders.ConfigSchema{})
+}
+
+func inverter(key string, options map[string]string) plantdata.InverterSource {
+	return plantdata.InverterSource{Key: key, DataProvider: "test",
+		InitiateData: dataproviders.InitiateData{PlantKey: dataproviders.SubKey("plant", key), Options: options}}
+}
+
+func Test_inverters(t *testing.T) {
+	store := &testStore{pv: map[string]dataproviders.PvData{}}
+	c := NewController(func() *http.Client { return http.DefaultClient }, store, testStatsStore{}, nil, nil)
+	plant := plantdata.PlantData{PlantKey: "plant", Inverters: []plantdata.InverterSource{
+		inverter("old", map[string]string{"power": "1000", "today": "2000", "total": "10"}),
+		inverter("new", map[string]string{"power": "500", "today": "1000", "total": "5"}),
+		// Has not been updated for an hour, so only its energy counts
+		inverter("lost", map[string]string{"power": "300", "today": "700", "total": "2", "age": "3600"}),
+	}}
+	if err := c.Provider(&plant); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var pv dataproviders.PvData
+	for i := 0; i < 100; i++ {
+		if pv = store.Get("plant"); pv.EnergyTotal == 17 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if pv.PowerAc != 1500 || pv.EnergyTotal != 17 {
+		t.Errorf("Expected the sum of the inverters, pvdata is %s", pv.ToJson())
+	}
+	if time.Now().Add(-time.Hour).Day() == time.Now().Day() && pv.EnergyToday != 3700 {
+		t.Errorf("Expected energy today of all inverters, pvdata is %s", pv.ToJson())
+	}
+	if inv := store.Get("plant.new"); inv.PowerAc != 500 {
+		t.Errorf("Expected the inverter under its sub key, pvdata is %s", inv.ToJson())
+	}
+
+	status := c.Status("plant")
+	if status.State != dataproviders.Online || !status.Running || len(status.Inverters) != 3 ||
+		status.Inverters[1].PlantKey != "plant.new" || status.Inverters[1].State != dataproviders.Online {
+		t.Errorf("Expected the plant and its inverters online, status is %v", status)
+	}
+
+	provider, ok := c.Live("plant")
+	aggregate, isAggregate := provider.(*dataproviders.Aggregate)
+	if !ok || !isAggregate || provider.Status() != dataproviders.Online {
+		t.Fatalf("Expected an online aggregate, got %v", provider)
+	}
+	old, _ := aggregate.Inverter("old")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := c.Stop(ctx, "plant"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if old.Status() != dataproviders.Terminated {
+		t.Errorf("Expected the inverters to be stopped with the plant, was %s", old.Status())
+	}
+}
+
+// Retries quickly, and probes every 50ms when the circuit is open
+func failingPlant(options map[string]string) plantdata.PlantData {
+	options["retry.backoff"] = "10ms"
+	options["retry.maxbackoff"] = "20ms"
+	options["retry.probe"] = "50ms"
+	return plantdata.PlantData{PlantKey: "plant", DataProvider: "testfailing",
+		InitiateData: dataproviders.InitiateData{PlantKey: "plant", UserName: "user", Options: options}}
+}
+
+// Wait up to a second for the status of the plant to be as expected
+func waitStatus(c Controller, expected func(s PlantStatus) bool) PlantStatus {
+	var status PlantStatus
+	for i := 0; i < 100; i++ {
+		if status = c.Status("plant"); expected(status) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return status
+}
+
+func Test_status(t *testing.T) {
+	store := &testStore{pv: map[string]dataproviders.PvData{}}
+	c := NewController(func() *http.Client { return http.DefaultClient }, store, testStatsStore{}, nil, nil)
+	if status := c.Status("plant"); status.State != dataproviders.Idle || status.Running {
+		t.Errorf("Expected a plant that is not started to be idle, status is %v", status)
+	}
+
+	plant := failingPlant(map[string]string{"terminate": "500ms"})
+	if err := c.Provider(&plant); err != nil {
+		t.Fatal(err.Error())
+	}
+	// The circuit opens, but the provider keeps running
+	status := waitStatus(c, func(s PlantStatus) bool { return s.CircuitOpen })
+	if _, ok := c.Live("plant"); !ok || status.State != dataproviders.LoginFailed || !status.Running ||
+		status.ConsecutiveErrors < 2 || status.NextPoll == nil {
+		t.Errorf("Expected a running provider with an open circuit, status is %v", status)
+	}
+
+	// And is not terminated while the circuit is open
+	time.Sleep(600 * time.Millisecond)
+	if status = c.Status("plant"); !status.Running || !status.CircuitOpen {
+		t.Fatalf("Expected the provider to keep probing past its terminate time, status is %v", status)
+	}
+
+	// The plant does not disappear when the provider ends, but tells why it ended
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := c.Stop(ctx, "plant"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, ok := c.Live("plant"); ok {
+		t.Fatal("Expected the provider to be stopped")
+	}
+	status = c.Status("plant")
+	if status.State != dataproviders.Terminated || status.Running || status.ConsecutiveErrors == 0 ||
+		status.LastError != "Wrong password for user" || status.LastSuccess != nil {
+		t.Errorf("Expected the provider to have ended with a failed login, status is %v", status)
+	}
+}
+
+func Test_recovery(t *testing.T) {
+	store := &testStore{pv: map[string]dataproviders.PvData{}}
+	c := NewController(func() *http.Client { return http.DefaultClient }, store, testStatsStore{}, nil, nil)
+	plant := failingPlant(map[string]string{"failures": "4", "terminate": "1h"})
+	if err := c.Provider(&plant); err != nil {
+		t.Fatal(err.Error())
+	}
+	status := waitStatus(c, func(s PlantStatus) bool { return s.State == dataproviders.Online })
+	if status.State != dataproviders.Online || status.CircuitOpen || status.ConsecutiveErrors != 0 ||
+		status.LastSuccess == nil || status.LastError != "Wrong password for user" {
+		t.Errorf("Expected the plant to recover, status is %v", status)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := c.Stop(ctx, "plant"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if status = c.Status("plant"); status.State != dataproviders.Terminated || status.Running {
+		t.Errorf("Expected a stopped provider to be terminated, status is %v", status)
+	}
+}
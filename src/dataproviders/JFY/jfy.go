@@ -11,21 +11,40 @@ import (
 )
 
 type jfyDataProvider struct {
+	dataproviders.Lifecycle
 	InitiateData   dataproviders.InitiateData
 //	latestReqCh    chan chan dataproviders.PvData
 //	latestUpdateCh chan dataproviders.PvData
 //	terminateCh    chan int
-	latestErr      error
 	client         *http.Client
+	term           dataproviders.TerminateCallback
+	pvStore        dataproviders.PvStore
+	statsStore     dataproviders.PlantStatsStore
+	historyStore   dataproviders.HistoryStore
 }
 
 const GetUrl = "http://cts.jbr.dk:81/json"
 
+const ProviderName = "jfy"
+
 var log = logger.NewLogger(logger.INFO, "Dataprovider: JFY:")
 
 const MAX_ERRORS = 10
 const INACTIVE_TIMOUT = 30 //secs
 
+func init() {
+	dataproviders.Register(ProviderName,
+		func(initiateData dataproviders.InitiateData,
+			term dataproviders.TerminateCallback,
+			client *http.Client,
+			pvStore dataproviders.PvStore,
+			statsStore dataproviders.PlantStatsStore,
+			historyStore dataproviders.HistoryStore) (dataproviders.DataProvider, error) {
+			return NewDataProvider(initiateData, term, client, pvStore, statsStore, historyStore), nil
+		},
+		dataproviders.ConfigSchema{})
+}
+
 func (jfy *jfyDataProvider) Name() string {
 	return "JFY"
 }
@@ -34,44 +53,61 @@ func NewDataProvider(initiateData dataproviders.InitiateData,
 	term dataproviders.TerminateCallback, 
 	client *http.Client,
 	pvStore dataproviders.PvStore,
-	statsStore dataproviders.PlantStatsStore) jfyDataProvider {
+	statsStore dataproviders.PlantStatsStore,
+	historyStore dataproviders.HistoryStore) *jfyDataProvider {
 	log.Debug("New JFY dataprovider")
 	
 
-	jfy := jfyDataProvider{initiateData,
+	jfy := jfyDataProvider{InitiateData: initiateData,
 //		make(chan chan dataproviders.PvData),
 //		make(chan dataproviders.PvData),
 //		make(chan int),
-		nil,
-		client}
-	go dataproviders.RunUpdates(
-		&initiateData,
-		func(id *dataproviders.InitiateData, pv *dataproviders.PvData) error {
-			newpv, err := updatePvData(client)
-			if err != nil {return err}
-			pv.PowerAc = newpv.PowerAc
-			pv.AmpereAc = newpv.AmpereAc
-			pv.EnergyToday = newpv.EnergyToday
-			pv.EnergyTotal = newpv.EnergyTotal
-			pv.VoltDc = newpv.VoltDc
-			pv.LatestUpdate = nil
-
-			return nil
-		},
-		func(id *dataproviders.InitiateData, pv *dataproviders.PvData) error {
-			return nil
-		},
-		time.Second*5,
-		time.Minute*5,
-		time.Minute*30,
-		term,
-		MAX_ERRORS,
-		statsStore,
-		pvStore)
+		client: client,
+		term: term,
+		pvStore: pvStore,
+		statsStore: statsStore,
+		historyStore: historyStore}
+
+	return &jfy
+}
+
+func (jfy *jfyDataProvider) Capabilities() dataproviders.Capabilities {
+	return dataproviders.Capabilities{PowerAc: true, EnergyToday: true,
+		EnergyTotal: true, VoltDc: true, AmpereAc: true}
+}
+
+func (jfy *jfyDataProvider) Start() error {
+	client := jfy.client
+	return jfy.Launch(func() {
+		dataproviders.RunUpdates(
+			&jfy.Lifecycle,
+			&jfy.InitiateData,
+			func(id *dataproviders.InitiateData, pv *dataproviders.PvData) error {
+				newpv, err := updatePvData(client)
+				if err != nil {return err}
+				pv.PowerAc = newpv.PowerAc
+				pv.AmpereAc = newpv.AmpereAc
+				pv.EnergyToday = newpv.EnergyToday
+				pv.EnergyTotal = newpv.EnergyTotal
+				pv.VoltDc = newpv.VoltDc
+				pv.LatestUpdate = nil
+
+				return nil
+			},
+			func(id *dataproviders.InitiateData, pv *dataproviders.PvData) error {
+				return nil
+			},
+			time.Second*5,
+			time.Minute*5,
+			time.Minute*30,
+			jfy.term,
+			dataproviders.DefaultRetryPolicy(MAX_ERRORS),
+			jfy.statsStore,
+			jfy.pvStore,
+			jfy.historyStore)
+	})
 	//go dataproviders.LatestPvData(jfy.latestReqCh, jfy.latestUpdateCh, jfy.terminateCh, 
 	//                              pvDataUpdatedEvent, initiateData.PlantKey)
-
-	return jfy
 }
 
 // Update PvData
@@ -0,0 +1,362 @@
+package dataproviders
+
+// Plants with more than one inverter, eg. an old inverter and a newer
+// extension from another vendor, are run by an Aggregate. It starts a
+// provider for each inverter, that stores its pvdata under the sub key
+// of the inverter, and stores the sum of the inverters as the plant
+// on every update.
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Separates the plantkey and the inverter key in a sub key.
+// Is not allowed in plantkeys, so a sub key never clashes with a plant.
+const SubKeySeparator = "."
+
+// The key an inverter of a plant is stored under, eg. in the PvStore and the history
+func SubKey(plantkey string, inverterkey string) string {
+	return plantkey + SubKeySeparator + inverterkey
+}
+
+// Creates the provider of an inverter. The provider must store its
+// pvdata in pvStore, and call term when it terminates.
+type InverterFactory func(inverterkey string, term TerminateCallback, pvStore PvStore) (DataProvider, error)
+
+// An inverter without updates for this long no longer adds its power
+// to the plant, while its energy total still counts
+var staleTime = 30 * time.Minute
+
+// How long the inverters get to stop, when the plant is stopped
+const inverterStopTime = 30 * time.Second
+
+type Aggregate struct {
+	Lifecycle
+	plantKey     string
+	keys         []string
+	inverters    map[string]DataProvider
+	term         TerminateCallback
+	pvStore      PvStore
+	statsStore   PlantStatsStore
+	historyStore HistoryStore
+	// The key of each inverter that terminates
+	terminated chan string
+	// Locker for sync'ing the sum of the plant
+	lock sync.Mutex
+	pv   PvData
+}
+
+// New aggregate of the inverters with the keys, created by factory
+func NewAggregate(plantKey string,
+	keys []string,
+	factory InverterFactory,
+	term TerminateCallback,
+	pvStore PvStore,
+	statsStore PlantStatsStore,
+	historyStore HistoryStore) (*Aggregate, error) {
+	a := &Aggregate{plantKey: plantKey,
+		keys:         keys,
+		inverters:    map[string]DataProvider{},
+		term:         term,
+		pvStore:      pvStore,
+		statsStore:   statsStore,
+		historyStore: historyStore,
+		terminated:   make(chan string, len(keys))}
+	for _, k := range keys {
+		key := k
+		provider, err := factory(key, func() { a.terminated <- key }, aggregateStore{a})
+		if err != nil {
+			return nil, fmt.Errorf("Inverter %s: %s", key, err.Error())
+		}
+		a.inverters[key] = provider
+	}
+	return a, nil
+}
+
+func (a *Aggregate) Name() string {
+	return "Aggregate"
+}
+
+// The keys of the inverters
+func (a *Aggregate) Inverters() []string {
+	return a.keys
+}
+
+// The provider of the inverter with the key
+func (a *Aggregate) Inverter(key string) (DataProvider, bool) {
+	provider, ok := a.inverters[key]
+	return provider, ok
+}
+
+// Everything any of the inverters fill
+func (a *Aggregate) Capabilities() Capabilities {
+	c := Capabilities{}
+	for _, provider := range a.inverters {
+		ic := provider.Capabilities()
+		c.PowerAc = c.PowerAc || ic.PowerAc
+		c.EnergyToday = c.EnergyToday || ic.EnergyToday
+		c.EnergyTotal = c.EnergyTotal || ic.EnergyTotal
+		c.VoltDc = c.VoltDc || ic.VoltDc
+		c.AmpereAc = c.AmpereAc || ic.AmpereAc
+		c.Panels = c.Panels || ic.Panels
+		c.Strings = c.Strings || ic.Strings
+		c.Phases = c.Phases || ic.Phases
+		c.Frequency = c.Frequency || ic.Frequency
+		c.Temperature = c.Temperature || ic.Temperature
+	}
+	return c
+}
+
+// The latest error of the plant, or else of any of the inverters
+func (a *Aggregate) LastError() error {
+	if err := a.Lifecycle.LastError(); err != nil {
+		return err
+	}
+	for _, k := range a.keys {
+		if err := a.inverters[k].LastError(); err != nil {
+			return fmt.Errorf("Inverter %s: %s", k, err.Error())
+		}
+	}
+	return nil
+}
+
+// How bad a state of an inverter is for the plant
+func stateRank(state State) int {
+	switch state {
+	case Online:
+		return 0
+	case Starting:
+		return 1
+	case Unreachable:
+		return 3
+	case LoginFailed:
+		return 4
+	}
+	return 2
+}
+
+// The health of the plant while it runs is that of its inverters, the worst
+// state of them, the sum of their errors, and polled next when the first
+// inverter is. An inverter that is not running, while the plant is, degrades it,
+// and the plant itself only fails when an inverter can not start.
+func (a *Aggregate) Health() Health {
+	h := a.Lifecycle.Health()
+	if err := a.LastError(); err != nil {
+		h.LastError = err.Error()
+	}
+	if !h.Running {
+		return h
+	}
+	if h.ConsecutiveErrors == 0 {
+		h.State = Online
+	}
+	for _, k := range a.keys {
+		ih := a.inverters[k].Health()
+		state := ih.State
+		if state == Idle || state == Terminated {
+			state = Degraded
+		}
+		if stateRank(state) > stateRank(h.State) {
+			h.State = state
+		}
+		h.ConsecutiveErrors += ih.ConsecutiveErrors
+		h.CircuitOpen = h.CircuitOpen || ih.CircuitOpen
+		if ih.LastSuccess != nil && (h.LastSuccess == nil || ih.LastSuccess.After(*h.LastSuccess)) {
+			h.LastSuccess = ih.LastSuccess
+		}
+		if ih.NextPoll != nil && (h.NextPoll == nil || ih.NextPoll.Before(*h.NextPoll)) {
+			h.NextPoll = ih.NextPoll
+		}
+	}
+	return h
+}
+
+// The state of the health of the plant
+func (a *Aggregate) Status() State {
+	return a.Health().State
+}
+
+// Start the inverters. The plant terminates when all of them has terminated
+func (a *Aggregate) Start() error {
+	return a.Launch(a.run)
+}
+
+func (a *Aggregate) run() {
+	stats := a.statsStore.LoadStats(a.plantKey)
+	a.lock.Lock()
+	a.pv = a.pvStore.Get(a.plantKey)
+	a.pv.PowerAcPeakAll = stats.PowerAcPeakAll
+	a.pv.PowerAcPeakAllTime = stats.PowerAcPeakAllTime
+	a.pv.PowerAcPeakToday = stats.PowerAcPeakToday
+	a.pv.PowerAcPeakTodayTime = stats.PowerAcPeakTodayTime
+	a.lock.Unlock()
+
+	running := 0
+	for _, k := range a.keys {
+		if err := a.inverters[k].Start(); err != nil {
+			log.Failf("Could not start inverter %s of plant %s: %s", k, a.plantKey, err.Error())
+			a.SetError(fmt.Errorf("Inverter %s: %s", k, err.Error()))
+			continue
+		}
+		running++
+	}
+
+LOOP:
+	for running > 0 {
+		select {
+		case k := <-a.terminated:
+			log.Infof("Inverter %s of plant %s terminated", k, a.plantKey)
+			running--
+		case <-a.Stopping():
+			ctx, cancel := context.WithTimeout(context.Background(), inverterStopTime)
+			for _, provider := range a.inverters {
+				if err := provider.Stop(ctx); err != nil {
+					log.Failf("Could not stop an inverter of plant %s: %s", a.plantKey, err.Error())
+				}
+			}
+			cancel()
+			break LOOP
+		}
+	}
+
+	a.lock.Lock()
+	pv := a.pv
+	a.lock.Unlock()
+	a.statsStore.SaveStats(a.plantKey, &pv)
+	a.term()
+	log.Infof("Aggregate exited for plant %s", a.plantKey)
+}
+
+// Store the sum of the inverters as the plant. The peaks and the history
+// are only updated when an inverter has new data, not when eg. only its state changed
+func (a *Aggregate) update(updated bool) {
+	inverters := make([]PvData, 0, len(a.keys))
+	for _, k := range a.keys {
+		inverters = append(inverters, a.pvStore.Get(SubKey(a.plantKey, k)))
+	}
+	a.lock.Lock()
+	pv := Sum(inverters, time.Now())
+	pv.PowerAcPeakAll = a.pv.PowerAcPeakAll
+	pv.PowerAcPeakAllTime = a.pv.PowerAcPeakAllTime
+	pv.PowerAcPeakToday = a.pv.PowerAcPeakToday
+	pv.PowerAcPeakTodayTime = a.pv.PowerAcPeakTodayTime
+	if updated {
+		updatePvPeak(a.pvStore, a.historyStore, &a.plantKey, &pv)
+		a.pv = pv
+	} else if pv.LatestUpdate != nil {
+		a.pvStore.Set(a.plantKey, &pv)
+		a.pv = pv
+	}
+	a.lock.Unlock()
+}
+
+// The PvStore given to the inverters, that updates the plant on every Set
+type aggregateStore struct {
+	a *Aggregate
+}
+
+func (s aggregateStore) Set(key string, pv *PvData) {
+	old := s.a.pvStore.Get(key)
+	s.a.pvStore.Set(key, pv)
+	s.a.update(pv.LatestUpdate != nil &&
+		(old.LatestUpdate == nil || pv.LatestUpdate.After(*old.LatestUpdate)))
+}
+
+func (s aggregateStore) Get(key string) PvData {
+	return s.a.pvStore.Get(key)
+}
+
+// The sum of the inverters of a plant, as of now.
+// Power, energy and current are added up, while voltage and frequency
+// are averaged, and the temperature is the highest. Inverters that
+// are stale only adds their energy, and only the energy today if
+// they were updated today. The peaks are left out.
+func Sum(inverters []PvData, now time.Time) PvData {
+	pv := PvData{}
+	var power, energyToday uint64
+	var volt, frequency float64
+	nVolt, nFrequency := 0, 0
+	phases := []PhaseData{}
+	phaseVolts := []int{}
+	state := ""
+	first := true
+	for _, i := range inverters {
+		if i.LatestUpdate == nil {
+			continue
+		}
+		if pv.LatestUpdate == nil || i.LatestUpdate.After(*pv.LatestUpdate) {
+			t := *i.LatestUpdate
+			pv.LatestUpdate = &t
+		}
+		pv.EnergyTotal += i.EnergyTotal
+		if sameDay(*i.LatestUpdate, now) {
+			energyToday += uint64(i.EnergyToday)
+		}
+		if now.Sub(*i.LatestUpdate) > staleTime {
+			continue
+		}
+		power += uint64(i.PowerAc)
+		pv.AmpereAc += i.AmpereAc
+		if i.VoltDc > 0 {
+			volt += float64(i.VoltDc)
+			nVolt++
+		}
+		if i.Frequency > 0 {
+			frequency += float64(i.Frequency)
+			nFrequency++
+		}
+		if i.Temperature > pv.Temperature {
+			pv.Temperature = i.Temperature
+		}
+		pv.Strings = append(pv.Strings, i.Strings...)
+		pv.Panels = append(pv.Panels, i.Panels...)
+		for n, p := range i.Phases {
+			if n == len(phases) {
+				phases = append(phases, PhaseData{})
+				phaseVolts = append(phaseVolts, 0)
+			}
+			phases[n].AmpereAc += p.AmpereAc
+			phases[n].PowerAc = Watt(math.Min(float64(phases[n].PowerAc)+float64(p.PowerAc), math.MaxUint32))
+			if p.VoltAc > 0 {
+				phases[n].VoltAc += p.VoltAc
+				phaseVolts[n]++
+			}
+		}
+		// The state is only told when the inverters agree on it
+		if first {
+			state = i.State
+			first = false
+		} else if i.State != state {
+			state = ""
+		}
+	}
+	// The sums can only overflow above 4.29 GW, so they are clamped
+	pv.PowerAc = Watt(math.Min(float64(power), math.MaxUint32))
+	pv.EnergyToday = WattHour(math.Min(float64(energyToday), math.MaxUint32))
+	if nVolt > 0 {
+		pv.VoltDc = float32(volt / float64(nVolt))
+	}
+	if nFrequency > 0 {
+		pv.Frequency = float32(frequency / float64(nFrequency))
+	}
+	for n := range phases {
+		if phaseVolts[n] > 0 {
+			phases[n].VoltAc /= float32(phaseVolts[n])
+		}
+	}
+	if len(phases) > 0 {
+		pv.Phases = phases
+	}
+	pv.State = state
+	return pv
+}
+
+func sameDay(a time.Time, b time.Time) bool {
+	ay, am, ad := a.In(b.Location()).Date()
+	by, bm, bd := b.Date()
+	return ay == by && am == bm && ad == bd
+}
@@ -0,0 +1,158 @@
+package dataproviders
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Keeps the samples appended to the history
+type sampleHistory struct {
+	lock    sync.Mutex
+	samples map[string][]PvSample
+}
+
+func (h *sampleHistory) Append(plantkey string, sample PvSample) error {
+	h.lock.Lock()
+	h.samples[plantkey] = append(h.samples[plantkey], sample)
+	h.lock.Unlock()
+	return nil
+}
+
+func (h *sampleHistory) Range(plantkey string, from time.Time, to time.Time) ([]PvSample, error) {
+	return nil, nil
+}
+
+func (h *sampleHistory) count(plantkey string) int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.samples[plantkey])
+}
+
+// An inverter that is updated by the test, through the store it was given
+type testInverter struct {
+	Lifecycle
+	store PvStore
+}
+
+func (i *testInverter) Name() string {
+	return "Test"
+}
+
+func (i *testInverter) Capabilities() Capabilities {
+	return Capabilities{PowerAc: true}
+}
+
+func (i *testInverter) Start() error {
+	return i.Launch(func() { <-i.Stopping() })
+}
+
+func newTestAggregate(t *testing.T, store PvStore, history HistoryStore) (*Aggregate, map[string]*testInverter) {
+	inverters := map[string]*testInverter{}
+	a, err := NewAggregate("plant", []string{"a", "b"},
+		func(key string, term TerminateCallback, pvStore PvStore) (DataProvider, error) {
+			inverters[key] = &testInverter{store: pvStore}
+			return inverters[key], nil
+		},
+		func() {}, store, &nopStatsStore{}, history)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return a, inverters
+}
+
+func Test_aggregate_history(t *testing.T) {
+	store := newMapStore()
+	history := &sampleHistory{samples: map[string][]PvSample{}}
+	_, inverters := newTestAggregate(t, store, history)
+	a, b := inverters["a"].store, inverters["b"].store
+
+	// An inverter that has never been updated stores nothing for the plant
+	a.Set("plant.a", &PvData{})
+	if pv := store.Get("plant"); history.count("plant") != 0 || pv.LatestUpdate != nil {
+		t.Errorf("Expected no data for the plant, pvdata is %s", pv.ToJson())
+	}
+
+	t1 := time.Now().Add(-time.Minute)
+	pvA := PvData{PowerAc: 1000, LatestUpdate: &t1}
+	a.Set("plant.a", &pvA)
+	if pv := store.Get("plant"); history.count("plant") != 1 || pv.PowerAc != 1000 || pv.PowerAcPeakAll != 1000 {
+		t.Errorf("Expected the update to be stored, %d samples, pvdata is %s", history.count("plant"), pv.ToJson())
+	}
+
+	// Sets without new data, like the state of a failed update, or on start and terminate,
+	// update the plant but not its history
+	pvA.State = string(Unreachable)
+	a.Set("plant.a", &pvA)
+	a.Set("plant.a", &pvA)
+	if pv := store.Get("plant"); history.count("plant") != 1 || pv.State != string(Unreachable) || pv.PowerAc != 1000 {
+		t.Errorf("Expected only the state of the plant to change, %d samples, pvdata is %s", history.count("plant"), pv.ToJson())
+	}
+
+	t2 := time.Now()
+	b.Set("plant.b", &PvData{PowerAc: 500, LatestUpdate: &t2})
+	b.Set("plant.b", &PvData{PowerAc: 500, LatestUpdate: &t2})
+	if pv := store.Get("plant"); history.count("plant") != 2 || pv.PowerAc != 1500 || !pv.LatestUpdate.Equal(t2) {
+		t.Errorf("Expected one sample for the new data, %d samples, pvdata is %s", history.count("plant"), pv.ToJson())
+	}
+	for _, s := range history.samples["plant"] {
+		if s.PowerAc == 0 {
+			t.Errorf("Expected no empty samples, got %v", s)
+		}
+	}
+}
+
+func Test_aggregate_health(t *testing.T) {
+	store := newMapStore()
+	aggregate, inverters := newTestAggregate(t, store, nil)
+	a, b := inverters["a"], inverters["b"]
+	if err := aggregate.Start(); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer aggregate.Stop(context.Background())
+	waitState(&a.Lifecycle, Starting)
+	waitState(&b.Lifecycle, Starting)
+	if h := aggregate.Health(); h.State != Starting || !h.Running {
+		t.Errorf("Expected the plant to be starting with its inverters, health is %v", h)
+	}
+
+	now := time.Now()
+	a.SetSuccess()
+	a.store.Set("plant.a", &PvData{PowerAc: 1000, LatestUpdate: &now})
+	b.SetSuccess()
+	if h := aggregate.Health(); h.State != Online || h.LastSuccess == nil {
+		t.Errorf("Expected the plant online, health is %v", h)
+	}
+
+	// An inverter that keeps failing is not hidden by the updates of the other,
+	// nor by the state it stores on its errors
+	for i := 0; i < 3; i++ {
+		b.SetError(errors.New("bad reply"))
+		b.store.Set("plant.b", &PvData{State: string(Degraded)})
+		a.SetSuccess()
+		a.store.Set("plant.a", &PvData{PowerAc: 1000, LatestUpdate: &now})
+	}
+	if h := aggregate.Health(); h.State != Degraded || h.ConsecutiveErrors != 3 || h.LastError != "Inverter b: bad reply" {
+		t.Errorf("Expected the plant degraded by the failing inverter, health is %v", h)
+	}
+	a.SetError(NewLoginError("Wrong password"))
+	if h := aggregate.Health(); h.State != LoginFailed || h.ConsecutiveErrors != 4 || aggregate.Status() != LoginFailed {
+		t.Errorf("Expected the worst state of the inverters, health is %v", h)
+	}
+
+	a.SetSuccess()
+	b.SetSuccess()
+	if h := aggregate.Health(); h.State != Online || h.ConsecutiveErrors != 0 {
+		t.Errorf("Expected the plant to recover with its inverters, health is %v", h)
+	}
+
+	// An inverter that terminates degrades the plant
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	b.Stop(ctx)
+	if h := aggregate.Health(); h.State != Degraded || !h.Running {
+		t.Errorf("Expected the plant degraded by the terminated inverter, health is %v", h)
+	}
+}
@@ -0,0 +1,22 @@
+// Package all links in every known dataprovider.
+// Each provider registers itself by name in its init func,
+// so importing this package for its side effects is enough
+// to make them available to the dispatcher.
+// New vendors only need to be added here.
+package all
+
+import (
+	_ "dataproviders/JFY"
+	_ "dataproviders/danfoss"
+	_ "dataproviders/enphase"
+	_ "dataproviders/fronius"
+	_ "dataproviders/generic"
+	_ "dataproviders/ingest"
+	_ "dataproviders/kostal"
+	_ "dataproviders/mqttingest"
+	_ "dataproviders/solaredge"
+	_ "dataproviders/sunnyportal"
+	_ "dataproviders/sunspec"
+	_ "dataproviders/suntrol"
+	_ "dataproviders/webconnect"
+)
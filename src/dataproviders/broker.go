@@ -0,0 +1,102 @@
+package dataproviders
+
+import (
+	"sync"
+)
+
+// Size of the buffer for each subscriber.
+// If a subscriber falls further behind, updates to it are dropped
+const subscriptionBuffer = 16
+
+// A pvdata update as delivered to subscribers
+type PvUpdate struct {
+	PlantKey string
+	PvData   PvData
+}
+
+// Implemented by a PvStore that can tell when new pvdata is stored
+type PvSubscriber interface {
+	// Subscribe to updates for the given plants, or all plants if none given
+	Subscribe(plantkeys ...string) *Subscription
+}
+
+// Broker fans out pvdata updates to any number of subscribers.
+// A PvStore embeds it, and calls Publish on every Set, while it holds its
+// lock so updates of a plant are published in the order they are stored
+type Broker struct {
+	lock sync.RWMutex
+	subs map[*Subscription]bool
+}
+
+type Subscription struct {
+	// Updates are received here. Is closed when the subscription is closed
+	C      <-chan PvUpdate
+	ch     chan PvUpdate
+	broker *Broker
+	// Guarded by the broker lock
+	all    bool
+	plants map[string]bool
+}
+
+func NewBroker() *Broker {
+	return &Broker{subs: map[*Subscription]bool{}}
+}
+
+func (b *Broker) Subscribe(plantkeys ...string) *Subscription {
+	ch := make(chan PvUpdate, subscriptionBuffer)
+	s := &Subscription{C: ch, ch: ch, broker: b, all: len(plantkeys) == 0, plants: map[string]bool{}}
+	for _, k := range plantkeys {
+		s.plants[k] = true
+	}
+	b.lock.Lock()
+	b.subs[s] = true
+	b.lock.Unlock()
+	return s
+}
+
+// Publish the pvdata to all subscribers of the plant.
+// Never blocks, slow subscribers will miss updates, so it is safe to call
+// with a lock held.
+func (b *Broker) Publish(plantkey string, pv *PvData) {
+	u := PvUpdate{plantkey, *pv}
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	for s := range b.subs {
+		if !s.all && !s.plants[plantkey] {
+			continue
+		}
+		select {
+		case s.ch <- u:
+		default:
+			log.Debugf("Subscriber is behind, dropped update for plant %s", plantkey)
+		}
+	}
+}
+
+// Add plants to the subscription
+func (s *Subscription) Add(plantkeys ...string) {
+	s.broker.lock.Lock()
+	defer s.broker.lock.Unlock()
+	for _, k := range plantkeys {
+		s.plants[k] = true
+	}
+}
+
+// Remove plants from the subscription
+func (s *Subscription) Remove(plantkeys ...string) {
+	s.broker.lock.Lock()
+	defer s.broker.lock.Unlock()
+	for _, k := range plantkeys {
+		delete(s.plants, k)
+	}
+}
+
+// Close the subscription, and its channel
+func (s *Subscription) Close() {
+	s.broker.lock.Lock()
+	defer s.broker.lock.Unlock()
+	if s.broker.subs[s] {
+		delete(s.broker.subs, s)
+		close(s.ch)
+	}
+}
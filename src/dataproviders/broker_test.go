@@ -0,0 +1,93 @@
+package dataproviders
+
+import (
+	"testing"
+)
+
+// The update waiting on the subscription, if any
+func received(s *Subscription) (PvUpdate, bool) {
+	select {
+	case u, ok := <-s.C:
+		return u, ok
+	default:
+		return PvUpdate{}, false
+	}
+}
+
+func Test_broker_subscribe(t *testing.T) {
+	b := NewBroker()
+	all := b.Subscribe()
+	one := b.Subscribe("a")
+
+	b.Publish("a", &PvData{PowerAc: 100})
+	b.Publish("b", &PvData{PowerAc: 200})
+
+	if u, ok := received(one); !ok || u.PlantKey != "a" || u.PvData.PowerAc != 100 {
+		t.Errorf("Expected the update of plant a, got %v", u)
+	}
+	if u, ok := received(one); ok {
+		t.Errorf("Expected no update of other plants, got %v", u)
+	}
+	for _, expected := range []string{"a", "b"} {
+		if u, ok := received(all); !ok || u.PlantKey != expected {
+			t.Errorf("Expected the update of plant %s to a subscriber of all plants, got %v", expected, u)
+		}
+	}
+
+	one.Add("b")
+	one.Remove("a")
+	b.Publish("a", &PvData{PowerAc: 101})
+	b.Publish("b", &PvData{PowerAc: 201})
+	if u, ok := received(one); !ok || u.PlantKey != "b" || u.PvData.PowerAc != 201 {
+		t.Errorf("Expected the update of the added plant b only, got %v", u)
+	}
+	if u, ok := received(one); ok {
+		t.Errorf("Expected no update of the removed plant a, got %v", u)
+	}
+
+	// The pvdata is copied, so a later change by the publisher is not seen
+	pv := PvData{PowerAc: 300}
+	b.Publish("b", &pv)
+	pv.PowerAc = 0
+	if u, _ := received(one); u.PvData.PowerAc != 300 {
+		t.Errorf("Expected a copy of the pvdata, got %v", u)
+	}
+}
+
+func Test_broker_close(t *testing.T) {
+	b := NewBroker()
+	s := b.Subscribe("a")
+	s.Close()
+	if _, ok := <-s.C; ok {
+		t.Error("Expected the channel to be closed")
+	}
+	// Publishing after close and closing again does not panic
+	b.Publish("a", &PvData{})
+	s.Close()
+	if len(b.subs) != 0 {
+		t.Errorf("Expected no subscribers, was %d", len(b.subs))
+	}
+}
+
+func Test_broker_slow_subscriber(t *testing.T) {
+	b := NewBroker()
+	slow := b.Subscribe("a")
+	fast := b.Subscribe("a")
+
+	// The slow subscriber never reads, which must not block the publisher or the others
+	for i := 0; i < subscriptionBuffer*2; i++ {
+		b.Publish("a", &PvData{PowerAc: Watt(i)})
+		if u, ok := received(fast); !ok || u.PvData.PowerAc != Watt(i) {
+			t.Fatalf("Expected update %d to the fast subscriber, got %v", i, u)
+		}
+	}
+	// The slow one gets the first updates, in order, and misses the rest
+	for i := 0; i < subscriptionBuffer; i++ {
+		if u, ok := received(slow); !ok || u.PvData.PowerAc != Watt(i) {
+			t.Fatalf("Expected buffered update %d to the slow subscriber, got %v", i, u)
+		}
+	}
+	if u, ok := received(slow); ok {
+		t.Errorf("Expected the updates beyond the buffer to be dropped, got %v", u)
+	}
+}
@@ -14,9 +14,13 @@ import (
 
 
 type dataProvider struct {
+	dataproviders.Lifecycle
 	InitiateData   dataproviders.InitiateData
-	latestErr      error
 	client         *http.Client
+	term           dataproviders.TerminateCallback
+	pvStore        dataproviders.PvStore
+	statsStore     dataproviders.PlantStatsStore
+	historyStore   dataproviders.HistoryStore
 }
 
 
@@ -24,6 +28,8 @@ var log = logger.NewLogger(logger.DEBUG, "Dataprovider: Danfoss:")
 
 const MAX_ERRORS = 5
 
+const ProviderName = "danfoss"
+
 const urlTemplate = "http://%s/%s"
 const loginUrl = "cgi-bin/handle_login.tcl"
 const logoutUrl = "cgi-bin/logout.tcl?sid=%s"
@@ -35,39 +41,73 @@ const curPwr1RegEx = "<td id=\"curr_power\" class=\"parValue\" style=\"width:25%
 const numberRegEx = ">[0-9|\\.]+"
 const etodayRegEx = "<td id=\"prod_today\" class=\"parValue\">[0-9|\\.]+ [kW|W]"
 const etotalRegEx = "<td id=\"total_yield\" class=\"parValue\">[0-9|\\.]+"
+func init() {
+	dataproviders.Register(ProviderName,
+		func(initiateData dataproviders.InitiateData,
+			term dataproviders.TerminateCallback,
+			client *http.Client,
+			pvStore dataproviders.PvStore,
+			statsStore dataproviders.PlantStatsStore,
+			historyStore dataproviders.HistoryStore) (dataproviders.DataProvider, error) {
+			return NewDataProvider(initiateData, term, client, pvStore, statsStore, historyStore), nil
+		},
+		dataproviders.ConfigSchema{
+			{Field: "UserName", Required: true, Description: "Username on the inverter web interface"},
+			{Field: "Password", Required: true, Description: "Password on the inverter web interface"},
+			{Field: "Address", Required: true, Description: "Hostname or ip of the inverter"},
+		})
+}
+
 func (d *dataProvider) Name() string {
-	return "N/A"
+	return "Danfoss"
 }
 
 func NewDataProvider(initiateData dataproviders.InitiateData, 
                      term dataproviders.TerminateCallback,
                      client *http.Client,
                      pvStore dataproviders.PvStore,
-                     statsStore dataproviders.PlantStatsStore) dataProvider {
+                     statsStore dataproviders.PlantStatsStore,
+                     historyStore dataproviders.HistoryStore) *dataProvider {
 	log.Debug("New dataprovider")
 
-	dp := dataProvider{initiateData,
-		nil,
-		client}
-	go dataproviders.RunUpdates(
-		&initiateData,
-		func(initiateData *dataproviders.InitiateData, pv *dataproviders.PvData) error {
-			err := updatePvData(client, initiateData, pv)
-			pv.LatestUpdate = nil
-			return err
-		}, 
-		func(initiateData *dataproviders.InitiateData, pv *dataproviders.PvData) error {
-			return nil
-		}, 
-		time.Second * 10,
-		time.Minute * 5,
-		time.Minute * 30,
-		term,
-		MAX_ERRORS,
-		statsStore,
-		pvStore)
+	dp := dataProvider{InitiateData: initiateData,
+		client: client,
+		term: term,
+		pvStore: pvStore,
+		statsStore: statsStore,
+		historyStore: historyStore}
+
+	return &dp
+}
 
-	return dp
+func (dp *dataProvider) Capabilities() dataproviders.Capabilities {
+	return dataproviders.Capabilities{PowerAc: true, EnergyToday: true,
+		EnergyTotal: true}
+}
+
+func (dp *dataProvider) Start() error {
+	client := dp.client
+	return dp.Launch(func() {
+		dataproviders.RunUpdates(
+			&dp.Lifecycle,
+			&dp.InitiateData,
+			func(initiateData *dataproviders.InitiateData, pv *dataproviders.PvData) error {
+				err := updatePvData(client, initiateData, pv)
+				pv.LatestUpdate = nil
+				return err
+			}, 
+			func(initiateData *dataproviders.InitiateData, pv *dataproviders.PvData) error {
+				return nil
+			}, 
+			time.Second * 10,
+			time.Minute * 5,
+			time.Minute * 30,
+			dp.term,
+			dataproviders.DefaultRetryPolicy(MAX_ERRORS),
+			dp.statsStore,
+			dp.pvStore,
+			dp.historyStore)
+	})
 }
 
 // Update PvData
@@ -122,7 +162,7 @@ func login(client *http.Client,
 	}
 	found := reg.Find(b)
 	if len(found) < 6 {
-		err = fmt.Errorf("Could not login to inverter. Wrong username/password")
+		err = dataproviders.NewLoginError("Could not login to inverter. Wrong username/password")
 		return
 	}
 	sid = string(found[4:])
@@ -200,9 +240,9 @@ func pac(sid string, client *http.Client,
 	if string(foundPart1[len(foundPart1)-1:len(foundPart1)]) == "k" {
 		factor = 1000.0
 	}
-	pv.PowerAc = uint16(pacfloat*factor)
+	pv.PowerAc, err = dataproviders.ToWatt(pacfloat*factor)
 	
-	return nil
+	return err
 }
 
 func etoday(sid string, client *http.Client, 
@@ -238,8 +278,8 @@ func etoday(sid string, client *http.Client,
 	if string(foundPart1[len(foundPart1)-1:len(foundPart1)]) == "k" {
 		factor = 1000.0
 	}
-	pv.EnergyToday = uint16(etodayfloat*factor)
-	return nil
+	pv.EnergyToday, err = dataproviders.ToWattHour(etodayfloat*factor)
+	return err
 }
 func etotal(sid string, client *http.Client, 
             initiateData *dataproviders.InitiateData, pv *dataproviders.PvData, resp *[]byte) error {
@@ -269,7 +309,7 @@ func etotal(sid string, client *http.Client,
 	log.Debugf("Current etotal is %s", etotal)
 	etotalfloat, err := strconv.ParseFloat(etotal, 64)
 	
-	pv.EnergyTotal = float32(etotalfloat)
+	pv.EnergyTotal = dataproviders.KiloWattHour(etotalfloat)
 	return nil
 }
 
@@ -23,7 +23,7 @@ func Test_Connection (t *testing.T) {
 	t.Log("Trying to launch provider...")
 	pv := dataproviders.PvData{}
 	err := updatePvData(httpclient.NewClient(), 
-				&dataproviders.InitiateData{"jan", "anonym", "anonym", "", "5.103.131.3"},
+				&dataproviders.InitiateData{PlantKey: "jan", UserName: "anonym", Password: "anonym", Address: "5.103.131.3"},
 				&pv)
 	
 	if err != nil {
@@ -1,14 +1,17 @@
 package dataproviders
 
 import (
+	"fmt"
 	"logger"
 	"time"
 )
 
 type PlantStats struct {
-	PowerAcPeakAll       uint16
+	// The version the json was read as, see SchemaVersion
+	SchemaVersion        int `json:",omitempty"`
+	PowerAcPeakAll       Watt
 	PowerAcPeakAllTime   time.Time
-	PowerAcPeakToday     uint16
+	PowerAcPeakToday     Watt
 	PowerAcPeakTodayTime time.Time
 }
 
@@ -29,6 +32,18 @@ type InitiateData struct {
 	Password string
 	PlantNo  string
 	Address  string
+	// Provider specific settings, described by the schema of the provider
+	Options map[string]string `json:",omitempty"`
+}
+
+// Never print the password, it may end up in a log
+func (i InitiateData) String() string {
+	password := ""
+	if i.Password != "" {
+		password = "***"
+	}
+	return fmt.Sprintf("{PlantKey:%s UserName:%s Password:%s PlantNo:%s Address:%s Options:%v}",
+		i.PlantKey, i.UserName, password, i.PlantNo, i.Address, i.Options)
 }
 
 var log = logger.NewLogger(logger.DEBUG, "Dataprovider: generic: ")
@@ -37,43 +52,43 @@ type TerminateCallback func()
 
 type UpdatePvData func(i *InitiateData, pv *PvData) error
 
-// List of all known dataproviders
-// This would be nice if we could autodetect them somehow
-const (
-	FJY         = iota
-	SunnyPortal = iota
-	Suntrol     = iota
-	Danfoss     = iota
-	Kostal      = iota
-)
+// Known dataproviders register themselves by name, see registry.go
 
 // RunUpdates on the provider. 
+// lifecycle, the state of the provider. RunUpdates terminates when the provider is stopped
 // updateFast, a function that gets called when a fast update is scheduled
 // updateSlow, a function that gets called when a slow update is scheduled
 // fastTime, secs on updateFast should be scheduled
 // slowTime, secs on updateSlow should be scheduled
-// terminateTime, secs on how long the provider will stay online before it terminates
+// terminateTime, secs on how long the provider will stay online before it terminates,
+// a provider with an open circuit stays until it recovers
 // term, a function that gets called when RunUpdates terminates
-// errClose, maximum number of errors received before giving up, and terminates
+// retry, how updates are retried after errors, overridden by the retry options of the plant
 // statsStore service for storinging peak
 // pvStore store for setting and getting actual data
-func RunUpdates(initiateData *InitiateData,
+// historyStore store where every successful update is appended, may be nil
+// PvData.State is the state of the provider, unless the update sets the state of the device
+func RunUpdates(lifecycle *Lifecycle,
+	initiateData *InitiateData,
 	updateFast UpdatePvData,
 	updateSlow UpdatePvData,
 	fastTime time.Duration,
 	slowTime time.Duration,
 	terminateTime time.Duration,
 	term TerminateCallback,
-	errClose int,
+	retry RetryPolicy,
 	statsStore PlantStatsStore,
-	pvStore PvStore) {
+	pvStore PvStore,
+	historyStore HistoryStore) {
 
 	log.Trace("Started a RunUpdates rutine")
 	stats := statsStore.LoadStats(initiateData.PlantKey)
+	// The options are validated with the plant, so this only fails for plants that are not
+	retry, err := retry.WithOptions(initiateData.Options)
+	if err != nil {
+		log.Failf("Using the default retries for plant %s: %s", initiateData.PlantKey, err.Error())
+	}
 
-	// Fast Ticker
-	fastTick := time.NewTicker(fastTime)
-	fastTickCh := fastTick.C
 	// Slow Ticker
 	slowTick := time.NewTicker(slowTime)
 	slowTickCh := slowTick.C
@@ -81,18 +96,25 @@ func RunUpdates(initiateData *InitiateData,
 	terminateTicker := time.NewTicker(terminateTime)
 	terminateCh := terminateTicker.C
 
+	// Counts up on every error, and is halved by every success.
+	// Kept at OpenAfter while the circuit is open, and reset when it closes
 	errCounter := 0
+	circuitOpen := false
 	firstRun := true
+	// Whether the latest update succeeded
+	lastOk := false
+	state := providerState{lifecycle: lifecycle}
 
 	shutdown := func() {
 		log.Infof("About to terminate RunUpdates for plant %s", initiateData.PlantKey)
-		fastTick.Stop()
 		slowTick.Stop()
 		terminateTicker.Stop()
 		//pvCh := make(chan PvData)
 		//reqCh <- pvCh
 		//pv := <- pvCh
 		pv := pvStore.Get(initiateData.PlantKey)
+		state.terminate(&pv)
+		pvStore.Set(initiateData.PlantKey, &pv)
 		statsStore.SaveStats(initiateData.PlantKey, &pv)
 		term()
 		//termCh <- 0
@@ -114,59 +136,94 @@ func RunUpdates(initiateData *InitiateData,
 	pv.PowerAcPeakToday = stats.PowerAcPeakToday
 	pv.PowerAcPeakTodayTime = stats.PowerAcPeakTodayTime
 	pvStore.Set(initiateData.PlantKey, &pv)
-LOOP:
-	for {
-		err := updateFast(initiateData, &pv)
+
+	update := func(updatePvData UpdatePvData) {
+		state.clear(&pv)
+		err := updatePvData(initiateData, &pv)
+		lastOk = err == nil
 		if err != nil {
-			errCounter++
+			if !circuitOpen {
+				errCounter++
+			}
 			log.Infof("There was on error on updatePvData: %s, error counter is now %d for plant %s",
 				err.Error(), errCounter, initiateData.PlantKey)
-		} else {
-			updatePvPeak(pvStore, &initiateData.PlantKey, &pv)
-		}
-		
-		if firstRun {
-			err = updateSlow(initiateData, &pv)
-			if err != nil {
-				errCounter++
-				log.Infof("There was on error on updatePvData: %s, error counter is now %d for plant %s",
-					err.Error(), errCounter, initiateData.PlantKey)
-			} else {
-				updatePvPeak(pvStore, &initiateData.PlantKey, &pv)
+			lifecycle.SetError(err)
+			state.setError(&pv, initiateData.PlantKey, pvStore)
+			if !circuitOpen && retry.Open(errCounter) {
+				circuitOpen = true
+				log.Failf("Plant %s failed %d times, only probing it every %s, the latest error was: %s",
+					initiateData.PlantKey, errCounter, retry.ProbeInterval, err.Error())
+				lifecycle.SetCircuitOpen(true)
 			}
+			return
+		}
+		errCounter /= 2
+		lifecycle.SetSuccess()
+		state.set(&pv)
+		updatePvPeak(pvStore, historyStore, &initiateData.PlantKey, &pv)
+		// A probe that succeeds closes the circuit, and the plant starts over,
+		// so it is polled as usual and a single error does not open it again
+		if circuitOpen {
+			circuitOpen = false
+			errCounter = 0
+			log.Infof("Plant %s recovered", initiateData.PlantKey)
+			lifecycle.SetCircuitOpen(false)
+		}
+	}
+LOOP:
+	for {
+		update(updateFast)
+		// The slow update of the first run waits for a fast update that succeeds
+		if firstRun && lastOk {
+			update(updateSlow)
 			firstRun = false
-		} 
-		
-		if errCounter > errClose {
-			break LOOP
 		}
-		//Wait for rerequest
+
+		// A plant that fails is never polled more often than one that does not
+		wait := fastTime
+		if circuitOpen {
+			wait = retry.Jittered(retry.ProbeInterval)
+		} else if errCounter > 0 {
+			wait = retry.Delay(errCounter)
+		}
+		if wait < fastTime {
+			wait = fastTime
+		}
+		lifecycle.SetNextPoll(time.Now().Add(wait))
+		poll := time.NewTimer(wait)
 		log.Debug("Waiting on tickers...")
-		select {
-		case <- fastTickCh:
-			// Restart terminate ticker
-		case <- slowTickCh:
-			err := updateSlow(initiateData, &pv)
-			if err != nil {
-				errCounter++
-				log.Infof("There was on error on updatePvData: %s, error counter is now %d for plant %s",
-					err.Error(), errCounter, initiateData.PlantKey)
-			} else {
-				updatePvPeak(pvStore, &initiateData.PlantKey, &pv)
-			}
+	WAIT:
+		for {
+			select {
+			case <-poll.C:
+				break WAIT
+			case <-slowTickCh:
+				// The slow update waits until a failing plant succeeds again
+				if lastOk {
+					update(updateSlow)
+				}
+				statsStore.SaveStats(initiateData.PlantKey, &pv)
+				if lastOk {
+					poll.Stop()
+					break WAIT
+				}
 
-			statsStore.SaveStats(initiateData.PlantKey, &pv)
-			if errCounter > errClose {
+			case <-terminateCh:
+				// A plant with an open circuit is kept, and probed, until it recovers
+				if circuitOpen {
+					log.Debugf("Keeping provider for plant %s while its circuit is open", initiateData.PlantKey)
+					continue
+				}
+				poll.Stop()
 				break LOOP
-			}
 
-		case <-terminateCh:
-			break LOOP
+			case <-lifecycle.Stopping():
+				log.Infof("Provider for plant %s was asked to stop", initiateData.PlantKey)
+				poll.Stop()
+				break LOOP
+			}
 		}
-
 	}
-
-	shutdown()
 }
 
 func midnight() time.Time {
@@ -174,7 +231,7 @@ func midnight() time.Time {
 	return time.Date(y, m, d, 0, 0, 0, 0, time.Local)
 }
 
-func updatePvPeak(pvStore PvStore, plantKey *string, pv *PvData) {
+func updatePvPeak(pvStore PvStore, historyStore HistoryStore, plantKey *string, pv *PvData) {
 	if pv.LatestUpdate == nil {
 		t := time.Now()
 		pv.LatestUpdate = &t
@@ -197,5 +254,12 @@ func updatePvPeak(pvStore PvStore, plantKey *string, pv *PvData) {
 	}
 
 	pvStore.Set(*plantKey, pv)
+
+	if historyStore != nil {
+		err := historyStore.Append(*plantKey, NewPvSample(pv))
+		if err != nil {
+			log.Failf("Could not append pvdata to history for plant %s: %s", *plantKey, err.Error())
+		}
+	}
 }
 
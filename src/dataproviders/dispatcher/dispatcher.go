@@ -2,50 +2,26 @@ package dispatcher
 
 import (
 	"dataproviders"
-	"dataproviders/JFY"
-	"dataproviders/sunnyportal"
-	"dataproviders/suntrol"
-	"dataproviders/danfoss"
-	"dataproviders/kostal"
 	"fmt"
 	"net/http"
 )
 
 type NewClient func() *http.Client
 
-func Provider(implType int,
+// Create a new provider from the registered provider with the given name.
+// The provider is not started.
+func Provider(name string,
 	init dataproviders.InitiateData,
 	term dataproviders.TerminateCallback,
 	newClient NewClient,
 	pvStore dataproviders.PvStore,
-	statsStore dataproviders.PlantStatsStore) (err error) {
-	switch implType {
-	case dataproviders.FJY:
-		JFY.NewDataProvider(init, term, newClient(), pvStore, statsStore)
-		//provider = &jfy
+	statsStore dataproviders.PlantStatsStore,
+	historyStore dataproviders.HistoryStore) (provider dataproviders.DataProvider, err error) {
+	r, ok := dataproviders.Lookup(name)
+	if !ok {
+		err = fmt.Errorf("No provider found for %s", name)
 		return
-	case dataproviders.SunnyPortal:
-		_, err2 := sunnyportal.NewDataProvider(init, term, newClient(), 
-		                                           pvStore, statsStore)
-		if err2 != nil {
-			err = err2
-			return
-		}
-		//provider = &sunny
-		return
-	case dataproviders.Suntrol:
-		suntrol.NewDataProvider(init, term, newClient(), pvStore, statsStore)
-		//provider = &dp
-		return
-	case dataproviders.Danfoss:
-		danfoss.NewDataProvider(init, term, newClient(), pvStore, statsStore)
-		//provider = &dp
-		return
-	case dataproviders.Kostal:
-		kostal.NewDataProvider(init, term, newClient(), pvStore, statsStore)
-		//provider = &dp
-		return
-	err = fmt.Errorf("No provider found for %d", implType)
 	}
+	provider, err = r.Factory(init, term, newClient(), pvStore, statsStore, historyStore)
 	return
 }
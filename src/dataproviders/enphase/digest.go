@@ -0,0 +1,102 @@
+package enphase
+
+// Client side http digest authentication, RFC 2617, as used by the Envoy
+// for the inverter data. Only MD5 and qop auth is supported.
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Parse the parameters of a Digest challenge
+func parseChallenge(header string) (map[string]string, bool) {
+	if !strings.HasPrefix(header, "Digest ") {
+		return nil, false
+	}
+	params := map[string]string{}
+	rest := strings.TrimSpace(header[len("Digest "):])
+	for rest != "" {
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.TrimSpace(rest[:eq])
+		rest = strings.TrimSpace(rest[eq+1:])
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return nil, false
+			}
+			value = rest[1 : end+1]
+			rest = rest[end+2:]
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				end = len(rest)
+			}
+			value = strings.TrimSpace(rest[:end])
+			rest = rest[end:]
+		}
+		params[strings.ToLower(key)] = value
+		rest = strings.TrimLeft(rest, ", ")
+	}
+	return params, params["nonce"] != ""
+}
+
+func md5hex(s string) string {
+	h := md5.Sum([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+// The Authorization header answering the challenge for the request
+func digestAuthorization(challenge map[string]string, method string, uri string,
+	user string, password string) string {
+	ha1 := md5hex(user + ":" + challenge["realm"] + ":" + password)
+	ha2 := md5hex(method + ":" + uri)
+	header := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`,
+		user, challenge["realm"], challenge["nonce"], uri)
+	qopAuth := false
+	for _, qop := range strings.Split(challenge["qop"], ",") {
+		if strings.TrimSpace(qop) == "auth" {
+			qopAuth = true
+		}
+	}
+	if qopAuth {
+		b := make([]byte, 8)
+		rand.Read(b)
+		cnonce := hex.EncodeToString(b)
+		const nc = "00000001"
+		response := md5hex(ha1 + ":" + challenge["nonce"] + ":" + nc + ":" + cnonce + ":auth:" + ha2)
+		header += fmt.Sprintf(`, qop=auth, nc=%s, cnonce="%s", response="%s"`, nc, cnonce, response)
+	} else {
+		header += fmt.Sprintf(`, response="%s"`, md5hex(ha1+":"+challenge["nonce"]+":"+ha2))
+	}
+	if opaque, ok := challenge["opaque"]; ok {
+		header += fmt.Sprintf(`, opaque="%s"`, opaque)
+	}
+	return header + `, algorithm=MD5`
+}
+
+// Get the url, answering a digest challenge if the server sends one
+func getDigest(client *http.Client, url string, user string, password string) (*http.Response, error) {
+	resp, err := client.Get(url)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	resp.Body.Close()
+	challenge, ok := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+	if !ok {
+		return nil, fmt.Errorf("Dataprovider enphase fail. Envoy asked for an unsupported authentication")
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", digestAuthorization(challenge, "GET", req.URL.RequestURI(), user, password))
+	return client.Do(req)
+}
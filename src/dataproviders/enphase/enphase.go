@@ -0,0 +1,270 @@
+package enphase
+
+// Dataprovider for Enphase microinverter systems, read from the Envoy gateway.
+// Production of the plant is read from production.json, using the
+// production meter if the Envoy has one, and else the sum of the inverters.
+// The output of each microinverter is read less often, as the inverters
+// only report every 5 minutes, and it needs the installer password.
+
+import (
+	"dataproviders"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"logger"
+	"net/http"
+	"sort"
+	"time"
+)
+
+type dataProvider struct {
+	dataproviders.Lifecycle
+	InitiateData dataproviders.InitiateData
+	client       *http.Client
+	term         dataproviders.TerminateCallback
+	pvStore      dataproviders.PvStore
+	statsStore   dataproviders.PlantStatsStore
+	historyStore dataproviders.HistoryStore
+}
+
+var log = logger.NewLogger(logger.DEBUG, "Dataprovider: Enphase:")
+
+const MAX_ERRORS = 5
+
+const ProviderName = "enphase"
+
+const urlTemplate = "http://%s%s"
+
+const (
+	productionUrl = "/production.json"
+	invertersUrl  = "/api/v1/production/inverters"
+)
+
+// The user of the inverter data, if no UserName is given
+const defaultUser = "envoy"
+
+func init() {
+	dataproviders.Register(ProviderName,
+		func(initiateData dataproviders.InitiateData,
+			term dataproviders.TerminateCallback,
+			client *http.Client,
+			pvStore dataproviders.PvStore,
+			statsStore dataproviders.PlantStatsStore,
+			historyStore dataproviders.HistoryStore) (dataproviders.DataProvider, error) {
+			return NewDataProvider(initiateData, term, client, pvStore, statsStore, historyStore), nil
+		},
+		dataproviders.ConfigSchema{
+			{Field: "Address", Required: true, Description: "Hostname or ip of the Envoy"},
+			{Field: "UserName", Required: false, Description: "User for the inverter data, default envoy"},
+			{Field: "Password", Required: false, Description: "Password for the inverter data, on older Envoys the last 6 digits of the serial. Without it there is no panel data"},
+		})
+}
+
+func (d *dataProvider) Name() string {
+	return "Enphase"
+}
+
+func NewDataProvider(initiateData dataproviders.InitiateData,
+	term dataproviders.TerminateCallback,
+	client *http.Client,
+	pvStore dataproviders.PvStore,
+	statsStore dataproviders.PlantStatsStore,
+	historyStore dataproviders.HistoryStore) *dataProvider {
+	log.Debug("New dataprovider")
+
+	dp := dataProvider{InitiateData: initiateData,
+		client:       client,
+		term:         term,
+		pvStore:      pvStore,
+		statsStore:   statsStore,
+		historyStore: historyStore}
+
+	return &dp
+}
+
+func (dp *dataProvider) Capabilities() dataproviders.Capabilities {
+	return dataproviders.Capabilities{PowerAc: true, EnergyToday: true, EnergyTotal: true,
+		AmpereAc: true, Panels: dp.InitiateData.Password != ""}
+}
+
+func (dp *dataProvider) Start() error {
+	client := dp.client
+	p := &production{}
+	return dp.Launch(func() {
+		dataproviders.RunUpdates(
+			&dp.Lifecycle,
+			&dp.InitiateData,
+			func(initiateData *dataproviders.InitiateData, pv *dataproviders.PvData) error {
+				err := p.updatePvData(client, initiateData, pv)
+				pv.LatestUpdate = nil
+				return err
+			},
+			func(initiateData *dataproviders.InitiateData, pv *dataproviders.PvData) error {
+				err := updatePanels(client, initiateData, pv)
+				pv.LatestUpdate = nil
+				return err
+			},
+			time.Second*30,
+			time.Minute*5,
+			time.Minute*30,
+			dp.term,
+			dataproviders.DefaultRetryPolicy(MAX_ERRORS),
+			dp.statsStore,
+			dp.pvStore,
+			dp.historyStore)
+	})
+}
+
+type productionReply struct {
+	Production []struct {
+		Type            string
+		MeasurementType string
+		ActiveCount     int
+		WNow            float64
+		WhLifetime      float64
+		WhToday         *float64
+		RmsCurrent      *float64
+	}
+}
+
+// Counts energy today from the energy total, when the Envoy has no production meter
+type production struct {
+	day      string
+	dayStart float64
+}
+
+// Update PvData with the production of the plant
+func (p *production) updatePvData(client *http.Client, initiateData *dataproviders.InitiateData, pv *dataproviders.PvData) error {
+	log.Debug("Fetching update ...")
+	reply := productionReply{}
+	if err := get(client, initiateData, productionUrl, &reply); err != nil {
+		return err
+	}
+	inverters, meter := -1, -1
+	for i, entry := range reply.Production {
+		switch {
+		case entry.Type == "inverters":
+			inverters = i
+		case entry.Type == "eim" && entry.MeasurementType == "production" && entry.ActiveCount > 0:
+			meter = i
+		}
+	}
+	if meter < 0 && inverters < 0 {
+		return fmt.Errorf("Dataprovider enphase fail. No production in reply from Envoy")
+	}
+
+	if meter >= 0 {
+		m := reply.Production[meter]
+		var err error
+		if pv.PowerAc, err = dataproviders.ToWatt(positive(m.WNow)); err != nil {
+			return err
+		}
+		pv.EnergyTotal = dataproviders.KiloWattHour(m.WhLifetime / 1000)
+		if m.WhToday != nil {
+			if pv.EnergyToday, err = dataproviders.ToWattHour(positive(*m.WhToday)); err != nil {
+				return err
+			}
+		}
+		if m.RmsCurrent != nil {
+			pv.AmpereAc = float32(positive(*m.RmsCurrent))
+		}
+		return nil
+	}
+
+	i := reply.Production[inverters]
+	var err error
+	if pv.PowerAc, err = dataproviders.ToWatt(positive(i.WNow)); err != nil {
+		return err
+	}
+	total := i.WhLifetime / 1000
+	day := time.Now().Format(dataproviders.KeyDateFormat)
+	if p.day != day {
+		p.day = day
+		p.dayStart = total
+		// Continue the count, if the provider was restarted during the day
+		if pv.LatestUpdate != nil && pv.LatestUpdate.Format(dataproviders.KeyDateFormat) == day &&
+			pv.EnergyTotal > 0 && float64(pv.EnergyTotal) <= total {
+			p.dayStart = float64(pv.EnergyTotal) - float64(pv.EnergyToday)/1000
+		}
+	}
+	pv.EnergyTotal = dataproviders.KiloWattHour(total)
+	pv.EnergyToday, err = dataproviders.ToWattHour(positive((total - p.dayStart) * 1000))
+	return err
+}
+
+// The meter reports a little negative power at night
+func positive(f float64) float64 {
+	if f < 0 {
+		return 0
+	}
+	return f
+}
+
+type inverterReply []struct {
+	SerialNumber    string
+	LastReportDate  int64
+	LastReportWatts int
+	MaxReportWatts  int
+}
+
+// Update PvData with the output of each microinverter
+func updatePanels(client *http.Client, initiateData *dataproviders.InitiateData, pv *dataproviders.PvData) error {
+	if initiateData.Password == "" {
+		return nil
+	}
+	log.Debug("Fetching inverters ...")
+	reply := inverterReply{}
+	if err := get(client, initiateData, invertersUrl, &reply); err != nil {
+		return err
+	}
+	panels := make([]dataproviders.PanelData, 0, len(reply))
+	for _, inverter := range reply {
+		power, err := dataproviders.ToWatt(positive(float64(inverter.LastReportWatts)))
+		if err != nil {
+			return fmt.Errorf("Microinverter %s: %s", inverter.SerialNumber, err.Error())
+		}
+		powerMax, err := dataproviders.ToWatt(positive(float64(inverter.MaxReportWatts)))
+		if err != nil {
+			return fmt.Errorf("Microinverter %s: %s", inverter.SerialNumber, err.Error())
+		}
+		panels = append(panels, dataproviders.PanelData{
+			Serial:       inverter.SerialNumber,
+			PowerAc:      power,
+			PowerAcMax:   powerMax,
+			LatestReport: time.Unix(inverter.LastReportDate, 0)})
+	}
+	sort.Slice(panels, func(i, j int) bool { return panels[i].Serial < panels[j].Serial })
+	pv.Panels = panels
+	return nil
+}
+
+func get(client *http.Client, initiateData *dataproviders.InitiateData, path string, v interface{}) error {
+	url := fmt.Sprintf(urlTemplate, initiateData.Address, path)
+	log.Tracef("Getting data from Envoy... url is %s", url)
+	user := initiateData.UserName
+	if user == "" {
+		user = defaultUser
+	}
+	resp, err := getDigest(client, url, user, initiateData.Password)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return dataproviders.NewLoginError("Dataprovider enphase fail. Envoy rejected the password for %s", user)
+	}
+	if resp.StatusCode != 200 {
+		err = fmt.Errorf("Dataprovider enphase fail. Received http status %d from Envoy", resp.StatusCode)
+		log.Infof("%s", err.Error())
+		return err
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	log.Tracef("Received %s", b)
+	if err = json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("Dataprovider enphase fail. Could not parse reply from Envoy: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package enphase
+
+import (
+	"dataproviders"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+To run test export GOPATH=/Users/jbr/github/local/solarcompare
+then
+go test -test.v dataproviders/enphase
+*/
+
+const productionReplyMeter = `{"production":[
+	{"type":"inverters","activeCount":3,"readingTime":1560340000,"wNow":2440,"whLifetime":12480000},
+	{"type":"eim","activeCount":1,"measurementType":"production","readingTime":1560340010,
+	 "wNow":2451.2,"whLifetime":12480311.7,"whToday":8532.4,"rmsCurrent":10.69,"rmsVoltage":230.1}],
+	"consumption":[{"type":"eim","activeCount":1,"measurementType":"total-consumption","wNow":512.3}]}`
+
+const productionReplyInverters = `{"production":[
+	{"type":"inverters","activeCount":3,"readingTime":1560340000,"wNow":2440,"whLifetime":12480000},
+	{"type":"eim","activeCount":0,"measurementType":"production","wNow":0,"whLifetime":0}]}`
+
+const invertersReply = `[
+	{"serialNumber":"121547060497","lastReportDate":1560339900,"devType":1,"lastReportWatts":215,"maxReportWatts":240},
+	{"serialNumber":"121547060495","lastReportDate":1560339910,"devType":1,"lastReportWatts":201,"maxReportWatts":238}]`
+
+// A stand-in for an Envoy, asking for digest authentication on the inverter data
+func newEnvoy(t *testing.T, production string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case productionUrl:
+			fmt.Fprint(w, production)
+		case invertersUrl:
+			auth, ok := parseChallenge(r.Header.Get("Authorization"))
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Digest realm="enphaseenergy.com", qop="auth", nonce="a1b2c3", opaque="x"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			ha1 := md5hex("envoy:enphaseenergy.com:060495")
+			ha2 := md5hex("GET:" + auth["uri"])
+			expected := md5hex(ha1 + ":a1b2c3:" + auth["nc"] + ":" + auth["cnonce"] + ":auth:" + ha2)
+			if auth["response"] != expected || auth["opaque"] != "x" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, invertersReply)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func Test_update_meter(t *testing.T) {
+	srv := newEnvoy(t, productionReplyMeter)
+	defer srv.Close()
+	initiateData := dataproviders.InitiateData{PlantKey: "test", Address: strings.TrimPrefix(srv.URL, "http://")}
+
+	pv := dataproviders.PvData{}
+	if err := (&production{}).updatePvData(srv.Client(), &initiateData, &pv); err != nil {
+		t.Fatal(err.Error())
+	}
+	if pv.PowerAc != 2451 || pv.EnergyToday != 8532 || float32(pv.EnergyTotal) != 12480.312 || pv.AmpereAc != 10.69 {
+		t.Errorf("Expected values from the meter, pv data is %s", pv.ToJson())
+	}
+}
+
+func Test_update_inverters(t *testing.T) {
+	srv := newEnvoy(t, productionReplyInverters)
+	defer srv.Close()
+	initiateData := dataproviders.InitiateData{PlantKey: "test", Address: strings.TrimPrefix(srv.URL, "http://")}
+
+	pv := dataproviders.PvData{}
+	if err := (&production{}).updatePvData(srv.Client(), &initiateData, &pv); err != nil {
+		t.Fatal(err.Error())
+	}
+	if pv.PowerAc != 2440 || pv.EnergyToday != 0 || pv.EnergyTotal != 12480 {
+		t.Errorf("Expected values from the inverters, pv data is %s", pv.ToJson())
+	}
+}
+
+// A provider restarted during the day continues from the stored pvdata
+func Test_update_inverters_restarted(t *testing.T) {
+	srv := newEnvoy(t, productionReplyInverters)
+	defer srv.Close()
+	initiateData := dataproviders.InitiateData{PlantKey: "test", Address: strings.TrimPrefix(srv.URL, "http://")}
+
+	earlier := time.Now().Add(-time.Minute)
+	if earlier.Day() != time.Now().Day() {
+		t.Skip("Too close to midnight")
+	}
+	pv := dataproviders.PvData{LatestUpdate: &earlier, EnergyTotal: 12478.5, EnergyToday: 1000}
+	if err := (&production{}).updatePvData(srv.Client(), &initiateData, &pv); err != nil {
+		t.Fatal(err.Error())
+	}
+	if pv.EnergyToday != 2500 || pv.EnergyTotal != 12480 {
+		t.Errorf("Expected the energy today to continue, pv data is %s", pv.ToJson())
+	}
+
+	// Stored yesterday, so today starts from the current total
+	yesterday := time.Now().AddDate(0, 0, -1)
+	pv = dataproviders.PvData{LatestUpdate: &yesterday, EnergyTotal: 12478.5, EnergyToday: 1000}
+	if err := (&production{}).updatePvData(srv.Client(), &initiateData, &pv); err != nil {
+		t.Fatal(err.Error())
+	}
+	if pv.EnergyToday != 0 {
+		t.Errorf("Expected the energy today to start over, pv data is %s", pv.ToJson())
+	}
+}
+
+func Test_panels(t *testing.T) {
+	srv := newEnvoy(t, productionReplyMeter)
+	defer srv.Close()
+	initiateData := dataproviders.InitiateData{PlantKey: "test",
+		Address: strings.TrimPrefix(srv.URL, "http://"), Password: "060495"}
+
+	pv := dataproviders.PvData{}
+	if err := updatePanels(srv.Client(), &initiateData, &pv); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(pv.Panels) != 2 || pv.Panels[0].Serial != "121547060495" || pv.Panels[0].PowerAc != 201 ||
+		pv.Panels[1].PowerAcMax != 240 || pv.Panels[1].LatestReport.Unix() != 1560339900 {
+		t.Errorf("Wrong panels, pv data is %s", pv.ToJson())
+	}
+
+	initiateData.Password = "wrong"
+	if err := updatePanels(srv.Client(), &initiateData, &pv); err == nil {
+		t.Error("Expected wrong password to fail")
+	}
+}
@@ -0,0 +1,246 @@
+package fronius
+
+// Dataprovider for Fronius inverters, read through the local Solar API v1.
+// The power flow gives the totals for the site, and the realtime
+// data of the inverter gives the dc voltage and ac current.
+
+import (
+	"dataproviders"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"logger"
+	"net/http"
+	"time"
+)
+
+type dataProvider struct {
+	dataproviders.Lifecycle
+	InitiateData dataproviders.InitiateData
+	client       *http.Client
+	term         dataproviders.TerminateCallback
+	pvStore      dataproviders.PvStore
+	statsStore   dataproviders.PlantStatsStore
+	historyStore dataproviders.HistoryStore
+}
+
+var log = logger.NewLogger(logger.DEBUG, "Dataprovider: Fronius:")
+
+const MAX_ERRORS = 5
+
+const ProviderName = "fronius"
+
+const urlTemplate = "http://%s%s"
+
+const powerFlowUrl = "/solar_api/v1/GetPowerFlowRealtimeData.fcgi"
+const inverterUrl = "/solar_api/v1/GetInverterRealtimeData.cgi?Scope=Device&DeviceId=%s&DataCollection=CommonInverterData"
+
+const defaultDeviceId = "1"
+
+func init() {
+	dataproviders.Register(ProviderName,
+		func(initiateData dataproviders.InitiateData,
+			term dataproviders.TerminateCallback,
+			client *http.Client,
+			pvStore dataproviders.PvStore,
+			statsStore dataproviders.PlantStatsStore,
+			historyStore dataproviders.HistoryStore) (dataproviders.DataProvider, error) {
+			return NewDataProvider(initiateData, term, client, pvStore, statsStore, historyStore), nil
+		},
+		dataproviders.ConfigSchema{
+			{Field: "Address", Required: true, Description: "Hostname or ip of the inverter or datamanager"},
+			{Field: "PlantNo", Required: false, Description: "Device id of the inverter, default 1"},
+		})
+}
+
+func (d *dataProvider) Name() string {
+	return "Fronius"
+}
+
+func NewDataProvider(initiateData dataproviders.InitiateData,
+	term dataproviders.TerminateCallback,
+	client *http.Client,
+	pvStore dataproviders.PvStore,
+	statsStore dataproviders.PlantStatsStore,
+	historyStore dataproviders.HistoryStore) *dataProvider {
+	log.Debug("New dataprovider")
+
+	dp := dataProvider{InitiateData: initiateData,
+		client:       client,
+		term:         term,
+		pvStore:      pvStore,
+		statsStore:   statsStore,
+		historyStore: historyStore}
+
+	return &dp
+}
+
+func (dp *dataProvider) Capabilities() dataproviders.Capabilities {
+	return dataproviders.Capabilities{PowerAc: true, EnergyToday: true,
+		EnergyTotal: true, VoltDc: true, AmpereAc: true, Strings: true, Frequency: true}
+}
+
+func (dp *dataProvider) Start() error {
+	client := dp.client
+	return dp.Launch(func() {
+		dataproviders.RunUpdates(
+			&dp.Lifecycle,
+			&dp.InitiateData,
+			func(initiateData *dataproviders.InitiateData, pv *dataproviders.PvData) error {
+				err := updatePvData(client, initiateData, pv)
+				pv.LatestUpdate = nil
+				return err
+			},
+			func(initiateData *dataproviders.InitiateData, pv *dataproviders.PvData) error {
+				return nil
+			},
+			time.Second*10,
+			time.Minute*5,
+			time.Minute*30,
+			dp.term,
+			dataproviders.DefaultRetryPolicy(MAX_ERRORS),
+			dp.statsStore,
+			dp.pvStore,
+			dp.historyStore)
+	})
+}
+
+// Head of every Solar API reply
+type head struct {
+	Status struct {
+		Code   int
+		Reason string
+	}
+}
+
+// A measured value, missing when the inverter sleeps
+type value struct {
+	Value *float64
+	Unit  string
+}
+
+type powerFlowReply struct {
+	Head head
+	Body struct {
+		Data struct {
+			Site struct {
+				// Power in W, null when there is no production
+				P_PV *float64
+				// Energy in Wh
+				E_Day   *float64
+				E_Total *float64
+			}
+		}
+	}
+}
+
+type inverterReply struct {
+	Head head
+	Body struct {
+		Data struct {
+			PAC          value
+			DAY_ENERGY   value
+			TOTAL_ENERGY value
+			UDC          value
+			IDC          value
+			// Second MPPT tracker, on inverters that have one
+			UDC_2 value
+			IDC_2 value
+			IAC   value
+			FAC   value
+		}
+	}
+}
+
+// Update PvData
+func updatePvData(client *http.Client, initiateData *dataproviders.InitiateData, pv *dataproviders.PvData) error {
+	log.Debug("Fetching update ...")
+
+	flow := powerFlowReply{}
+	if err := get(client, initiateData, powerFlowUrl, &flow); err != nil {
+		return err
+	}
+	if flow.Head.Status.Code != 0 {
+		return fmt.Errorf("Dataprovider fronius fail. Power flow status %d: %s",
+			flow.Head.Status.Code, flow.Head.Status.Reason)
+	}
+	site := flow.Body.Data.Site
+	var err error
+	if pv.PowerAc, err = dataproviders.ToWatt(orZero(site.P_PV)); err != nil {
+		return err
+	}
+	if pv.EnergyToday, err = dataproviders.ToWattHour(orZero(site.E_Day)); err != nil {
+		return err
+	}
+	pv.EnergyTotal = dataproviders.KiloWattHour(orZero(site.E_Total) / 1000)
+
+	deviceId := initiateData.PlantNo
+	if deviceId == "" {
+		deviceId = defaultDeviceId
+	}
+	inverter := inverterReply{}
+	if err := get(client, initiateData, fmt.Sprintf(inverterUrl, deviceId), &inverter); err != nil {
+		return err
+	}
+	if inverter.Head.Status.Code != 0 {
+		// The inverter does not answer while it sleeps at night
+		log.Debugf("Inverter %s is not responding, status %d: %s", deviceId,
+			inverter.Head.Status.Code, inverter.Head.Status.Reason)
+		pv.VoltDc = 0
+		pv.AmpereAc = 0
+		pv.Strings = nil
+		pv.Frequency = 0
+		return nil
+	}
+	data := inverter.Body.Data
+	strings := []dataproviders.StringData{}
+	for _, tracker := range [][2]value{{data.UDC, data.IDC}, {data.UDC_2, data.IDC_2}} {
+		if tracker[0].Value == nil {
+			continue
+		}
+		volt, amp := orZero(tracker[0].Value), orZero(tracker[1].Value)
+		power, err := dataproviders.ToWatt(volt * amp)
+		if err != nil {
+			return err
+		}
+		strings = append(strings, dataproviders.StringData{VoltDc: float32(volt),
+			AmpereDc: float32(amp),
+			PowerDc:  power})
+	}
+	pv.VoltDc = 0
+	pv.SetStrings(strings)
+	pv.AmpereAc = float32(orZero(data.IAC.Value))
+	pv.Frequency = float32(orZero(data.FAC.Value))
+	return nil
+}
+
+func orZero(f *float64) float64 {
+	if f == nil || *f < 0 {
+		return 0
+	}
+	return *f
+}
+
+func get(client *http.Client, initiateData *dataproviders.InitiateData, path string, v interface{}) error {
+	url := fmt.Sprintf(urlTemplate, initiateData.Address, path)
+	log.Tracef("Getting data from inverter... url is %s", url)
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = fmt.Errorf("Dataprovider fronius fail. Received http status %d from inverter doing data gathering", resp.StatusCode)
+		log.Infof("%s", err.Error())
+		return err
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	log.Tracef("Received %s", b)
+	if err = json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("Dataprovider fronius fail. Could not parse reply from inverter: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package fronius
+
+import (
+	"dataproviders"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+/*
+To run test export GOPATH=/Users/jbr/github/local/solarcompare
+then
+go test -test.v dataproviders/fronius
+*/
+
+// A stand-in for the Solar API, serving recorded replies from testdata
+func newInverter(t *testing.T, powerFlow string, inverter string) *httptest.Server {
+	serve := func(file string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			b, err := ioutil.ReadFile("testdata/" + file)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/solar_api/v1/GetPowerFlowRealtimeData.fcgi", serve(powerFlow))
+	mux.HandleFunc("/solar_api/v1/GetInverterRealtimeData.cgi", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("DeviceId") != "1" {
+			http.NotFound(w, r)
+			return
+		}
+		serve(inverter)(w, r)
+	})
+	return httptest.NewServer(mux)
+}
+
+func address(srv *httptest.Server) string {
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+func Test_update(t *testing.T) {
+	srv := newInverter(t, "powerflow.json", "inverter.json")
+	defer srv.Close()
+
+	pv := dataproviders.PvData{}
+	err := updatePvData(srv.Client(),
+		&dataproviders.InitiateData{PlantKey: "test", Address: address(srv)}, &pv)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if pv.PowerAc != 2451 || pv.EnergyToday != 8532 || pv.EnergyTotal != 12480.311 {
+		t.Errorf("Wrong power or energy, pv data is %s", pv.ToJson())
+	}
+	if pv.VoltDc != 401.1 || pv.AmpereAc != 10.69 {
+		t.Errorf("Wrong volt or ampere, pv data is %s", pv.ToJson())
+	}
+	if len(pv.Strings) != 1 || pv.Strings[0].AmpereDc != 6.3 || pv.Strings[0].PowerDc != 2526 || pv.Frequency != 50.01 {
+		t.Errorf("Wrong string or frequency, pv data is %s", pv.ToJson())
+	}
+}
+
+func Test_update_night(t *testing.T) {
+	srv := newInverter(t, "powerflow_night.json", "inverter_night.json")
+	defer srv.Close()
+
+	pv := dataproviders.PvData{PowerAc: 100, VoltDc: 300, AmpereAc: 1}
+	err := updatePvData(srv.Client(),
+		&dataproviders.InitiateData{PlantKey: "test", Address: address(srv), PlantNo: "1"}, &pv)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if pv.PowerAc != 0 || pv.VoltDc != 0 || pv.AmpereAc != 0 || pv.EnergyTotal != 12489.102 {
+		t.Errorf("Expected a sleeping inverter, pv data is %s", pv.ToJson())
+	}
+}
+
+func Test_unknown_device(t *testing.T) {
+	srv := newInverter(t, "powerflow.json", "inverter.json")
+	defer srv.Close()
+
+	pv := dataproviders.PvData{}
+	err := updatePvData(srv.Client(),
+		&dataproviders.InitiateData{PlantKey: "test", Address: address(srv), PlantNo: "2"}, &pv)
+	if err == nil {
+		t.Error("Expected an error on unknown device")
+	}
+}
@@ -0,0 +1,297 @@
+package generic
+
+// Generic dataprovider for loggers that serve their data as json over http.
+// The plant config gives the url in Address, and in Options the json path
+// for each PvData field, eg. "PowerAc": "$.inverter[0].pac".
+// A field can be scaled to the unit of PvData with "{field}.scale",
+// eg. "EnergyTotal.scale": "0.001" when the logger counts in Wh.
+// Units in PvData are W for PowerAc, Wh for EnergyToday, kWh for
+// EnergyTotal, V for VoltDc and A for AmpereAc.
+
+import (
+	"dataproviders"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"jsonpath"
+	"logger"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type dataProvider struct {
+	dataproviders.Lifecycle
+	InitiateData dataproviders.InitiateData
+	client       *http.Client
+	term         dataproviders.TerminateCallback
+	pvStore      dataproviders.PvStore
+	statsStore   dataproviders.PlantStatsStore
+	historyStore dataproviders.HistoryStore
+	mapping      *mapping
+	interval     time.Duration
+}
+
+var log = logger.NewLogger(logger.DEBUG, "Dataprovider: Generic:")
+
+const MAX_ERRORS = 5
+
+const ProviderName = "generic"
+
+const defaultInterval = 30 * time.Second
+
+// Authentication methods
+const (
+	authNone   = "none"
+	authBasic  = "basic"
+	authBearer = "bearer"
+)
+
+// The PvData fields that can be mapped
+var numberFields = []string{"PowerAc", "EnergyToday", "EnergyTotal", "VoltDc", "AmpereAc"}
+
+const stateField = "State"
+
+func init() {
+	dataproviders.Register(ProviderName,
+		func(initiateData dataproviders.InitiateData,
+			term dataproviders.TerminateCallback,
+			client *http.Client,
+			pvStore dataproviders.PvStore,
+			statsStore dataproviders.PlantStatsStore,
+			historyStore dataproviders.HistoryStore) (dataproviders.DataProvider, error) {
+			return NewDataProvider(initiateData, term, client, pvStore, statsStore, historyStore)
+		},
+		dataproviders.ConfigSchema{
+			{Field: "Address", Required: true, Description: "Url of the json data"},
+			{Field: "Options.PowerAc", Required: true, Description: "Json path of the ac power, eg. $.data.pac"},
+			{Field: "Options.EnergyToday", Required: false, Description: "Json path of the energy today"},
+			{Field: "Options.EnergyTotal", Required: false, Description: "Json path of the energy total"},
+			{Field: "Options.VoltDc", Required: false, Description: "Json path of the dc voltage"},
+			{Field: "Options.AmpereAc", Required: false, Description: "Json path of the ac current"},
+			{Field: "Options.State", Required: false, Description: "Json path of the inverter state"},
+			{Field: "Options.auth", Required: false, Description: "none, basic with UserName and Password, or bearer with Password as token"},
+			{Field: "Options.interval", Required: false, Description: "Seconds between updates, default 30"},
+		})
+	dataproviders.RegisterValidator(ProviderName, func(initiateData *dataproviders.InitiateData) error {
+		_, _, err := parseOptions(initiateData.Options)
+		return err
+	})
+}
+
+func (d *dataProvider) Name() string {
+	return "Generic"
+}
+
+func NewDataProvider(initiateData dataproviders.InitiateData,
+	term dataproviders.TerminateCallback,
+	client *http.Client,
+	pvStore dataproviders.PvStore,
+	statsStore dataproviders.PlantStatsStore,
+	historyStore dataproviders.HistoryStore) (*dataProvider, error) {
+	log.Debug("New dataprovider")
+
+	m, interval, err := parseOptions(initiateData.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	dp := dataProvider{InitiateData: initiateData,
+		client:       client,
+		term:         term,
+		pvStore:      pvStore,
+		statsStore:   statsStore,
+		historyStore: historyStore,
+		mapping:      m,
+		interval:     interval}
+
+	return &dp, nil
+}
+
+func (dp *dataProvider) Capabilities() dataproviders.Capabilities {
+	_, energyToday := dp.mapping.paths["EnergyToday"]
+	_, energyTotal := dp.mapping.paths["EnergyTotal"]
+	_, voltDc := dp.mapping.paths["VoltDc"]
+	_, ampereAc := dp.mapping.paths["AmpereAc"]
+	return dataproviders.Capabilities{PowerAc: true, EnergyToday: energyToday,
+		EnergyTotal: energyTotal, VoltDc: voltDc, AmpereAc: ampereAc}
+}
+
+func (dp *dataProvider) Start() error {
+	client := dp.client
+	m := dp.mapping
+	return dp.Launch(func() {
+		dataproviders.RunUpdates(
+			&dp.Lifecycle,
+			&dp.InitiateData,
+			func(initiateData *dataproviders.InitiateData, pv *dataproviders.PvData) error {
+				err := updatePvData(client, initiateData, m, pv)
+				pv.LatestUpdate = nil
+				return err
+			},
+			func(initiateData *dataproviders.InitiateData, pv *dataproviders.PvData) error {
+				return nil
+			},
+			dp.interval,
+			time.Minute*5,
+			time.Minute*30,
+			dp.term,
+			dataproviders.DefaultRetryPolicy(MAX_ERRORS),
+			dp.statsStore,
+			dp.pvStore,
+			dp.historyStore)
+	})
+}
+
+// The json paths and scales of the mapped fields
+type mapping struct {
+	paths  map[string]*jsonpath.Path
+	scales map[string]float64
+}
+
+// The mapping and the interval given in the options
+func parseOptions(options map[string]string) (*mapping, time.Duration, error) {
+	m, err := newMapping(options)
+	if err != nil {
+		return nil, 0, err
+	}
+	interval := defaultInterval
+	if s := options["interval"]; s != "" {
+		secs, err := strconv.Atoi(s)
+		if err != nil || secs < 1 {
+			return nil, 0, fmt.Errorf("Bad interval %s", s)
+		}
+		interval = time.Duration(secs) * time.Second
+	}
+	switch options["auth"] {
+	case "", authNone, authBasic, authBearer:
+	default:
+		return nil, 0, fmt.Errorf("Unknown auth %s", options["auth"])
+	}
+	return m, interval, nil
+}
+
+func newMapping(options map[string]string) (*mapping, error) {
+	m := &mapping{paths: map[string]*jsonpath.Path{}, scales: map[string]float64{}}
+	for _, field := range append(numberFields, stateField) {
+		s, ok := options[field]
+		if !ok {
+			continue
+		}
+		p, err := jsonpath.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("Bad path for %s: %s", field, err.Error())
+		}
+		m.paths[field] = p
+		m.scales[field] = 1
+		if s, ok := options[field+".scale"]; ok {
+			scale, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Bad scale for %s: %s", field, s)
+			}
+			m.scales[field] = scale
+		}
+	}
+	if _, ok := m.paths["PowerAc"]; !ok {
+		return nil, fmt.Errorf("No path for PowerAc")
+	}
+	return m, nil
+}
+
+// The mapped value of the field, ok is false if the field is not mapped
+func (m *mapping) value(doc interface{}, field string) (f float64, ok bool, err error) {
+	p, ok := m.paths[field]
+	if !ok {
+		return
+	}
+	f, err = p.Float(doc)
+	f *= m.scales[field]
+	if f < 0 {
+		f = 0
+	}
+	return
+}
+
+// Update PvData
+func updatePvData(client *http.Client, initiateData *dataproviders.InitiateData,
+	m *mapping, pv *dataproviders.PvData) error {
+	log.Debug("Fetching update ...")
+	req, err := http.NewRequest("GET", initiateData.Address, nil)
+	if err != nil {
+		return err
+	}
+	switch initiateData.Options["auth"] {
+	case authBasic:
+		req.SetBasicAuth(initiateData.UserName, initiateData.Password)
+	case authBearer:
+		req.Header.Set("Authorization", "Bearer "+initiateData.Password)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return dataproviders.NewLoginError("Dataprovider generic fail. Logger rejected the credentials with http status %d", resp.StatusCode)
+	}
+	if resp.StatusCode != 200 {
+		err = fmt.Errorf("Dataprovider generic fail. Received http status %d from logger", resp.StatusCode)
+		log.Infof("%s", err.Error())
+		return err
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	log.Tracef("Received %s", b)
+	var doc interface{}
+	if err = json.Unmarshal(b, &doc); err != nil {
+		return fmt.Errorf("Dataprovider generic fail. Could not parse reply from logger: %s", err.Error())
+	}
+
+	// Read all fields before setting any, so a bad reply leaves pv as it was
+	values := map[string]float64{}
+	for _, field := range numberFields {
+		f, ok, err := m.value(doc, field)
+		if err != nil {
+			return fmt.Errorf("Dataprovider generic fail. %s", err.Error())
+		}
+		if ok {
+			values[field] = f
+		}
+	}
+	state := pv.State
+	if p, ok := m.paths[stateField]; ok {
+		v, err := p.Get(doc)
+		if err != nil {
+			return fmt.Errorf("Dataprovider generic fail. %s", err.Error())
+		}
+		state = fmt.Sprint(v)
+	}
+
+	power, err := dataproviders.ToWatt(values["PowerAc"])
+	if err != nil {
+		return fmt.Errorf("Dataprovider generic fail. PowerAc: %s", err.Error())
+	}
+	energyToday, err := dataproviders.ToWattHour(values["EnergyToday"])
+	if err != nil {
+		return fmt.Errorf("Dataprovider generic fail. EnergyToday: %s", err.Error())
+	}
+
+	pv.PowerAc = power
+	if _, ok := values["EnergyToday"]; ok {
+		pv.EnergyToday = energyToday
+	}
+	if f, ok := values["EnergyTotal"]; ok {
+		pv.EnergyTotal = dataproviders.KiloWattHour(f)
+	}
+	if f, ok := values["VoltDc"]; ok {
+		pv.VoltDc = float32(f)
+	}
+	if f, ok := values["AmpereAc"]; ok {
+		pv.AmpereAc = float32(f)
+	}
+	pv.State = state
+	return nil
+}
@@ -0,0 +1,99 @@
+package generic
+
+import (
+	"dataproviders"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+/*
+To run test export GOPATH=/Users/jbr/github/local/solarcompare
+then
+go test -test.v dataproviders/generic
+*/
+
+// A home grown logger, counting energy in Wh, with a token
+func newLogger() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer TOKEN" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"status": "ok", "inverters": [{"pac": "2451", "udc": 401.1, "iac": 10.69}],
+			"totals": {"today": 8532, "lifetime": 12480311}}`)
+	}))
+}
+
+func Test_update(t *testing.T) {
+	srv := newLogger()
+	defer srv.Close()
+	initiateData := dataproviders.InitiateData{PlantKey: "test", Address: srv.URL, Password: "TOKEN",
+		Options: map[string]string{
+			"auth":              "bearer",
+			"PowerAc":           "$.inverters[0].pac",
+			"EnergyToday":       "$.totals.today",
+			"EnergyTotal":       "$.totals.lifetime",
+			"EnergyTotal.scale": "0.001",
+			"VoltDc":            "$.inverters[0].udc",
+			"AmpereAc":          "$.inverters[0]['iac']",
+			"State":             "$.status"}}
+	dp, err := NewDataProvider(initiateData, nil, srv.Client(), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if c := dp.Capabilities(); !c.EnergyTotal || !c.AmpereAc {
+		t.Errorf("Expected capabilities from the mapping, was %v", c)
+	}
+
+	pv := dataproviders.PvData{}
+	if err = updatePvData(srv.Client(), &initiateData, dp.mapping, &pv); err != nil {
+		t.Fatal(err.Error())
+	}
+	if pv.PowerAc != 2451 || pv.EnergyToday != 8532 || pv.EnergyTotal != 12480.311 ||
+		pv.VoltDc != 401.1 || pv.AmpereAc != 10.69 || pv.State != "ok" {
+		t.Errorf("Wrong mapping, pv data is %s", pv.ToJson())
+	}
+
+	// A path that is not in the reply leaves pv as it was
+	initiateData.Options["VoltDc"] = "$.inverters[1].udc"
+	dp, _ = NewDataProvider(initiateData, nil, srv.Client(), nil, nil, nil)
+	pv = dataproviders.PvData{}
+	if err = updatePvData(srv.Client(), &initiateData, dp.mapping, &pv); err == nil || pv.PowerAc != 0 {
+		t.Errorf("Expected error and no update, got %v, pv data is %s", err, pv.ToJson())
+	}
+
+	// A plant above 65.5 kW, and energy today that does not fit in Wh
+	initiateData.Options["VoltDc"] = "$.inverters[0].udc"
+	initiateData.Options["PowerAc.scale"] = "100"
+	dp, _ = NewDataProvider(initiateData, nil, srv.Client(), nil, nil, nil)
+	pv = dataproviders.PvData{}
+	if err = updatePvData(srv.Client(), &initiateData, dp.mapping, &pv); err != nil || pv.PowerAc != 245100 {
+		t.Errorf("Expected power of a large plant, got %v, pv data is %s", err, pv.ToJson())
+	}
+	initiateData.Options["EnergyToday.scale"] = "1000000"
+	dp, _ = NewDataProvider(initiateData, nil, srv.Client(), nil, nil, nil)
+	pv = dataproviders.PvData{}
+	err = updatePvData(srv.Client(), &initiateData, dp.mapping, &pv)
+	if err == nil || !strings.Contains(err.Error(), "out of range") || pv.PowerAc != 0 {
+		t.Errorf("Expected overflow reported and no update, got %v, pv data is %s", err, pv.ToJson())
+	}
+}
+
+func Test_bad_config(t *testing.T) {
+	for _, options := range []map[string]string{
+		{},
+		{"PowerAc": "pac"},
+		{"PowerAc": "$.pac", "PowerAc.scale": "x"},
+		{"PowerAc": "$.pac", "auth": "digest"},
+		{"PowerAc": "$.pac", "interval": "0"},
+	} {
+		_, err := NewDataProvider(dataproviders.InitiateData{Address: "http://logger", Options: options},
+			nil, nil, nil, nil, nil)
+		if err == nil {
+			t.Errorf("Expected %v to be rejected", options)
+		}
+	}
+}
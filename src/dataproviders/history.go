@@ -0,0 +1,138 @@
+package dataproviders
+
+import (
+	"fmt"
+	"time"
+)
+
+// A timestamped sample of PvData as kept in the history
+type PvSample struct {
+	Time        time.Time
+	PowerAc     Watt
+	EnergyTotal KiloWattHour
+	EnergyToday WattHour
+	VoltDc      float32
+	AmpereAc    float32
+}
+
+// Interface for appending and querying the history of pvdata
+type HistoryStore interface {
+	Append(plantkey string, sample PvSample) error
+	// All samples with from <= Time < to, sorted by time
+	Range(plantkey string, from time.Time, to time.Time) ([]PvSample, error)
+}
+
+// Implemented by history stores that keep the energy of each day, so it
+// need not be summed up from every sample of the days on each request
+type DailyEnergyStore interface {
+	// Energy in Wh of the days with samples from the day of from until the day
+	// of to, excluding to, keyed by KeyDateFormat
+	DailyEnergy(plantkey string, from time.Time, to time.Time) (PvDataDaily, error)
+}
+
+// DailyEnergy of the store, read from the samples if the store does not keep it
+func DailyEnergy(store HistoryStore, plantkey string, from time.Time, to time.Time) (PvDataDaily, error) {
+	if d, ok := store.(DailyEnergyStore); ok {
+		return d.DailyEnergy(plantkey, from, to)
+	}
+	samples, err := store.Range(plantkey, from, to)
+	if err != nil {
+		return nil, err
+	}
+	days := PvDataDaily{}
+	for _, s := range Downsample(samples, Daily) {
+		days[s.Time.Format(KeyDateFormat)] = s.EnergyToday
+	}
+	return days, nil
+}
+
+// Bucket size used when downsampling history
+type Resolution time.Duration
+
+const (
+	Raw         = Resolution(0)
+	FiveMinutes = Resolution(5 * time.Minute)
+	Hourly      = Resolution(time.Hour)
+	Daily       = Resolution(24 * time.Hour)
+)
+
+func NewPvSample(pv *PvData) PvSample {
+	s := PvSample{PowerAc: pv.PowerAc,
+		EnergyTotal: pv.EnergyTotal,
+		EnergyToday: pv.EnergyToday,
+		VoltDc:      pv.VoltDc,
+		AmpereAc:    pv.AmpereAc}
+	if pv.LatestUpdate != nil {
+		s.Time = *pv.LatestUpdate
+	} else {
+		s.Time = time.Now()
+	}
+	return s
+}
+
+func ParseResolution(s string) (Resolution, error) {
+	switch s {
+	case "", "raw":
+		return Raw, nil
+	case "5m", "5min":
+		return FiveMinutes, nil
+	case "1h", "hour", "hourly":
+		return Hourly, nil
+	case "1d", "day", "daily":
+		return Daily, nil
+	}
+	return Raw, fmt.Errorf("Unknown resolution %s, use raw, 5m, hourly or daily", s)
+}
+
+// The start of the bucket that t falls into.
+// Daily buckets starts at local midnight.
+func (r Resolution) bucket(t time.Time) time.Time {
+	if r == Daily {
+		y, m, d := t.Date()
+		return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	}
+	return t.Truncate(time.Duration(r))
+}
+
+// Downsample samples into buckets of the given resolution.
+// Power, volt and ampere are averaged, while energy is the highest seen in the bucket.
+// The samples must be sorted by time.
+func Downsample(samples []PvSample, r Resolution) []PvSample {
+	if r == Raw || len(samples) == 0 {
+		return samples
+	}
+	result := []PvSample{}
+	var cur PvSample
+	var powerSum, voltSum, ampSum float64
+	n := 0
+	flush := func() {
+		if n == 0 {
+			return
+		}
+		cur.PowerAc = Watt(powerSum/float64(n) + 0.5)
+		cur.VoltDc = float32(voltSum / float64(n))
+		cur.AmpereAc = float32(ampSum / float64(n))
+		result = append(result, cur)
+	}
+	for _, s := range samples {
+		b := r.bucket(s.Time)
+		if n == 0 || !b.Equal(cur.Time) {
+			flush()
+			cur = PvSample{Time: b}
+			powerSum, voltSum, ampSum = 0, 0, 0
+			n = 0
+		}
+		powerSum += float64(s.PowerAc)
+		voltSum += float64(s.VoltDc)
+		ampSum += float64(s.AmpereAc)
+		if s.EnergyToday > cur.EnergyToday {
+			cur.EnergyToday = s.EnergyToday
+		}
+		if s.EnergyTotal > cur.EnergyTotal {
+			cur.EnergyTotal = s.EnergyTotal
+		}
+		n++
+	}
+	flush()
+	return result
+}
@@ -0,0 +1,115 @@
+package ingest
+
+// Dataprovider for plants whose logger posts its data to us, for plants
+// behind NAT where the inverter cannot be reached. The logger posts to
+// /ingest/{plantkey} with the token of the plant, see web.IngestHandler.
+
+import (
+	"crypto/subtle"
+	"dataproviders"
+	"fmt"
+	"logger"
+	"net/http"
+	"time"
+)
+
+type dataProvider struct {
+	dataproviders.Lifecycle
+	InitiateData dataproviders.InitiateData
+	term         dataproviders.TerminateCallback
+	pvStore      dataproviders.PvStore
+	statsStore   dataproviders.PlantStatsStore
+	historyStore dataproviders.HistoryStore
+	updates      chan dataproviders.PushUpdate
+}
+
+var log = logger.NewLogger(logger.DEBUG, "Dataprovider: Ingest:")
+
+const MAX_ERRORS = 5
+
+const ProviderName = "ingest"
+
+// How long a push waits for the provider to take it
+const pushTimeout = 5 * time.Second
+
+func init() {
+	dataproviders.Register(ProviderName,
+		func(initiateData dataproviders.InitiateData,
+			term dataproviders.TerminateCallback,
+			client *http.Client,
+			pvStore dataproviders.PvStore,
+			statsStore dataproviders.PlantStatsStore,
+			historyStore dataproviders.HistoryStore) (dataproviders.DataProvider, error) {
+			return NewDataProvider(initiateData, term, pvStore, statsStore, historyStore), nil
+		},
+		dataproviders.ConfigSchema{
+			{Field: "Password", Required: true, Description: "Api token the logger posts with"},
+		})
+}
+
+func (d *dataProvider) Name() string {
+	return "Ingest"
+}
+
+func NewDataProvider(initiateData dataproviders.InitiateData,
+	term dataproviders.TerminateCallback,
+	pvStore dataproviders.PvStore,
+	statsStore dataproviders.PlantStatsStore,
+	historyStore dataproviders.HistoryStore) *dataProvider {
+	log.Debug("New dataprovider")
+
+	dp := dataProvider{InitiateData: initiateData,
+		term:         term,
+		pvStore:      pvStore,
+		statsStore:   statsStore,
+		historyStore: historyStore,
+		updates:      make(chan dataproviders.PushUpdate)}
+
+	return &dp
+}
+
+// Loggers can post any of the fields
+func (dp *dataProvider) Capabilities() dataproviders.Capabilities {
+	return dataproviders.Capabilities{PowerAc: true, EnergyToday: true,
+		EnergyTotal: true, VoltDc: true, AmpereAc: true,
+		Strings: true, Phases: true, Frequency: true, Temperature: true}
+}
+
+func (dp *dataProvider) Start() error {
+	return dp.Launch(func() {
+		dataproviders.RunPushUpdates(
+			&dp.Lifecycle,
+			&dp.InitiateData,
+			dp.updates,
+			nil,
+			time.Minute*30,
+			dp.term,
+			MAX_ERRORS,
+			dp.statsStore,
+			dp.pvStore,
+			dp.historyStore)
+	})
+}
+
+func (dp *dataProvider) Authorize(token string) bool {
+	return Authorize(&dp.InitiateData, token)
+}
+
+// Is the token allowed to post data to the plant with the initiateData.
+// The token is the password of the plant, a plant without one accepts none
+func Authorize(initiateData *dataproviders.InitiateData, token string) bool {
+	return initiateData.Password != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(initiateData.Password)) == 1
+}
+
+func (dp *dataProvider) Push(update dataproviders.PushUpdate) error {
+	if dp.Status() == dataproviders.Terminated {
+		return fmt.Errorf("Provider for plant %s is terminated", dp.InitiateData.PlantKey)
+	}
+	select {
+	case dp.updates <- update:
+		return nil
+	case <-time.After(pushTimeout):
+		return fmt.Errorf("Provider for plant %s did not take the update", dp.InitiateData.PlantKey)
+	}
+}
@@ -0,0 +1,78 @@
+package ingest
+
+import (
+	"context"
+	"dataproviders"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+To run test export GOPATH=/Users/jbr/github/local/solarcompare
+then
+go test -test.v dataproviders/ingest
+*/
+
+type PlantStatsStore struct {
+}
+
+func (p PlantStatsStore) LoadStats(plantkey string) dataproviders.PlantStats {
+	return dataproviders.PlantStats{}
+}
+func (p PlantStatsStore) SaveStats(plantkey string, pv *dataproviders.PvData) {}
+
+type PvStore struct {
+	lock sync.Mutex
+	pv   dataproviders.PvData
+}
+
+func (s *PvStore) Set(plantkey string, pv *dataproviders.PvData) {
+	s.lock.Lock()
+	s.pv = *pv
+	s.lock.Unlock()
+}
+
+func (s *PvStore) Get(plantkey string) dataproviders.PvData {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.pv
+}
+
+func Test_push(t *testing.T) {
+	pvStore := &PvStore{}
+	dp := NewDataProvider(dataproviders.InitiateData{PlantKey: "test", Password: "TOKEN"},
+		func() {}, pvStore, PlantStatsStore{}, nil)
+	if dp.Authorize("WRONG") || dp.Authorize("") || !dp.Authorize("TOKEN") {
+		t.Error("Wrong authorization of tokens")
+	}
+	if err := dp.Start(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	at := time.Date(2019, 6, 12, 13, 0, 0, 0, time.Local)
+	err := dp.Push(func(pv *dataproviders.PvData) error {
+		pv.PowerAc = 2451
+		pv.LatestUpdate = &at
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// A second push is only taken when the first is applied
+	dp.Push(func(pv *dataproviders.PvData) error { return nil })
+	pv := pvStore.Get("test")
+	if pv.PowerAc != 2451 || pv.PowerAcPeakAll != 2451 || !pv.PowerAcPeakAllTime.Equal(at) {
+		t.Errorf("Push not applied, pv data is %s", pv.ToJson())
+	}
+	if dp.Status() != dataproviders.Online {
+		t.Errorf("Expected provider to be online, was %s", dp.Status())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dp.Stop(ctx)
+	if err = dp.Push(func(pv *dataproviders.PvData) error { return nil }); err == nil {
+		t.Error("Expected push to a stopped provider to fail")
+	}
+}
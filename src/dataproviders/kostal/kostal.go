@@ -13,9 +13,13 @@ import (
 
 
 type dataProvider struct {
+	dataproviders.Lifecycle
 	InitiateData   dataproviders.InitiateData
-	latestErr      error
 	client         *http.Client
+	term           dataproviders.TerminateCallback
+	pvStore        dataproviders.PvStore
+	statsStore     dataproviders.PlantStatsStore
+	historyStore   dataproviders.HistoryStore
 }
 
 
@@ -23,43 +27,79 @@ var log = logger.NewLogger(logger.DEBUG, "Dataprovider: Kostal:")
 
 const MAX_ERRORS = 5
 
+const ProviderName = "kostal"
+
 const urlTemplate = "http://%s"
 
 const allValuesRegEx = "[0-9|\\.]+</td>"
 const numberRegEx = "[0-9|\\.]+"
+func init() {
+	dataproviders.Register(ProviderName,
+		func(initiateData dataproviders.InitiateData,
+			term dataproviders.TerminateCallback,
+			client *http.Client,
+			pvStore dataproviders.PvStore,
+			statsStore dataproviders.PlantStatsStore,
+			historyStore dataproviders.HistoryStore) (dataproviders.DataProvider, error) {
+			return NewDataProvider(initiateData, term, client, pvStore, statsStore, historyStore), nil
+		},
+		dataproviders.ConfigSchema{
+			{Field: "UserName", Required: true, Description: "Username on the inverter web interface"},
+			{Field: "Password", Required: true, Description: "Password on the inverter web interface"},
+			{Field: "Address", Required: true, Description: "Hostname or ip of the inverter"},
+		})
+}
+
 func (d *dataProvider) Name() string {
-	return "N/A"
+	return "Kostal"
 }
 
 func NewDataProvider(initiateData dataproviders.InitiateData, 
                      term dataproviders.TerminateCallback,
                      client *http.Client,
                      pvStore dataproviders.PvStore,
-                     statsStore dataproviders.PlantStatsStore) dataProvider {
+                     statsStore dataproviders.PlantStatsStore,
+                     historyStore dataproviders.HistoryStore) *dataProvider {
 	log.Debug("New dataprovider")
 
-	dp := dataProvider{initiateData,
-		nil,
-		client}
-	go dataproviders.RunUpdates(
-		&initiateData,
-		func(initiateData *dataproviders.InitiateData, pv *dataproviders.PvData) error {
-			err := updatePvData(client, initiateData, pv)
-			pv.LatestUpdate = nil
-			return err
-		}, 
-		func(initiateData *dataproviders.InitiateData, pv *dataproviders.PvData) error {
-			return nil
-		}, 
-		time.Second * 10,
-		time.Minute * 5,
-		time.Minute * 30,
-		term,
-		MAX_ERRORS,
-		statsStore,
-		pvStore)
+	dp := dataProvider{InitiateData: initiateData,
+		client: client,
+		term: term,
+		pvStore: pvStore,
+		statsStore: statsStore,
+		historyStore: historyStore}
+
+	return &dp
+}
+
+func (dp *dataProvider) Capabilities() dataproviders.Capabilities {
+	return dataproviders.Capabilities{PowerAc: true, EnergyToday: true,
+		EnergyTotal: true, VoltDc: true, AmpereAc: true, Strings: true, Phases: true}
+}
 
-	return dp
+func (dp *dataProvider) Start() error {
+	client := dp.client
+	return dp.Launch(func() {
+		dataproviders.RunUpdates(
+			&dp.Lifecycle,
+			&dp.InitiateData,
+			func(initiateData *dataproviders.InitiateData, pv *dataproviders.PvData) error {
+				err := updatePvData(client, initiateData, pv)
+				pv.LatestUpdate = nil
+				return err
+			}, 
+			func(initiateData *dataproviders.InitiateData, pv *dataproviders.PvData) error {
+				return nil
+			}, 
+			time.Second * 10,
+			time.Minute * 5,
+			time.Minute * 30,
+			dp.term,
+			dataproviders.DefaultRetryPolicy(MAX_ERRORS),
+			dp.statsStore,
+			dp.pvStore,
+			dp.historyStore)
+	})
 }
 
 // Update PvData
@@ -67,47 +107,61 @@ func updatePvData(client *http.Client, initiateData *dataproviders.InitiateData,
 	log.Debug("Fetching update ...")
 	
 	b, err := genericdata(client, initiateData)
+	if err != nil {return err}
 	values, err := parseToValues(&b)
 	if err != nil {return err}	
+	if len(values) < 15 {
+		return fmt.Errorf("Dataprovider kostal fail. Found %d values in response from inverter, expected 15", len(values))
+	}
 
 	// Pac
 	pacFloat, err := parseToValue(values[0])
 	if err != nil {return err}	
-	pv.PowerAc = uint16(pacFloat) 
+	pv.PowerAc, err = dataproviders.ToWatt(pacFloat)
+	if err != nil {return err}
 
 	//Energy total
 	etFloat, err := parseToValue(values[1])
 	if err != nil {return err}	
-	pv.EnergyTotal = float32(etFloat)
+	pv.EnergyTotal = dataproviders.KiloWattHour(etFloat)
 	
 	// Energy today
 	edFloat, err := parseToValue(values[2])
 	if err != nil {return err}	
-	pv.EnergyToday = uint16(edFloat*1000)
-	
-	// Volt DC
-	voltFloatSum, err := parseToValue(values[3])
+	pv.EnergyToday, err = dataproviders.ToWattHour(edFloat*1000)
 	if err != nil {return err}
-	voltFloat, err := parseToValue(values[7])
-	if err != nil {return err}
-	voltFloatSum += voltFloat
-	voltFloat, err = parseToValue(values[11])
-	if err != nil {return err}
-	voltFloatSum += voltFloat
-	pv.VoltDc = float32(voltFloatSum)
-	
-	//Amp DC
-	ampFloatSum, err := parseToValue(values[5])
-	if err != nil {return err}
-	ampFloat, err := parseToValue(values[9])
-	if err != nil {return err}
-	ampFloatSum += ampFloat
-	ampFloat, err = parseToValue(values[13])
-	if err != nil {return err}
-	ampFloatSum += ampFloat
-	pv.AmpereAc = float32(ampFloatSum)
-	
 	
+	// Each string has a voltage and a current, and each phase a voltage and a power,
+	// in the order string, phase, string, phase for each of the three
+	strings := []dataproviders.StringData{}
+	for _, i := range []int{3, 7, 11} {
+		volt, err := parseToValue(values[i])
+		if err != nil {return err}
+		amp, err := parseToValue(values[i+2])
+		if err != nil {return err}
+		power, err := dataproviders.ToWatt(volt*amp)
+		if err != nil {return err}
+		strings = append(strings, dataproviders.StringData{VoltDc: float32(volt),
+			AmpereDc: float32(amp),
+			PowerDc: power})
+	}
+	pv.SetStrings(strings)
+
+	phases := []dataproviders.PhaseData{}
+	for _, i := range []int{4, 8, 12} {
+		volt, err := parseToValue(values[i])
+		if err != nil {return err}
+		power, err := parseToValue(values[i+2])
+		if err != nil {return err}
+		watt, err := dataproviders.ToWatt(power)
+		if err != nil {return err}
+		phase := dataproviders.PhaseData{VoltAc: float32(volt), PowerAc: watt}
+		if volt > 0 {
+			phase.AmpereAc = float32(power/volt)
+		}
+		phases = append(phases, phase)
+	}
+	pv.SetPhases(phases)
 	 
 	
 //	err = pac(sid, client, initiateData, pv, &b)
@@ -128,7 +182,14 @@ func genericdata(client *http.Client,
 	req, err := http.NewRequest("GET", url, nil)
 	req.SetBasicAuth(initiateData.UserName, initiateData.Password)
 	resp, err := client.Do(req)
-	
+	if err != nil {
+		return
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+		err = dataproviders.NewLoginError("Dataprovider kostal fail. Inverter rejected the login for %s", initiateData.UserName)
+		return
+	}
 	if resp.StatusCode != 200 {
 		err = fmt.Errorf("Dataprovider kostal fail. Received http status %d from inverter doing data gathering", resp.StatusCode)
 		log.Infof("%s", err.Error())
@@ -4,6 +4,9 @@ import (
 	"testing"
 	"httpclient"
 	"dataproviders"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 )
 
 /*
@@ -23,7 +26,7 @@ func Test_Connection (t *testing.T) {
 	t.Log("Trying to launch provider...")
 	pv := dataproviders.PvData{}
 	err := updatePvData(httpclient.NewClient(), 
-				&dataproviders.InitiateData{"jannik", "pvserver", "2674", "", "2.104.143.225"},
+				&dataproviders.InitiateData{PlantKey: "jannik", UserName: "pvserver", Password: "2674", Address: "2.104.143.225"},
 				&pv)
 	
 	if err != nil {
@@ -45,3 +48,45 @@ func Test_Connection (t *testing.T) {
 	return
 }
 
+
+// The values of the pvserver page, as pac, total, today, and then
+// string volt, phase volt, string ampere, phase power for each of the three
+const testPage = `<html><body><table>
+<tr><td>aktuell</td><td>3120</td><td>Gesamtenergie</td><td>10234</td></tr>
+<tr><td>Tagesenergie</td><td>12.50</td></tr>
+<tr><td>Spannung</td><td>512</td><td>L1 Spannung</td><td>231</td></tr>
+<tr><td>Strom</td><td>2.50</td><td>L1 Leistung</td><td>1039</td></tr>
+<tr><td>Spannung</td><td>498</td><td>L2 Spannung</td><td>232</td></tr>
+<tr><td>Strom</td><td>2.40</td><td>L2 Leistung</td><td>1044</td></tr>
+<tr><td>Spannung</td><td>505</td><td>L3 Spannung</td><td>230</td></tr>
+<tr><td>Strom</td><td>2.00</td><td>L3 Leistung</td><td>1035</td></tr>
+</table></body></html>`
+
+func Test_strings_phases(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testPage))
+	}))
+	defer server.Close()
+
+	pv := dataproviders.PvData{}
+	err := updatePvData(http.DefaultClient,
+		&dataproviders.InitiateData{PlantKey: "test", UserName: "pvserver", Password: "pass",
+			Address: strings.TrimPrefix(server.URL, "http://")},
+		&pv)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if pv.PowerAc != 3120 || pv.EnergyToday != 12500 || len(pv.Strings) != 3 || len(pv.Phases) != 3 {
+		t.Fatalf("Wrong pvdata %s", pv.ToJson())
+	}
+	if s := pv.Strings[1]; s.VoltDc != 498 || s.AmpereDc != 2.4 || s.PowerDc != 1195 {
+		t.Errorf("Wrong second string %v", s)
+	}
+	if p := pv.Phases[2]; p.VoltAc != 230 || p.PowerAc != 1035 || p.AmpereAc != 4.5 {
+		t.Errorf("Wrong third phase %v", p)
+	}
+	// The old fields are the average string voltage and the total phase current
+	if pv.VoltDc != 505 || pv.AmpereAc < 13.49 || pv.AmpereAc > 13.51 {
+		t.Errorf("Wrong VoltDc %f or AmpereAc %f", pv.VoltDc, pv.AmpereAc)
+	}
+}
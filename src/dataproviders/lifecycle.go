@@ -0,0 +1,328 @@
+package dataproviders
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// DataProvider is implemented by every provider package,
+// so the controller can manage the running providers
+type DataProvider interface {
+	// Name of the provider implementation
+	Name() string
+	// Start pulling data from the plant. A provider can only be started once
+	Start() error
+	// Stop the provider and wait until it has terminated or ctx is done
+	Stop(ctx context.Context) error
+	// Current state of the provider
+	Status() State
+	// The latest error the provider received, nil if none
+	LastError() error
+	// The state with the error count and the times of the updates
+	Health() Health
+	// Which fields of PvData the provider is able to fill
+	Capabilities() Capabilities
+}
+
+type State string
+
+const (
+	Idle     State = "idle"
+	Starting State = "starting"
+	Online   State = "online"
+	// The latest update failed, see SetError for how errors are told apart
+	Degraded    State = "degraded"
+	LoginFailed State = "login-failed"
+	Unreachable State = "unreachable"
+	Terminated  State = "terminated"
+)
+
+// Returned by a provider when the plant or the portal rejects the credentials
+type LoginError struct {
+	Msg string
+}
+
+func (e *LoginError) Error() string {
+	return e.Msg
+}
+
+func NewLoginError(format string, a ...interface{}) error {
+	return &LoginError{Msg: fmt.Sprintf(format, a...)}
+}
+
+// The state of a provider that received err
+func errorState(err error) State {
+	var loginErr *LoginError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &loginErr):
+		return LoginFailed
+	case errors.As(err, &netErr):
+		return Unreachable
+	}
+	return Degraded
+}
+
+// How a provider is doing
+type Health struct {
+	// A provider that terminated because of errors keeps the state of the last error
+	State State
+	// False when the provider has terminated
+	Running   bool
+	LastError string `json:",omitempty"`
+	// Errors since the latest successful update
+	ConsecutiveErrors int
+	// The plant failed too often, and is only probed now and then, see RetryPolicy
+	CircuitOpen bool       `json:",omitempty"`
+	LastSuccess *time.Time `json:",omitempty"`
+	// When the provider will poll the plant next, nil for providers the plant pushes to
+	NextPoll *time.Time `json:",omitempty"`
+}
+
+// Capabilities tells which fields of PvData a provider fills
+type Capabilities struct {
+	PowerAc     bool
+	EnergyToday bool
+	EnergyTotal bool
+	VoltDc      bool
+	AmpereAc    bool
+	// The provider fills in PvData.Panels
+	Panels bool
+	// The provider fills in PvData.Strings, Phases, Frequency and Temperature
+	Strings     bool
+	Phases      bool
+	Frequency   bool
+	Temperature bool
+}
+
+// Lifecycle keeps the state of a running provider.
+// Provider implementations embeds it, to get Start/Stop/Status/LastError
+// handling for free. The zero value is ready to use.
+type Lifecycle struct {
+	lock              sync.RWMutex
+	state             State
+	lastErr           error
+	consecutiveErrors int
+	lastSuccess       time.Time
+	nextPoll          time.Time
+	circuitOpen       bool
+	// Terminated by errors, and not because it was stopped
+	failed   bool
+	started  bool
+	stopping bool
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+}
+
+// Must be called with lock held
+func (l *Lifecycle) init() {
+	if l.stopCh == nil {
+		l.stopCh = make(chan struct{})
+		l.doneCh = make(chan struct{})
+	}
+	if l.state == "" {
+		l.state = Idle
+	}
+}
+
+// Launch run in a new go routine. The provider is terminated when run returns.
+func (l *Lifecycle) Launch(run func()) error {
+	l.lock.Lock()
+	l.init()
+	if l.started {
+		l.lock.Unlock()
+		return fmt.Errorf("Provider is allready started")
+	}
+	l.started = true
+	l.state = Starting
+	done := l.doneCh
+	l.lock.Unlock()
+
+	go func() {
+		defer func() {
+			l.lock.Lock()
+			l.failed = !l.stopping && l.consecutiveErrors > 0
+			l.state = Terminated
+			l.nextPoll = time.Time{}
+			l.circuitOpen = false
+			l.lock.Unlock()
+			close(done)
+		}()
+		run()
+	}()
+	return nil
+}
+
+// Stopping returns a channel that is closed when the provider is asked to stop
+func (l *Lifecycle) Stopping() <-chan struct{} {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.init()
+	return l.stopCh
+}
+
+// Stop the provider and wait for it to terminate
+func (l *Lifecycle) Stop(ctx context.Context) error {
+	l.lock.Lock()
+	l.init()
+	if !l.started {
+		l.state = Terminated
+		l.lock.Unlock()
+		return nil
+	}
+	if !l.stopping {
+		l.stopping = true
+		close(l.stopCh)
+	}
+	done := l.doneCh
+	l.lock.Unlock()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *Lifecycle) Status() State {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if l.state == "" {
+		return Idle
+	}
+	return l.state
+}
+
+func (l *Lifecycle) SetState(state State) {
+	l.lock.Lock()
+	l.state = state
+	l.lock.Unlock()
+}
+
+func (l *Lifecycle) LastError() error {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.lastErr
+}
+
+// Record a failed update. The provider becomes login-failed on a LoginError,
+// unreachable on a network error, and degraded on any other error.
+func (l *Lifecycle) SetError(err error) {
+	l.lock.Lock()
+	l.lastErr = err
+	l.consecutiveErrors++
+	if l.state != Terminated {
+		l.state = errorState(err)
+	}
+	l.lock.Unlock()
+}
+
+// Record a successful update, and set the provider online
+func (l *Lifecycle) SetSuccess() {
+	l.lock.Lock()
+	l.consecutiveErrors = 0
+	l.lastSuccess = time.Now()
+	if l.state != Terminated {
+		l.state = Online
+	}
+	l.lock.Unlock()
+}
+
+// Tell when the plant is polled next
+func (l *Lifecycle) SetNextPoll(t time.Time) {
+	l.lock.Lock()
+	l.nextPoll = t
+	l.lock.Unlock()
+}
+
+func (l *Lifecycle) SetCircuitOpen(open bool) {
+	l.lock.Lock()
+	l.circuitOpen = open
+	l.lock.Unlock()
+}
+
+func (l *Lifecycle) Health() Health {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	h := Health{State: l.state,
+		Running:           l.started && l.state != Terminated,
+		ConsecutiveErrors: l.consecutiveErrors,
+		CircuitOpen:       l.circuitOpen}
+	if h.State == "" {
+		h.State = Idle
+	}
+	if l.failed && l.lastErr != nil {
+		h.State = errorState(l.lastErr)
+	}
+	if l.lastErr != nil {
+		h.LastError = l.lastErr.Error()
+	}
+	if !l.lastSuccess.IsZero() {
+		t := l.lastSuccess
+		h.LastSuccess = &t
+	}
+	if !l.nextPoll.IsZero() {
+		t := l.nextPoll
+		h.NextPoll = &t
+	}
+	return h
+}
+
+// Tells the state of the provider in PvData.State, for providers that do not
+// tell the state of the device. A provider that sets PvData.State in its
+// update tells the state of the device, and PvData.State is left to it.
+type providerState struct {
+	lifecycle *Lifecycle
+	device    bool
+}
+
+// Before an update, so an update that sets no state can be told
+func (s *providerState) clear(pv *PvData) {
+	if !s.device {
+		pv.State = ""
+	}
+}
+
+// After an update, with the lifecycle set from its result
+func (s *providerState) set(pv *PvData) {
+	if s.device {
+		return
+	}
+	if pv.State != "" {
+		s.device = true
+		return
+	}
+	pv.State = string(s.lifecycle.Health().State)
+}
+
+// After a failed update. The pvdata of the failed update is not stored,
+// so the state is set in the stored pvdata
+func (s *providerState) setError(pv *PvData, plantkey string, pvStore PvStore) {
+	if s.device {
+		return
+	}
+	pv.State = string(s.lifecycle.Health().State)
+	stored := pvStore.Get(plantkey)
+	if stored.State != pv.State {
+		stored.State = pv.State
+		pvStore.Set(plantkey, &stored)
+	}
+}
+
+// When the provider terminates, a failing provider keeps the state of the error
+func (s *providerState) terminate(pv *PvData) {
+	if s.device {
+		return
+	}
+	switch state := s.lifecycle.Health().State; state {
+	case Starting, Online:
+		pv.State = string(Terminated)
+	default:
+		pv.State = string(state)
+	}
+}
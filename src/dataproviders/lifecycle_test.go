@@ -0,0 +1,254 @@
+package dataproviders
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type nopStatsStore struct {
+	lock  sync.Mutex
+	saved int
+}
+
+func (s *nopStatsStore) LoadStats(plantkey string) PlantStats {
+	return PlantStats{}
+}
+
+func (s *nopStatsStore) SaveStats(plantkey string, pv *PvData) {
+	s.lock.Lock()
+	s.saved++
+	s.lock.Unlock()
+}
+
+// Wait up to a second for the state of l
+func waitState(l *Lifecycle, state State) State {
+	for i := 0; i < 100 && l.Status() != state; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return l.Status()
+}
+
+func Test_lifecycle_start(t *testing.T) {
+	l := Lifecycle{}
+	if l.Status() != Idle || l.Health().Running {
+		t.Errorf("Expected the zero value to be idle, health is %v", l.Health())
+	}
+
+	started := make(chan struct{})
+	err := l.Launch(func() {
+		<-started
+		l.SetSuccess()
+		<-l.Stopping()
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if l.Status() != Starting || !l.Health().Running {
+		t.Errorf("Expected a launched provider to be starting, health is %v", l.Health())
+	}
+	close(started)
+	if waitState(&l, Online) != Online {
+		t.Errorf("Expected the provider online, was %s", l.Status())
+	}
+	if h := l.Health(); !h.Running || h.LastSuccess == nil {
+		t.Errorf("Expected a running provider with a successful update, health is %v", h)
+	}
+
+	if err = l.Launch(func() {}); err == nil {
+		t.Error("Expected a second start to fail")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = l.Stop(ctx); err != nil {
+		t.Fatal(err.Error())
+	}
+	if h := l.Health(); h.State != Terminated || h.Running {
+		t.Errorf("Expected a stopped provider to be terminated, health is %v", h)
+	}
+	// Stopping again is fine
+	if err = l.Stop(ctx); err != nil {
+		t.Errorf("Expected a second stop to succeed, was %s", err.Error())
+	}
+	if err = l.Launch(func() {}); err == nil {
+		t.Error("Expected a stopped provider not to start again")
+	}
+}
+
+func Test_lifecycle_stop_not_started(t *testing.T) {
+	l := Lifecycle{}
+	if err := l.Stop(context.Background()); err != nil {
+		t.Fatal(err.Error())
+	}
+	if l.Status() != Terminated {
+		t.Errorf("Expected a provider stopped before it started to be terminated, was %s", l.Status())
+	}
+}
+
+func Test_lifecycle_stop_timeout(t *testing.T) {
+	l := Lifecycle{}
+	release := make(chan struct{})
+	// Does not listen on Stopping
+	l.Launch(func() {
+		<-release
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := l.Stop(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected the stop to time out, was %v", err)
+	}
+	if l.Status() == Terminated {
+		t.Error("Expected the provider to still be running")
+	}
+	select {
+	case <-l.Stopping():
+	default:
+		t.Error("Expected the provider to be asked to stop")
+	}
+
+	close(release)
+	if err := l.Stop(context.Background()); err != nil {
+		t.Fatal(err.Error())
+	}
+	if l.Status() != Terminated {
+		t.Errorf("Expected the provider terminated when run returns, was %s", l.Status())
+	}
+}
+
+func Test_lifecycle_errors(t *testing.T) {
+	l := Lifecycle{}
+	done := make(chan struct{})
+	l.Launch(func() {
+		<-done
+	})
+
+	l.SetError(NewLoginError("Wrong password"))
+	if h := l.Health(); h.State != LoginFailed || h.ConsecutiveErrors != 1 || h.LastError != "Wrong password" {
+		t.Errorf("Expected a failed login, health is %v", h)
+	}
+	l.SetError(&net.OpError{Op: "dial", Err: errors.New("connection refused")})
+	if l.Status() != Unreachable {
+		t.Errorf("Expected a network error to make the plant unreachable, was %s", l.Status())
+	}
+	l.SetError(errors.New("bad json"))
+	if h := l.Health(); h.State != Degraded || h.ConsecutiveErrors != 3 {
+		t.Errorf("Expected a degraded provider, health is %v", h)
+	}
+	l.SetSuccess()
+	if h := l.Health(); h.State != Online || h.ConsecutiveErrors != 0 || h.LastError != "bad json" {
+		t.Errorf("Expected a success to reset the errors, health is %v", h)
+	}
+
+	// A provider that terminates while failing keeps the state of the error
+	l.SetError(NewLoginError("Wrong password"))
+	close(done)
+	waitState(&l, Terminated)
+	if h := l.Health(); h.State != LoginFailed || h.Running {
+		t.Errorf("Expected a terminated provider with a failed login, health is %v", h)
+	}
+}
+
+func Test_lifecycle_terminate(t *testing.T) {
+	l := Lifecycle{}
+	store := newMapStore()
+	stats := &nopStatsStore{}
+	terms := 0
+	update := func(i *InitiateData, pv *PvData) error {
+		pv.PowerAc = 1000
+		return nil
+	}
+	l.Launch(func() {
+		RunUpdates(&l, &InitiateData{PlantKey: "plant"}, update, update,
+			time.Hour, time.Hour, time.Hour, func() { terms++ },
+			DefaultRetryPolicy(5), stats, store, nil)
+	})
+	if waitState(&l, Online) != Online {
+		t.Fatalf("Expected the provider online, was %s", l.Status())
+	}
+
+	if err := l.Stop(context.Background()); err != nil {
+		t.Fatal(err.Error())
+	}
+	if terms != 1 {
+		t.Errorf("Expected the terminate callback to be called once, was %d", terms)
+	}
+	if stats.saved == 0 {
+		t.Error("Expected the stats to be saved on terminate")
+	}
+	if pv := store.Get("plant"); pv.PowerAc != 1000 || pv.PowerAcPeakAll != 1000 {
+		t.Errorf("Expected the update to be stored, pvdata is %s", pv.ToJson())
+	}
+	if pv := store.Get("plant"); pv.State != string(Terminated) {
+		t.Errorf("Expected the pvdata to tell the provider terminated, was %s", pv.State)
+	}
+
+	// The terminate time ends the provider by itself
+	l = Lifecycle{}
+	l.Launch(func() {
+		RunUpdates(&l, &InitiateData{PlantKey: "plant"}, update, update,
+			time.Hour, time.Hour, 20*time.Millisecond, func() { terms++ },
+			DefaultRetryPolicy(5), stats, store, nil)
+	})
+	if waitState(&l, Terminated) != Terminated || terms != 2 {
+		t.Errorf("Expected the provider to terminate, was %s after %d terminates", l.Status(), terms)
+	}
+}
+
+func Test_provider_state(t *testing.T) {
+	l := Lifecycle{}
+	store := newMapStore()
+	l.Launch(func() { <-l.Stopping() })
+	state := providerState{lifecycle: &l}
+
+	// A provider that sets no state gets the state of the provider
+	pv := PvData{State: "online"}
+	state.clear(&pv)
+	l.SetSuccess()
+	state.set(&pv)
+	store.Set("plant", &pv)
+	if pv.State != string(Online) {
+		t.Errorf("Expected the state of the provider, was %s", pv.State)
+	}
+	state.clear(&pv)
+	l.SetError(NewLoginError("Wrong password"))
+	state.setError(&pv, "plant", store)
+	if stored := store.Get("plant"); stored.State != string(LoginFailed) {
+		t.Errorf("Expected a failed update to set the state of the stored pvdata, was %s", stored.State)
+	}
+
+	// A provider that sets the state of the device keeps it
+	device := providerState{lifecycle: &l}
+	pv = PvData{}
+	device.clear(&pv)
+	pv.State = "MPPT"
+	l.SetSuccess()
+	device.set(&pv)
+	store.Set("device", &pv)
+	device.clear(&pv)
+	if pv.State != "MPPT" {
+		t.Errorf("Expected the state of the device to be kept, was %s", pv.State)
+	}
+	l.SetError(errors.New("bad reply"))
+	device.setError(&pv, "device", store)
+	device.terminate(&pv)
+	if stored := store.Get("device"); pv.State != "MPPT" || stored.State != "MPPT" {
+		t.Errorf("Expected the state of the device to be left to the provider, was %s and %s", pv.State, stored.State)
+	}
+
+	// A provider that terminates while failing tells the error
+	state.terminate(&pv)
+	if pv.State != string(Degraded) {
+		t.Errorf("Expected a failing provider to terminate with its error state, was %s", pv.State)
+	}
+	l.SetSuccess()
+	state.terminate(&pv)
+	if pv.State != string(Terminated) {
+		t.Errorf("Expected the provider to be terminated, was %s", pv.State)
+	}
+	l.Stop(context.Background())
+}
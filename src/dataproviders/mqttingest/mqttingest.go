@@ -0,0 +1,319 @@
+package mqttingest
+
+// Dataprovider for plants that publish their readings to an MQTT broker,
+// eg. from OpenDTU, ESPHome or Tasmota. The plant config gives the broker
+// in Address, and in Options the topic of each PvData field,
+// eg. "PowerAc": "solar/116180000000/0/power". If the payload is json,
+// "{field}.path" gives the json path of the value, and "{field}.scale"
+// scales it to the unit of PvData, as for the generic provider.
+// Messages arriving close together are applied as one update.
+
+import (
+	"dataproviders"
+	"encoding/json"
+	"fmt"
+	"jsonpath"
+	"logger"
+	"mqtt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type dataProvider struct {
+	dataproviders.Lifecycle
+	InitiateData dataproviders.InitiateData
+	term         dataproviders.TerminateCallback
+	pvStore      dataproviders.PvStore
+	statsStore   dataproviders.PlantStatsStore
+	historyStore dataproviders.HistoryStore
+	fields       []field
+}
+
+var log = logger.NewLogger(logger.DEBUG, "Dataprovider: MQTT:")
+
+const MAX_ERRORS = 5
+
+const ProviderName = "mqtt"
+
+// How long to collect messages before they are applied
+var settleTime = time.Second
+
+// How long to wait before connecting again, after the connection was lost
+var reconnectTime = 30 * time.Second
+
+// The PvData fields that can be mapped
+var fieldNames = []string{"PowerAc", "EnergyToday", "EnergyTotal", "VoltDc", "AmpereAc"}
+
+func init() {
+	dataproviders.Register(ProviderName,
+		func(initiateData dataproviders.InitiateData,
+			term dataproviders.TerminateCallback,
+			client *http.Client,
+			pvStore dataproviders.PvStore,
+			statsStore dataproviders.PlantStatsStore,
+			historyStore dataproviders.HistoryStore) (dataproviders.DataProvider, error) {
+			return NewDataProvider(initiateData, term, pvStore, statsStore, historyStore)
+		},
+		dataproviders.ConfigSchema{
+			{Field: "Address", Required: true, Description: "Host or host:port of the MQTT broker"},
+			{Field: "UserName", Required: false, Description: "User name on the broker"},
+			{Field: "Password", Required: false, Description: "Password on the broker"},
+			{Field: "Options.PowerAc", Required: true, Description: "Topic of the ac power"},
+			{Field: "Options.EnergyToday", Required: false, Description: "Topic of the energy today"},
+			{Field: "Options.EnergyTotal", Required: false, Description: "Topic of the energy total"},
+			{Field: "Options.VoltDc", Required: false, Description: "Topic of the dc voltage"},
+			{Field: "Options.AmpereAc", Required: false, Description: "Topic of the ac current"},
+		})
+	dataproviders.RegisterValidator(ProviderName, func(initiateData *dataproviders.InitiateData) error {
+		_, err := newFields(initiateData.Options)
+		return err
+	})
+}
+
+func (d *dataProvider) Name() string {
+	return "MQTT"
+}
+
+func NewDataProvider(initiateData dataproviders.InitiateData,
+	term dataproviders.TerminateCallback,
+	pvStore dataproviders.PvStore,
+	statsStore dataproviders.PlantStatsStore,
+	historyStore dataproviders.HistoryStore) (*dataProvider, error) {
+	log.Debug("New dataprovider")
+
+	fields, err := newFields(initiateData.Options)
+	if err != nil {
+		return nil, err
+	}
+	dp := dataProvider{InitiateData: initiateData,
+		term:         term,
+		pvStore:      pvStore,
+		statsStore:   statsStore,
+		historyStore: historyStore,
+		fields:       fields}
+
+	return &dp, nil
+}
+
+func (dp *dataProvider) Capabilities() dataproviders.Capabilities {
+	c := dataproviders.Capabilities{}
+	for _, f := range dp.fields {
+		switch f.name {
+		case "PowerAc":
+			c.PowerAc = true
+		case "EnergyToday":
+			c.EnergyToday = true
+		case "EnergyTotal":
+			c.EnergyTotal = true
+		case "VoltDc":
+			c.VoltDc = true
+		case "AmpereAc":
+			c.AmpereAc = true
+		}
+	}
+	return c
+}
+
+func (dp *dataProvider) Start() error {
+	return dp.Launch(func() {
+		updates := make(chan dataproviders.PushUpdate)
+		errs := make(chan error)
+		quit := make(chan struct{})
+		defer close(quit)
+		go subscribe(&dp.InitiateData, dp.fields, updates, errs, quit)
+		dataproviders.RunPushUpdates(
+			&dp.Lifecycle,
+			&dp.InitiateData,
+			updates,
+			errs,
+			time.Minute*30,
+			dp.term,
+			MAX_ERRORS,
+			dp.statsStore,
+			dp.pvStore,
+			dp.historyStore)
+	})
+}
+
+// A PvData field, and where its value is found
+type field struct {
+	name  string
+	topic string
+	path  *jsonpath.Path
+	scale float64
+}
+
+func newFields(options map[string]string) ([]field, error) {
+	fields := []field{}
+	for _, name := range fieldNames {
+		topic, ok := options[name]
+		if !ok {
+			continue
+		}
+		if topic == "" || strings.ContainsAny(topic, "+#") {
+			return nil, fmt.Errorf("Bad topic '%s' for %s", topic, name)
+		}
+		f := field{name: name, topic: topic, scale: 1}
+		if s, ok := options[name+".path"]; ok {
+			p, err := jsonpath.Compile(s)
+			if err != nil {
+				return nil, fmt.Errorf("Bad path for %s: %s", name, err.Error())
+			}
+			f.path = p
+		}
+		if s, ok := options[name+".scale"]; ok {
+			scale, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Bad scale for %s: %s", name, s)
+			}
+			f.scale = scale
+		}
+		fields = append(fields, f)
+	}
+	if len(fields) == 0 || fields[0].name != "PowerAc" {
+		return nil, fmt.Errorf("No topic for PowerAc")
+	}
+	return fields, nil
+}
+
+// The value of the field in the payload
+func (f *field) value(payload []byte) (float64, error) {
+	var v float64
+	if f.path == nil {
+		var err error
+		v, err = strconv.ParseFloat(strings.TrimSpace(string(payload)), 64)
+		if err != nil {
+			return 0, fmt.Errorf("Payload on %s is not a number", f.topic)
+		}
+	} else {
+		var doc interface{}
+		if err := json.Unmarshal(payload, &doc); err != nil {
+			return 0, fmt.Errorf("Payload on %s is not json", f.topic)
+		}
+		var err error
+		if v, err = f.path.Float(doc); err != nil {
+			return 0, err
+		}
+	}
+	v *= f.scale
+	if v < 0 {
+		v = 0
+	}
+	return v, nil
+}
+
+// Set the values of the fields in pv.
+// A value out of range fails the update, and leaves pv as it was.
+func apply(values map[string]float64, pv *dataproviders.PvData) error {
+	power, err := dataproviders.ToWatt(values["PowerAc"])
+	if err != nil {
+		return fmt.Errorf("Dataprovider mqtt fail. PowerAc: %s", err.Error())
+	}
+	energyToday, err := dataproviders.ToWattHour(values["EnergyToday"])
+	if err != nil {
+		return fmt.Errorf("Dataprovider mqtt fail. EnergyToday: %s", err.Error())
+	}
+	for name, v := range values {
+		switch name {
+		case "PowerAc":
+			pv.PowerAc = power
+		case "EnergyToday":
+			pv.EnergyToday = energyToday
+		case "EnergyTotal":
+			pv.EnergyTotal = dataproviders.KiloWattHour(v)
+		case "VoltDc":
+			pv.VoltDc = float32(v)
+		case "AmpereAc":
+			pv.AmpereAc = float32(v)
+		}
+	}
+	return nil
+}
+
+// Subscribe to the topics of the fields, and send an update for the messages received.
+// Reconnects when the connection is lost, until quit is closed.
+func subscribe(initiateData *dataproviders.InitiateData, fields []field,
+	updates chan<- dataproviders.PushUpdate, errs chan<- error, quit <-chan struct{}) {
+	topics := []string{}
+	for _, f := range fields {
+		topics = append(topics, f.topic)
+	}
+	for {
+		c, err := mqtt.Dial(initiateData.Address, mqtt.Options{
+			ClientId: "solarcompare-" + initiateData.PlantKey,
+			UserName: initiateData.UserName,
+			Password: initiateData.Password})
+		if err == nil {
+			log.Debugf("Connected to %s for plant %s", initiateData.Address, initiateData.PlantKey)
+			if err = c.Subscribe(topics...); err == nil {
+				err = receive(c, fields, updates, errs, quit)
+			}
+			c.Close()
+		}
+		if err == nil {
+			return
+		}
+		select {
+		case errs <- fmt.Errorf("Dataprovider mqtt fail. %s", err.Error()):
+		case <-quit:
+			return
+		}
+		select {
+		case <-time.After(reconnectTime):
+		case <-quit:
+			return
+		}
+	}
+}
+
+// Receive messages until the connection is lost, or quit is closed
+func receive(c *mqtt.Client, fields []field,
+	updates chan<- dataproviders.PushUpdate, errs chan<- error, quit <-chan struct{}) error {
+	values := map[string]float64{}
+	var settle <-chan time.Time
+	for {
+		select {
+		case m, ok := <-c.Messages():
+			if !ok {
+				if c.Err() != nil {
+					return c.Err()
+				}
+				return fmt.Errorf("Connection closed by broker")
+			}
+			for i := range fields {
+				if fields[i].topic != m.Topic {
+					continue
+				}
+				v, err := fields[i].value(m.Payload)
+				if err != nil {
+					select {
+					case errs <- fmt.Errorf("Dataprovider mqtt fail. %s", err.Error()):
+					case <-quit:
+						return nil
+					}
+					continue
+				}
+				values[fields[i].name] = v
+			}
+			if settle == nil && len(values) > 0 {
+				settle = time.After(settleTime)
+			}
+		case <-settle:
+			received := values
+			update := func(pv *dataproviders.PvData) error {
+				return apply(received, pv)
+			}
+			select {
+			case updates <- update:
+			case <-quit:
+				return nil
+			}
+			values = map[string]float64{}
+			settle = nil
+		case <-quit:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package mqttingest
+
+import (
+	"context"
+	"dataproviders"
+	"mqtt"
+	"mqtt/mqtttest"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+To run test export GOPATH=/Users/jbr/github/local/solarcompare
+then
+go test -test.v dataproviders/mqttingest
+*/
+
+type PlantStatsStore struct {
+}
+
+func (p PlantStatsStore) LoadStats(plantkey string) dataproviders.PlantStats {
+	return dataproviders.PlantStats{}
+}
+func (p PlantStatsStore) SaveStats(plantkey string, pv *dataproviders.PvData) {}
+
+type PvStore struct {
+	lock sync.Mutex
+	pv   dataproviders.PvData
+	set  chan dataproviders.PvData
+}
+
+func (s *PvStore) Set(plantkey string, pv *dataproviders.PvData) {
+	s.lock.Lock()
+	s.pv = *pv
+	s.lock.Unlock()
+	select {
+	case s.set <- *pv:
+	default:
+	}
+}
+
+func (s *PvStore) Get(plantkey string) dataproviders.PvData {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.pv
+}
+
+// Wait for pv data matching ok to be set
+func (s *PvStore) waitFor(t *testing.T, ok func(pv dataproviders.PvData) bool) dataproviders.PvData {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case pv := <-s.set:
+			if ok(pv) {
+				return pv
+			}
+		case <-timeout:
+			pv := s.Get("test")
+			t.Fatalf("Timed out waiting for pv data, was %s", pv.ToJson())
+		}
+	}
+}
+
+func Test_ingest(t *testing.T) {
+	settleTime = 50 * time.Millisecond
+	broker := mqtttest.NewBroker()
+	broker.UserName, broker.Password = "user", "secret"
+	defer broker.Close()
+
+	pvStore := &PvStore{set: make(chan dataproviders.PvData, 10)}
+	terminated := make(chan bool, 1)
+	dp, err := NewDataProvider(dataproviders.InitiateData{PlantKey: "test", Address: broker.Addr,
+		UserName: "user", Password: "secret",
+		Options: map[string]string{
+			"PowerAc":           "solar/1161/0/power",
+			"EnergyTotal":       "tele/plug/SENSOR",
+			"EnergyTotal.path":  "$.ENERGY.Total",
+			"EnergyToday":       "tele/plug/SENSOR",
+			"EnergyToday.path":  "$.ENERGY.Today",
+			"EnergyToday.scale": "1000"}},
+		func() { terminated <- true }, pvStore, PlantStatsStore{}, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if c := dp.Capabilities(); !c.PowerAc || !c.EnergyTotal || c.VoltDc {
+		t.Errorf("Wrong capabilities %v", c)
+	}
+	if err = dp.Start(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Wait for the provider to subscribe
+	for i := 0; broker.Clients() == 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	broker.Publish(mqtt.Message{Topic: "solar/1161/0/power", Payload: []byte("2451.3")})
+	broker.Publish(mqtt.Message{Topic: "tele/plug/SENSOR",
+		Payload: []byte(`{"Time":"2019-06-12T13:00:00","ENERGY":{"Total":12480.311,"Today":8.532,"Power":2451}}`)})
+	pv := pvStore.waitFor(t, func(pv dataproviders.PvData) bool { return pv.EnergyTotal > 0 })
+	if pv.PowerAc != 2451 || pv.EnergyToday != 8532 || pv.EnergyTotal != 12480.311 {
+		t.Errorf("Wrong pv data %s", pv.ToJson())
+	}
+	if dp.Status() != dataproviders.Online {
+		t.Errorf("Expected provider to be online, was %s", dp.Status())
+	}
+
+	// A payload that is not a number is an error, but keeps the provider running
+	broker.Publish(mqtt.Message{Topic: "solar/1161/0/power", Payload: []byte("n/a")})
+	broker.Publish(mqtt.Message{Topic: "solar/1161/0/power", Payload: []byte("1200")})
+	pvStore.waitFor(t, func(pv dataproviders.PvData) bool { return pv.PowerAc == 1200 })
+	if dp.LastError() == nil {
+		t.Error("Expected the bad payload to be reported")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = dp.Stop(ctx); err != nil {
+		t.Fatal(err.Error())
+	}
+	select {
+	case <-terminated:
+	default:
+		t.Error("Expected term to be called")
+	}
+}
+
+func Test_bad_config(t *testing.T) {
+	for _, options := range []map[string]string{
+		{},
+		{"EnergyTotal": "tele/plug/SENSOR"},
+		{"PowerAc": "solar/+/power"},
+		{"PowerAc": "solar/power", "PowerAc.path": "ENERGY"},
+	} {
+		_, err := NewDataProvider(dataproviders.InitiateData{Address: "broker", Options: options}, nil, nil, nil, nil)
+		if err == nil {
+			t.Errorf("Expected %v to be rejected", options)
+		}
+	}
+}
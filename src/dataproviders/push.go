@@ -0,0 +1,121 @@
+package dataproviders
+
+import (
+	"time"
+)
+
+// PushUpdate applies data pushed to a provider to pv
+type PushUpdate func(pv *PvData) error
+
+// RunPushUpdates on a provider that is pushed its data, instead of polling for it.
+// lifecycle, the state of the provider. RunPushUpdates terminates when the provider is stopped
+// updates, receives an update for every message pushed to the provider. Terminates when it is closed
+// errs, receives errors from eg. the connection the data is pushed on, may be nil
+// terminateTime, how long the provider will stay online without any updates before it terminates
+// term, a function that gets called when RunPushUpdates terminates
+// errClose, maximum number of errors received before giving up, and terminates.
+// Every update halves the count
+// statsStore service for storinging peak
+// pvStore store for setting and getting actual data
+// historyStore store where every successful update is appended, may be nil
+// PvData.State is the state of the provider, unless an update sets the state of the device
+func RunPushUpdates(lifecycle *Lifecycle,
+	initiateData *InitiateData,
+	updates <-chan PushUpdate,
+	errs <-chan error,
+	terminateTime time.Duration,
+	term TerminateCallback,
+	errClose int,
+	statsStore PlantStatsStore,
+	pvStore PvStore,
+	historyStore HistoryStore) {
+
+	log.Trace("Started a RunPushUpdates rutine")
+	stats := statsStore.LoadStats(initiateData.PlantKey)
+
+	// Peak is saved as often as by RunUpdates
+	statsTick := time.NewTicker(5 * time.Minute)
+	terminateTimer := time.NewTimer(terminateTime)
+	errCounter := 0
+	state := providerState{lifecycle: lifecycle}
+
+	defer func() {
+		log.Infof("About to terminate RunPushUpdates for plant %s", initiateData.PlantKey)
+		statsTick.Stop()
+		terminateTimer.Stop()
+		pv := pvStore.Get(initiateData.PlantKey)
+		state.terminate(&pv)
+		pvStore.Set(initiateData.PlantKey, &pv)
+		statsStore.SaveStats(initiateData.PlantKey, &pv)
+		term()
+		if r := recover(); r != nil {
+			log.Infof("Recovered in dataprovider.RunPushUpdates, %s", r)
+		}
+		log.Infof("RunPushUpdates exited for plant %s", initiateData.PlantKey)
+	}()
+
+	// Loud up from previous pvdata, then setup peak from store
+	pv := pvStore.Get(initiateData.PlantKey)
+	pv.PowerAcPeakAll = stats.PowerAcPeakAll
+	pv.PowerAcPeakAllTime = stats.PowerAcPeakAllTime
+	pv.PowerAcPeakToday = stats.PowerAcPeakToday
+	pv.PowerAcPeakTodayTime = stats.PowerAcPeakTodayTime
+	pvStore.Set(initiateData.PlantKey, &pv)
+
+	for {
+		var err error
+		select {
+		case update, ok := <-updates:
+			if !ok {
+				return
+			}
+			// The update may set the time of the data, else it is now
+			pv.LatestUpdate = nil
+			state.clear(&pv)
+			if err = update(&pv); err == nil {
+				lifecycle.SetSuccess()
+				state.set(&pv)
+				updatePvPeak(pvStore, historyStore, &initiateData.PlantKey, &pv)
+				// Errors decay, so only errors close together terminates the provider
+				errCounter /= 2
+				// Still alive, restart the terminate timer
+				if !terminateTimer.Stop() {
+					<-terminateTimer.C
+				}
+				terminateTimer.Reset(terminateTime)
+			}
+		case e, ok := <-errs:
+			if !ok {
+				errs = nil
+			}
+			err = e
+		case <-statsTick.C:
+			statsStore.SaveStats(initiateData.PlantKey, &pv)
+		case <-terminateTimer.C:
+			log.Infof("No updates pushed for plant %s in %s", initiateData.PlantKey, terminateTime)
+			return
+		case <-lifecycle.Stopping():
+			log.Infof("Provider for plant %s was asked to stop", initiateData.PlantKey)
+			return
+		}
+		if err != nil {
+			errCounter++
+			log.Infof("There was on error on pushed pvdata: %s, error counter is now %d for plant %s",
+				err.Error(), errCounter, initiateData.PlantKey)
+			lifecycle.SetError(err)
+			state.setError(&pv, initiateData.PlantKey, pvStore)
+			if errCounter > errClose {
+				return
+			}
+		}
+	}
+}
+
+// Pusher is a provider that is pushed its data from outside, eg. by a logger
+// posting to the ingest endpoint
+type Pusher interface {
+	// Is the token allowed to push data to the plant
+	Authorize(token string) bool
+	// Push an update to the provider, fails if it is not running
+	Push(update PushUpdate) error
+}
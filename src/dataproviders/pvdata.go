@@ -6,17 +6,79 @@ import (
 )
 
 type PvData struct {
+	// The version the json was read as, see SchemaVersion
+	SchemaVersion        int `json:",omitempty"`
 	LatestUpdate         *time.Time
-	PowerAc              uint16
-	PowerAcPeakAll       uint16
+	PowerAc              Watt
+	PowerAcPeakAll       Watt
 	PowerAcPeakAllTime   time.Time
-	PowerAcPeakToday     uint16
+	PowerAcPeakToday     Watt
 	PowerAcPeakTodayTime time.Time
-	EnergyTotal          float32
-	EnergyToday          uint16
-	VoltDc               float32
-	AmpereAc             float32
-	State                string
+	EnergyTotal          KiloWattHour
+	EnergyToday          WattHour
+	// Average voltage of the DC inputs
+	VoltDc float32
+	// Total current of the AC phases
+	AmpereAc float32
+	State    string
+	// Output of each panel, for plants with microinverters or optimizers
+	Panels []PanelData `json:",omitempty"`
+	// Each DC input and each AC phase, for providers that can tell them apart.
+	// VoltDc and AmpereAc are kept for old clients, see SetStrings and SetPhases
+	Strings []StringData `json:",omitempty"`
+	Phases  []PhaseData  `json:",omitempty"`
+	// Grid frequency in Hz, 0 if unknown
+	Frequency float32 `json:",omitempty"`
+	// Inverter temperature in °C, 0 if unknown
+	Temperature float32 `json:",omitempty"`
+}
+
+// A DC input of the inverter, a string or an MPPT tracker
+type StringData struct {
+	VoltDc   float32
+	AmpereDc float32
+	PowerDc  Watt
+}
+
+// An AC phase of the inverter
+type PhaseData struct {
+	VoltAc   float32
+	AmpereAc float32
+	PowerAc  Watt
+}
+
+type PanelData struct {
+	// Serial number of the microinverter or optimizer
+	Serial       string
+	PowerAc      Watt
+	PowerAcMax   Watt
+	LatestReport time.Time
+}
+
+// Set the DC inputs, and VoltDc to their average voltage
+func (data *PvData) SetStrings(strings []StringData) {
+	data.Strings = strings
+	if len(strings) == 0 {
+		return
+	}
+	sum := 0.0
+	for _, s := range strings {
+		sum += float64(s.VoltDc)
+	}
+	data.VoltDc = float32(sum / float64(len(strings)))
+}
+
+// Set the AC phases, and AmpereAc to their total current
+func (data *PvData) SetPhases(phases []PhaseData) {
+	data.Phases = phases
+	if len(phases) == 0 {
+		return
+	}
+	sum := 0.0
+	for _, p := range phases {
+		sum += float64(p.AmpereAc)
+	}
+	data.AmpereAc = float32(sum)
 }
 
 func (data *PvData) ToJson() (b []byte) {
@@ -39,4 +101,4 @@ func FromJson(b []byte) PvData {
 const KeyDateFormat = "20060102"
 
 // Key is YYYYMMDD
-type PvDataDaily map[string]uint16
+type PvDataDaily map[string]WattHour
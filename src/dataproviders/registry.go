@@ -0,0 +1,140 @@
+package dataproviders
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Factory creates a new dataprovider for a plant. The provider is not started
+type Factory func(initiateData InitiateData,
+	term TerminateCallback,
+	client *http.Client,
+	pvStore PvStore,
+	statsStore PlantStatsStore,
+	historyStore HistoryStore) (DataProvider, error)
+
+// ConfigField describes one of the InitiateData fields a provider uses
+type ConfigField struct {
+	// Name of the field in InitiateData, eg. UserName or Address,
+	// or Options.{key} for a provider specific option
+	Field       string
+	Required    bool
+	Description string
+}
+
+// ConfigSchema lists the InitiateData fields a provider uses
+type ConfigSchema []ConfigField
+
+// Validator checks the InitiateData of a plant beyond the fields the schema
+// requires, eg. that the options of the provider can be parsed
+type Validator func(initiateData *InitiateData) error
+
+// Registration is what a provider package registers itself with
+type Registration struct {
+	Name    string
+	Factory Factory
+	Schema  ConfigSchema
+	// Nil if the schema is all there is to check
+	Validator Validator
+}
+
+// Locker for sync'ing the registry map
+var registryLock = sync.RWMutex{}
+
+var registry = map[string]Registration{}
+
+// Register a dataprovider by a stable name.
+// Is meant to be called from the init func of the provider package.
+// Registering the same name twice will panic.
+func Register(name string, factory Factory, schema ConfigSchema) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if name == "" || factory == nil {
+		panic("dataproviders: Register called with empty name or nil factory")
+	}
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("dataproviders: Register called twice for provider %s", name))
+	}
+	registry[name] = Registration{Name: name, Factory: factory, Schema: schema}
+}
+
+// Register a validator for a provider, that is run when the config is validated.
+// Is meant to be called from the init func of the provider package, after Register.
+func RegisterValidator(name string, validator Validator) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	r, ok := registry[name]
+	if !ok {
+		panic(fmt.Sprintf("dataproviders: RegisterValidator called for unregistered provider %s", name))
+	}
+	r.Validator = validator
+	registry[name] = r
+}
+
+// Lookup the registration for the given provider name
+func Lookup(name string) (r Registration, ok bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	r, ok = registry[name]
+	return
+}
+
+// Names of all registered providers, sorted
+func Names() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Validate checks that all required fields in the schema are set in initiateData
+func (s ConfigSchema) Validate(initiateData *InitiateData) error {
+	for _, f := range s {
+		if !f.Required {
+			continue
+		}
+		if initiateData.field(f.Field) == "" {
+			return fmt.Errorf("Field %s is required (%s)", f.Field, f.Description)
+		}
+	}
+	return nil
+}
+
+// Validate initiateData against the schema and the validator of the provider
+func (r Registration) Validate(initiateData *InitiateData) error {
+	if err := r.Schema.Validate(initiateData); err != nil {
+		return err
+	}
+	if r.Validator != nil {
+		return r.Validator(initiateData)
+	}
+	return nil
+}
+
+const optionPrefix = "Options."
+
+func (i *InitiateData) field(name string) string {
+	switch name {
+	case "PlantKey":
+		return i.PlantKey
+	case "UserName":
+		return i.UserName
+	case "Password":
+		return i.Password
+	case "PlantNo":
+		return i.PlantNo
+	case "Address":
+		return i.Address
+	}
+	if strings.HasPrefix(name, optionPrefix) {
+		return i.Options[name[len(optionPrefix):]]
+	}
+	return ""
+}
@@ -0,0 +1,148 @@
+package dataproviders
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func testFactory(initiateData InitiateData,
+	term TerminateCallback,
+	client *http.Client,
+	pvStore PvStore,
+	statsStore PlantStatsStore,
+	historyStore HistoryStore) (DataProvider, error) {
+	return nil, nil
+}
+
+// Panics are the only errors of Register, so tests check them like this
+func registerPanics(name string, factory Factory) (panicked bool) {
+	defer func() {
+		panicked = recover() != nil
+	}()
+	Register(name, factory, ConfigSchema{})
+	return
+}
+
+func Test_register(t *testing.T) {
+	schema := ConfigSchema{{Field: "Address", Required: true, Description: "Host of the test inverter"}}
+	Register("registrytest", testFactory, schema)
+	defer func() {
+		registryLock.Lock()
+		delete(registry, "registrytest")
+		registryLock.Unlock()
+	}()
+
+	r, ok := Lookup("registrytest")
+	if !ok || r.Name != "registrytest" || r.Factory == nil || len(r.Schema) != 1 {
+		t.Errorf("Registration looked up wrong, %v", r)
+	}
+	if _, ok = Lookup("nosuchprovider"); ok {
+		t.Error("Expected an unknown provider not to be found")
+	}
+
+	names := Names()
+	found := false
+	for i, name := range names {
+		found = found || name == "registrytest"
+		if i > 0 && names[i-1] > name {
+			t.Errorf("Names should be sorted, was %v", names)
+		}
+	}
+	if !found {
+		t.Errorf("Names should contain registrytest, was %v", names)
+	}
+
+	if !registerPanics("registrytest", testFactory) {
+		t.Error("Expected registering a name twice to panic")
+	}
+	if !registerPanics("", testFactory) {
+		t.Error("Expected registering an empty name to panic")
+	}
+	if !registerPanics("registrynil", nil) {
+		t.Error("Expected registering a nil factory to panic")
+	}
+}
+
+func Test_register_validator(t *testing.T) {
+	Register("validatortest", testFactory,
+		ConfigSchema{{Field: "Address", Required: true, Description: "Host of the test inverter"}})
+	defer func() {
+		registryLock.Lock()
+		delete(registry, "validatortest")
+		registryLock.Unlock()
+	}()
+	RegisterValidator("validatortest", func(i *InitiateData) error {
+		if i.Options["unit"] != "" && i.Options["unit"] != "1" {
+			return fmt.Errorf("Bad unit %s", i.Options["unit"])
+		}
+		return nil
+	})
+
+	r, _ := Lookup("validatortest")
+	if err := r.Validate(&InitiateData{Options: map[string]string{"unit": "2"}}); err == nil ||
+		!strings.Contains(err.Error(), "Field Address is required") {
+		t.Errorf("Expected the schema to be checked first, error was %v", err)
+	}
+	if err := r.Validate(&InitiateData{Address: "a", Options: map[string]string{"unit": "2"}}); err == nil ||
+		err.Error() != "Bad unit 2" {
+		t.Errorf("Expected the validator to reject the unit, error was %v", err)
+	}
+	if err := r.Validate(&InitiateData{Address: "a"}); err != nil {
+		t.Errorf("Expected the data to be valid, error was %s", err.Error())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected a validator for an unknown provider to panic")
+		}
+	}()
+	RegisterValidator("nosuchprovider", func(i *InitiateData) error { return nil })
+}
+
+func Test_schema_validate(t *testing.T) {
+	schema := ConfigSchema{
+		{Field: "UserName", Required: true, Description: "Login"},
+		{Field: "Options.PowerAc", Required: true, Description: "Path of the power"},
+		{Field: "Options.State", Required: false, Description: "Path of the state"},
+	}
+
+	err := schema.Validate(&InitiateData{Options: map[string]string{"PowerAc": "$.pac"}})
+	if err == nil || !strings.Contains(err.Error(), "Field UserName is required (Login)") {
+		t.Errorf("Expected UserName to be required, error was %v", err)
+	}
+	// Options.{key} is looked up among the options
+	err = schema.Validate(&InitiateData{UserName: "u", Options: map[string]string{"State": "$.state"}})
+	if err == nil || !strings.Contains(err.Error(), "Field Options.PowerAc is required") {
+		t.Errorf("Expected Options.PowerAc to be required, error was %v", err)
+	}
+	if err = schema.Validate(&InitiateData{UserName: "u", Options: map[string]string{"PowerAc": "$.pac"}}); err != nil {
+		t.Errorf("Expected the data to be valid, error was %s", err.Error())
+	}
+}
+
+func Test_initiatedata_field(t *testing.T) {
+	i := InitiateData{PlantKey: "k", UserName: "u", Password: "p", PlantNo: "1", Address: "a",
+		Options: map[string]string{"unit": "3", "Options.nested": "n"}}
+	for field, expected := range map[string]string{
+		"PlantKey":               "k",
+		"UserName":               "u",
+		"Password":               "p",
+		"PlantNo":                "1",
+		"Address":                "a",
+		"Options.unit":           "3",
+		"Options.missing":        "",
+		"Options.Options.nested": "n",
+		"unit":                   "",
+		"NoSuchField":            "",
+	} {
+		if v := i.field(field); v != expected {
+			t.Errorf("Field %s should be '%s' was '%s'", field, expected, v)
+		}
+	}
+	// A plant without options
+	if v := (&InitiateData{}).field("Options.unit"); v != "" {
+		t.Errorf("Expected no option, was '%s'", v)
+	}
+}
@@ -0,0 +1,79 @@
+package dataproviders
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// How RunUpdates retries a plant that fails.
+// The delay before a retry doubles for every error, and the error count
+// is halved by every successful update, so a plant that fails now and then
+// is retried soon, while one that keeps failing is retried ever slower.
+// When the count reaches OpenAfter the circuit opens, and the plant is only
+// probed every ProbeInterval, until a probe succeeds and closes it again,
+// and the error count starts over.
+type RetryPolicy struct {
+	// Delay after the first error
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Every delay is varied randomly by up to this fraction of it,
+	// so plants that fail together are not retried together
+	Jitter        float64
+	OpenAfter     int
+	ProbeInterval time.Duration
+}
+
+// Options of any provider, that override the retry policy for a plant,
+// as durations like 30s or 5m
+const (
+	BackoffOption       = "retry.backoff"
+	MaxBackoffOption    = "retry.maxbackoff"
+	ProbeIntervalOption = "retry.probe"
+)
+
+// The policy of most providers, that opens the circuit after openAfter errors
+func DefaultRetryPolicy(openAfter int) RetryPolicy {
+	return RetryPolicy{Backoff: 10 * time.Second,
+		MaxBackoff:    5 * time.Minute,
+		Jitter:        0.2,
+		OpenAfter:     openAfter,
+		ProbeInterval: 10 * time.Minute}
+}
+
+// The policy with the retry options of a plant
+func (p RetryPolicy) WithOptions(options map[string]string) (RetryPolicy, error) {
+	for option, d := range map[string]*time.Duration{
+		BackoffOption:       &p.Backoff,
+		MaxBackoffOption:    &p.MaxBackoff,
+		ProbeIntervalOption: &p.ProbeInterval,
+	} {
+		s, ok := options[option]
+		if !ok {
+			continue
+		}
+		v, err := time.ParseDuration(s)
+		if err != nil || v <= 0 {
+			return p, fmt.Errorf("Option %s must be a positive duration like 30s or 5m, was '%s'", option, s)
+		}
+		*d = v
+	}
+	return p, nil
+}
+
+// Whether the circuit opens after errors errors
+func (p RetryPolicy) Open(errors int) bool {
+	return p.OpenAfter > 0 && errors >= p.OpenAfter
+}
+
+// The delay before retrying after errors errors, while the circuit is closed
+func (p RetryPolicy) Delay(errors int) time.Duration {
+	d := math.Min(float64(p.Backoff)*math.Pow(2, float64(errors-1)), float64(p.MaxBackoff))
+	return p.Jittered(time.Duration(d))
+}
+
+// The delay varied randomly by up to Jitter of it
+func (p RetryPolicy) Jittered(d time.Duration) time.Duration {
+	return time.Duration(float64(d) * (1 + p.Jitter*(2*rand.Float64()-1)))
+}
@@ -0,0 +1,163 @@
+package dataproviders
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_retry_delay(t *testing.T) {
+	p := RetryPolicy{Backoff: 10 * time.Second, MaxBackoff: time.Minute, OpenAfter: 3}
+	for errors, delay := range map[int]time.Duration{1: 10 * time.Second, 2: 20 * time.Second,
+		3: 40 * time.Second, 4: time.Minute, 10: time.Minute} {
+		if d := p.Delay(errors); d != delay {
+			t.Errorf("Expected a delay of %s after %d errors, was %s", delay, errors, d)
+		}
+	}
+	if p.Open(2) || !p.Open(3) || (RetryPolicy{}).Open(100) {
+		t.Error("Wrong opening of the circuit")
+	}
+	p.Jitter = 0.2
+	for i := 0; i < 100; i++ {
+		if d := p.Jittered(time.Minute); d < 48*time.Second || d > 72*time.Second {
+			t.Fatalf("Expected the jitter to be within 20%%, was %s", d)
+		}
+	}
+}
+
+// The results of the updates in turn, with the time of each update
+// and whether the circuit was open when it was called
+type scriptedUpdates struct {
+	lock    sync.Mutex
+	l       *Lifecycle
+	results []error
+	times   []time.Time
+	open    []bool
+}
+
+func (s *scriptedUpdates) update(i *InitiateData, pv *PvData) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	n := len(s.times)
+	s.times = append(s.times, time.Now())
+	s.open = append(s.open, s.l.Health().CircuitOpen)
+	pv.PowerAc = 1000
+	if n < len(s.results) {
+		return s.results[n]
+	}
+	return nil
+}
+
+func (s *scriptedUpdates) calls() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.times)
+}
+
+func Test_retry_recovery(t *testing.T) {
+	l := Lifecycle{}
+	failed := errors.New("no reply")
+	// Three updates fail, the third opens the circuit, three probes fail, the fourth
+	// closes it, and the slow update of the first run, that waited for it, fails once
+	s := &scriptedUpdates{l: &l, results: []error{failed, failed, failed, failed, failed, failed, nil, failed}}
+	retry := RetryPolicy{Backoff: 200 * time.Millisecond, MaxBackoff: 200 * time.Millisecond,
+		OpenAfter: 3, ProbeInterval: 20 * time.Millisecond}
+	l.Launch(func() {
+		RunUpdates(&l, &InitiateData{PlantKey: "plant"}, s.update, s.update,
+			10*time.Millisecond, time.Hour, time.Hour, func() {},
+			retry, &nopStatsStore{}, newMapStore(), nil)
+	})
+	defer l.Stop(context.Background())
+	for i := 0; i < 300 && s.calls() < 12; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.times) < 12 {
+		t.Fatalf("Expected the plant to be polled again, was updated %d times", len(s.times))
+	}
+
+	if s.open[2] || !s.open[3] || !s.open[6] {
+		t.Errorf("Expected the circuit to open on the third error, open was %v", s.open)
+	}
+	if gap := s.times[5].Sub(s.times[4]); gap > 100*time.Millisecond {
+		t.Errorf("Expected the open circuit to be probed, was after %s", gap)
+	}
+	// A single error after the recovery does not open the circuit again
+	if s.open[7] || s.open[8] {
+		t.Errorf("Expected the circuit to be closed after the recovery, open was %v", s.open)
+	}
+	if gap := s.times[8].Sub(s.times[7]); gap < 200*time.Millisecond {
+		t.Errorf("Expected the error after the recovery to be retried with backoff, was after %s", gap)
+	}
+	// And the plant is polled as usual again
+	for n := 9; n < 12; n++ {
+		if gap := s.times[n].Sub(s.times[n-1]); gap > 100*time.Millisecond {
+			t.Errorf("Expected update %d to be polled as usual, was after %s", n, gap)
+		}
+	}
+	if h := l.Health(); h.CircuitOpen || h.ConsecutiveErrors != 0 || h.State != Online {
+		t.Errorf("Expected the plant to have recovered, health is %v", h)
+	}
+}
+
+func Test_retry_open_past_terminate(t *testing.T) {
+	l := Lifecycle{}
+	failing := true
+	var lock sync.Mutex
+	fast, slow := 0, 0
+	updateFast := func(i *InitiateData, pv *PvData) error {
+		lock.Lock()
+		defer lock.Unlock()
+		fast++
+		if failing {
+			return errors.New("no reply")
+		}
+		return nil
+	}
+	updateSlow := func(i *InitiateData, pv *PvData) error {
+		lock.Lock()
+		slow++
+		lock.Unlock()
+		return nil
+	}
+	retry := RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 10 * time.Millisecond,
+		OpenAfter: 2, ProbeInterval: 20 * time.Millisecond}
+	terminated := make(chan struct{})
+	l.Launch(func() {
+		RunUpdates(&l, &InitiateData{PlantKey: "plant"}, updateFast, updateSlow,
+			10*time.Millisecond, time.Hour, 50*time.Millisecond, func() { close(terminated) },
+			retry, &nopStatsStore{}, newMapStore(), nil)
+	})
+	defer l.Stop(context.Background())
+
+	// Several terminate intervals pass while the circuit is open
+	select {
+	case <-terminated:
+		t.Fatal("Expected a provider with an open circuit not to terminate")
+	case <-time.After(300 * time.Millisecond):
+	}
+	lock.Lock()
+	if h := l.Health(); !h.CircuitOpen || !h.Running || fast < 5 {
+		t.Errorf("Expected the plant to be probed with the circuit open, health is %v after %d updates", h, fast)
+	}
+	if slow != 0 {
+		t.Errorf("Expected the slow update to wait for a fast update that succeeds, was called %d times", slow)
+	}
+	failing = false
+	lock.Unlock()
+
+	// Once it recovers, it terminates as usual
+	select {
+	case <-terminated:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the provider to terminate after it recovered")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if h := l.Health(); h.CircuitOpen || h.State != Terminated || h.ConsecutiveErrors != 0 || slow != 1 {
+		t.Errorf("Expected the plant recovered, with the slow update of the first run, health is %v, slow updates %d", h, slow)
+	}
+}
@@ -0,0 +1,299 @@
+package solaredge
+
+// Dataprovider for the SolarEdge monitoring api.
+// The api allows 300 requests a day for each api key, so the overview
+// is only read every 10 minutes, and the power and energy details
+// every hour. As the provider is restarted when it has been offline,
+// requests are also counted for each api key, and refused when
+// the daily budget is spent.
+
+import (
+	"dataproviders"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"logger"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+type dataProvider struct {
+	dataproviders.Lifecycle
+	InitiateData dataproviders.InitiateData
+	client       *http.Client
+	term         dataproviders.TerminateCallback
+	pvStore      dataproviders.PvStore
+	statsStore   dataproviders.PlantStatsStore
+	historyStore dataproviders.HistoryStore
+}
+
+var log = logger.NewLogger(logger.DEBUG, "Dataprovider: SolarEdge:")
+
+const MAX_ERRORS = 5
+
+const ProviderName = "solaredge"
+
+// Where the monitoring api is, may be changed for testing
+var BaseUrl = "https://monitoringapi.solaredge.com"
+
+const (
+	overviewUrl      = "/site/%s/overview"
+	powerDetailsUrl  = "/site/%s/powerDetails"
+	energyDetailsUrl = "/site/%s/energyDetails"
+)
+
+// Format of times in the api, in the time zone of the site
+const timeFormat = "2006-01-02 15:04:05"
+
+// 24 hours with an overview every 10 minutes, and two details
+// every hour, is 192 requests, which leaves room for restarts
+const (
+	fastTime = 10 * time.Minute
+	slowTime = time.Hour
+	// Requests allowed for an api key each day, a little below the 300 of SolarEdge
+	dailyBudget = 280
+)
+
+func init() {
+	dataproviders.Register(ProviderName,
+		func(initiateData dataproviders.InitiateData,
+			term dataproviders.TerminateCallback,
+			client *http.Client,
+			pvStore dataproviders.PvStore,
+			statsStore dataproviders.PlantStatsStore,
+			historyStore dataproviders.HistoryStore) (dataproviders.DataProvider, error) {
+			return NewDataProvider(initiateData, term, client, pvStore, statsStore, historyStore), nil
+		},
+		dataproviders.ConfigSchema{
+			{Field: "Password", Required: true, Description: "Api key from the SolarEdge monitoring portal"},
+			{Field: "PlantNo", Required: true, Description: "Site id in the SolarEdge monitoring portal"},
+		})
+}
+
+func (d *dataProvider) Name() string {
+	return "SolarEdge"
+}
+
+func NewDataProvider(initiateData dataproviders.InitiateData,
+	term dataproviders.TerminateCallback,
+	client *http.Client,
+	pvStore dataproviders.PvStore,
+	statsStore dataproviders.PlantStatsStore,
+	historyStore dataproviders.HistoryStore) *dataProvider {
+	log.Debug("New dataprovider")
+
+	dp := dataProvider{InitiateData: initiateData,
+		client:       client,
+		term:         term,
+		pvStore:      pvStore,
+		statsStore:   statsStore,
+		historyStore: historyStore}
+
+	return &dp
+}
+
+func (dp *dataProvider) Capabilities() dataproviders.Capabilities {
+	return dataproviders.Capabilities{PowerAc: true, EnergyToday: true, EnergyTotal: true}
+}
+
+func (dp *dataProvider) Start() error {
+	client := dp.client
+	return dp.Launch(func() {
+		dataproviders.RunUpdates(
+			&dp.Lifecycle,
+			&dp.InitiateData,
+			func(initiateData *dataproviders.InitiateData, pv *dataproviders.PvData) error {
+				return updateOverview(client, initiateData, pv)
+			},
+			func(initiateData *dataproviders.InitiateData, pv *dataproviders.PvData) error {
+				return updateDetails(client, initiateData, pv)
+			},
+			fastTime,
+			slowTime,
+			time.Minute*30,
+			dp.term,
+			dataproviders.DefaultRetryPolicy(MAX_ERRORS),
+			dp.statsStore,
+			dp.pvStore,
+			dp.historyStore)
+	})
+}
+
+// Requests made today for each api key
+type quota struct {
+	lock     sync.Mutex
+	day      string
+	requests map[string]int
+}
+
+var requestQuota = quota{requests: map[string]int{}}
+
+// Take a request from the budget of the api key, false if it is spent
+func (q *quota) take(apiKey string) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	day := time.Now().Format(dataproviders.KeyDateFormat)
+	if q.day != day {
+		q.day = day
+		q.requests = map[string]int{}
+	}
+	if q.requests[apiKey] >= dailyBudget {
+		return false
+	}
+	q.requests[apiKey]++
+	return true
+}
+
+type overviewReply struct {
+	Overview struct {
+		LastUpdateTime string
+		LifeTimeData   struct{ Energy float64 }
+		LastDayData    struct{ Energy float64 }
+		CurrentPower   struct{ Power float64 }
+	}
+}
+
+// A list of meter readings, as in power and energy details
+type meters struct {
+	TimeUnit string
+	Unit     string
+	Meters   []struct {
+		Type   string
+		Values []struct {
+			Date  string
+			Value *float64
+		}
+	}
+}
+
+// Update power and energy from the site overview
+func updateOverview(client *http.Client, initiateData *dataproviders.InitiateData, pv *dataproviders.PvData) error {
+	log.Debug("Fetching overview ...")
+	reply := overviewReply{}
+	if err := get(client, initiateData, overviewUrl, nil, &reply); err != nil {
+		return err
+	}
+	o := reply.Overview
+	var err error
+	if pv.PowerAc, err = dataproviders.ToWatt(o.CurrentPower.Power); err != nil {
+		return err
+	}
+	if pv.EnergyToday, err = dataproviders.ToWattHour(o.LastDayData.Energy); err != nil {
+		return err
+	}
+	pv.EnergyTotal = dataproviders.KiloWattHour(o.LifeTimeData.Energy / 1000)
+	if t, err := time.ParseInLocation(timeFormat, o.LastUpdateTime, time.Local); err == nil {
+		pv.LatestUpdate = &t
+	} else {
+		pv.LatestUpdate = nil
+	}
+	return nil
+}
+
+// Update the peak of today from the quarterly power details,
+// and energy today from the energy details
+func updateDetails(client *http.Client, initiateData *dataproviders.InitiateData, pv *dataproviders.PvData) error {
+	log.Debug("Fetching details ...")
+	now := time.Now()
+	y, m, d := now.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+	params := url.Values{}
+	params.Set("startTime", midnight.Format(timeFormat))
+	params.Set("endTime", now.Format(timeFormat))
+	params.Set("meters", "Production")
+
+	power := struct{ PowerDetails meters }{}
+	if err := get(client, initiateData, powerDetailsUrl, params, &power); err != nil {
+		return err
+	}
+	if pv.PowerAcPeakTodayTime.Before(midnight) {
+		pv.PowerAcPeakToday = 0
+	}
+	for _, meter := range power.PowerDetails.Meters {
+		for _, v := range meter.Values {
+			if v.Value == nil {
+				continue
+			}
+			peak, err := dataproviders.ToWatt(*v.Value)
+			if err != nil {
+				return err
+			}
+			if peak <= pv.PowerAcPeakToday {
+				continue
+			}
+			t, err := time.ParseInLocation(timeFormat, v.Date, time.Local)
+			if err != nil {
+				continue
+			}
+			pv.PowerAcPeakToday = peak
+			pv.PowerAcPeakTodayTime = t
+			if pv.PowerAcPeakToday > pv.PowerAcPeakAll {
+				pv.PowerAcPeakAll = pv.PowerAcPeakToday
+				pv.PowerAcPeakAllTime = t
+			}
+		}
+	}
+
+	params.Set("timeUnit", "DAY")
+	energy := struct{ EnergyDetails meters }{}
+	if err := get(client, initiateData, energyDetailsUrl, params, &energy); err != nil {
+		return err
+	}
+	for _, meter := range energy.EnergyDetails.Meters {
+		if n := len(meter.Values); n > 0 && meter.Values[n-1].Value != nil {
+			today, err := dataproviders.ToWattHour(*meter.Values[n-1].Value)
+			if err != nil {
+				return err
+			}
+			pv.EnergyToday = today
+		}
+	}
+	return nil
+}
+
+func get(client *http.Client, initiateData *dataproviders.InitiateData,
+	path string, params url.Values, v interface{}) error {
+	if !requestQuota.take(initiateData.Password) {
+		return fmt.Errorf("Dataprovider solaredge fail. The daily request budget of %d is spent", dailyBudget)
+	}
+	path = fmt.Sprintf(path, url.PathEscape(initiateData.PlantNo))
+	if params == nil {
+		params = url.Values{}
+	}
+	// The api key is in the query, so only the path is logged
+	log.Tracef("Getting data from %s", path)
+	query := url.Values{}
+	for k, v := range params {
+		query[k] = v
+	}
+	query.Set("api_key", initiateData.Password)
+	resp, err := client.Get(BaseUrl + path + "?" + query.Encode())
+	if err != nil {
+		// The error holds the url, and with that the api key, so only the cause is kept
+		return fmt.Errorf("Dataprovider solaredge fail. Request to %s failed: %w", path, errors.Unwrap(err))
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case 200:
+	case http.StatusForbidden:
+		return dataproviders.NewLoginError("Dataprovider solaredge fail. Api key was rejected for site %s", initiateData.PlantNo)
+	case http.StatusTooManyRequests:
+		return fmt.Errorf("Dataprovider solaredge fail. Too many requests")
+	default:
+		err = fmt.Errorf("Dataprovider solaredge fail. Received http status %d from %s", resp.StatusCode, path)
+		log.Infof("%s", err.Error())
+		return err
+	}
+	log.Tracef("Received %s", b)
+	if err = json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("Dataprovider solaredge fail. Could not parse reply: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package solaredge
+
+import (
+	"dataproviders"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+To run test export GOPATH=/Users/jbr/github/local/solarcompare
+then
+go test -test.v dataproviders/solaredge
+*/
+
+// A stand-in for the monitoring api of site 1234 with api key KEY
+func newApi(t *testing.T, requests *int) *httptest.Server {
+	today := time.Now().Format("2006-01-02")
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		if r.URL.Query().Get("api_key") != "KEY" {
+			http.Error(w, "Invalid token", http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/site/1234/overview":
+			fmt.Fprintf(w, `{"overview":{"lastUpdateTime":"%s 13:00:00",
+				"lifeTimeData":{"energy":12480311.0},"lastYearData":{"energy":2381090.0},
+				"lastMonthData":{"energy":412000.0},"lastDayData":{"energy":8532.0},
+				"currentPower":{"power":2451.0}}}`, today)
+		case "/site/1234/powerDetails":
+			if r.URL.Query().Get("startTime") != today+" 00:00:00" {
+				t.Errorf("Expected details from midnight, was %s", r.URL.Query().Get("startTime"))
+			}
+			fmt.Fprintf(w, `{"powerDetails":{"timeUnit":"QUARTER_OF_AN_HOUR","unit":"W","meters":[
+				{"type":"Production","values":[{"date":"%[1]s 11:45:00","value":3012.5},
+				{"date":"%[1]s 12:00:00","value":3210.0},{"date":"%[1]s 12:15:00"}]}]}}`, today)
+		case "/site/1234/energyDetails":
+			fmt.Fprintf(w, `{"energyDetails":{"timeUnit":"DAY","unit":"Wh","meters":[
+				{"type":"Production","values":[{"date":"%s 00:00:00","value":8601.0}]}]}}`, today)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func Test_update(t *testing.T) {
+	requests := 0
+	srv := newApi(t, &requests)
+	defer srv.Close()
+	BaseUrl = srv.URL
+	requestQuota = quota{requests: map[string]int{}}
+
+	initiateData := dataproviders.InitiateData{PlantKey: "test", Password: "KEY", PlantNo: "1234"}
+	pv := dataproviders.PvData{}
+	if err := updateOverview(srv.Client(), &initiateData, &pv); err != nil {
+		t.Fatal(err.Error())
+	}
+	if pv.PowerAc != 2451 || pv.EnergyToday != 8532 || pv.EnergyTotal != 12480.311 {
+		t.Errorf("Wrong power or energy, pv data is %s", pv.ToJson())
+	}
+	if pv.LatestUpdate == nil || pv.LatestUpdate.Hour() != 13 {
+		t.Errorf("Expected update time from the overview, was %v", pv.LatestUpdate)
+	}
+
+	if err := updateDetails(srv.Client(), &initiateData, &pv); err != nil {
+		t.Fatal(err.Error())
+	}
+	if pv.PowerAcPeakToday != 3210 || pv.PowerAcPeakTodayTime.Hour() != 12 || pv.PowerAcPeakAll != 3210 {
+		t.Errorf("Wrong peak from power details, pv data is %s", pv.ToJson())
+	}
+	if pv.EnergyToday != 8601 {
+		t.Errorf("Wrong energy from energy details, pv data is %s", pv.ToJson())
+	}
+}
+
+func Test_quota(t *testing.T) {
+	requests := 0
+	srv := newApi(t, &requests)
+	defer srv.Close()
+	BaseUrl = srv.URL
+	requestQuota = quota{requests: map[string]int{}}
+
+	initiateData := dataproviders.InitiateData{PlantKey: "test", Password: "KEY", PlantNo: "1234"}
+	var err error
+	for i := 0; i <= dailyBudget && err == nil; i++ {
+		err = updateOverview(srv.Client(), &initiateData, &dataproviders.PvData{})
+	}
+	if err == nil || !strings.Contains(err.Error(), "budget") {
+		t.Errorf("Expected the budget to be spent, got %v", err)
+	}
+	if requests != dailyBudget {
+		t.Errorf("Expected %d requests to the api, was %d", dailyBudget, requests)
+	}
+}
+
+func Test_bad_key(t *testing.T) {
+	requests := 0
+	srv := newApi(t, &requests)
+	defer srv.Close()
+	BaseUrl = srv.URL
+	requestQuota = quota{requests: map[string]int{}}
+
+	initiateData := dataproviders.InitiateData{PlantKey: "test", Password: "WRONG", PlantNo: "1234"}
+	err := updateOverview(srv.Client(), &initiateData, &dataproviders.PvData{})
+	if err == nil || strings.Contains(err.Error(), "WRONG") {
+		t.Errorf("Expected an error without the api key, got %v", err)
+	}
+}
@@ -17,12 +17,15 @@ import (
 )
 
 type sunnyDataProvider struct {
+	dataproviders.Lifecycle
 	InitiateData   dataproviders.InitiateData
-	latestErr      error
 	client         *http.Client
 	viewstate      string //Something that sma portal uses, must be posted to login
 	Plantname      string
-
+	term           dataproviders.TerminateCallback
+	pvStore        dataproviders.PvStore
+	statsStore     dataproviders.PlantStatsStore
+	historyStore   dataproviders.HistoryStore
 }
 
 type smaPacReply struct {
@@ -34,6 +37,8 @@ type smaPacReply struct {
 var log = logger.NewLogger(logger.DEBUG, "Dataprovider: SunnyPortal:")
 
 const MAX_ERRORS = 5
+
+const ProviderName = "sunnyportal"
 //const INACTIVE_TIMOUT = 300 //secs
 
 const startUrl = "http://www.sunnyportal.com/Templates/Start.aspx"
@@ -48,29 +53,56 @@ const keyDateFormat = "20060102"
 const smaCsvDateFormat = "1/2/06"
 const smaWebDateFormat = "1/2/2006"
 
+func init() {
+	dataproviders.Register(ProviderName,
+		func(initiateData dataproviders.InitiateData,
+			term dataproviders.TerminateCallback,
+			client *http.Client,
+			pvStore dataproviders.PvStore,
+			statsStore dataproviders.PlantStatsStore,
+			historyStore dataproviders.HistoryStore) (dataproviders.DataProvider, error) {
+			return NewDataProvider(initiateData, term, client, pvStore, statsStore, historyStore)
+		},
+		dataproviders.ConfigSchema{
+			{Field: "UserName", Required: true, Description: "Login on sunnyportal.com"},
+			{Field: "Password", Required: true, Description: "Password on sunnyportal.com"},
+			{Field: "PlantNo", Required: true, Description: "Index of the plant in the sunnyportal plant menu"},
+		})
+}
+
 func (sunny *sunnyDataProvider) Name() string {
-	return sunny.Plantname
+	return "SunnyPortal"
 }
 
 func NewDataProvider(initiateData dataproviders.InitiateData,
 	term dataproviders.TerminateCallback, client *http.Client,
 	pvStore dataproviders.PvStore,
-	statsStore dataproviders.PlantStatsStore) (sunny sunnyDataProvider, err error) {
+	statsStore dataproviders.PlantStatsStore,
+	historyStore dataproviders.HistoryStore) (sunny *sunnyDataProvider, err error) {
 
 	log.Debug("New dataprovider")
 
-	sunny = sunnyDataProvider{initiateData,
-		nil,
-		client,
-		"",
-		""}
-	
-	go initiate(&sunny, initiateData, term, pvStore, statsStore)
+	sunny = &sunnyDataProvider{InitiateData: initiateData,
+		client: client,
+		term: term,
+		pvStore: pvStore,
+		statsStore: statsStore,
+		historyStore: historyStore}
 	
 	return
 		
 }
 
+func (sunny *sunnyDataProvider) Capabilities() dataproviders.Capabilities {
+	return dataproviders.Capabilities{PowerAc: true, EnergyToday: true}
+}
+
+func (sunny *sunnyDataProvider) Start() error {
+	return sunny.Launch(func() {
+		initiate(sunny, sunny.InitiateData, sunny.term, sunny.pvStore, sunny.statsStore)
+	})
+}
+
 func initiate(sunny *sunnyDataProvider, 
               initiateData dataproviders.InitiateData, 
               term dataproviders.TerminateCallback, 
@@ -81,35 +113,41 @@ func initiate(sunny *sunnyDataProvider,
 	// And give us cookies and viewstate that we need when logging in
 	err := sunny.preLogin()
 	if err != nil {
+		sunny.SetError(err)
 		term()
 		return
 	}
 	err = sunny.login(initiateData.UserName, initiateData.Password)
 	if err != nil {
+		sunny.SetError(err)
 		term()
 		return
 	}
 
 	_, err = sunny.plantName()
 	if err != nil {
+		sunny.SetError(err)
 		term()
 		return
 	}
 
 	err = sunny.setPlantNo(initiateData.PlantNo)
 	if err != nil {
+		sunny.SetError(err)
 		term()
 		return
 	}
 	
 	sunny.Plantname, err = sunny.plantName()
 	if err != nil {
+		sunny.SetError(err)
 		term()
 		return
 	}
 	log.Infof("Plant %s is now online", sunny.Plantname)
 
-	go dataproviders.RunUpdates(
+	dataproviders.RunUpdates(
+		&sunny.Lifecycle,
 		&initiateData,
 		func(id *dataproviders.InitiateData, pv *dataproviders.PvData) error {
 			pac, err := updatePacData(sunny.client)
@@ -135,9 +173,10 @@ func initiate(sunny *sunnyDataProvider,
 		time.Minute*5,
 		time.Minute*30,
 		term,
-		MAX_ERRORS,
+		dataproviders.DefaultRetryPolicy(MAX_ERRORS),
 		statsStore,
-		pvStore)
+		pvStore,
+		sunny.historyStore)
 
 
 
@@ -178,7 +217,7 @@ func (c *sunnyDataProvider) login(username string, password string) error {
 	formData.Add("ctl00$ContentPlaceHolder1$Logincontrol1$txtUserName", username)
 	formData.Add("ctl00$ContentPlaceHolder1$Logincontrol1$txtPassword", password)
 	formData.Add("ctl00$ContentPlaceHolder1$Logincontrol1$LoginBtn", "Login")
-	log.Debugf("Posting to %s, with body: %s", loginUrl, formData)
+	log.Debugf("Posting login to %s", loginUrl)
 	resp, err := c.client.PostForm(loginUrl, formData)
 	if err != nil {
 		log.Fail(err.Error())
@@ -194,7 +233,7 @@ func (c *sunnyDataProvider) login(username string, password string) error {
 	} else {
 		b, _ := ioutil.ReadAll(resp.Body)
 		log.Failf("Login failed, http status codes was %s\n%s", resp.Status, b)
-		return fmt.Errorf("Login to portal failed. Wrong username and password")
+		return dataproviders.NewLoginError("Login to portal failed. Wrong username and password")
 	}
 	return nil
 }
@@ -260,7 +299,7 @@ func  (c *sunnyDataProvider) plantName() (name string, err error) {
 	return
 }
 
-func updatePacData(c *http.Client) (pac uint16, err error) {
+func updatePacData(c *http.Client) (pac dataproviders.Watt, err error) {
 	resp, err := c.Get(pacUrl)
 	if err != nil {
 		log.Fail(err.Error())
@@ -288,7 +327,7 @@ func updatePacData(c *http.Client) (pac uint16, err error) {
 		log.Fail(err.Error())
 		return
 	}
-	pac = uint16(pacint)
+	pac, err = dataproviders.ToWatt(float64(pacint))
 	return
 }
 
@@ -370,7 +409,7 @@ func updateDailyProduction(client *http.Client) (pvDaily dataproviders.PvDataDai
 	log.Debug("CSV received:")
 	// Jump over first line
 	_, _ = reader.ReadString('\n')
-	pvDaily = make(map[string]uint16)
+	pvDaily = make(dataproviders.PvDataDaily)
 	for {
 		line, err := reader.ReadString('\n')
 		if err != nil {
@@ -382,7 +421,11 @@ func updateDailyProduction(client *http.Client) (pvDaily dataproviders.PvDataDai
 		}
 		log.Tracef("Date %s, production %s", cols[0], cols[1])
 		prod, _ := strconv.ParseFloat(cols[1], 64)
-		pvDaily[parseSmaDateToKey(cols[0])] = uint16(prod * 1000)
+		energy, err := dataproviders.ToWattHour(prod * 1000)
+		if err != nil {
+			return nil, fmt.Errorf("Production of %s: %s", cols[0], err.Error())
+		}
+		pvDaily[parseSmaDateToKey(cols[0])] = energy
 	}
 
 	return
@@ -0,0 +1,423 @@
+package sunspec
+
+// Dataprovider for inverters speaking SunSpec over Modbus TCP.
+// The SunSpec model chain is discovered at the base address, and the
+// inverter model (101, 102 or 103) and the MPPT model (160) are read
+// on every update. SunSpec has no energy for today, so it is counted
+// from the energy total at the first update of the day.
+
+import (
+	"dataproviders"
+	"fmt"
+	"logger"
+	"math"
+	"modbus"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type dataProvider struct {
+	dataproviders.Lifecycle
+	InitiateData dataproviders.InitiateData
+	client       *http.Client
+	term         dataproviders.TerminateCallback
+	pvStore      dataproviders.PvStore
+	statsStore   dataproviders.PlantStatsStore
+	historyStore dataproviders.HistoryStore
+	reader       *reader
+}
+
+var log = logger.NewLogger(logger.DEBUG, "Dataprovider: SunSpec:")
+
+const MAX_ERRORS = 5
+
+const ProviderName = "sunspec"
+
+const timeout = 5 * time.Second
+
+// Base addresses tried when none is configured, in the order SunSpec recommends
+var defaultBases = []uint16{40000, 0, 50000}
+
+const defaultUnit = 1
+
+// "SunS" in the two registers at the base address
+const (
+	sunsHigh = 0x5375
+	sunsLow  = 0x6e53
+)
+
+const endModel = 0xffff
+
+// Largest number of models walked, in case the chain never ends
+const maxModels = 64
+
+func init() {
+	dataproviders.Register(ProviderName,
+		func(initiateData dataproviders.InitiateData,
+			term dataproviders.TerminateCallback,
+			client *http.Client,
+			pvStore dataproviders.PvStore,
+			statsStore dataproviders.PlantStatsStore,
+			historyStore dataproviders.HistoryStore) (dataproviders.DataProvider, error) {
+			return NewDataProvider(initiateData, term, client, pvStore, statsStore, historyStore)
+		},
+		dataproviders.ConfigSchema{
+			{Field: "Address", Required: true, Description: "Hostname or ip of the inverter, optionally with :port, default port 502"},
+			{Field: "Options.unit", Required: false, Description: "Modbus unit id, default 1"},
+			{Field: "Options.base", Required: false, Description: "Modbus address of the SunSpec header, default is to try 40000, 0 and 50000"},
+		})
+}
+
+func (d *dataProvider) Name() string {
+	return "SunSpec"
+}
+
+func NewDataProvider(initiateData dataproviders.InitiateData,
+	term dataproviders.TerminateCallback,
+	client *http.Client,
+	pvStore dataproviders.PvStore,
+	statsStore dataproviders.PlantStatsStore,
+	historyStore dataproviders.HistoryStore) (*dataProvider, error) {
+	log.Debug("New dataprovider")
+
+	reader, err := newReader(&initiateData)
+	if err != nil {
+		return nil, err
+	}
+	dp := dataProvider{InitiateData: initiateData,
+		client:       client,
+		term:         term,
+		pvStore:      pvStore,
+		statsStore:   statsStore,
+		historyStore: historyStore,
+		reader:       reader}
+
+	return &dp, nil
+}
+
+func (dp *dataProvider) Capabilities() dataproviders.Capabilities {
+	return dataproviders.Capabilities{PowerAc: true, EnergyToday: true,
+		EnergyTotal: true, VoltDc: true, AmpereAc: true,
+		Strings: true, Phases: true, Frequency: true, Temperature: true}
+}
+
+func (dp *dataProvider) Start() error {
+	reader := dp.reader
+	return dp.Launch(func() {
+		dataproviders.RunUpdates(
+			&dp.Lifecycle,
+			&dp.InitiateData,
+			func(initiateData *dataproviders.InitiateData, pv *dataproviders.PvData) error {
+				err := reader.updatePvData(initiateData, pv)
+				pv.LatestUpdate = nil
+				return err
+			},
+			func(initiateData *dataproviders.InitiateData, pv *dataproviders.PvData) error {
+				return nil
+			},
+			time.Second*10,
+			time.Minute*5,
+			time.Minute*30,
+			dp.term,
+			dataproviders.DefaultRetryPolicy(MAX_ERRORS),
+			dp.statsStore,
+			dp.pvStore,
+			dp.historyStore)
+	})
+}
+
+// Where a model is found in the register map
+type model struct {
+	id      uint16
+	address uint16
+	length  uint16
+}
+
+// Reads one device, and remembers where its models are
+type reader struct {
+	unit  byte
+	bases []uint16
+	// Found by discover, nil until then
+	inverter *model
+	mppt     *model
+	// Energy total in kWh at the start of day
+	day      string
+	dayStart float64
+}
+
+func newReader(initiateData *dataproviders.InitiateData) (*reader, error) {
+	r := &reader{unit: defaultUnit, bases: defaultBases}
+	if s := initiateData.Options["unit"]; s != "" {
+		unit, err := strconv.ParseUint(s, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("Bad modbus unit id %s", s)
+		}
+		r.unit = byte(unit)
+	}
+	if s := initiateData.Options["base"]; s != "" {
+		base, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("Bad modbus base address %s", s)
+		}
+		r.bases = []uint16{uint16(base)}
+	}
+	return r, nil
+}
+
+// Update PvData
+func (r *reader) updatePvData(initiateData *dataproviders.InitiateData, pv *dataproviders.PvData) error {
+	log.Debug("Fetching update ...")
+	c, err := modbus.Dial(initiateData.Address, r.unit, timeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if r.inverter == nil {
+		if err = r.discover(c); err != nil {
+			return err
+		}
+	}
+	err = r.readInverter(c, pv)
+	if err == nil && r.mppt != nil {
+		err = r.readMppt(c, pv)
+	}
+	if err != nil {
+		// The device may have been reconfigured, so discover again next time
+		r.inverter = nil
+		r.mppt = nil
+	}
+	return err
+}
+
+// Find the SunSpec header and walk the model chain
+func (r *reader) discover(c *modbus.Client) error {
+	for _, base := range r.bases {
+		header, err := c.ReadHoldingRegisters(base, 2)
+		if err != nil {
+			if _, ok := err.(modbus.Exception); ok {
+				continue
+			}
+			return err
+		}
+		if header[0] != sunsHigh || header[1] != sunsLow {
+			continue
+		}
+		log.Debugf("Found SunSpec header at %d", base)
+		address := base + 2
+		for i := 0; i < maxModels; i++ {
+			m, err := c.ReadHoldingRegisters(address, 2)
+			if err != nil {
+				return err
+			}
+			if m[0] == endModel {
+				break
+			}
+			found := &model{id: m[0], address: address + 2, length: m[1]}
+			log.Debugf("Found model %d at %d, length %d", found.id, found.address, found.length)
+			switch found.id {
+			case 101, 102, 103:
+				r.inverter = found
+			case 160:
+				r.mppt = found
+			}
+			address += 2 + m[1]
+		}
+		if r.inverter == nil {
+			return fmt.Errorf("Dataprovider sunspec fail. No inverter model found at base %d", base)
+		}
+		return nil
+	}
+	return fmt.Errorf("Dataprovider sunspec fail. No SunSpec header found at %v", r.bases)
+}
+
+// Read a whole model, in as many requests as needed
+func read(c *modbus.Client, m *model) ([]uint16, error) {
+	registers := make([]uint16, 0, m.length)
+	for offset := uint16(0); offset < m.length; {
+		count := m.length - offset
+		if count > modbus.MaxRegisters {
+			count = modbus.MaxRegisters
+		}
+		block, err := c.ReadHoldingRegisters(m.address+offset, count)
+		if err != nil {
+			return nil, err
+		}
+		registers = append(registers, block...)
+		offset += count
+	}
+	return registers, nil
+}
+
+// Offsets in the inverter models 101, 102 and 103
+const (
+	invA      = 0
+	invAphA   = 1
+	invA_SF   = 4
+	invPhVphA = 8
+	invV_SF   = 11
+	invW      = 12
+	invW_SF   = 13
+	invHz     = 14
+	invHz_SF  = 15
+	invWH     = 22
+	invWH_SF  = 24
+	invDCV    = 27
+	invDCVSF  = 28
+	invTmpCab = 31
+	invTmp_SF = 35
+	invSt     = 36
+	// Registers up to and including St
+	invLength = 37
+)
+
+// Operating states of the inverter
+var states = map[uint16]string{
+	1: "Off",
+	2: "Sleeping",
+	3: "Starting",
+	4: "MPPT",
+	5: "Throttled",
+	6: "Shutting down",
+	7: "Fault",
+	8: "Standby",
+}
+
+func (r *reader) readInverter(c *modbus.Client, pv *dataproviders.PvData) error {
+	if r.inverter.length < invLength {
+		return fmt.Errorf("Dataprovider sunspec fail. Inverter model %d is too short", r.inverter.id)
+	}
+	v, err := read(c, &model{r.inverter.id, r.inverter.address, invLength})
+	if err != nil {
+		return err
+	}
+
+	if w, ok := int16Value(v[invW], v[invW_SF]); ok && w > 0 {
+		if pv.PowerAc, err = dataproviders.ToWatt(w); err != nil {
+			return err
+		}
+	} else {
+		pv.PowerAc = 0
+	}
+	// Model 101 is single phase, 102 split phase and 103 three phase
+	phases := []dataproviders.PhaseData{}
+	for i := 0; i < int(r.inverter.id-100); i++ {
+		phase := dataproviders.PhaseData{}
+		if a, ok := uint16Value(v[invAphA+i], v[invA_SF]); ok {
+			phase.AmpereAc = float32(a)
+		}
+		if volt, ok := uint16Value(v[invPhVphA+i], v[invV_SF]); ok {
+			phase.VoltAc = float32(volt)
+		}
+		phases = append(phases, phase)
+	}
+	if len(phases) == 1 {
+		phases[0].PowerAc = pv.PowerAc
+	}
+	pv.SetPhases(phases)
+	if a, ok := uint16Value(v[invA], v[invA_SF]); ok {
+		pv.AmpereAc = float32(a)
+	} else {
+		pv.AmpereAc = 0
+	}
+	if volt, ok := uint16Value(v[invDCV], v[invDCVSF]); ok {
+		pv.VoltDc = float32(volt)
+	}
+	if hz, ok := uint16Value(v[invHz], v[invHz_SF]); ok {
+		pv.Frequency = float32(hz)
+	}
+	if tmp, ok := int16Value(v[invTmpCab], v[invTmp_SF]); ok {
+		pv.Temperature = float32(tmp)
+	}
+	pv.State = states[v[invSt]]
+
+	wh, ok := acc32Value(v[invWH], v[invWH+1], v[invWH_SF])
+	if !ok {
+		return fmt.Errorf("Dataprovider sunspec fail. Inverter has no energy total")
+	}
+	total := wh / 1000
+	day := time.Now().Format(dataproviders.KeyDateFormat)
+	if r.day != day {
+		r.day = day
+		r.dayStart = total
+		// Continue the count, if the provider was restarted during the day
+		if pv.LatestUpdate != nil && pv.LatestUpdate.Format(dataproviders.KeyDateFormat) == day &&
+			pv.EnergyTotal > 0 && float64(pv.EnergyTotal) <= total {
+			r.dayStart = float64(pv.EnergyTotal) - float64(pv.EnergyToday)/1000
+		}
+	}
+	pv.EnergyTotal = dataproviders.KiloWattHour(total)
+	pv.EnergyToday, err = dataproviders.ToWattHour(math.Max(0, (total-r.dayStart)*1000))
+	return err
+}
+
+// Offsets in the MPPT model 160
+const (
+	mpptDCA_SF  = 0
+	mpptDCV_SF  = 1
+	mpptDCW_SF  = 2
+	mpptN       = 6
+	mpptModules = 8
+	// Length of each module block, and the offsets in it
+	mpptModuleLength = 20
+	mpptModuleDCA    = 9
+	mpptModuleDCV    = 10
+	mpptModuleDCW    = 11
+)
+
+// Each MPPT module is a string, and the dc voltage is their average
+func (r *reader) readMppt(c *modbus.Client, pv *dataproviders.PvData) error {
+	v, err := read(c, r.mppt)
+	if err != nil {
+		return err
+	}
+	if len(v) < mpptModules {
+		return nil
+	}
+	n := int(v[mpptN])
+	strings := []dataproviders.StringData{}
+	for i := 0; i < n; i++ {
+		offset := mpptModules + i*mpptModuleLength
+		if offset+mpptModuleDCW >= len(v) {
+			break
+		}
+		volt, ok := uint16Value(v[offset+mpptModuleDCV], v[mpptDCV_SF])
+		if !ok {
+			continue
+		}
+		s := dataproviders.StringData{VoltDc: float32(volt)}
+		if a, ok := uint16Value(v[offset+mpptModuleDCA], v[mpptDCA_SF]); ok {
+			s.AmpereDc = float32(a)
+		}
+		if w, ok := uint16Value(v[offset+mpptModuleDCW], v[mpptDCW_SF]); ok {
+			if s.PowerDc, err = dataproviders.ToWatt(w); err != nil {
+				return err
+			}
+		}
+		strings = append(strings, s)
+	}
+	pv.SetStrings(strings)
+	return nil
+}
+
+// Scaled values. Not ok if the value or the scale factor is not implemented
+func uint16Value(v uint16, sf uint16) (float64, bool) {
+	return scaled(int64(v), v != 0xffff, sf)
+}
+
+func int16Value(v uint16, sf uint16) (float64, bool) {
+	return scaled(int64(int16(v)), v != 0x8000, sf)
+}
+
+func acc32Value(high uint16, low uint16, sf uint16) (float64, bool) {
+	v := int64(high)<<16 | int64(low)
+	return scaled(v, v != 0, sf)
+}
+
+func scaled(value int64, implemented bool, sf uint16) (float64, bool) {
+	if !implemented || sf == 0x8000 {
+		return 0, false
+	}
+	return float64(value) * math.Pow10(int(int16(sf))), true
+}
@@ -0,0 +1,141 @@
+package sunspec
+
+import (
+	"dataproviders"
+	"modbus/modbustest"
+	"testing"
+)
+
+/*
+To run test export GOPATH=/Users/jbr/github/local/solarcompare
+then
+go test -test.v dataproviders/sunspec
+*/
+
+// A register map with the common model, a three phase inverter
+// and an MPPT model with two modules, starting at base
+func sunspecRegisters(base uint16) map[uint16]uint16 {
+	registers := map[uint16]uint16{}
+	address := base
+	put := func(values ...uint16) {
+		for _, v := range values {
+			registers[address] = v
+			address++
+		}
+	}
+	put(sunsHigh, sunsLow)
+
+	// Common model, manufacturer and such is not used
+	put(1, 66)
+	put(make([]uint16, 66)...)
+
+	inverter := make([]uint16, 50)
+	inverter[invA] = 1069
+	inverter[invA_SF] = 0xfffe // -2
+	inverter[invAphA], inverter[invAphA+1], inverter[invAphA+2] = 356, 357, 356
+	inverter[invPhVphA], inverter[invPhVphA+1], inverter[invPhVphA+2] = 2310, 2325, 2301
+	inverter[invV_SF] = 0xffff // -1
+	inverter[invHz] = 5001
+	inverter[invHz_SF] = 0xfffe
+	inverter[invTmpCab] = 412
+	inverter[invTmp_SF] = 0xffff
+	inverter[invW] = 2451
+	inverter[invW_SF] = 0
+	inverter[invWH] = 12480311 >> 16
+	inverter[invWH+1] = 12480311 & 0xffff
+	inverter[invWH_SF] = 0
+	inverter[invDCV] = 0xffff // Not implemented, is in the MPPT model
+	inverter[invDCVSF] = 0xffff
+	inverter[invSt] = 4
+	put(103, 50)
+	put(inverter...)
+
+	mppt := make([]uint16, 48)
+	mppt[mpptDCV_SF] = 0xffff // -1
+	mppt[mpptN] = 2
+	mppt[mpptDCA_SF] = 0xfffe // -2
+	mppt[mpptModules+mpptModuleDCV] = 4000
+	mppt[mpptModules+mpptModuleDCA] = 312
+	mppt[mpptModules+mpptModuleDCW] = 1248
+	mppt[mpptModules+mpptModuleLength+mpptModuleDCV] = 4022
+	mppt[mpptModules+mpptModuleLength+mpptModuleDCA] = 309
+	mppt[mpptModules+mpptModuleLength+mpptModuleDCW] = 1243
+	put(160, 48)
+	put(mppt...)
+
+	put(endModel, 0)
+	return registers
+}
+
+func Test_update(t *testing.T) {
+	srv := modbustest.NewServer(sunspecRegisters(40000))
+	defer srv.Close()
+
+	initiateData := dataproviders.InitiateData{PlantKey: "test", Address: srv.Addr}
+	r, err := newReader(&initiateData)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pv := dataproviders.PvData{}
+	if err = r.updatePvData(&initiateData, &pv); err != nil {
+		t.Fatal(err.Error())
+	}
+	if pv.PowerAc != 2451 || pv.AmpereAc != 10.69 || pv.VoltDc != 401.1 || pv.State != "MPPT" {
+		t.Errorf("Wrong inverter values, pv data is %s", pv.ToJson())
+	}
+	if len(pv.Phases) != 3 || pv.Phases[1].VoltAc != 232.5 || pv.Phases[1].AmpereAc != 3.57 {
+		t.Errorf("Wrong phases, pv data is %s", pv.ToJson())
+	}
+	if len(pv.Strings) != 2 || pv.Strings[1].VoltDc != 402.2 || pv.Strings[1].AmpereDc != 3.09 ||
+		pv.Strings[1].PowerDc != 1243 {
+		t.Errorf("Wrong strings, pv data is %s", pv.ToJson())
+	}
+	if pv.Frequency != 50.01 || pv.Temperature != 41.2 {
+		t.Errorf("Wrong frequency or temperature, pv data is %s", pv.ToJson())
+	}
+	if pv.EnergyTotal != 12480.311 || pv.EnergyToday != 0 {
+		t.Errorf("Wrong energy, pv data is %s", pv.ToJson())
+	}
+
+	// Energy today is counted from the first update
+	total := uint32(12480311 + 1500)
+	srv.Set(40000+2+2+66+2+invWH, uint16(total>>16))
+	srv.Set(40000+2+2+66+2+invWH+1, uint16(total))
+	if err = r.updatePvData(&initiateData, &pv); err != nil {
+		t.Fatal(err.Error())
+	}
+	if pv.EnergyToday != 1500 {
+		t.Errorf("Expected 1500 Wh today, pv data is %s", pv.ToJson())
+	}
+}
+
+func Test_discover_base(t *testing.T) {
+	srv := modbustest.NewServer(sunspecRegisters(0))
+	defer srv.Close()
+
+	// 40000 is tried first, and gives an exception
+	initiateData := dataproviders.InitiateData{PlantKey: "test", Address: srv.Addr}
+	r, _ := newReader(&initiateData)
+	pv := dataproviders.PvData{}
+	if err := r.updatePvData(&initiateData, &pv); err != nil {
+		t.Fatal(err.Error())
+	}
+	if r.inverter == nil || r.inverter.address != 2+2+66+2 || r.mppt == nil {
+		t.Errorf("Models not discovered at base 0, %v %v", r.inverter, r.mppt)
+	}
+
+	// A configured base is the only one tried
+	initiateData.Options = map[string]string{"base": "50000", "unit": "126"}
+	r, err := newReader(&initiateData)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = r.updatePvData(&initiateData, &pv); err == nil {
+		t.Error("Expected no SunSpec at base 50000")
+	}
+
+	initiateData.Options = map[string]string{"unit": "300"}
+	if _, err = newReader(&initiateData); err == nil {
+		t.Error("Expected bad unit id to fail")
+	}
+}
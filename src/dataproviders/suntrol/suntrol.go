@@ -11,12 +11,16 @@ import (
 )
 
 type dataProvider struct {
+	dataproviders.Lifecycle
 	InitiateData   dataproviders.InitiateData
 //	latestReqCh    chan chan dataproviders.PvData
 //	latestUpdateCh chan dataproviders.PvData
 //	terminateCh    chan int
-	latestErr      error
 	client         *http.Client
+	term           dataproviders.TerminateCallback
+	pvStore        dataproviders.PvStore
+	statsStore     dataproviders.PlantStatsStore
+	historyStore   dataproviders.HistoryStore
 }
 
 type dataPart struct {
@@ -35,9 +39,26 @@ const MonthUrl = "http://suntrol-portal.com/en/plant/graph-json/month/p/1/pid/%s
 
 var log = logger.NewLogger(logger.INFO, "Dataprovider: Suntrol:")
 
+const ProviderName = "suntrol"
+
 const MAX_ERRORS = 10
 const INACTIVE_TIMOUT = 30 //secs
 
+func init() {
+	dataproviders.Register(ProviderName,
+		func(initiateData dataproviders.InitiateData,
+			term dataproviders.TerminateCallback,
+			client *http.Client,
+			pvStore dataproviders.PvStore,
+			statsStore dataproviders.PlantStatsStore,
+			historyStore dataproviders.HistoryStore) (dataproviders.DataProvider, error) {
+			return NewDataProvider(initiateData, term, client, pvStore, statsStore, historyStore), nil
+		},
+		dataproviders.ConfigSchema{
+			{Field: "PlantNo", Required: true, Description: "Plant id (pid) on suntrol-portal.com"},
+		})
+}
+
 func (dp *dataProvider) Name() string {
 	return "Suntrol"
 }
@@ -46,36 +67,53 @@ func NewDataProvider(initiateData dataproviders.InitiateData,
 	term dataproviders.TerminateCallback,
 	client *http.Client,
 	pvStore dataproviders.PvStore,
-	statsStore dataproviders.PlantStatsStore) dataProvider {
+	statsStore dataproviders.PlantStatsStore,
+	historyStore dataproviders.HistoryStore) *dataProvider {
 	log.Debug("New dataprovider")
 
-	dp := dataProvider{initiateData,
+	dp := dataProvider{InitiateData: initiateData,
 //		make(chan chan dataproviders.PvData),
 //		make(chan dataproviders.PvData),
 //		make(chan int),
-		nil,
-		client}
-	go dataproviders.RunUpdates(
-		&initiateData,
-		func(initiateData *dataproviders.InitiateData, pv *dataproviders.PvData) error {
-			err := updatePvData(client, initiateData, pv)
-			pv.LatestUpdate = nil
-			return err
-		},
-		func(initiateData *dataproviders.InitiateData, pv *dataproviders.PvData) error {
-			return nil
-		},
-		time.Minute*1,
-		time.Minute*5,
-		time.Minute*30,
-		term,
-		MAX_ERRORS,
-		statsStore,
-		pvStore)
+		client: client,
+		term: term,
+		pvStore: pvStore,
+		statsStore: statsStore,
+		historyStore: historyStore}
+
+	return &dp
+}
+
+func (dp *dataProvider) Capabilities() dataproviders.Capabilities {
+	return dataproviders.Capabilities{EnergyToday: true}
+}
+
+func (dp *dataProvider) Start() error {
+	client := dp.client
+	return dp.Launch(func() {
+		dataproviders.RunUpdates(
+			&dp.Lifecycle,
+			&dp.InitiateData,
+			func(initiateData *dataproviders.InitiateData, pv *dataproviders.PvData) error {
+				err := updatePvData(client, initiateData, pv)
+				pv.LatestUpdate = nil
+				return err
+			},
+			func(initiateData *dataproviders.InitiateData, pv *dataproviders.PvData) error {
+				return nil
+			},
+			time.Minute*1,
+			time.Minute*5,
+			time.Minute*30,
+			dp.term,
+			dataproviders.DefaultRetryPolicy(MAX_ERRORS),
+			dp.statsStore,
+			dp.pvStore,
+			dp.historyStore)
+	})
 //	go dataproviders.LatestPvData(dp.latestReqCh, dp.latestUpdateCh, dp.terminateCh,
 //		pvDataUpdatedEvent, initiateData.PlantKey)
 
-	return dp
 }
 
 // Update PvData
@@ -108,7 +146,10 @@ func updatePvData(client *http.Client,
 
 	log.Tracef("Unmashaled charData is %s", chartData)
 
-	pv.EnergyToday = uint16(chartData.DataPart[time.Now().Day()-1].Value * 1000)
+	pv.EnergyToday, err = dataproviders.ToWattHour(float64(chartData.DataPart[time.Now().Day()-1].Value) * 1000)
+	if err != nil {
+		return err
+	}
 
 	log.Tracef("pv is now %s", pv)
 
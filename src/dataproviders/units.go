@@ -0,0 +1,115 @@
+package dataproviders
+
+// Power and energy in PvData and PlantStats have explicit units, wide
+// enough for any plant. The first version of the schema kept them in
+// uint16, which silently wrapped around above 65.5 kW and 65.5 kWh a day.
+// Providers convert the values they read with ToWatt and ToWattHour,
+// that report a value out of range instead of wrapping it.
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// The version of PvData and PlantStats as json, always written as the
+// current version. Json without a SchemaVersion is version 1, with the
+// same fields in narrower types, and is read as is.
+const SchemaVersion = 2
+
+type Watt uint32
+
+type WattHour uint32
+
+type KiloWattHour float64
+
+// A value read from a plant that does not fit its unit
+type OverflowError struct {
+	Value float64
+	Unit  string
+}
+
+func (e *OverflowError) Error() string {
+	return fmt.Sprintf("Value %g %s is out of range", e.Value, e.Unit)
+}
+
+// The value in W, truncated like a plain conversion.
+// Negative values, NaN and values above 4.29 GW are an OverflowError.
+func ToWatt(f float64) (Watt, error) {
+	u, err := toUint32(f, "W")
+	return Watt(u), err
+}
+
+// The value in Wh, see ToWatt
+func ToWattHour(f float64) (WattHour, error) {
+	u, err := toUint32(f, "Wh")
+	return WattHour(u), err
+}
+
+func toUint32(f float64, unit string) (uint32, error) {
+	t := math.Trunc(f)
+	if math.IsNaN(f) || t < 0 || t > math.MaxUint32 {
+		return 0, &OverflowError{Value: f, Unit: unit}
+	}
+	return uint32(t), nil
+}
+
+// Json of a newer version than this build knows
+type VersionError struct {
+	Version int
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("Schema version %d is newer than the supported version %d", e.Version, SchemaVersion)
+}
+
+func checkVersion(version int) error {
+	if version > SchemaVersion {
+		return &VersionError{Version: version}
+	}
+	return nil
+}
+
+func (data PvData) MarshalJSON() ([]byte, error) {
+	type plain PvData
+	p := plain(data)
+	p.SchemaVersion = SchemaVersion
+	return json.Marshal(p)
+}
+
+// SchemaVersion is left as read, so it tells if the json was migrated
+func (data *PvData) UnmarshalJSON(b []byte) error {
+	type plain PvData
+	p := plain{}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	if err := checkVersion(p.SchemaVersion); err != nil {
+		return err
+	}
+	*data = PvData(p)
+	return nil
+}
+
+func (stats PlantStats) MarshalJSON() ([]byte, error) {
+	type plain PlantStats
+	p := plain(stats)
+	p.SchemaVersion = SchemaVersion
+	return json.Marshal(p)
+}
+
+// Stats written by the first version, eg. the stats files and the
+// datastore entries, are read with SchemaVersion 0. The stores write
+// them back as the current version on the next SaveStats.
+func (stats *PlantStats) UnmarshalJSON(b []byte) error {
+	type plain PlantStats
+	p := plain{}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	if err := checkVersion(p.SchemaVersion); err != nil {
+		return err
+	}
+	*stats = PlantStats(p)
+	return nil
+}
@@ -0,0 +1,386 @@
+package webconnect
+
+// Dataprovider for SMA inverters on the LAN, read through the
+// Webconnect JSON-RPC of the inverter web interface.
+// A session is kept between updates, as the inverter only allows
+// a few at a time, and it is logged out when the provider terminates.
+
+import (
+	"bytes"
+	"dataproviders"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"logger"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type dataProvider struct {
+	dataproviders.Lifecycle
+	InitiateData dataproviders.InitiateData
+	client       *http.Client
+	term         dataproviders.TerminateCallback
+	pvStore      dataproviders.PvStore
+	statsStore   dataproviders.PlantStatsStore
+	historyStore dataproviders.HistoryStore
+}
+
+var log = logger.NewLogger(logger.DEBUG, "Dataprovider: SMA Webconnect:")
+
+const MAX_ERRORS = 5
+
+const ProviderName = "webconnect"
+
+const urlTemplate = "https://%s%s"
+
+const (
+	loginUrl     = "/dyn/login.json"
+	getValuesUrl = "/dyn/getValues.json"
+	logoutUrl    = "/dyn/logout.json"
+)
+
+// The user group logged in as, if no UserName is given
+const defaultRight = "usr"
+
+// Value keys of the inverter
+const (
+	// GridMs.TotW, W
+	keyPowerAc = "6100_40263F00"
+	// Metering.TotWhOut, Wh
+	keyEnergyTotal = "6400_00260100"
+	// Metering.DyWhOut, Wh
+	keyEnergyToday = "6400_00262200"
+	// DcMs.Vol, DcMs.Amp and DcMs.Watt, one per string, 1/100 V, mA and W
+	keyVoltDc   = "6380_40451F00"
+	keyAmpereDc = "6380_40452100"
+	keyPowerDc  = "6380_40251E00"
+	// GridMs.A.phsA, .phsB and .phsC, mA
+	keyAmpereAcA = "6100_40465300"
+	keyAmpereAcB = "6100_40465400"
+	keyAmpereAcC = "6100_40465500"
+	// GridMs.PhV.phsA, .phsB and .phsC, 1/100 V
+	keyVoltAcA = "6100_00464800"
+	keyVoltAcB = "6100_00464900"
+	keyVoltAcC = "6100_00464A00"
+	// GridMs.W.phsA, .phsB and .phsC, W
+	keyPowerAcA = "6100_40464000"
+	keyPowerAcB = "6100_40464100"
+	keyPowerAcC = "6100_40464200"
+	// GridMs.Hz, 1/100 Hz
+	keyFrequency = "6100_00465700"
+)
+
+// Keys of the voltage, current and power of each phase
+var phaseKeys = [][3]string{
+	{keyVoltAcA, keyAmpereAcA, keyPowerAcA},
+	{keyVoltAcB, keyAmpereAcB, keyPowerAcB},
+	{keyVoltAcC, keyAmpereAcC, keyPowerAcC},
+}
+
+var keys = []string{keyPowerAc, keyEnergyTotal, keyEnergyToday,
+	keyVoltDc, keyAmpereDc, keyPowerDc,
+	keyAmpereAcA, keyAmpereAcB, keyAmpereAcC,
+	keyVoltAcA, keyVoltAcB, keyVoltAcC,
+	keyPowerAcA, keyPowerAcB, keyPowerAcC,
+	keyFrequency}
+
+// Webconnect error codes
+const (
+	errCodeSession  = 401
+	errCodeSessions = 503
+)
+
+var errSessionExpired = errors.New("Dataprovider webconnect fail. Session expired")
+
+func init() {
+	dataproviders.Register(ProviderName,
+		func(initiateData dataproviders.InitiateData,
+			term dataproviders.TerminateCallback,
+			client *http.Client,
+			pvStore dataproviders.PvStore,
+			statsStore dataproviders.PlantStatsStore,
+			historyStore dataproviders.HistoryStore) (dataproviders.DataProvider, error) {
+			return NewDataProvider(initiateData, term, client, pvStore, statsStore, historyStore), nil
+		},
+		dataproviders.ConfigSchema{
+			{Field: "Address", Required: true, Description: "Hostname or ip of the inverter"},
+			{Field: "Password", Required: true, Description: "Password of the inverter web interface"},
+			{Field: "UserName", Required: false, Description: "User group, usr or istl, default usr"},
+		})
+}
+
+func (d *dataProvider) Name() string {
+	return "SMA Webconnect"
+}
+
+func NewDataProvider(initiateData dataproviders.InitiateData,
+	term dataproviders.TerminateCallback,
+	client *http.Client,
+	pvStore dataproviders.PvStore,
+	statsStore dataproviders.PlantStatsStore,
+	historyStore dataproviders.HistoryStore) *dataProvider {
+	log.Debug("New dataprovider")
+
+	dp := dataProvider{InitiateData: initiateData,
+		client:       client,
+		term:         term,
+		pvStore:      pvStore,
+		statsStore:   statsStore,
+		historyStore: historyStore}
+
+	return &dp
+}
+
+func (dp *dataProvider) Capabilities() dataproviders.Capabilities {
+	return dataproviders.Capabilities{PowerAc: true, EnergyToday: true,
+		EnergyTotal: true, VoltDc: true, AmpereAc: true,
+		Strings: true, Phases: true, Frequency: true}
+}
+
+func (dp *dataProvider) Start() error {
+	s := &session{client: dp.client}
+	return dp.Launch(func() {
+		defer s.logout(&dp.InitiateData)
+		dataproviders.RunUpdates(
+			&dp.Lifecycle,
+			&dp.InitiateData,
+			func(initiateData *dataproviders.InitiateData, pv *dataproviders.PvData) error {
+				err := s.updatePvData(initiateData, pv)
+				pv.LatestUpdate = nil
+				return err
+			},
+			func(initiateData *dataproviders.InitiateData, pv *dataproviders.PvData) error {
+				return nil
+			},
+			time.Second*10,
+			time.Minute*5,
+			time.Minute*30,
+			dp.term,
+			dataproviders.DefaultRetryPolicy(MAX_ERRORS),
+			dp.statsStore,
+			dp.pvStore,
+			dp.historyStore)
+	})
+}
+
+// A login session on the inverter
+type session struct {
+	client *http.Client
+	sid    string
+}
+
+// Update PvData, logging in if there is no session, or it has expired
+func (s *session) updatePvData(initiateData *dataproviders.InitiateData, pv *dataproviders.PvData) error {
+	log.Debug("Fetching update ...")
+	if s.sid == "" {
+		if err := s.login(initiateData); err != nil {
+			return err
+		}
+	}
+	values, err := s.getValues(initiateData)
+	if err == errSessionExpired {
+		log.Debug("Session expired, logging in again")
+		if err = s.login(initiateData); err != nil {
+			return err
+		}
+		values, err = s.getValues(initiateData)
+	}
+	if err != nil {
+		return err
+	}
+
+	total, ok := values.first(keyEnergyTotal)
+	if !ok {
+		return fmt.Errorf("Dataprovider webconnect fail. No energy total in reply from inverter")
+	}
+	pv.EnergyTotal = dataproviders.KiloWattHour(total / 1000)
+	today, _ := values.first(keyEnergyToday)
+	if pv.EnergyToday, err = dataproviders.ToWattHour(today); err != nil {
+		return err
+	}
+	// Power and current are null while the inverter sleeps
+	power, _ := values.first(keyPowerAc)
+	if pv.PowerAc, err = dataproviders.ToWatt(power); err != nil {
+		return err
+	}
+
+	strings := []dataproviders.StringData{}
+	for i := range values[keyVoltDc] {
+		volt, ok := values.at(keyVoltDc, i)
+		if !ok {
+			continue
+		}
+		ampere, _ := values.at(keyAmpereDc, i)
+		power, _ := values.at(keyPowerDc, i)
+		watt, err := dataproviders.ToWatt(power)
+		if err != nil {
+			return err
+		}
+		strings = append(strings, dataproviders.StringData{VoltDc: float32(volt / 100),
+			AmpereDc: float32(ampere / 1000),
+			PowerDc:  watt})
+	}
+	pv.VoltDc = 0
+	pv.SetStrings(strings)
+
+	phases := []dataproviders.PhaseData{}
+	for _, k := range phaseKeys {
+		volt, vok := values.first(k[0])
+		ampere, aok := values.first(k[1])
+		power, pok := values.first(k[2])
+		if !vok && !aok && !pok {
+			continue
+		}
+		watt, err := dataproviders.ToWatt(power)
+		if err != nil {
+			return err
+		}
+		phases = append(phases, dataproviders.PhaseData{VoltAc: float32(volt / 100),
+			AmpereAc: float32(ampere / 1000),
+			PowerAc:  watt})
+	}
+	pv.AmpereAc = 0
+	pv.SetPhases(phases)
+
+	frequency, _ := values.first(keyFrequency)
+	pv.Frequency = float32(frequency / 100)
+	return nil
+}
+
+type reply struct {
+	Err    int             `json:"err"`
+	Result json.RawMessage `json:"result"`
+}
+
+func (s *session) post(initiateData *dataproviders.InitiateData, path string, body interface{}) (*reply, error) {
+	u := fmt.Sprintf(urlTemplate, initiateData.Address, path)
+	if s.sid != "" {
+		u += "?sid=" + url.QueryEscape(s.sid)
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	log.Tracef("Posting to %s", fmt.Sprintf(urlTemplate, initiateData.Address, path))
+	resp, err := s.client.Post(u, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = fmt.Errorf("Dataprovider webconnect fail. Received http status %d from inverter", resp.StatusCode)
+		log.Infof("%s", err.Error())
+		return nil, err
+	}
+	b, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	log.Tracef("Received %s", b)
+	r := reply{}
+	if err = json.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("Dataprovider webconnect fail. Could not parse reply from inverter: %s", err.Error())
+	}
+	return &r, nil
+}
+
+func (s *session) login(initiateData *dataproviders.InitiateData) error {
+	s.sid = ""
+	right := initiateData.UserName
+	if right == "" {
+		right = defaultRight
+	}
+	r, err := s.post(initiateData, loginUrl, map[string]string{"right": right, "pass": initiateData.Password})
+	if err != nil {
+		return err
+	}
+	switch r.Err {
+	case 0:
+	case errCodeSession:
+		return dataproviders.NewLoginError("Dataprovider webconnect fail. Login was rejected, wrong password?")
+	case errCodeSessions:
+		return fmt.Errorf("Dataprovider webconnect fail. Inverter has no free sessions")
+	default:
+		return fmt.Errorf("Dataprovider webconnect fail. Login failed with error %d", r.Err)
+	}
+	result := struct{ Sid string }{}
+	if err = json.Unmarshal(r.Result, &result); err != nil || result.Sid == "" {
+		return fmt.Errorf("Dataprovider webconnect fail. No session in login reply")
+	}
+	log.Debug("Login success!")
+	s.sid = result.Sid
+	return nil
+}
+
+func (s *session) logout(initiateData *dataproviders.InitiateData) {
+	if s.sid == "" {
+		return
+	}
+	if _, err := s.post(initiateData, logoutUrl, struct{}{}); err != nil {
+		log.Infof("Logout failed: %s", err.Error())
+	}
+	s.sid = ""
+}
+
+// The values of each key, a key can have more than one, eg. one per string.
+// Values that are null are kept as NaN, so the instances stay in order.
+type values map[string][]float64
+
+// The first value of the key that is not null
+func (v values) first(key string) (float64, bool) {
+	for _, f := range v[key] {
+		if !math.IsNaN(f) {
+			return f, true
+		}
+	}
+	return 0, false
+}
+
+// The value of instance i of the key, not ok if null or missing
+func (v values) at(key string, i int) (float64, bool) {
+	if i >= len(v[key]) || math.IsNaN(v[key][i]) {
+		return 0, false
+	}
+	return v[key][i], true
+}
+
+func (s *session) getValues(initiateData *dataproviders.InitiateData) (values, error) {
+	r, err := s.post(initiateData, getValuesUrl, map[string]interface{}{"destDev": []string{}, "keys": keys})
+	if err != nil {
+		return nil, err
+	}
+	if r.Err == errCodeSession {
+		return nil, errSessionExpired
+	}
+	if r.Err != 0 {
+		return nil, fmt.Errorf("Dataprovider webconnect fail. Reading values failed with error %d", r.Err)
+	}
+	// The result is keyed by device, then by value key, then by instance
+	result := map[string]map[string]map[string][]struct {
+		Val *float64 `json:"val"`
+	}{}
+	if err = json.Unmarshal(r.Result, &result); err != nil {
+		return nil, fmt.Errorf("Dataprovider webconnect fail. Could not parse values: %s", err.Error())
+	}
+	v := values{}
+	for _, device := range result {
+		for key, instances := range device {
+			for _, instance := range instances {
+				for _, val := range instance {
+					if val.Val != nil {
+						v[key] = append(v[key], *val.Val)
+					} else {
+						v[key] = append(v[key], math.NaN())
+					}
+				}
+			}
+		}
+		// Only one device is expected on a Webconnect interface
+		break
+	}
+	return v, nil
+}
@@ -0,0 +1,128 @@
+package webconnect
+
+import (
+	"dataproviders"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+/*
+To run test export GOPATH=/Users/jbr/github/local/solarcompare
+then
+go test -test.v dataproviders/webconnect
+*/
+
+const valuesReply = `{"result":{"0156-76BC1234":{
+	"6100_40263F00":{"1":[{"val":2451}]},
+	"6400_00260100":{"1":[{"val":12480311}]},
+	"6400_00262200":{"1":[{"val":8532}]},
+	"6380_40451F00":{"1":[{"val":40000},{"val":40220}]},
+	"6380_40452100":{"1":[{"val":null},{"val":3090}]},
+	"6380_40251E00":{"1":[{"val":1248},{"val":1243}]},
+	"6100_00464800":{"1":[{"val":23100}]},
+	"6100_00464900":{"1":[{"val":23250}]},
+	"6100_40464000":{"1":[{"val":1220}]},
+	"6100_00465700":{"1":[{"val":5001}]},
+	"6100_40465300":{"1":[{"val":3561}]},
+	"6100_40465400":{"1":[{"val":3570}]},
+	"6100_40465500":{"1":[{"val":null}]}}}}`
+
+// A stand-in for the web interface of an SMA inverter
+type inverter struct {
+	sid     string
+	logins  int
+	logouts int
+}
+
+func (i *inverter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body := map[string]interface{}{}
+	json.NewDecoder(r.Body).Decode(&body)
+	switch r.URL.Path {
+	case "/dyn/login.json":
+		if body["right"] != "usr" || body["pass"] != "secret" {
+			fmt.Fprint(w, `{"err":401}`)
+			return
+		}
+		i.logins++
+		i.sid = fmt.Sprintf("sid%d", i.logins)
+		fmt.Fprintf(w, `{"result":{"sid":"%s"}}`, i.sid)
+	case "/dyn/getValues.json":
+		if i.sid == "" || r.URL.Query().Get("sid") != i.sid {
+			fmt.Fprint(w, `{"err":401}`)
+			return
+		}
+		fmt.Fprint(w, valuesReply)
+	case "/dyn/logout.json":
+		if r.URL.Query().Get("sid") == i.sid {
+			i.logouts++
+			i.sid = ""
+		}
+		fmt.Fprint(w, `{"result":{"isLogin":false}}`)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func Test_update(t *testing.T) {
+	inv := &inverter{}
+	srv := httptest.NewTLSServer(inv)
+	defer srv.Close()
+	initiateData := dataproviders.InitiateData{PlantKey: "test",
+		Address: strings.TrimPrefix(srv.URL, "https://"), Password: "secret"}
+
+	s := &session{client: srv.Client()}
+	pv := dataproviders.PvData{}
+	if err := s.updatePvData(&initiateData, &pv); err != nil {
+		t.Fatal(err.Error())
+	}
+	if pv.PowerAc != 2451 || pv.EnergyToday != 8532 || pv.EnergyTotal != 12480.311 {
+		t.Errorf("Wrong power or energy, pv data is %s", pv.ToJson())
+	}
+	if pv.VoltDc != 401.1 || pv.AmpereAc != 7.131 {
+		t.Errorf("Wrong volt or ampere, pv data is %s", pv.ToJson())
+	}
+	if len(pv.Strings) != 2 || pv.Strings[0].AmpereDc != 0 || pv.Strings[1].AmpereDc != 3.09 ||
+		pv.Strings[1].PowerDc != 1243 {
+		t.Errorf("Wrong strings, pv data is %s", pv.ToJson())
+	}
+	if len(pv.Phases) != 2 || pv.Phases[0].PowerAc != 1220 || pv.Phases[1].VoltAc != 232.5 ||
+		pv.Phases[1].AmpereAc != 3.57 || pv.Frequency != 50.01 {
+		t.Errorf("Wrong phases or frequency, pv data is %s", pv.ToJson())
+	}
+
+	// The session is kept
+	s.updatePvData(&initiateData, &pv)
+	if inv.logins != 1 {
+		t.Errorf("Expected one login, was %d", inv.logins)
+	}
+	// and renewed when it expires
+	inv.sid = "expired"
+	if err := s.updatePvData(&initiateData, &pv); err != nil {
+		t.Fatal(err.Error())
+	}
+	if inv.logins != 2 {
+		t.Errorf("Expected a new login, was %d", inv.logins)
+	}
+
+	s.logout(&initiateData)
+	if inv.logouts != 1 || s.sid != "" {
+		t.Errorf("Expected logout, was %d", inv.logouts)
+	}
+}
+
+func Test_wrong_password(t *testing.T) {
+	srv := httptest.NewTLSServer(&inverter{})
+	defer srv.Close()
+	initiateData := dataproviders.InitiateData{PlantKey: "test",
+		Address: strings.TrimPrefix(srv.URL, "https://"), Password: "wrong"}
+
+	s := &session{client: srv.Client()}
+	err := s.updatePvData(&initiateData, &dataproviders.PvData{})
+	if err == nil || !strings.Contains(err.Error(), "wrong password") {
+		t.Errorf("Expected login to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,223 @@
+// Package mqttexport publishes every pvdata update to an MQTT broker.
+// Each plant gets the topics
+//
+//	{prefix}/{plantkey}/state with the pvdata as json
+//	{prefix}/{plantkey}/{field} with each value, eg. PowerAc
+//
+// all retained, and {prefix}/status is online while connected.
+// Home Assistant discovery messages are published for each plant,
+// the first time it is updated on a connection.
+package mqttexport
+
+import (
+	"dataproviders"
+	"encoding/json"
+	"fmt"
+	"logger"
+	"mqtt"
+	"plantdata"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var log = logger.NewLogger(logger.INFO, "Exporter: MQTT:")
+
+const DefaultPrefix = "solarcompare"
+
+const DefaultDiscoveryPrefix = "homeassistant"
+
+// How long to wait before connecting again, after the connection was lost
+var reconnectTime = 30 * time.Second
+
+type PlantGetter interface {
+	PlantData(plantkey string) *plantdata.PlantData
+}
+
+type Exporter struct {
+	address string
+	options mqtt.Options
+	prefix  string
+	// Home Assistant discovery is disabled if empty
+	discoveryPrefix string
+	plants          PlantGetter
+}
+
+// A sensor for a field of PvData
+type sensor struct {
+	field       string
+	name        string
+	unit        string
+	deviceClass string
+	stateClass  string
+	value       func(pv *dataproviders.PvData) float64
+}
+
+var sensors = []sensor{
+	{"PowerAc", "Power", "W", "power", "measurement",
+		func(pv *dataproviders.PvData) float64 { return float64(pv.PowerAc) }},
+	{"EnergyToday", "Energy today", "Wh", "energy", "total_increasing",
+		func(pv *dataproviders.PvData) float64 { return float64(pv.EnergyToday) }},
+	{"EnergyTotal", "Energy total", "kWh", "energy", "total_increasing",
+		func(pv *dataproviders.PvData) float64 { return float64(pv.EnergyTotal) }},
+	{"VoltDc", "DC voltage", "V", "voltage", "measurement",
+		func(pv *dataproviders.PvData) float64 { return float64(pv.VoltDc) }},
+	{"AmpereAc", "AC current", "A", "current", "measurement",
+		func(pv *dataproviders.PvData) float64 { return float64(pv.AmpereAc) }},
+}
+
+// New exporter to the broker at address.
+// The will of options is set to mark the exporter offline.
+func NewExporter(address string, options mqtt.Options, prefix string, discoveryPrefix string,
+	plants PlantGetter) *Exporter {
+	options.Will = &mqtt.Message{Topic: prefix + "/status", Payload: []byte("offline"), Retain: true}
+	return &Exporter{address: address,
+		options:         options,
+		prefix:          prefix,
+		discoveryPrefix: discoveryPrefix,
+		plants:          plants}
+}
+
+// Publish the updates until stop is closed. Reconnects when the connection is lost.
+// Updates received while not connected are dropped.
+func (e *Exporter) Run(updates *dataproviders.Subscription, stop <-chan struct{}) {
+	defer updates.Close()
+	for {
+		c, err := mqtt.Dial(e.address, e.options)
+		if err == nil {
+			log.Infof("Connected to %s", e.address)
+			err = e.publish(c, updates, stop)
+			c.Close()
+		}
+		if err == nil {
+			return
+		}
+		log.Failf("Publishing to %s failed: %s", e.address, err.Error())
+		// Drain updates while waiting, so the subscription does not fill up
+		wait := time.After(reconnectTime)
+	WAIT:
+		for {
+			select {
+			case _, ok := <-updates.C:
+				if !ok {
+					return
+				}
+			case <-wait:
+				break WAIT
+			case <-stop:
+				return
+			}
+		}
+	}
+}
+
+func (e *Exporter) publish(c *mqtt.Client, updates *dataproviders.Subscription, stop <-chan struct{}) error {
+	if err := c.Publish(e.prefix+"/status", []byte("online"), true); err != nil {
+		return err
+	}
+	discovered := map[string]bool{}
+	for {
+		select {
+		case u, ok := <-updates.C:
+			if !ok {
+				return nil
+			}
+			if e.discoveryPrefix != "" && !discovered[u.PlantKey] {
+				if err := e.discover(c, u.PlantKey); err != nil {
+					return err
+				}
+				discovered[u.PlantKey] = true
+			}
+			if err := e.publishPvData(c, u.PlantKey, &u.PvData); err != nil {
+				return err
+			}
+		case <-c.Done():
+			if c.Err() != nil {
+				return c.Err()
+			}
+			return fmt.Errorf("Connection closed")
+		case <-stop:
+			c.Publish(e.prefix+"/status", []byte("offline"), true)
+			return nil
+		}
+	}
+}
+
+func (e *Exporter) publishPvData(c *mqtt.Client, plantkey string, pv *dataproviders.PvData) error {
+	b, err := json.Marshal(pv)
+	if err != nil {
+		return err
+	}
+	if err = c.Publish(e.stateTopic(plantkey), b, true); err != nil {
+		return err
+	}
+	for _, s := range sensors {
+		value := strconv.FormatFloat(s.value(pv), 'f', -1, 32)
+		if err = c.Publish(e.fieldTopic(plantkey, s.field), []byte(value), true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Exporter) stateTopic(plantkey string) string {
+	return e.prefix + "/" + plantkey + "/state"
+}
+
+func (e *Exporter) fieldTopic(plantkey string, field string) string {
+	return e.prefix + "/" + plantkey + "/" + field
+}
+
+type discoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model,omitempty"`
+}
+
+type discoveryConfig struct {
+	Name              string          `json:"name"`
+	UniqueId          string          `json:"unique_id"`
+	StateTopic        string          `json:"state_topic"`
+	AvailabilityTopic string          `json:"availability_topic"`
+	UnitOfMeasurement string          `json:"unit_of_measurement"`
+	DeviceClass       string          `json:"device_class"`
+	StateClass        string          `json:"state_class"`
+	Device            discoveryDevice `json:"device"`
+}
+
+// Publish a Home Assistant sensor for each field of the plant
+func (e *Exporter) discover(c *mqtt.Client, plantkey string) error {
+	// The inverters of a plant are published under their sub key,
+	// but discovery ids must be letters, digits, _ and - only
+	nodeId := e.prefix + "_" + strings.Replace(plantkey, dataproviders.SubKeySeparator, "_", -1)
+	device := discoveryDevice{Identifiers: []string{nodeId},
+		Name:         plantkey,
+		Manufacturer: "solarcompare"}
+	if plant := e.plants.PlantData(plantkey); plant != nil {
+		if plant.Name != "" {
+			device.Name = plant.Name
+		}
+		device.Model = plant.DataProvider
+	}
+	for _, s := range sensors {
+		id := nodeId + "_" + s.field
+		config := discoveryConfig{Name: device.Name + " " + s.name,
+			UniqueId:          id,
+			StateTopic:        e.fieldTopic(plantkey, s.field),
+			AvailabilityTopic: e.prefix + "/status",
+			UnitOfMeasurement: s.unit,
+			DeviceClass:       s.deviceClass,
+			StateClass:        s.stateClass,
+			Device:            device}
+		b, err := json.Marshal(&config)
+		if err != nil {
+			return err
+		}
+		topic := e.discoveryPrefix + "/sensor/" + nodeId + "/" + s.field + "/config"
+		if err = c.Publish(topic, b, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
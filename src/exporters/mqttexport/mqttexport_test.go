@@ -0,0 +1,103 @@
+package mqttexport
+
+import (
+	"dataproviders"
+	"encoding/json"
+	"mqtt"
+	"mqtt/mqtttest"
+	"plantdata"
+	"testing"
+	"time"
+)
+
+type testPlants map[string]*plantdata.PlantData
+
+func (p testPlants) PlantData(plantkey string) *plantdata.PlantData {
+	return p[plantkey]
+}
+
+// Wait for the retained message of the topic
+func waitRetained(t *testing.T, b *mqtttest.Broker, topic string) mqtt.Message {
+	for i := 0; i < 100; i++ {
+		if m, ok := b.Retained(topic); ok {
+			return m
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("Nothing was published on %s", topic)
+	return mqtt.Message{}
+}
+
+// Wait for the retained message of the topic to be payload
+func waitPayload(t *testing.T, b *mqtttest.Broker, topic string, payload string) {
+	for i := 0; i < 100; i++ {
+		if m, ok := b.Retained(topic); ok && string(m.Payload) == payload {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	m, _ := b.Retained(topic)
+	t.Errorf("Expected %s on %s, got %s", payload, topic, m.Payload)
+}
+
+func Test_export(t *testing.T) {
+	b := mqtttest.NewBroker()
+	defer b.Close()
+	plants := testPlants{"jbr": {PlantKey: "jbr", Name: "Klarinetvej 25", DataProvider: "jfy"}}
+	e := NewExporter(b.Addr, mqtt.Options{ClientId: "test"}, DefaultPrefix, DefaultDiscoveryPrefix, plants)
+
+	broker := dataproviders.NewBroker()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		e.Run(broker.Subscribe(), stop)
+		close(done)
+	}()
+	waitPayload(t, b, "solarcompare/status", "online")
+
+	broker.Publish("jbr", &dataproviders.PvData{PowerAc: 1234, EnergyToday: 5600, EnergyTotal: 12.5})
+	waitPayload(t, b, "solarcompare/jbr/PowerAc", "1234")
+	waitPayload(t, b, "solarcompare/jbr/EnergyTotal", "12.5")
+	var pv dataproviders.PvData
+	m := waitRetained(t, b, "solarcompare/jbr/state")
+	if err := json.Unmarshal(m.Payload, &pv); err != nil || pv.EnergyToday != 5600 {
+		t.Errorf("Expected pvdata as state, got %s", m.Payload)
+	}
+
+	var config discoveryConfig
+	m = waitRetained(t, b, "homeassistant/sensor/solarcompare_jbr/EnergyToday/config")
+	if err := json.Unmarshal(m.Payload, &config); err != nil {
+		t.Fatal(err.Error())
+	}
+	if config.StateTopic != "solarcompare/jbr/EnergyToday" || config.UnitOfMeasurement != "Wh" ||
+		config.StateClass != "total_increasing" || config.Device.Name != "Klarinetvej 25" ||
+		config.Device.Model != "jfy" || config.AvailabilityTopic != "solarcompare/status" {
+		t.Errorf("Unexpected discovery config %s", m.Payload)
+	}
+
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Exporter did not stop")
+	}
+	waitPayload(t, b, "solarcompare/status", "offline")
+}
+
+func Test_export_no_discovery(t *testing.T) {
+	b := mqtttest.NewBroker()
+	defer b.Close()
+	e := NewExporter(b.Addr, mqtt.Options{ClientId: "test"}, "solar", "", testPlants{})
+
+	broker := dataproviders.NewBroker()
+	stop := make(chan struct{})
+	defer close(stop)
+	go e.Run(broker.Subscribe(), stop)
+	waitRetained(t, b, "solar/status")
+
+	broker.Publish("nat", &dataproviders.PvData{PowerAc: 10})
+	waitRetained(t, b, "solar/nat/state")
+	if _, ok := b.Retained("homeassistant/sensor/solar_nat/PowerAc/config"); ok {
+		t.Error("Expected no discovery when disabled")
+	}
+}
@@ -0,0 +1,287 @@
+// Package pvoutput uploads the plants to pvoutput.org.
+// Every 5 minutes the history of each plant with PvOutput set is read
+// from where the latest upload ended, averaged into 5 minute statuses,
+// and posted to the pvoutput api. So after an outage, of solarcompare or
+// of pvoutput, the missed statuses are backfilled from the history.
+// The provider of each plant is started before its upload, as providers
+// terminate when idle and there would be no history to upload.
+package pvoutput
+
+import (
+	"dataproviders"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"logger"
+	"net/http"
+	"net/url"
+	"os"
+	"plantdata"
+	"secrets"
+	"strings"
+	"sync"
+	"time"
+)
+
+var log = logger.NewLogger(logger.INFO, "Exporter: PVOutput:")
+
+// Where the pvoutput api is, may be changed for testing
+var BaseUrl = "https://pvoutput.org/service/r2"
+
+const (
+	addStatusUrl      = "/addstatus.jsp"
+	addBatchStatusUrl = "/addbatchstatus.jsp"
+)
+
+const (
+	// The status interval of a system on pvoutput
+	statusInterval = 5 * time.Minute
+	resolution     = dataproviders.FiveMinutes
+	// Statuses older than this are refused by pvoutput
+	maxBackfill = 14 * 24 * time.Hour
+	// Statuses in a batch request
+	batchSize = 30
+	// Requests for each plant each interval. Pvoutput allows 60 requests
+	// an hour, so a long backfill is spread over several intervals
+	maxRequests = 4
+)
+
+// The plants to upload
+type Plants interface {
+	// The plantkeys of all plants
+	PlantKeys() []string
+	PlantData(plantkey string) *plantdata.PlantData
+}
+
+// Starts the provider of a plant, if it is not live, see controller.Controller
+type Starter interface {
+	Provider(plant *plantdata.PlantData) error
+}
+
+type Exporter struct {
+	plants       Plants
+	starter      Starter
+	historyStore dataproviders.HistoryStore
+	keyring      *secrets.Keyring
+	client       *http.Client
+	// File with the end of the latest upload of each plant
+	stateFile string
+	// Locker for sync'ing uploaded
+	lock     sync.Mutex
+	uploaded map[string]time.Time
+}
+
+// A status as posted to pvoutput
+type status struct {
+	Time time.Time
+	// Energy today, power and volt
+	Energy dataproviders.WattHour
+	Power  dataproviders.Watt
+	VoltDc float32
+}
+
+// New exporter that keeps the state of the uploads in stateFile.
+// starter keeps the providers of the plants uploaded live.
+// keyring opens the api keys, may be nil if they are not sealed.
+func NewExporter(plants Plants,
+	starter Starter,
+	historyStore dataproviders.HistoryStore,
+	keyring *secrets.Keyring,
+	client *http.Client,
+	stateFile string) (*Exporter, error) {
+	e := &Exporter{plants: plants,
+		starter:      starter,
+		historyStore: historyStore,
+		keyring:      keyring,
+		client:       client,
+		stateFile:    stateFile,
+		uploaded:     map[string]time.Time{}}
+	b, err := ioutil.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		return e, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, &e.uploaded); err != nil {
+		return nil, fmt.Errorf("%s: %s", stateFile, err.Error())
+	}
+	return e, nil
+}
+
+// Upload every status interval until stop is closed
+func (e *Exporter) Run(stop <-chan struct{}) {
+	tick := time.NewTicker(statusInterval)
+	defer tick.Stop()
+	for {
+		e.Upload(time.Now())
+		select {
+		case <-tick.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Upload the statuses of all plants that ended before now,
+// and start the providers of the plants that are not live.
+// Errors are logged, and the statuses are tried again on the next upload.
+func (e *Exporter) Upload(now time.Time) {
+	for _, k := range e.plants.PlantKeys() {
+		plant := e.plants.PlantData(k)
+		if plant == nil || plant.PvOutput == nil {
+			continue
+		}
+		// A provider that has terminated is started again, so the history of the plant goes on
+		if err := e.starter.Provider(plant); err != nil {
+			log.Failf("Could not start the provider of plant %s: %s", k, err.Error())
+		}
+		n, err := e.uploadPlant(plant, now)
+		if err != nil {
+			log.Failf("Upload of plant %s failed: %s", k, err.Error())
+		} else if n > 0 {
+			log.Debugf("Uploaded %d statuses of plant %s", n, k)
+		}
+	}
+}
+
+// Upload the statuses of the plant, returns the number uploaded
+func (e *Exporter) uploadPlant(plant *plantdata.PlantData, now time.Time) (int, error) {
+	apiKey, err := e.keyring.Open(plant.PlantKey, plantdata.PvOutputApiKeyField, plant.PvOutput.ApiKey)
+	if err != nil {
+		return 0, err
+	}
+	from := e.latestUpload(plant.PlantKey, now)
+	to := now.Truncate(statusInterval)
+	samples, err := e.historyStore.Range(plant.PlantKey, from, to)
+	if err != nil {
+		return 0, err
+	}
+	statuses := []status{}
+	for _, s := range dataproviders.Downsample(samples, resolution) {
+		statuses = append(statuses, status{Time: s.Time.Add(statusInterval),
+			Energy: s.EnergyToday,
+			Power:  s.PowerAc,
+			VoltDc: s.VoltDc})
+	}
+	uploaded := 0
+	for requests := 0; len(statuses) > 0 && requests < maxRequests; requests++ {
+		batch := statuses
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+		err = e.post(apiKey, plant.PvOutput.SystemId, batch)
+		if rejected, ok := err.(rejectedError); ok {
+			// Trying again will not help, so skip the statuses
+			log.Failf("Skipping %d statuses of plant %s from %s: %s",
+				len(batch), plant.PlantKey, batch[0].Time, rejected.Error())
+		} else if err != nil {
+			return uploaded, err
+		} else {
+			uploaded += len(batch)
+		}
+		statuses = statuses[len(batch):]
+		if err = e.setLatestUpload(plant.PlantKey, batch[len(batch)-1].Time); err != nil {
+			return uploaded, err
+		}
+	}
+	return uploaded, nil
+}
+
+// Where the next upload of the plant starts.
+// A plant that was never uploaded starts at midnight, so today is uploaded.
+func (e *Exporter) latestUpload(plantkey string, now time.Time) time.Time {
+	e.lock.Lock()
+	from, ok := e.uploaded[plantkey]
+	e.lock.Unlock()
+	if !ok {
+		y, m, d := now.Date()
+		from = time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	}
+	if oldest := now.Add(-maxBackfill).Truncate(statusInterval); from.Before(oldest) {
+		from = oldest
+	}
+	return from
+}
+
+func (e *Exporter) setLatestUpload(plantkey string, t time.Time) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.uploaded[plantkey] = t
+	b, err := json.MarshalIndent(e.uploaded, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(e.stateFile, b, 0644)
+}
+
+// Pvoutput refused the statuses as invalid, eg. too old
+type rejectedError struct {
+	message string
+}
+
+func (r rejectedError) Error() string {
+	return r.message
+}
+
+// Date and time of the status, as pvoutput wants them.
+// A status that ends at midnight is the last of the day before.
+func (s *status) dateTime() (string, string) {
+	t := s.Time
+	if t.Hour() == 0 && t.Minute() == 0 {
+		t = t.Add(-time.Minute)
+	}
+	return t.Format("20060102"), t.Format("15:04")
+}
+
+// Post the statuses, with addstatus if there is only one, else with addbatchstatus
+func (e *Exporter) post(apiKey string, systemId string, statuses []status) error {
+	values := url.Values{}
+	path := addStatusUrl
+	if len(statuses) == 1 {
+		s := statuses[0]
+		d, t := s.dateTime()
+		values.Set("d", d)
+		values.Set("t", t)
+		values.Set("v1", fmt.Sprint(s.Energy))
+		values.Set("v2", fmt.Sprint(s.Power))
+		if s.VoltDc > 0 {
+			values.Set("v6", fmt.Sprintf("%.1f", s.VoltDc))
+		}
+	} else {
+		path = addBatchStatusUrl
+		data := []string{}
+		for _, s := range statuses {
+			d, t := s.dateTime()
+			volt := ""
+			if s.VoltDc > 0 {
+				volt = fmt.Sprintf("%.1f", s.VoltDc)
+			}
+			// Date,Time,Energy,Power,Consumption energy,Consumption power,Temperature,Voltage
+			data = append(data, fmt.Sprintf("%s,%s,%d,%d,,,,%s", d, t, s.Energy, s.Power, volt))
+		}
+		values.Set("data", strings.Join(data, ";"))
+	}
+
+	req, err := http.NewRequest("POST", BaseUrl+path, strings.NewReader(values.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Pvoutput-Apikey", apiKey)
+	req.Header.Set("X-Pvoutput-SystemId", systemId)
+	resp, err := e.client.Do(req)
+	if err != nil {
+		// The error holds the url only, the api key is in a header
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusBadRequest {
+		return rejectedError{strings.TrimSpace(string(body))}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s for system %s: %s", resp.Status, systemId, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package pvoutput
+
+import (
+	"dataproviders"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"plantdata"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+To run test export GOPATH=/Users/jbr/github/local/solarcompare
+then
+go test -test.v exporters/pvoutput
+*/
+
+type testPlants map[string]*plantdata.PlantData
+
+func (p testPlants) PlantKeys() []string {
+	keys := []string{}
+	for k := range p {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (p testPlants) PlantData(plantkey string) *plantdata.PlantData {
+	return p[plantkey]
+}
+
+type testHistory struct {
+	samples []dataproviders.PvSample
+}
+
+func (h *testHistory) Append(plantkey string, sample dataproviders.PvSample) error {
+	h.samples = append(h.samples, sample)
+	return nil
+}
+
+func (h *testHistory) Range(plantkey string, from time.Time, to time.Time) ([]dataproviders.PvSample, error) {
+	result := []dataproviders.PvSample{}
+	for _, s := range h.samples {
+		if !s.Time.Before(from) && s.Time.Before(to) {
+			result = append(result, s)
+		}
+	}
+	return result, nil
+}
+
+// Records the plants started, fails if err is set
+type testStarter struct {
+	started []string
+	err     error
+}
+
+func (s *testStarter) Provider(plant *plantdata.PlantData) error {
+	s.started = append(s.started, plant.PlantKey)
+	return s.err
+}
+
+// A fake pvoutput api, that records the posted forms
+type fakePvOutput struct {
+	lock     sync.Mutex
+	requests []*http.Request
+	status   int
+}
+
+func (f *fakePvOutput) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if r.Header.Get("X-Pvoutput-Apikey") != "secretkey" || r.Header.Get("X-Pvoutput-SystemId") != "1234" {
+		http.Error(w, "Unauthorized 401: Invalid API Key", http.StatusUnauthorized)
+		return
+	}
+	if f.status != 0 {
+		http.Error(w, "Service Unavailable", f.status)
+		return
+	}
+	f.requests = append(f.requests, r)
+	w.Write([]byte("OK 200: Added Status"))
+}
+
+func newTestExporter(t *testing.T, history *testHistory, starter *testStarter) (*Exporter, *fakePvOutput, func()) {
+	fake := &fakePvOutput{}
+	server := httptest.NewServer(fake)
+	BaseUrl = server.URL
+	dir, _ := ioutil.TempDir("", "pvoutput")
+	plants := testPlants{"jbr": {PlantKey: "jbr",
+		PvOutput: &plantdata.PvOutputData{ApiKey: "secretkey", SystemId: "1234"}},
+		"other": {PlantKey: "other"}}
+	e, err := NewExporter(plants, starter, history, nil, http.DefaultClient, filepath.Join(dir, "pvoutput.json"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return e, fake, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func Test_upload(t *testing.T) {
+	day := time.Date(2026, 6, 1, 0, 0, 0, 0, time.Local)
+	history := &testHistory{}
+	for m := 10 * 60; m < 10*60+12; m++ {
+		history.Append("jbr", dataproviders.PvSample{Time: day.Add(time.Duration(m) * time.Minute),
+			PowerAc: 2000, EnergyToday: dataproviders.WattHour(5000 + m - 10*60), VoltDc: 400})
+	}
+	e, fake, cleanup := newTestExporter(t, history, &testStarter{})
+	defer cleanup()
+
+	// 10:00 - 10:05 and 10:05 - 10:10 are complete, 10:10 - is not
+	e.Upload(day.Add(10*time.Hour + 11*time.Minute))
+	if len(fake.requests) != 1 || fake.requests[0].URL.Path != addBatchStatusUrl {
+		t.Fatalf("Expected one batch, got %d requests", len(fake.requests))
+	}
+	data := fake.requests[0].Form.Get("data")
+	if data != "20260601,10:05,5004,2000,,,,400.0;20260601,10:10,5009,2000,,,,400.0" {
+		t.Errorf("Wrong batch %s", data)
+	}
+
+	// The next upload continues where the latest ended
+	e.Upload(day.Add(10*time.Hour + 16*time.Minute))
+	if len(fake.requests) != 2 || fake.requests[1].URL.Path != addStatusUrl {
+		t.Fatalf("Expected a single status, got %d requests", len(fake.requests))
+	}
+	r := fake.requests[1]
+	if r.Form.Get("d") != "20260601" || r.Form.Get("t") != "10:15" ||
+		r.Form.Get("v1") != "5011" || r.Form.Get("v2") != "2000" || r.Form.Get("v6") != "400.0" {
+		t.Errorf("Wrong status %v", r.Form)
+	}
+	e.Upload(day.Add(10*time.Hour + 19*time.Minute))
+	if len(fake.requests) != 2 {
+		t.Errorf("Expected nothing new to upload, got %d requests", len(fake.requests))
+	}
+}
+
+func Test_backfill(t *testing.T) {
+	day := time.Date(2026, 6, 1, 0, 0, 0, 0, time.Local)
+	history := &testHistory{}
+	// A sample every 5 minutes for 12 hours
+	for m := 6 * 60; m < 18*60; m += 5 {
+		history.Append("jbr", dataproviders.PvSample{Time: day.Add(time.Duration(m) * time.Minute),
+			PowerAc: 1000, EnergyToday: dataproviders.WattHour(m)})
+	}
+	e, fake, cleanup := newTestExporter(t, history, &testStarter{})
+	defer cleanup()
+
+	// Pvoutput is down, so nothing is uploaded
+	fake.status = http.StatusServiceUnavailable
+	now := day.Add(7 * time.Hour)
+	e.Upload(now)
+	if len(fake.requests) != 0 {
+		t.Fatalf("Expected no statuses while down")
+	}
+
+	// Backfilled in batches, a few requests at a time
+	fake.status = 0
+	now = day.Add(18 * time.Hour)
+	e.Upload(now)
+	if len(fake.requests) != maxRequests {
+		t.Fatalf("Expected %d batches, got %d", maxRequests, len(fake.requests))
+	}
+	first := strings.Split(fake.requests[0].Form.Get("data"), ";")
+	if len(first) != batchSize || first[0] != "20260601,06:05,360,1000,,,," {
+		t.Errorf("Wrong first batch, starts with %s", first[0])
+	}
+	e.Upload(now.Add(statusInterval))
+	if len(fake.requests) != maxRequests+1 {
+		t.Fatalf("Expected the rest in one batch, got %d requests", len(fake.requests))
+	}
+	last := strings.Split(fake.requests[maxRequests].Form.Get("data"), ";")
+	if l := last[len(last)-1]; l != "20260601,18:00,1075,1000,,,," {
+		t.Errorf("Wrong last status %s", l)
+	}
+
+	// The uploads are remembered over a restart
+	e, err := NewExporter(e.plants, e.starter, history, nil, http.DefaultClient, e.stateFile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	e.Upload(now.Add(2 * statusInterval))
+	if len(fake.requests) != maxRequests+1 {
+		t.Errorf("Expected nothing to upload after restart, got %d requests", len(fake.requests))
+	}
+}
+
+func Test_start_providers(t *testing.T) {
+	day := time.Date(2026, 6, 1, 0, 0, 0, 0, time.Local)
+	history := &testHistory{}
+	history.Append("jbr", dataproviders.PvSample{Time: day.Add(10 * time.Hour), PowerAc: 2000, EnergyToday: 5000})
+	starter := &testStarter{}
+	e, fake, cleanup := newTestExporter(t, history, starter)
+	defer cleanup()
+
+	// Only the plants uploaded are started, on every upload
+	e.Upload(day.Add(10*time.Hour + 6*time.Minute))
+	e.Upload(day.Add(10*time.Hour + 11*time.Minute))
+	if len(starter.started) != 2 || starter.started[0] != "jbr" || starter.started[1] != "jbr" {
+		t.Errorf("Expected the provider of the plant to be started on each upload, started %v", starter.started)
+	}
+
+	// The history is uploaded, even if the provider does not start
+	starter.err = errors.New("plant unreachable")
+	history.Append("jbr", dataproviders.PvSample{Time: day.Add(10*time.Hour + 12*time.Minute), PowerAc: 1000, EnergyToday: 5100})
+	e.Upload(day.Add(10*time.Hour + 16*time.Minute))
+	if len(starter.started) != 3 || len(fake.requests) != 2 {
+		t.Errorf("Expected the upload to go on, started %v, %d requests", starter.started, len(fake.requests))
+	}
+}
+
+func Test_midnight(t *testing.T) {
+	s := status{Time: time.Date(2026, 6, 2, 0, 0, 0, 0, time.Local)}
+	if d, tm := s.dateTime(); d != "20260601" || tm != "23:59" {
+		t.Errorf("Expected the last status of the day before, got %s %s", d, tm)
+	}
+}
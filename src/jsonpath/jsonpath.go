@@ -0,0 +1,122 @@
+// Package jsonpath picks values out of decoded json with a small
+// subset of JSONPath: $ for the root, .name and ['name'] for members,
+// and [n] for array elements, where a negative n counts from the end.
+package jsonpath
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A step in a path, either a member name or an array index
+type step struct {
+	name    string
+	index   int
+	isIndex bool
+}
+
+type Path struct {
+	text  string
+	steps []step
+}
+
+func (p *Path) String() string {
+	return p.text
+}
+
+// Compile the path, eg. $.inverters[0].pac or $['Body']['Data']
+func Compile(path string) (*Path, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("jsonpath: %s does not start with $", path)
+	}
+	p := &Path{text: path}
+	rest := path[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("jsonpath: empty name in %s", path)
+			}
+			p.steps = append(p.steps, step{name: rest[:end]})
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("jsonpath: missing ] in %s", path)
+			}
+			inner := strings.TrimSpace(rest[1:end])
+			rest = rest[end+1:]
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				p.steps = append(p.steps, step{name: inner[1 : len(inner)-1]})
+				continue
+			}
+			index, err := strconv.Atoi(inner)
+			if err != nil {
+				return nil, fmt.Errorf("jsonpath: bad index %s in %s", inner, path)
+			}
+			p.steps = append(p.steps, step{index: index, isIndex: true})
+		default:
+			return nil, fmt.Errorf("jsonpath: unexpected %q in %s", rest[0], path)
+		}
+	}
+	return p, nil
+}
+
+// Get the value at the path in doc, as decoded by encoding/json into an interface{}
+func (p *Path) Get(doc interface{}) (interface{}, error) {
+	v := doc
+	for i, s := range p.steps {
+		if s.isIndex {
+			a, ok := v.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("jsonpath: %s is not an array at step %d", p.text, i+1)
+			}
+			index := s.index
+			if index < 0 {
+				index += len(a)
+			}
+			if index < 0 || index >= len(a) {
+				return nil, fmt.Errorf("jsonpath: index %d out of range in %s", s.index, p.text)
+			}
+			v = a[index]
+			continue
+		}
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("jsonpath: %s is not an object at step %d", p.text, i+1)
+		}
+		v, ok = m[s.name]
+		if !ok {
+			return nil, fmt.Errorf("jsonpath: no %s in %s", s.name, p.text)
+		}
+	}
+	return v, nil
+}
+
+// Get a number at the path. Strings holding a number are accepted,
+// as many loggers send their values as strings.
+func (p *Path) Float(doc interface{}) (float64, error) {
+	v, err := p.Get(doc)
+	if err != nil {
+		return 0, err
+	}
+	switch n := v.(type) {
+	case float64:
+		return n, nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		if err != nil {
+			return 0, fmt.Errorf("jsonpath: %s is not a number, was %s", p.text, n)
+		}
+		return f, nil
+	case nil:
+		return 0, fmt.Errorf("jsonpath: %s is null", p.text)
+	}
+	return 0, fmt.Errorf("jsonpath: %s is not a number", p.text)
+}
@@ -0,0 +1,44 @@
+package jsonpath
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const doc = `{"inverters": [{"pac": 2451, "sn": "A1"}, {"pac": "12.5"}],
+	"Body": {"Data": {"DAY ENERGY": {"Value": 8532}}}, "none": null}`
+
+func Test_get(t *testing.T) {
+	var v interface{}
+	json.Unmarshal([]byte(doc), &v)
+	for path, expected := range map[string]float64{
+		"$.inverters[0].pac":                       2451,
+		"$.inverters[-1].pac":                      12.5,
+		"$['Body'].Data['DAY ENERGY'].Value":       8532,
+		`$["Body"]["Data"]["DAY ENERGY"]["Value"]`: 8532,
+	} {
+		p, err := Compile(path)
+		if err != nil {
+			t.Errorf("Could not compile %s: %s", path, err.Error())
+			continue
+		}
+		f, err := p.Float(v)
+		if err != nil || f != expected {
+			t.Errorf("Expected %f at %s, got %f, %v", expected, path, f, err)
+		}
+	}
+	for _, path := range []string{"$.inverters[2].pac", "$.inverters.pac", "$.missing", "$.none", "$.inverters[0].sn"} {
+		p, _ := Compile(path)
+		if _, err := p.Float(v); err == nil {
+			t.Errorf("Expected %s to fail", path)
+		}
+	}
+}
+
+func Test_compile(t *testing.T) {
+	for _, path := range []string{"inverters", "$..pac", "$[x]", "$.a[0", "$a"} {
+		if _, err := Compile(path); err == nil {
+			t.Errorf("Expected %s not to compile", path)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Package modbus is a minimal Modbus TCP client.
+// It reads holding registers, which is all the SunSpec provider needs.
+package modbus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const DefaultPort = "502"
+
+const funcReadHoldingRegisters = 0x03
+
+// Most registers that can be read in one request
+const MaxRegisters = 125
+
+// An exception reply from the device
+type Exception struct {
+	Function byte
+	Code     byte
+}
+
+func (e Exception) Error() string {
+	return fmt.Sprintf("modbus: exception %d on function %d", e.Code, e.Function)
+}
+
+const (
+	ExceptionIllegalFunction = 1
+	ExceptionIllegalAddress  = 2
+)
+
+type Client struct {
+	conn    net.Conn
+	unit    byte
+	timeout time.Duration
+	// Locker for sync'ing requests, only one can be outstanding
+	lock          sync.Mutex
+	transactionId uint16
+}
+
+// Dial the device at address, host or host:port, talking to the given unit id.
+// timeout applies to the dial and to every request.
+func Dial(address string, unit byte, timeout time.Duration) (*Client, error) {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, DefaultPort)
+	}
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, unit: unit, timeout: timeout}, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Read count holding registers starting at address
+func (c *Client) ReadHoldingRegisters(address uint16, count uint16) ([]uint16, error) {
+	if count == 0 || count > MaxRegisters {
+		return nil, fmt.Errorf("modbus: cannot read %d registers", count)
+	}
+	pdu := make([]byte, 5)
+	pdu[0] = funcReadHoldingRegisters
+	binary.BigEndian.PutUint16(pdu[1:], address)
+	binary.BigEndian.PutUint16(pdu[3:], count)
+	reply, err := c.request(pdu)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) < 2 || int(reply[1]) != 2*int(count) || len(reply) != 2+2*int(count) {
+		return nil, fmt.Errorf("modbus: bad reply length %d for %d registers", len(reply), count)
+	}
+	registers := make([]uint16, count)
+	for i := range registers {
+		registers[i] = binary.BigEndian.Uint16(reply[2+2*i:])
+	}
+	return registers, nil
+}
+
+// Send the pdu and return the pdu of the reply
+func (c *Client) request(pdu []byte) ([]byte, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.transactionId++
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+
+	// MBAP header, transaction id, protocol id 0, length and unit id
+	frame := make([]byte, 7, 7+len(pdu))
+	binary.BigEndian.PutUint16(frame[0:], c.transactionId)
+	binary.BigEndian.PutUint16(frame[4:], uint16(len(pdu)+1))
+	frame[6] = c.unit
+	frame = append(frame, pdu...)
+	if _, err := c.conn.Write(frame); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint16(header[4:])
+	if length < 2 || length > 256 {
+		return nil, fmt.Errorf("modbus: bad frame length %d", length)
+	}
+	reply := make([]byte, length-1)
+	if _, err := io.ReadFull(c.conn, reply); err != nil {
+		return nil, err
+	}
+	if id := binary.BigEndian.Uint16(header[0:]); id != c.transactionId {
+		return nil, fmt.Errorf("modbus: reply to transaction %d, expected %d", id, c.transactionId)
+	}
+	if reply[0] == pdu[0]|0x80 {
+		if len(reply) < 2 {
+			return nil, fmt.Errorf("modbus: short exception reply")
+		}
+		return nil, Exception{pdu[0], reply[1]}
+	}
+	if reply[0] != pdu[0] {
+		return nil, fmt.Errorf("modbus: reply to function %d, expected %d", reply[0], pdu[0])
+	}
+	return reply, nil
+}
@@ -0,0 +1,34 @@
+package modbus
+
+import (
+	"modbus/modbustest"
+	"testing"
+	"time"
+)
+
+func Test_read_holding_registers(t *testing.T) {
+	srv := modbustest.NewServer(map[uint16]uint16{40000: 0x5375, 40001: 0x6e53})
+	defer srv.Close()
+
+	c, err := Dial(srv.Addr, 1, time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	registers, err := c.ReadHoldingRegisters(40000, 2)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if registers[0] != 0x5375 || registers[1] != 0x6e53 {
+		t.Errorf("Wrong registers %x", registers)
+	}
+
+	_, err = c.ReadHoldingRegisters(40001, 2)
+	if e, ok := err.(Exception); !ok || e.Code != ExceptionIllegalAddress {
+		t.Errorf("Expected illegal address exception, got %v", err)
+	}
+	// The connection is still usable after an exception
+	if _, err = c.ReadHoldingRegisters(40000, 1); err != nil {
+		t.Errorf("Expected read after exception to work, got %s", err.Error())
+	}
+}
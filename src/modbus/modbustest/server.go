@@ -0,0 +1,90 @@
+// Package modbustest provides a Modbus TCP server for tests,
+// serving holding registers from a map.
+package modbustest
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+)
+
+type Server struct {
+	// Address the server listens on, host:port
+	Addr     string
+	listener net.Listener
+	// Locker for sync'ing the registers
+	lock      sync.Mutex
+	registers map[uint16]uint16
+}
+
+// Start a server on a local port. Registers not in the map
+// give an illegal address exception when read.
+func NewServer(registers map[uint16]uint16) *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("modbustest: failed to listen: " + err.Error())
+	}
+	s := &Server{Addr: l.Addr().String(), listener: l, registers: registers}
+	go s.serve()
+	return s
+}
+
+// Set a register while the server is running
+func (s *Server) Set(address uint16, value uint16) {
+	s.lock.Lock()
+	s.registers[address] = value
+	s.lock.Unlock()
+}
+
+func (s *Server) Close() {
+	s.listener.Close()
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		header := make([]byte, 7)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		pdu := make([]byte, binary.BigEndian.Uint16(header[4:])-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			return
+		}
+		reply := s.reply(pdu)
+		binary.BigEndian.PutUint16(header[4:], uint16(len(reply)+1))
+		if _, err := conn.Write(append(header, reply...)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) reply(pdu []byte) []byte {
+	if pdu[0] != 0x03 || len(pdu) != 5 {
+		return []byte{pdu[0] | 0x80, 1}
+	}
+	address := binary.BigEndian.Uint16(pdu[1:])
+	count := binary.BigEndian.Uint16(pdu[3:])
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	reply := []byte{pdu[0], byte(2 * count)}
+	for i := uint16(0); i < count; i++ {
+		value, ok := s.registers[address+i]
+		if !ok {
+			return []byte{pdu[0] | 0x80, 2}
+		}
+		reply = append(reply, byte(value>>8), byte(value))
+	}
+	return reply
+}
@@ -0,0 +1,276 @@
+// Package mqtt is a minimal MQTT 3.1.1 client.
+// It publishes and subscribes with qos 0, which is all solarcompare needs
+// for reading inverters and publishing to home automation.
+package mqtt
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultPort = "1883"
+
+type Options struct {
+	ClientId string
+	UserName string
+	Password string
+	// Interval of pings, when nothing else is sent or received. Default one minute.
+	// The connection is dropped when a ping is not answered within KeepAlive
+	KeepAlive time.Duration
+	// Timeout of the dial and of the replies to connect and subscribe. Default 10 seconds
+	Timeout time.Duration
+	// Published by the broker if the connection is lost, may be nil
+	Will *Message
+}
+
+type Client struct {
+	conn    net.Conn
+	options Options
+	// Locker for sync'ing writes, and the fields below
+	lock      sync.Mutex
+	packetId  uint16
+	pending   map[uint16]chan struct{}
+	lastWrite time.Time
+	lastRead  time.Time
+	// When the unanswered ping was sent, zero if none
+	pingSent  time.Time
+	messages  chan Message
+	done      chan struct{}
+	err       error
+	closeOnce sync.Once
+}
+
+// Dial the broker at address, host or host:port, optionally prefixed by tcp://
+func Dial(address string, options Options) (*Client, error) {
+	if options.KeepAlive == 0 {
+		options.KeepAlive = time.Minute
+	}
+	if options.Timeout == 0 {
+		options.Timeout = 10 * time.Second
+	}
+	address = strings.TrimPrefix(address, "tcp://")
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, DefaultPort)
+	}
+	conn, err := net.DialTimeout("tcp", address, options.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{conn: conn,
+		options:  options,
+		pending:  map[uint16]chan struct{}{},
+		messages: make(chan Message, 64),
+		done:     make(chan struct{})}
+
+	r := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(options.Timeout))
+	connect := Connect{ClientId: options.ClientId,
+		UserName:  options.UserName,
+		Password:  options.Password,
+		Will:      options.Will,
+		KeepAlive: uint16(options.KeepAlive / time.Second)}
+	if err = c.write(ConnectPacket(connect)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	p, err := ReadPacket(r)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if p.Type != TypeConnack || len(p.Body) < 2 {
+		conn.Close()
+		return nil, fmt.Errorf("mqtt: expected connack, got packet type %d", p.Type)
+	}
+	if code := p.Body[1]; code != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("mqtt: connection refused, %s", refusedReason(code))
+	}
+	conn.SetDeadline(time.Time{})
+	c.lastRead = time.Now()
+
+	go c.read(r)
+	go c.keepAlive()
+	return c, nil
+}
+
+func refusedReason(code byte) string {
+	switch code {
+	case 1:
+		return "unacceptable protocol version"
+	case 2:
+		return "client id rejected"
+	case 3:
+		return "server unavailable"
+	case 4:
+		return "bad user name or password"
+	case 5:
+		return "not authorized"
+	}
+	return fmt.Sprintf("code %d", code)
+}
+
+// Messages received on the subscribed topics.
+// The channel is closed when the connection is lost.
+func (c *Client) Messages() <-chan Message {
+	return c.messages
+}
+
+// Closed when the connection is lost or closed
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Why the connection was lost, nil if it was closed
+func (c *Client) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+// Subscribe to the topic filters, and wait for the broker to acknowledge
+func (c *Client) Subscribe(filters ...string) error {
+	c.lock.Lock()
+	c.packetId++
+	if c.packetId == 0 {
+		c.packetId++
+	}
+	id := c.packetId
+	ack := make(chan struct{})
+	c.pending[id] = ack
+	c.lock.Unlock()
+
+	if err := c.write(SubscribePacket(id, filters...)); err != nil {
+		return err
+	}
+	select {
+	case <-ack:
+		return nil
+	case <-c.done:
+		return fmt.Errorf("mqtt: connection lost while subscribing")
+	case <-time.After(c.options.Timeout):
+		c.lock.Lock()
+		delete(c.pending, id)
+		c.lock.Unlock()
+		return fmt.Errorf("mqtt: no reply to subscribe")
+	}
+}
+
+// Publish the payload to the topic with qos 0
+func (c *Client) Publish(topic string, payload []byte, retain bool) error {
+	return c.write(PublishPacket(Message{Topic: topic, Payload: payload, Retain: retain}))
+}
+
+// Disconnect from the broker
+func (c *Client) Close() error {
+	c.write(&Packet{Type: TypeDisconnect})
+	c.shutdown(nil)
+	return nil
+}
+
+func (c *Client) write(p *Packet) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lastWrite = time.Now()
+	_, err := c.conn.Write(p.Bytes())
+	return err
+}
+
+func (c *Client) shutdown(err error) {
+	c.closeOnce.Do(func() {
+		c.lock.Lock()
+		c.err = err
+		c.lock.Unlock()
+		c.conn.Close()
+		close(c.done)
+	})
+}
+
+func (c *Client) read(r *bufio.Reader) {
+	defer close(c.messages)
+	for {
+		p, err := ReadPacket(r)
+		if err != nil {
+			c.shutdown(err)
+			return
+		}
+		c.lock.Lock()
+		c.lastRead = time.Now()
+		if p.Type == TypePingresp {
+			c.pingSent = time.Time{}
+		}
+		c.lock.Unlock()
+		switch p.Type {
+		case TypePublish:
+			m, id, err := ParsePublish(p)
+			if err != nil {
+				c.shutdown(err)
+				return
+			}
+			if (p.Flags>>1)&0x03 == 1 {
+				c.write(PacketIdPacket(TypePuback, id))
+			}
+			select {
+			case c.messages <- m:
+			case <-c.done:
+				return
+			}
+		case TypeSuback:
+			id, err := ParsePacketId(p)
+			if err != nil {
+				c.shutdown(err)
+				return
+			}
+			c.lock.Lock()
+			if ack, ok := c.pending[id]; ok {
+				close(ack)
+				delete(c.pending, id)
+			}
+			c.lock.Unlock()
+		case TypePingresp, TypePuback:
+		default:
+			c.shutdown(fmt.Errorf("mqtt: unexpected packet type %d", p.Type))
+			return
+		}
+	}
+}
+
+// Ping the broker when nothing has been sent or received for half the keep alive,
+// so the broker does not drop the connection, and a half-open connection is noticed.
+// The connection is shut down when the ping is not answered within the keep alive
+func (c *Client) keepAlive() {
+	tick := time.NewTicker(c.options.KeepAlive / 2)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			c.lock.Lock()
+			idle := time.Since(c.lastWrite)
+			if read := time.Since(c.lastRead); read > idle {
+				idle = read
+			}
+			pingSent := c.pingSent
+			c.lock.Unlock()
+			if !pingSent.IsZero() {
+				if time.Since(pingSent) >= c.options.KeepAlive {
+					c.shutdown(fmt.Errorf("mqtt: no reply to ping within %s", c.options.KeepAlive))
+					return
+				}
+			} else if idle >= c.options.KeepAlive/2 {
+				c.lock.Lock()
+				c.pingSent = time.Now()
+				c.lock.Unlock()
+				if err := c.write(&Packet{Type: TypePingreq}); err != nil {
+					c.shutdown(err)
+					return
+				}
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
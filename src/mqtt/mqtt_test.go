@@ -0,0 +1,155 @@
+package mqtt_test
+
+import (
+	"bufio"
+	"mqtt"
+	"mqtt/mqtttest"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_match(t *testing.T) {
+	for _, c := range []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"solar/1/power", "solar/1/power", true},
+		{"solar/+/power", "solar/1/power", true},
+		{"solar/#", "solar/1/power", true},
+		{"solar/#", "solar", true},
+		{"#", "solar/1", true},
+		{"solar/+", "solar/1/power", false},
+		{"solar/1/power", "solar/1", false},
+		{"solar/1", "solar/1/power", false},
+		{"solar/+/power", "solar/1/voltage", false},
+	} {
+		if mqtt.Match(c.filter, c.topic) != c.match {
+			t.Errorf("Expected match of %s on %s to be %t", c.filter, c.topic, c.match)
+		}
+	}
+}
+
+func Test_publish_subscribe(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	broker.UserName, broker.Password = "user", "secret"
+	defer broker.Close()
+
+	if _, err := mqtt.Dial(broker.Addr, mqtt.Options{ClientId: "bad", UserName: "user", Password: "wrong"}); err == nil {
+		t.Error("Expected connect with wrong password to be refused")
+	}
+
+	sub, err := mqtt.Dial(broker.Addr, mqtt.Options{ClientId: "sub", UserName: "user", Password: "secret"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer sub.Close()
+	if err = sub.Subscribe("solar/+/power"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	pub, err := mqtt.Dial("tcp://"+broker.Addr, mqtt.Options{ClientId: "pub", UserName: "user", Password: "secret"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer pub.Close()
+	pub.Publish("solar/1/voltage", []byte("401.1"), false)
+	pub.Publish("solar/1/power", []byte("2451"), true)
+
+	select {
+	case m := <-sub.Messages():
+		if m.Topic != "solar/1/power" || string(m.Payload) != "2451" {
+			t.Errorf("Wrong message %s %s", m.Topic, m.Payload)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("No message received")
+	}
+
+	// Retained messages are sent to new subscribers
+	late, err := mqtt.Dial(broker.Addr, mqtt.Options{ClientId: "late", UserName: "user", Password: "secret"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	late.Subscribe("solar/#")
+	select {
+	case m := <-late.Messages():
+		if m.Topic != "solar/1/power" || !m.Retain {
+			t.Errorf("Expected retained power, got %s", m.Topic)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("No retained message received")
+	}
+	late.Close()
+	select {
+	case <-late.Done():
+	case <-time.After(time.Second):
+		t.Error("Expected Done to be closed")
+	}
+	if late.Err() != nil {
+		t.Errorf("Expected no error on close, was %s", late.Err())
+	}
+}
+
+// A broker that accepts the connection, and then answers nothing,
+// like one behind a half-open connection
+func silentBroker(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		if p, err := mqtt.ReadPacket(r); err != nil || p.Type != mqtt.TypeConnect {
+			return
+		}
+		conn.Write((&mqtt.Packet{Type: mqtt.TypeConnack, Body: []byte{0, 0}}).Bytes())
+		for {
+			if _, err := mqtt.ReadPacket(r); err != nil {
+				return
+			}
+		}
+	}()
+	return l
+}
+
+func Test_keep_alive(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	// Pings that are answered keep the connection
+	c, err := mqtt.Dial(broker.Addr, mqtt.Options{ClientId: "alive", KeepAlive: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	select {
+	case <-c.Done():
+		t.Fatalf("Expected the connection to be kept, was lost with %v", c.Err())
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// A ping that is not answered drops the connection
+	l := silentBroker(t)
+	defer l.Close()
+	silent, err := mqtt.Dial(l.Addr().String(), mqtt.Options{ClientId: "silent", KeepAlive: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer silent.Close()
+	select {
+	case <-silent.Done():
+		if silent.Err() == nil {
+			t.Error("Expected an error for the lost connection")
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the connection to be dropped when pings are not answered")
+	}
+	if _, ok := <-silent.Messages(); ok {
+		t.Error("Expected the messages to be closed")
+	}
+}
@@ -0,0 +1,187 @@
+// Package mqtttest provides an MQTT broker for tests.
+// It routes qos 0 messages between its clients, and keeps retained messages.
+package mqtttest
+
+import (
+	"bufio"
+	"mqtt"
+	"net"
+	"sync"
+)
+
+type Broker struct {
+	// Address the broker listens on, host:port
+	Addr     string
+	listener net.Listener
+	// If set, clients must connect with this user name and password
+	UserName string
+	Password string
+	// Locker for sync'ing the fields below
+	lock     sync.Mutex
+	sessions map[*session]bool
+	retained map[string]mqtt.Message
+}
+
+type session struct {
+	conn net.Conn
+	// Locker for sync'ing writes
+	lock    sync.Mutex
+	filters []string
+}
+
+func (s *session) write(p *mqtt.Packet) {
+	s.lock.Lock()
+	s.conn.Write(p.Bytes())
+	s.lock.Unlock()
+}
+
+// Start a broker on a local port
+func NewBroker() *Broker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("mqtttest: failed to listen: " + err.Error())
+	}
+	b := &Broker{Addr: l.Addr().String(), listener: l,
+		sessions: map[*session]bool{},
+		retained: map[string]mqtt.Message{}}
+	go b.serve()
+	return b
+}
+
+// Close the broker and all client connections
+func (b *Broker) Close() {
+	b.listener.Close()
+	b.lock.Lock()
+	for s := range b.sessions {
+		s.conn.Close()
+	}
+	b.lock.Unlock()
+}
+
+// Publish a message to the subscribed clients, as if a client had sent it
+func (b *Broker) Publish(m mqtt.Message) {
+	b.lock.Lock()
+	if m.Retain {
+		if len(m.Payload) == 0 {
+			delete(b.retained, m.Topic)
+		} else {
+			b.retained[m.Topic] = m
+		}
+	}
+	var receivers []*session
+	for s := range b.sessions {
+		for _, f := range s.filters {
+			if mqtt.Match(f, m.Topic) {
+				receivers = append(receivers, s)
+				break
+			}
+		}
+	}
+	b.lock.Unlock()
+	m.Retain = false
+	for _, s := range receivers {
+		s.write(mqtt.PublishPacket(m))
+	}
+}
+
+// The retained message of the topic
+func (b *Broker) Retained(topic string) (mqtt.Message, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	m, ok := b.retained[topic]
+	return m, ok
+}
+
+// Number of connected clients
+func (b *Broker) Clients() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.sessions)
+}
+
+func (b *Broker) serve() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(conn)
+	}
+}
+
+func (b *Broker) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	p, err := mqtt.ReadPacket(r)
+	if err != nil || p.Type != mqtt.TypeConnect {
+		return
+	}
+	connect, err := mqtt.ParseConnect(p)
+	if err != nil {
+		return
+	}
+	s := &session{conn: conn}
+	if b.UserName != "" && (connect.UserName != b.UserName || connect.Password != b.Password) {
+		s.write(&mqtt.Packet{Type: mqtt.TypeConnack, Body: []byte{0, 4}})
+		return
+	}
+	s.write(&mqtt.Packet{Type: mqtt.TypeConnack, Body: []byte{0, 0}})
+	b.lock.Lock()
+	b.sessions[s] = true
+	b.lock.Unlock()
+	disconnected := false
+	defer func() {
+		b.lock.Lock()
+		delete(b.sessions, s)
+		b.lock.Unlock()
+		// The will is only published when the client is lost
+		if !disconnected && connect.Will != nil {
+			b.Publish(*connect.Will)
+		}
+	}()
+
+	for {
+		p, err := mqtt.ReadPacket(r)
+		if err != nil {
+			return
+		}
+		switch p.Type {
+		case mqtt.TypePublish:
+			m, _, err := mqtt.ParsePublish(p)
+			if err != nil {
+				return
+			}
+			b.Publish(m)
+		case mqtt.TypeSubscribe:
+			id, filters, err := mqtt.ParseSubscribe(p)
+			if err != nil {
+				return
+			}
+			b.lock.Lock()
+			s.filters = append(s.filters, filters...)
+			var retained []mqtt.Message
+			for _, m := range b.retained {
+				for _, f := range filters {
+					if mqtt.Match(f, m.Topic) {
+						retained = append(retained, m)
+						break
+					}
+				}
+			}
+			b.lock.Unlock()
+			ack := mqtt.PacketIdPacket(mqtt.TypeSuback, id)
+			for range filters {
+				ack.Body = append(ack.Body, 0)
+			}
+			s.write(ack)
+			for _, m := range retained {
+				s.write(mqtt.PublishPacket(m))
+			}
+		case mqtt.TypePingreq:
+			s.write(&mqtt.Packet{Type: mqtt.TypePingresp})
+		case mqtt.TypeDisconnect:
+			disconnected = true
+			return
+		}
+	}
+}
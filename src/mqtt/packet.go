@@ -0,0 +1,288 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Control packet types
+const (
+	TypeConnect    = 1
+	TypeConnack    = 2
+	TypePublish    = 3
+	TypePuback     = 4
+	TypeSubscribe  = 8
+	TypeSuback     = 9
+	TypePingreq    = 12
+	TypePingresp   = 13
+	TypeDisconnect = 14
+)
+
+// Largest packet accepted
+const MaxPacketSize = 256 * 1024
+
+// A control packet, as read from or written to the wire
+type Packet struct {
+	Type  byte
+	Flags byte
+	Body  []byte
+}
+
+// Read a control packet
+func ReadPacket(r *bufio.Reader) (*Packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length := 0
+	for shift := uint(0); ; shift += 7 {
+		if shift > 21 {
+			return nil, fmt.Errorf("mqtt: bad remaining length")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	if length > MaxPacketSize {
+		return nil, fmt.Errorf("mqtt: packet of %d bytes is too large", length)
+	}
+	p := &Packet{Type: header >> 4, Flags: header & 0x0f, Body: make([]byte, length)}
+	if _, err = io.ReadFull(r, p.Body); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// The packet as bytes on the wire
+func (p *Packet) Bytes() []byte {
+	b := []byte{p.Type<<4 | p.Flags}
+	length := len(p.Body)
+	for {
+		digit := byte(length & 0x7f)
+		length >>= 7
+		if length > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if length == 0 {
+			break
+		}
+	}
+	return append(b, p.Body...)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = appendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// Reads the fields of a packet body in order
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) uint16() uint16 {
+	if r.err != nil || len(r.b) < 2 {
+		r.err = fmt.Errorf("mqtt: packet too short")
+		return 0
+	}
+	v := binary.BigEndian.Uint16(r.b)
+	r.b = r.b[2:]
+	return v
+}
+
+func (r *reader) byte() byte {
+	if r.err != nil || len(r.b) < 1 {
+		r.err = fmt.Errorf("mqtt: packet too short")
+		return 0
+	}
+	v := r.b[0]
+	r.b = r.b[1:]
+	return v
+}
+
+func (r *reader) string() string {
+	n := int(r.uint16())
+	if r.err != nil || len(r.b) < n {
+		r.err = fmt.Errorf("mqtt: packet too short")
+		return ""
+	}
+	s := string(r.b[:n])
+	r.b = r.b[n:]
+	return s
+}
+
+// A message published to a topic
+type Message struct {
+	Topic   string
+	Payload []byte
+	Retain  bool
+}
+
+// Build a PUBLISH packet with qos 0
+func PublishPacket(m Message) *Packet {
+	flags := byte(0)
+	if m.Retain {
+		flags |= 0x01
+	}
+	return &Packet{Type: TypePublish, Flags: flags, Body: append(appendString(nil, m.Topic), m.Payload...)}
+}
+
+// Parse a PUBLISH packet, and the packet id if qos is above 0
+func ParsePublish(p *Packet) (m Message, packetId uint16, err error) {
+	r := &reader{b: p.Body}
+	m.Topic = r.string()
+	if qos := (p.Flags >> 1) & 0x03; qos > 0 {
+		packetId = r.uint16()
+	}
+	m.Payload = r.b
+	m.Retain = p.Flags&0x01 != 0
+	err = r.err
+	return
+}
+
+// Does the topic match the filter, which may hold the wildcards + and #
+func Match(filter string, topic string) bool {
+	for {
+		if filter == "#" {
+			return true
+		}
+		fi, ti := indexSlash(filter), indexSlash(topic)
+		fpart, tpart := filter[:fi], topic[:ti]
+		if fpart != "+" && fpart != tpart {
+			return false
+		}
+		if fi == len(filter) || ti == len(topic) {
+			// "a/#" also matches "a"
+			return fi == len(filter) && ti == len(topic) || (ti == len(topic) && filter[fi:] == "/#")
+		}
+		filter, topic = filter[fi+1:], topic[ti+1:]
+	}
+}
+
+func indexSlash(s string) int {
+	for i := 0; i < len(s); i++ {
+		if s[i] == '/' {
+			return i
+		}
+	}
+	return len(s)
+}
+
+// The fields of a CONNECT packet
+type Connect struct {
+	ClientId string
+	UserName string
+	Password string
+	// Published by the broker with qos 0 if the client is lost, may be nil
+	Will      *Message
+	KeepAlive uint16
+}
+
+// Build a CONNECT packet for MQTT 3.1.1 with a clean session
+func ConnectPacket(c Connect) *Packet {
+	flags := byte(0x02)
+	if c.Will != nil {
+		flags |= 0x04
+		if c.Will.Retain {
+			flags |= 0x20
+		}
+	}
+	if c.UserName != "" {
+		flags |= 0x80
+		if c.Password != "" {
+			flags |= 0x40
+		}
+	}
+	b := appendString(nil, "MQTT")
+	b = append(b, 4, flags)
+	b = appendUint16(b, c.KeepAlive)
+	b = appendString(b, c.ClientId)
+	if c.Will != nil {
+		b = appendString(b, c.Will.Topic)
+		b = appendUint16(b, uint16(len(c.Will.Payload)))
+		b = append(b, c.Will.Payload...)
+	}
+	if c.UserName != "" {
+		b = appendString(b, c.UserName)
+		if c.Password != "" {
+			b = appendString(b, c.Password)
+		}
+	}
+	return &Packet{Type: TypeConnect, Body: b}
+}
+
+// Parse a CONNECT packet
+func ParseConnect(p *Packet) (*Connect, error) {
+	r := &reader{b: p.Body}
+	if protocol := r.string(); r.err == nil && protocol != "MQTT" {
+		return nil, fmt.Errorf("mqtt: unsupported protocol %s", protocol)
+	}
+	r.byte()
+	flags := r.byte()
+	c := &Connect{}
+	c.KeepAlive = r.uint16()
+	c.ClientId = r.string()
+	if flags&0x04 != 0 {
+		c.Will = &Message{Topic: r.string(), Payload: []byte(r.string()), Retain: flags&0x20 != 0}
+	}
+	if flags&0x80 != 0 {
+		c.UserName = r.string()
+	}
+	if flags&0x40 != 0 {
+		c.Password = r.string()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return c, nil
+}
+
+// Build a SUBSCRIBE packet asking for qos 0 on every filter
+func SubscribePacket(packetId uint16, filters ...string) *Packet {
+	b := appendUint16(nil, packetId)
+	for _, f := range filters {
+		b = appendString(b, f)
+		b = append(b, 0)
+	}
+	return &Packet{Type: TypeSubscribe, Flags: 0x02, Body: b}
+}
+
+// Parse a SUBSCRIBE packet
+func ParseSubscribe(p *Packet) (packetId uint16, filters []string, err error) {
+	r := &reader{b: p.Body}
+	packetId = r.uint16()
+	for r.err == nil && len(r.b) > 0 {
+		filters = append(filters, r.string())
+		r.byte()
+	}
+	if r.err == nil && len(filters) == 0 {
+		r.err = fmt.Errorf("mqtt: subscribe without topics")
+	}
+	err = r.err
+	return
+}
+
+// Build a packet that is only a packet id, eg. PUBACK
+func PacketIdPacket(packetType byte, packetId uint16) *Packet {
+	return &Packet{Type: packetType, Body: appendUint16(nil, packetId)}
+}
+
+// The packet id of a PUBACK or SUBACK
+func ParsePacketId(p *Packet) (uint16, error) {
+	r := &reader{b: p.Body}
+	id := r.uint16()
+	return id, r.err
+}
@@ -0,0 +1,171 @@
+package persistence
+
+import (
+	"bufio"
+	"dataproviders"
+	"encoding/json"
+	"logger"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var log = logger.NewLogger(logger.INFO, "Persistence: ")
+
+// HistoryStore that appends samples to one file per plant per day.
+// Every line in a file is one json encoded PvSample.
+// The energy of the days before today is kept in memory once it is read,
+// see DailyEnergy.
+type FileHistoryStore struct {
+	dir string
+	// Locker for sync'ing writes to the files
+	lock sync.Mutex
+	// Locker for the energy of the days, by plantkey and day
+	dailyLock sync.Mutex
+	daily     map[string]map[string]dayEnergy
+}
+
+type dayEnergy struct {
+	energy dataproviders.WattHour
+	// The day has samples
+	found bool
+}
+
+func NewFileHistoryStore(dir string) (*FileHistoryStore, error) {
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return nil, err
+	}
+	return &FileHistoryStore{dir: dir, daily: map[string]map[string]dayEnergy{}}, nil
+}
+
+func (h *FileHistoryStore) filename(plantkey string, day time.Time) string {
+	return filepath.Join(h.dir,
+		plantkey+"_history_"+day.Format(dataproviders.KeyDateFormat)+".json")
+}
+
+func (h *FileHistoryStore) Append(plantkey string, sample dataproviders.PvSample) error {
+	b, err := json.Marshal(sample)
+	if err != nil {
+		return err
+	}
+	// Samples backfilled into a past day changes its energy
+	defer func() {
+		h.dailyLock.Lock()
+		delete(h.daily[plantkey], sample.Time.Local().Format(dataproviders.KeyDateFormat))
+		h.dailyLock.Unlock()
+	}()
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	f, err := os.OpenFile(h.filename(plantkey, sample.Time.Local()),
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+func (h *FileHistoryStore) Range(plantkey string,
+	from time.Time, to time.Time) ([]dataproviders.PvSample, error) {
+	samples := []dataproviders.PvSample{}
+	y, m, d := from.Local().Date()
+	for day := time.Date(y, m, d, 0, 0, 0, 0, time.Local); day.Before(to); day = day.AddDate(0, 0, 1) {
+		daySamples, err := h.readDay(plantkey, day)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range daySamples {
+			if !s.Time.Before(from) && s.Time.Before(to) {
+				samples = append(samples, s)
+			}
+		}
+	}
+	sort.Sort(byTime(samples))
+	return samples, nil
+}
+
+// The energy of today is read from its samples on every call, while the
+// days before are only read the first time.
+func (h *FileHistoryStore) DailyEnergy(plantkey string,
+	from time.Time, to time.Time) (dataproviders.PvDataDaily, error) {
+	days := dataproviders.PvDataDaily{}
+	y, m, d := time.Now().Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+	y, m, d = from.Local().Date()
+	for day := time.Date(y, m, d, 0, 0, 0, 0, time.Local); day.Before(to); day = day.AddDate(0, 0, 1) {
+		e, err := h.dayEnergy(plantkey, day, day.Before(today))
+		if err != nil {
+			return nil, err
+		}
+		if e.found {
+			days[day.Format(dataproviders.KeyDateFormat)] = e.energy
+		}
+	}
+	return days, nil
+}
+
+// The energy of the day, kept if cache is set. The lock is held while the
+// day is read, so a sample appended meanwhile is not lost.
+func (h *FileHistoryStore) dayEnergy(plantkey string, day time.Time, cache bool) (dayEnergy, error) {
+	key := day.Format(dataproviders.KeyDateFormat)
+	h.dailyLock.Lock()
+	defer h.dailyLock.Unlock()
+	if e, ok := h.daily[plantkey][key]; ok {
+		return e, nil
+	}
+	samples, err := h.readDay(plantkey, day)
+	if err != nil {
+		return dayEnergy{}, err
+	}
+	e := dayEnergy{}
+	for _, s := range samples {
+		e.found = true
+		if s.EnergyToday > e.energy {
+			e.energy = s.EnergyToday
+		}
+	}
+	if cache {
+		if h.daily[plantkey] == nil {
+			h.daily[plantkey] = map[string]dayEnergy{}
+		}
+		h.daily[plantkey][key] = e
+	}
+	return e, nil
+}
+
+func (h *FileHistoryStore) readDay(plantkey string, day time.Time) ([]dataproviders.PvSample, error) {
+	samples := []dataproviders.PvSample{}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	f, err := os.Open(h.filename(plantkey, day))
+	if os.IsNotExist(err) {
+		return samples, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		s := dataproviders.PvSample{}
+		err = json.Unmarshal(scanner.Bytes(), &s)
+		if err != nil {
+			// A half written line from a crash should not hide the rest of the day
+			log.Infof("Skipping bad line in history for plant %s: %s", plantkey, err.Error())
+			continue
+		}
+		samples = append(samples, s)
+	}
+	return samples, scanner.Err()
+}
+
+type byTime []dataproviders.PvSample
+
+func (s byTime) Len() int           { return len(s) }
+func (s byTime) Less(i, j int) bool { return s[i].Time.Before(s[j].Time) }
+func (s byTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
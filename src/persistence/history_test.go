@@ -0,0 +1,133 @@
+package persistence
+
+import (
+	"dataproviders"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+/*
+To run test export GOPATH=/Users/jbr/github/local/solarcompare
+then
+go test -test.v persistence
+*/
+
+func newTestStore(t *testing.T) (*FileHistoryStore, func()) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	h, err := NewFileHistoryStore(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return h, func() { os.RemoveAll(dir) }
+}
+
+func Test_history_range(t *testing.T) {
+	h, cleanup := newTestStore(t)
+	defer cleanup()
+
+	start := time.Date(2013, 6, 1, 23, 50, 0, 0, time.Local)
+	for i := 0; i < 4; i++ {
+		err := h.Append("key", dataproviders.PvSample{Time: start.Add(time.Duration(i) * 5 * time.Minute),
+			PowerAc: dataproviders.Watt(100 * (i + 1))})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	// Another plant should not show up
+	h.Append("other", dataproviders.PvSample{Time: start, PowerAc: 1})
+
+	samples, err := h.Range("key", start.Add(5*time.Minute), start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// Spans midnight, so two files are read
+	if len(samples) != 3 {
+		t.Fatalf("Expected 3 samples, got %d", len(samples))
+	}
+	if samples[0].PowerAc != 200 || samples[2].PowerAc != 400 {
+		t.Errorf("Samples not in order or wrong, got %v", samples)
+	}
+
+	samples, err = h.Range("nosuchplant", start, start.Add(time.Hour))
+	if err != nil || len(samples) != 0 {
+		t.Errorf("Expected no samples and no error, got %v, %v", samples, err)
+	}
+}
+
+func Test_history_downsample(t *testing.T) {
+	h, cleanup := newTestStore(t)
+	defer cleanup()
+
+	start := time.Date(2013, 6, 1, 12, 0, 0, 0, time.Local)
+	for i := 0; i < 24; i++ {
+		h.Append("key", dataproviders.PvSample{Time: start.Add(time.Duration(i) * 5 * time.Minute),
+			PowerAc:     dataproviders.Watt(i),
+			EnergyToday: dataproviders.WattHour(i * 10)})
+	}
+	samples, _ := h.Range("key", start, start.Add(24*time.Hour))
+	hourly := dataproviders.Downsample(samples, dataproviders.Hourly)
+	if len(hourly) != 2 {
+		t.Fatalf("Expected 2 hourly buckets, got %d", len(hourly))
+	}
+	if !hourly[1].Time.Equal(start.Add(time.Hour)) {
+		t.Errorf("Second bucket should start at %s, was %s", start.Add(time.Hour), hourly[1].Time)
+	}
+	// Average of 0..11 rounded
+	if hourly[0].PowerAc != 6 {
+		t.Errorf("PowerAc of first bucket should be 6 was %d", hourly[0].PowerAc)
+	}
+	if hourly[1].EnergyToday != 230 {
+		t.Errorf("EnergyToday of second bucket should be 230 was %d", hourly[1].EnergyToday)
+	}
+
+	daily := dataproviders.Downsample(samples, dataproviders.Daily)
+	if len(daily) != 1 || daily[0].EnergyToday != 230 {
+		t.Errorf("Expected one daily bucket with 230 Wh, got %v", daily)
+	}
+}
+
+func Test_history_daily_energy(t *testing.T) {
+	h, cleanup := newTestStore(t)
+	defer cleanup()
+
+	day := time.Date(2013, 6, 1, 12, 0, 0, 0, time.Local)
+	for i, energy := range []dataproviders.WattHour{1000, 3000, 2500} {
+		h.Append("key", dataproviders.PvSample{Time: day.Add(time.Duration(i) * time.Hour), EnergyToday: energy})
+	}
+	h.Append("key", dataproviders.PvSample{Time: day.AddDate(0, 0, 2), EnergyToday: 700})
+
+	from := time.Date(2013, 6, 1, 0, 0, 0, 0, time.Local)
+	days, err := h.DailyEnergy("key", from, from.AddDate(0, 1, 0))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(days) != 2 || days["20130601"] != 3000 || days["20130603"] != 700 {
+		t.Errorf("Daily energy read wrong, %v", days)
+	}
+
+	// Past days are not read again
+	os.Remove(h.filename("key", day))
+	if days, _ = h.DailyEnergy("key", from, from.AddDate(0, 0, 1)); days["20130601"] != 3000 {
+		t.Errorf("Expected the energy of a past day to be kept, %v", days)
+	}
+
+	// Unless a sample is backfilled into the day
+	h.Append("key", dataproviders.PvSample{Time: day, EnergyToday: 1200})
+	if days, _ = h.DailyEnergy("key", from, from.AddDate(0, 0, 1)); days["20130601"] != 1200 {
+		t.Errorf("Expected a backfilled day to be read again, %v", days)
+	}
+
+	// Today is always read from the samples
+	now := time.Now()
+	h.Append("key", dataproviders.PvSample{Time: now, EnergyToday: 100})
+	h.DailyEnergy("key", now, now.AddDate(0, 0, 1))
+	h.Append("key", dataproviders.PvSample{Time: now, EnergyToday: 200})
+	if days, _ = h.DailyEnergy("key", now, now.AddDate(0, 0, 1)); days[now.Format(dataproviders.KeyDateFormat)] != 200 {
+		t.Errorf("Expected the energy of today to be read again, %v", days)
+	}
+}
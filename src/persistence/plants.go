@@ -0,0 +1,242 @@
+package persistence
+
+import (
+	"config"
+	"dataproviders"
+	"encoding/json"
+	"plantdata"
+	"reflect"
+	"secrets"
+	"sort"
+	"sync"
+)
+
+// Plants kept in a json config file.
+// The file is rewritten on every change.
+// Credentials are sealed with the keyring, both in the file and in memory.
+// Plain credentials, eg. written by hand, are sealed when the file is loaded.
+type FilePlantRepository struct {
+	path    string
+	keyring *secrets.Keyring
+	// Locker for sync'ing the plants map and the file
+	lock   sync.RWMutex
+	plants map[string]plantdata.PlantData
+}
+
+// Load the plants from the config file at path.
+// If keyring is nil, credentials are kept in plain text.
+func NewFilePlantRepository(path string, keyring *secrets.Keyring) (*FilePlantRepository, error) {
+	r := &FilePlantRepository{path: path, keyring: keyring}
+	plants, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	r.plants = plants
+	return r, nil
+}
+
+func (r *FilePlantRepository) PlantData(plantkey string) *plantdata.PlantData {
+	r.lock.RLock()
+	plant, ok := r.plants[plantkey]
+	r.lock.RUnlock()
+	if !ok {
+		return nil
+	}
+	return &plant
+}
+
+// The plantkeys of all plants, sorted
+func (r *FilePlantRepository) PlantKeys() []string {
+	r.lock.RLock()
+	keys := make([]string, 0, len(r.plants))
+	for k := range r.plants {
+		keys = append(keys, k)
+	}
+	r.lock.RUnlock()
+	sort.Strings(keys)
+	return keys
+}
+
+func (r *FilePlantRepository) ToJson() []byte {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	b, _ := json.MarshalIndent(&r.plants, "", "   ")
+	return b
+}
+
+func (r *FilePlantRepository) Len() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return len(r.plants)
+}
+
+func (r *FilePlantRepository) Put(plant plantdata.PlantData) (*plantdata.PlantData, error) {
+	plant.InitiateData.PlantKey = plant.PlantKey
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	old, ok := r.plants[plant.PlantKey]
+	if err := r.seal(&plant, r.plants); err != nil {
+		return nil, err
+	}
+	plants := r.copyPlants()
+	plants[plant.PlantKey] = plant
+	if err := r.save(plants); err != nil {
+		return nil, err
+	}
+	r.plants = plants
+	if !ok {
+		return nil, nil
+	}
+	return &old, nil
+}
+
+// True for a plant with credentials when there is no keyring
+func (r *FilePlantRepository) PlainCredentials(plant *plantdata.PlantData) bool {
+	return r.keyring == nil && hasPlainCredentials(plant)
+}
+
+func (r *FilePlantRepository) Delete(plantkey string) (*plantdata.PlantData, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	old, ok := r.plants[plantkey]
+	if !ok {
+		return nil, nil
+	}
+	plants := r.copyPlants()
+	delete(plants, plantkey)
+	if err := r.save(plants); err != nil {
+		return nil, err
+	}
+	r.plants = plants
+	return &old, nil
+}
+
+// Reload the plants from the file, eg. after it was edited by hand.
+// Returns the plants that was changed or removed, as they were before the reload.
+func (r *FilePlantRepository) Reload() (changed []plantdata.PlantData, removed []plantdata.PlantData, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	plants, err := r.load()
+	if err != nil {
+		return
+	}
+	for k, old := range r.plants {
+		plant, ok := plants[k]
+		if !ok {
+			removed = append(removed, old)
+		} else if !reflect.DeepEqual(old, plant) {
+			changed = append(changed, old)
+		}
+	}
+	r.plants = plants
+	return
+}
+
+// Load the plants from the file, and seal any plain credentials.
+// If there was any, the file is rewritten so they are no longer kept in plain text.
+// Must be called with lock held, or before the repository is shared
+func (r *FilePlantRepository) load() (map[string]plantdata.PlantData, error) {
+	plants, err := config.Load(r.path)
+	if err != nil {
+		return nil, err
+	}
+	if r.keyring == nil {
+		return plants, nil
+	}
+	plain := false
+	for k, plant := range plants {
+		if !hasPlainCredentials(&plant) {
+			continue
+		}
+		plain = true
+		if err = r.seal(&plant, r.plants); err != nil {
+			return nil, err
+		}
+		plants[k] = plant
+	}
+	if plain {
+		log.Infof("Encrypting plain credentials in %s", r.path)
+		if err = r.save(plants); err != nil {
+			return nil, err
+		}
+	}
+	return plants, nil
+}
+
+// Seal the credentials of the plant, reusing the sealed values
+// of the plant in current if they are unchanged
+func (r *FilePlantRepository) seal(plant *plantdata.PlantData, current map[string]plantdata.PlantData) error {
+	if r.keyring == nil {
+		return nil
+	}
+	var old *dataproviders.InitiateData
+	oldApiKey := ""
+	if p, ok := current[plant.PlantKey]; ok {
+		old = &p.InitiateData
+		if p.PvOutput != nil {
+			oldApiKey = p.PvOutput.ApiKey
+		}
+	}
+	if len(plant.Inverters) > 0 {
+		// The inverters may be shared with the plant in current
+		inverters := make([]plantdata.InverterSource, len(plant.Inverters))
+		for i, inv := range plant.Inverters {
+			var oldInv *dataproviders.InitiateData
+			if p, ok := current[plant.PlantKey]; ok {
+				for _, o := range p.Inverters {
+					if o.Key == inv.Key {
+						oldInv = &o.InitiateData
+						break
+					}
+				}
+			}
+			if err := r.keyring.SealInitiateData(&inv.InitiateData, oldInv); err != nil {
+				return err
+			}
+			inverters[i] = inv
+		}
+		plant.Inverters = inverters
+	}
+	if plant.PvOutput != nil {
+		// The PvOutputData may be shared with the plant in current
+		pvOutput := *plant.PvOutput
+		var err error
+		pvOutput.ApiKey, err = r.keyring.Reseal(plant.PlantKey, plantdata.PvOutputApiKeyField, pvOutput.ApiKey, oldApiKey)
+		if err != nil {
+			return err
+		}
+		plant.PvOutput = &pvOutput
+	}
+	return r.keyring.SealInitiateData(&plant.InitiateData, old)
+}
+
+// Does the plant hold any credentials that are not sealed
+func hasPlainCredentials(plant *plantdata.PlantData) bool {
+	if secrets.HasPlainCredentials(&plant.InitiateData) {
+		return true
+	}
+	for i := range plant.Inverters {
+		if secrets.HasPlainCredentials(&plant.Inverters[i].InitiateData) {
+			return true
+		}
+	}
+	return plant.PvOutput != nil && !secrets.IsSealed(plant.PvOutput.ApiKey)
+}
+
+// Must be called with lock held
+func (r *FilePlantRepository) copyPlants() map[string]plantdata.PlantData {
+	plants := make(map[string]plantdata.PlantData, len(r.plants))
+	for k, v := range r.plants {
+		plants[k] = v
+	}
+	return plants
+}
+
+// Validate and write the plants to the file. Must be called with lock held
+func (r *FilePlantRepository) save(plants map[string]plantdata.PlantData) error {
+	f := config.NewFile(plants)
+	if err := f.Validate(); err != nil {
+		return err
+	}
+	return f.Save(r.path)
+}
@@ -0,0 +1,143 @@
+package persistence
+
+import (
+	"bytes"
+	"dataproviders"
+	_ "dataproviders/all"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"plantdata"
+	"reflect"
+	"secrets"
+	"testing"
+)
+
+func newTestRepository(t *testing.T) (*FilePlantRepository, string, func()) {
+	dir, err := ioutil.TempDir("", "plants")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	path := filepath.Join(dir, "plants.json")
+	ioutil.WriteFile(path, []byte(`{"Plants": [{"PlantKey": "jbr", "Provider": "jfy"}]}`), 0600)
+	r, err := NewFilePlantRepository(path, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return r, path, func() { os.RemoveAll(dir) }
+}
+
+func Test_plants_put_delete(t *testing.T) {
+	r, path, cleanup := newTestRepository(t)
+	defer cleanup()
+
+	old, err := r.Put(plantdata.PlantData{PlantKey: "new", DataProvider: "suntrol",
+		InitiateData: dataproviders.InitiateData{PlantNo: "7982"}})
+	if err != nil || old != nil {
+		t.Fatalf("Expected new plant to be stored, got %v, %v", old, err)
+	}
+	// Must survive a reload from the file
+	r, _ = NewFilePlantRepository(path, nil)
+	p := r.PlantData("new")
+	if p == nil || p.InitiateData.PlantNo != "7982" || p.InitiateData.PlantKey != "new" {
+		t.Fatalf("Plant was not stored in the file, got %v", p)
+	}
+
+	// An invalid plant must not be stored
+	_, err = r.Put(plantdata.PlantData{PlantKey: "bad", DataProvider: "kostal"})
+	if err == nil || r.PlantData("bad") != nil {
+		t.Error("Expected kostal without address to be rejected")
+	}
+
+	// Without a keyring, credentials would be kept in plain text
+	if !r.PlainCredentials(&plantdata.PlantData{InitiateData: dataproviders.InitiateData{Password: "secret"}}) ||
+		!r.PlainCredentials(&plantdata.PlantData{PvOutput: &plantdata.PvOutputData{ApiKey: "apikey"}}) ||
+		r.PlainCredentials(r.PlantData("new")) {
+		t.Error("Expected only plants with credentials to be kept in plain text")
+	}
+
+	old, err = r.Delete("jbr")
+	if err != nil || old == nil || old.DataProvider != "jfy" {
+		t.Fatalf("Expected jbr to be deleted, got %v, %v", old, err)
+	}
+	r, _ = NewFilePlantRepository(path, nil)
+	if r.PlantData("jbr") != nil || r.Len() != 1 {
+		t.Errorf("Delete was not stored in the file")
+	}
+}
+
+func Test_plants_reload(t *testing.T) {
+	r, path, cleanup := newTestRepository(t)
+	defer cleanup()
+	r.Put(plantdata.PlantData{PlantKey: "other", DataProvider: "jfy"})
+
+	ioutil.WriteFile(path, []byte(`{"Plants": [{"PlantKey": "jbr", "Provider": "jfy", "Name": "Renamed"}]}`), 0600)
+	changed, removed, err := r.Reload()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(changed) != 1 || changed[0].PlantKey != "jbr" || changed[0].Name != "" {
+		t.Errorf("Expected jbr as it was before to be changed, got %v", changed)
+	}
+	if len(removed) != 1 || removed[0].PlantKey != "other" {
+		t.Errorf("Expected other to be removed, got %v", removed)
+	}
+
+	// A broken file keeps the old plants
+	ioutil.WriteFile(path, []byte(`{"Plants": [{"PlantKey": "jbr"}]}`), 0600)
+	if _, _, err = r.Reload(); err == nil {
+		t.Error("Expected reload of invalid file to fail")
+	}
+	if p := r.PlantData("jbr"); p == nil || p.Name != "Renamed" {
+		t.Errorf("Expected plants to be kept after failed reload, got %v", p)
+	}
+}
+
+func Test_plants_sealed_credentials(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "plants")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "plants.json")
+	ioutil.WriteFile(path, []byte(`{"Plants": [{"PlantKey": "jbr", "Provider": "kostal",
+		"InitiateData": {"UserName": "user", "Password": "secret", "Address": "10.0.0.1"},
+		"PvOutput": {"ApiKey": "apikey", "SystemId": "1234"}}]}`), 0600)
+	key, _ := secrets.GenerateKey()
+	os.Setenv(secrets.KeyEnv, key)
+	defer os.Unsetenv(secrets.KeyEnv)
+	keyring, err := secrets.LoadKeyring("")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	r, err := NewFilePlantRepository(path, keyring)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// Plain credentials are sealed in the file when loaded
+	b, _ := ioutil.ReadFile(path)
+	if bytes.Contains(b, []byte("secret")) || bytes.Contains(b, []byte("apikey")) {
+		t.Errorf("Password is stored in plain text:\n%s", b)
+	}
+	p := r.PlantData("jbr")
+	if p == nil || !secrets.IsSealed(p.InitiateData.Password) {
+		t.Fatalf("Expected sealed password, got %v", p)
+	}
+	i, err := keyring.OpenInitiateData(p.InitiateData)
+	if err != nil || i.Password != "secret" {
+		t.Errorf("Could not open password, %v", err)
+	}
+	if k, err := keyring.Open("jbr", plantdata.PvOutputApiKeyField, p.PvOutput.ApiKey); err != nil || k != "apikey" {
+		t.Errorf("Could not open pvoutput api key, %v", err)
+	}
+
+	if r.PlainCredentials(&plantdata.PlantData{InitiateData: dataproviders.InitiateData{Password: "secret"}}) {
+		t.Error("Expected credentials to be sealed with a keyring")
+	}
+
+	// Putting the same password again is not a change
+	plant := *p
+	plant.InitiateData.Password = "secret"
+	old, _ := r.Put(plant)
+	if !reflect.DeepEqual(*old, *r.PlantData("jbr")) {
+		t.Error("Expected unchanged password to keep its sealed value")
+	}
+}
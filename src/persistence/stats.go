@@ -0,0 +1,59 @@
+package persistence
+
+import (
+	"dataproviders"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+)
+
+const StatsFilename = "_stats.json"
+
+// PlantStatsStore with a json file per plant, named {plantkey}_stats.json.
+// Files written before the PvData schema was versioned are read as version 1,
+// and written back as the current version on the next save.
+type FileStatsStore struct {
+	dir string
+}
+
+func NewFileStatsStore(dir string) *FileStatsStore {
+	return &FileStatsStore{dir: dir}
+}
+
+func (s *FileStatsStore) filename(plantkey string) string {
+	return filepath.Join(s.dir, plantkey+StatsFilename)
+}
+
+// The stats of the plant, empty if they could not be read
+func (s *FileStatsStore) LoadStats(plantkey string) dataproviders.PlantStats {
+	stats := dataproviders.PlantStats{}
+	b, err := ioutil.ReadFile(s.filename(plantkey))
+	if err != nil {
+		log.Infof("Error in reading statfile for plant %s: %s", plantkey, err.Error())
+		return stats
+	}
+	if err = json.Unmarshal(b, &stats); err != nil {
+		log.Failf("Could not read stats for plant %s: %s", plantkey, err.Error())
+		return dataproviders.PlantStats{}
+	}
+	if stats.SchemaVersion < dataproviders.SchemaVersion {
+		log.Infof("Migrating stats for plant %s to schema version %d", plantkey, dataproviders.SchemaVersion)
+	}
+	return stats
+}
+
+func (s *FileStatsStore) SaveStats(plantkey string, pv *dataproviders.PvData) {
+	stats := dataproviders.PlantStats{}
+	stats.PowerAcPeakAll = pv.PowerAcPeakAll
+	stats.PowerAcPeakAllTime = pv.PowerAcPeakAllTime
+	stats.PowerAcPeakToday = pv.PowerAcPeakToday
+	stats.PowerAcPeakTodayTime = pv.PowerAcPeakTodayTime
+	b, err := json.Marshal(stats)
+	if err != nil {
+		log.Failf("Could not marshal plant stats for plant %s: %s", plantkey, err.Error())
+		return
+	}
+	if err = ioutil.WriteFile(s.filename(plantkey), b, 0666); err != nil {
+		log.Failf("Could not write plant stats for plant %s: %s", plantkey, err.Error())
+	}
+}
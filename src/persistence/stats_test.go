@@ -0,0 +1,53 @@
+package persistence
+
+import (
+	"dataproviders"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_stats_migration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stats")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	s := NewFileStatsStore(dir)
+
+	// Written before the schema was versioned
+	legacy := `{"PowerAcPeakAll":4711,"PowerAcPeakAllTime":"2014-06-21T13:02:00+02:00",` +
+		`"PowerAcPeakToday":3120,"PowerAcPeakTodayTime":"2014-09-02T12:30:00+02:00"}`
+	if err = ioutil.WriteFile(filepath.Join(dir, "old"+StatsFilename), []byte(legacy), 0666); err != nil {
+		t.Fatal(err.Error())
+	}
+	stats := s.LoadStats("old")
+	if stats.SchemaVersion != 0 || stats.PowerAcPeakAll != 4711 || stats.PowerAcPeakToday != 3120 ||
+		stats.PowerAcPeakAllTime.Year() != 2014 {
+		t.Errorf("Legacy stats read wrong, %v", stats)
+	}
+
+	// Saved as the current version, with peaks above what 16 bits could hold
+	pv := dataproviders.PvData{PowerAcPeakAll: 70000, PowerAcPeakAllTime: stats.PowerAcPeakAllTime,
+		PowerAcPeakToday: 68000, PowerAcPeakTodayTime: stats.PowerAcPeakTodayTime}
+	s.SaveStats("old", &pv)
+	b, _ := ioutil.ReadFile(filepath.Join(dir, "old"+StatsFilename))
+	if !strings.Contains(string(b), `"SchemaVersion":2`) {
+		t.Errorf("Expected stats saved as version 2, was %s", b)
+	}
+	stats = s.LoadStats("old")
+	if stats.SchemaVersion != dataproviders.SchemaVersion || stats.PowerAcPeakAll != 70000 || stats.PowerAcPeakToday != 68000 {
+		t.Errorf("Stats read back wrong, %v", stats)
+	}
+
+	// A newer version is not guessed at
+	newer := `{"SchemaVersion":3,"PowerAcPeakAll":1000}`
+	if err = ioutil.WriteFile(filepath.Join(dir, "new"+StatsFilename), []byte(newer), 0666); err != nil {
+		t.Fatal(err.Error())
+	}
+	if stats = s.LoadStats("new"); stats.PowerAcPeakAll != 0 {
+		t.Errorf("Expected stats of a newer version to be skipped, was %v", stats)
+	}
+}
@@ -8,13 +8,31 @@ import (
 type InverterData struct {
 	InverterVendor   string
 	InverterModel    string
-	InverterCapacity uint16
+	InverterCapacity dataproviders.Watt
 }
 
 type CellData struct {
 	CellVendor   string
 	CellModel    string
-	CellCapatity uint16
+	CellCapatity dataproviders.Watt // Wp
+}
+
+// Field the pvoutput.org api key is sealed as, see secrets.Keyring
+const PvOutputApiKeyField = "PvOutput.ApiKey"
+
+// Where the plant is reported on pvoutput.org
+type PvOutputData struct {
+	ApiKey   string
+	SystemId string
+}
+
+// An inverter of a plant with more than one, each with its own provider
+type InverterSource struct {
+	// Unique within the plant. The inverter is stored under
+	// dataproviders.SubKey(plantkey, key), eg. in the history
+	Key          string
+	DataProvider string
+	InitiateData dataproviders.InitiateData `json:"-"`
 }
 
 type PlantData struct {
@@ -27,11 +45,37 @@ type PlantData struct {
 	InverterData InverterData
 	InitiateData dataproviders.InitiateData `json:"-"`
 	PvData       dataproviders.PvData       `json:"-"` //Live data 
-	// The dataproviders implementation
-	DataProvider int
+	// The name of the dataproviders implementation, eg. "sunnyportal"
+	DataProvider string
+	// Nil if the plant is not uploaded to pvoutput.org
+	PvOutput *PvOutputData `json:"-"`
+	// The inverters of a plant with more than one. If set, DataProvider
+	// and InitiateData are not used, and the plant is the sum of them
+	Inverters []InverterSource `json:",omitempty"`
 }
 
 func (data *PlantData) ToJson() (b []byte, err error) {
 	b, err = json.MarshalIndent(data, "", "  ")
 	return
 }
+
+// Installed capacity of the plant in Wp.
+// Taken from the cells, and if unknown from the inverter. 0 if none is known
+func (data *PlantData) Capacity() dataproviders.Watt {
+	if data.CellData.CellCapatity > 0 {
+		return data.CellData.CellCapatity
+	}
+	return data.InverterData.InverterCapacity
+}
+
+// Where the plants are kept
+type Repository interface {
+	// The plant with the plantkey, nil if not found
+	PlantData(plantkey string) *PlantData
+	// Add or replace the plant. Returns the replaced plant, if any
+	Put(plant PlantData) (old *PlantData, err error)
+	// Remove the plant. Returns the removed plant, nil if not found
+	Delete(plantkey string) (old *PlantData, err error)
+	// Whether Put would store credentials of the plant in plain text
+	PlainCredentials(plant *PlantData) bool
+}
@@ -0,0 +1,164 @@
+// Package secrets encrypts provider credentials at rest.
+// Credentials are sealed with AES-256-GCM using a master key, that is
+// taken from the environment or a key file, and never stored with the plants.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"dataproviders"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Environment variable holding the base64 encoded master key
+const KeyEnv = "SOLARCOMPARE_MASTER_KEY"
+
+// Prefix of sealed values, the version allows for changing the scheme later
+const sealedPrefix = "enc:v1:"
+
+const keySize = 32
+
+type Keyring struct {
+	aead cipher.AEAD
+}
+
+func NewKeyring(key []byte) (*Keyring, error) {
+	if len(key) != keySize {
+		return nil, fmt.Errorf("Master key must be %d bytes, was %d", keySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Keyring{aead}, nil
+}
+
+// Load the master key from the environment, or else from keyFile.
+// Returns nil and no error if no key is configured.
+func LoadKeyring(keyFile string) (*Keyring, error) {
+	encoded := os.Getenv(KeyEnv)
+	source := KeyEnv
+	if encoded == "" && keyFile != "" {
+		b, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(b)
+		source = keyFile
+	}
+	if encoded == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("Master key in %s is not base64: %s", source, err.Error())
+	}
+	return NewKeyring(key)
+}
+
+// A new random master key, base64 encoded
+func GenerateKey() (string, error) {
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+func IsSealed(s string) bool {
+	return strings.HasPrefix(s, sealedPrefix)
+}
+
+// Binds a sealed value to the plant and field, so it cannot be moved to another
+func additionalData(plantkey string, field string) []byte {
+	return []byte(plantkey + "/" + field)
+}
+
+// Seal the value of the field for the plant.
+// Empty and allready sealed values are returned as they are.
+func (k *Keyring) Seal(plantkey string, field string, value string) (string, error) {
+	if value == "" || IsSealed(value) {
+		return value, nil
+	}
+	if k == nil {
+		return "", fmt.Errorf("No master key is configured")
+	}
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := k.aead.Seal(nonce, nonce, []byte(value), additionalData(plantkey, field))
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open a sealed value. Values that are not sealed are returned as they are.
+func (k *Keyring) Open(plantkey string, field string, value string) (string, error) {
+	if !IsSealed(value) {
+		return value, nil
+	}
+	if k == nil {
+		return "", fmt.Errorf("%s is encrypted, but no master key is configured", field)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(value[len(sealedPrefix):])
+	if err != nil || len(sealed) < k.aead.NonceSize() {
+		return "", fmt.Errorf("%s is not a valid encrypted value", field)
+	}
+	nonce := sealed[:k.aead.NonceSize()]
+	plain, err := k.aead.Open(nil, nonce, sealed[len(nonce):], additionalData(plantkey, field))
+	if err != nil {
+		return "", fmt.Errorf("Could not decrypt %s, wrong master key?", field)
+	}
+	return string(plain), nil
+}
+
+// Seal the value like Seal, but return old if it holds the same value sealed,
+// so storing the same password twice does not look like a change.
+func (k *Keyring) Reseal(plantkey string, field string, value string, old string) (string, error) {
+	if IsSealed(value) {
+		return value, nil
+	}
+	if plain, err := k.Open(plantkey, field, old); err == nil && plain == value && value != "" {
+		return old, nil
+	}
+	return k.Seal(plantkey, field, value)
+}
+
+// Seal the credentials in the InitiateData in place.
+// A credential is kept as in old, if old holds the same value sealed.
+func (k *Keyring) SealInitiateData(i *dataproviders.InitiateData, old *dataproviders.InitiateData) (err error) {
+	if old == nil {
+		old = &dataproviders.InitiateData{}
+	}
+	if i.UserName, err = k.Reseal(i.PlantKey, "UserName", i.UserName, old.UserName); err != nil {
+		return
+	}
+	i.Password, err = k.Reseal(i.PlantKey, "Password", i.Password, old.Password)
+	return
+}
+
+// A copy of the InitiateData with the credentials decrypted
+func (k *Keyring) OpenInitiateData(i dataproviders.InitiateData) (dataproviders.InitiateData, error) {
+	var err error
+	i.UserName, err = k.Open(i.PlantKey, "UserName", i.UserName)
+	if err != nil {
+		return i, err
+	}
+	i.Password, err = k.Open(i.PlantKey, "Password", i.Password)
+	return i, err
+}
+
+// Does the InitiateData hold any credentials that are not sealed
+func HasPlainCredentials(i *dataproviders.InitiateData) bool {
+	return (i.UserName != "" && !IsSealed(i.UserName)) ||
+		(i.Password != "" && !IsSealed(i.Password))
+}
@@ -0,0 +1,88 @@
+package secrets
+
+import (
+	"dataproviders"
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestKeyring(t *testing.T) *Keyring {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	b, _ := base64.StdEncoding.DecodeString(key)
+	k, err := NewKeyring(b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return k
+}
+
+func Test_seal_open(t *testing.T) {
+	k := newTestKeyring(t)
+	sealed, err := k.Seal("jbr", "Password", "secret")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !IsSealed(sealed) || strings.Contains(sealed, "secret") {
+		t.Fatalf("Expected sealed value, got %s", sealed)
+	}
+	plain, err := k.Open("jbr", "Password", sealed)
+	if err != nil || plain != "secret" {
+		t.Errorf("Expected secret, got %s, %v", plain, err)
+	}
+	// A sealed value is bound to the plant
+	if _, err = k.Open("other", "Password", sealed); err == nil {
+		t.Error("Expected open for another plant to fail")
+	}
+	// and to the key
+	if _, err = newTestKeyring(t).Open("jbr", "Password", sealed); err == nil {
+		t.Error("Expected open with another key to fail")
+	}
+	// Plain values pass through
+	if plain, _ = k.Open("jbr", "Password", "plain"); plain != "plain" {
+		t.Errorf("Expected plain, got %s", plain)
+	}
+}
+
+func Test_no_key(t *testing.T) {
+	var k *Keyring
+	if _, err := k.Seal("jbr", "Password", "secret"); err == nil {
+		t.Error("Expected seal without a key to fail")
+	}
+	if _, err := k.Open("jbr", "Password", sealedPrefix+"AAAA"); err == nil {
+		t.Error("Expected open without a key to fail")
+	}
+	if plain, err := k.Open("jbr", "Password", "plain"); err != nil || plain != "plain" {
+		t.Errorf("Expected plain, got %s, %v", plain, err)
+	}
+}
+
+func Test_initiate_data(t *testing.T) {
+	k := newTestKeyring(t)
+	i := dataproviders.InitiateData{PlantKey: "jbr", UserName: "user", Password: "secret", PlantNo: "1"}
+	if err := k.SealInitiateData(&i, nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	if HasPlainCredentials(&i) || i.PlantNo != "1" {
+		t.Fatalf("Expected credentials to be sealed, got %#v", i)
+	}
+	// Sealing the same credentials again keeps the old sealed values
+	again := dataproviders.InitiateData{PlantKey: "jbr", UserName: "user", Password: "secret", PlantNo: "1"}
+	k.SealInitiateData(&again, &i)
+	if !reflect.DeepEqual(again, i) {
+		t.Errorf("Expected unchanged credentials to keep their sealed values")
+	}
+	opened, err := k.OpenInitiateData(i)
+	if err != nil || opened.UserName != "user" || opened.Password != "secret" {
+		t.Errorf("Expected credentials to be opened, got %v", err)
+	}
+	// Printing never reveals the password
+	if s := fmt.Sprint(opened); strings.Contains(s, "secret") {
+		t.Errorf("Password is printed in %s", s)
+	}
+}
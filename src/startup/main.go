@@ -3,110 +3,191 @@
 package main
 
 import (
+	"context"
 	"controller"
+	_ "dataproviders/all"
 	"net/http"
 	"web"
-	"plantdata"
 	"dataproviders"
-	"encoding/json"
+	"flag"
 	"logger"
 	"time"
 	"httpclient"
-	"io/ioutil"
+	"persistence"
+	"secrets"
+	"exporters/mqttexport"
+	"exporters/pvoutput"
+	"mqtt"
+	"fmt"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 )
 
 import _ "net/http/pprof"
 
 var log = logger.NewLogger(logger.INFO, "main: ")
 
-type staticPlants struct {
-	plants map[string]plantdata.PlantData
-}
+var plantsFile = flag.String("plants", "plants.json", "Config file with the plants")
+var keyFile = flag.String("keyfile", "",
+	"File with the master key for the credentials, used if "+secrets.KeyEnv+" is not set")
+var genKey = flag.Bool("genkey", false, "Print a new master key and exit")
+var mqttBroker = flag.String("mqtt", "", "MQTT broker to publish the pvdata to, host:port, disabled if empty")
+var mqttUser = flag.String("mqttuser", "", "User name for the MQTT broker, the password is read from "+MqttPasswordEnv)
+var mqttPrefix = flag.String("mqttprefix", mqttexport.DefaultPrefix, "Topic prefix for the published pvdata")
+var haDiscovery = flag.String("hadiscovery", mqttexport.DefaultDiscoveryPrefix,
+	"Home Assistant discovery prefix, disabled if empty")
 
-// Load up an example plant
-var plantmap = map[string]plantdata.PlantData {
-	"jbr": plantdata.PlantData{PlantKey: "jbr", 
-	                           Name: "Klarinetvej 25",
-	                           DataProvider: dataproviders.FJY,
-	                           InitiateData: dataproviders.InitiateData{PlantKey: "jbr"}},
-	"peterlarsen": plantdata.PlantData{PlantKey: "peterlarsen", 
-	                           Name: "Guldnældevænget 35",
-	                           DataProvider: dataproviders.SunnyPortal,
-	                           InitiateData: dataproviders.InitiateData{"peterlarsen", "jesper@jbr.dk", "cidaxura", "3", ""}},
-	"kaup": plantdata.PlantData{PlantKey: "kaup", 
-	                           Name: "Pandebjergvej",
-	                           DataProvider: dataproviders.SunnyPortal,
-	                           InitiateData: dataproviders.InitiateData{"kaup", "jesper@jbr.dk", "cidaxura", "2", ""}},
-	"gldv33": plantdata.PlantData{PlantKey: "gldv33", 
-	                           Name: "Guldnældevænget 33",
-	                           DataProvider: dataproviders.SunnyPortal,
-	                           InitiateData: dataproviders.InitiateData{"gldv33", "jesper@jbr.dk", "cidaxura", "1", ""}},
-	"janbang": plantdata.PlantData{PlantKey: "janbang", 
-	                           Name: "Fuglehaven",
-	                           DataProvider: dataproviders.Danfoss,
-	                           InitiateData: dataproviders.InitiateData{"janbang", "anonym", "anonym", "", "5.103.131.3"}},
-	"lysningen": plantdata.PlantData{PlantKey: "lysningen", 
-	                           Name: "Janniks anlæg",
-	                           DataProvider: dataproviders.Kostal,
-	                           InitiateData: dataproviders.InitiateData{"lysningen", "pvserver", "2674", "", "2.104.143.225"}},
-}
+const MqttPasswordEnv = "SOLARCOMPARE_MQTT_PASSWORD"
+
+// Token for the plant management api, which is disabled if it is not set.
+// Only read from the environment, so it is not shown by -h or in ps
+const AdminTokenEnv = "SOLARCOMPARE_ADMIN_TOKEN"
 
+const HistoryDir = "history"
+
+// Where the pvoutput exporter remembers how far each plant is uploaded
+const PvOutputStateFile = "pvoutput.json"
 
 func main() {
+	flag.Parse()
+	if *genKey {
+		key, err := secrets.GenerateKey()
+		if err != nil {
+			log.Failf("Could not generate key: %s", err.Error())
+			os.Exit(1)
+		}
+		fmt.Println(key)
+		return
+	}
+	keyring, err := secrets.LoadKeyring(*keyFile)
+	if err != nil {
+		log.Failf("Could not load master key: %s", err.Error())
+		os.Exit(1)
+	}
+	if keyring == nil {
+		log.Infof("No master key in %s or -keyfile, credentials are stored in plain text", secrets.KeyEnv)
+	}
+	plants, err := persistence.NewFilePlantRepository(*plantsFile, keyring)
+	if err != nil {
+		log.Failf("Could not load plants: %s", err.Error())
+		os.Exit(1)
+	}
+	log.Infof("Loaded %d plants from %s", plants.Len(), *plantsFile)
+	adminToken := os.Getenv(AdminTokenEnv)
+	if adminToken == "" {
+		log.Infof("No %s is set, the plant management api is disabled", AdminTokenEnv)
+	}
 	pvStore := NewPvStore()
-	plants := staticPlants{plantmap}
+	historyStore, err := persistence.NewFileHistoryStore(HistoryDir)
+	if err != nil {
+		log.Failf("Could not open history store in %s: %s", HistoryDir, err.Error())
+		return
+	}
 	controller := controller.NewController(httpclient.NewClient, 
 		 pvStore,
-		 StatsStore{})
+		 persistence.NewFileStatsStore("."),
+		 historyStore,
+		 keyring)
+	go reloadOnHangup(plants, &controller)
+	if *mqttBroker != "" {
+		options := mqtt.Options{ClientId: "solarcompare", UserName: *mqttUser, Password: os.Getenv(MqttPasswordEnv)}
+		exporter := mqttexport.NewExporter(*mqttBroker, options, *mqttPrefix, *haDiscovery, plants)
+		go exporter.Run(pvStore.Subscribe(), nil)
+	}
+	pvOutput, err := pvoutput.NewExporter(plants, &controller, historyStore, keyring, httpclient.NewClient(), PvOutputStateFile)
+	if err != nil {
+		log.Failf("Could not start the pvoutput exporter: %s", err.Error())
+	} else {
+		go pvOutput.Run(nil)
+	}
 	http.HandleFunc("/", web.DefaultHandler)
 	http.HandleFunc("/plant/", func(w http.ResponseWriter, r *http.Request) {
-		web.PlantHandler(w, r, &controller, plants, pvStore, true)
+		if r.Method != "GET" {
+			web.PlantAdminHandler(w, r, &controller, plants, adminToken, true)
+			return
+		}
+		web.PlantHandler(w, r, &controller, plants, pvStore, historyStore, true)
+	})
+	http.HandleFunc("/compare", func(w http.ResponseWriter, r *http.Request) {
+		web.CompareHandler(w, r, &controller, plants, pvStore, historyStore)
+	})
+	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		web.StatusHandler(w, r, &controller, plants)
+	})
+	http.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		web.StreamHandler(w, r, &controller, plants, pvStore)
+	})
+	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		web.WebSocketHandler(w, r, &controller, plants, pvStore)
+	})
+	http.HandleFunc("/ingest/", func(w http.ResponseWriter, r *http.Request) {
+		web.IngestHandler(w, r, &controller, plants, true)
 	})
 	http.Handle("/scripts/",  http.FileServer(http.Dir(".")))
 	http.Handle("/html/",  http.FileServer(http.Dir(".")))
 	
 	srv := http.Server{Addr: ":8090", ReadTimeout: 10*time.Second}
 
-	err := srv.ListenAndServe()
+	err = srv.ListenAndServe()
 	
 	if err != nil {
 		log.Info(err.Error())
 	}
 }
 
-func (s staticPlants)PlantData(plantkey string) *plantdata.PlantData {
-	log.Tracef("Getting plant for plantkey: %s", plantkey)
-	plant, ok := s.plants[plantkey]
-	if !ok {
-		return nil
+// Reload the config file on SIGHUP.
+// Providers are only restarted for plants where the provider was changed.
+func reloadOnHangup(plants *persistence.FilePlantRepository, c *controller.Controller) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		log.Infof("Reloading plants from %s", *plantsFile)
+		changed, removed, err := plants.Reload()
+		if err != nil {
+			log.Failf("Could not reload plants, keeping the old ones: %s", err.Error())
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		for i := range removed {
+			log.Infof("Plant %s was removed", removed[i].PlantKey)
+			if err := c.PlantChanged(ctx, &removed[i], nil); err != nil {
+				log.Failf("Could not stop provider for plant %s: %s", removed[i].PlantKey, err.Error())
+			}
+		}
+		for i := range changed {
+			k := changed[i].PlantKey
+			if err := c.PlantChanged(ctx, &changed[i], plants.PlantData(k)); err != nil {
+				log.Failf("Could not restart provider for plant %s: %s", k, err.Error())
+			}
+		}
+		cancel()
+		log.Infof("Loaded %d plants from %s", plants.Len(), *plantsFile)
 	}
-	return &plant;
-}
-
-func (s staticPlants)ToJson() []byte {
-	log.Tracef("Getting all plants as json")
-	b, _ := json.MarshalIndent(&s.plants, "", "   ")
-	return b;
 }
 
 
 type PvStore struct {
 	// Locker for sync'ing the live map
-	pvStoreLock sync.RWMutex
+	pvStoreLock *sync.RWMutex
 	pvDataMap map[string]dataproviders.PvData
+	// Subscribers are told about every Set
+	*dataproviders.Broker
 }
 
 func NewPvStore() PvStore {
-	pvStoreLock := sync.RWMutex{}
+	pvStoreLock := &sync.RWMutex{}
 	pvDataMap := map[string]dataproviders.PvData{}
-	return PvStore{pvStoreLock, pvDataMap}
+	return PvStore{pvStoreLock, pvDataMap, dataproviders.NewBroker()}
 }
 
+// Published under the lock, so subscribers get the updates in the order they are stored
 func (p PvStore)Set(plantkey string, pv *dataproviders.PvData) {
 	p.pvStoreLock.Lock()
+	defer p.pvStoreLock.Unlock()
 	p.pvDataMap[plantkey] = *pv
-	p.pvStoreLock.Unlock()
+	p.Publish(plantkey, pv)
 }
 
 func (p PvStore)Get(plantkey string) dataproviders.PvData {
@@ -116,40 +197,3 @@ func (p PvStore)Get(plantkey string) dataproviders.PvData {
 	}()
 	return p.pvDataMap[plantkey]
 } 
-
-
-const Statfilename = "_stats.json"
-
-type StatsStore struct {
-}
-
-// Load up stats from filesystem
-func (s StatsStore)LoadStats(plantkey string) dataproviders.PlantStats {
-	stats := dataproviders.PlantStats{}
-	bytes, err := ioutil.ReadFile(plantkey + Statfilename)
-	if err != nil {
-		log.Infof("Error in reading statfile for plant %s: %s", plantkey, err.Error())
-		return stats
-	}
-	err = json.Unmarshal(bytes, &stats)
-	return stats
-}
-
-func (s StatsStore)SaveStats(plantkey string, pv *dataproviders.PvData) {
-	stats := dataproviders.PlantStats{}
-	stats.PowerAcPeakAll = pv.PowerAcPeakAll
-	stats.PowerAcPeakAllTime = pv.PowerAcPeakAllTime
-	stats.PowerAcPeakToday = pv.PowerAcPeakToday
-	stats.PowerAcPeakTodayTime = pv.PowerAcPeakTodayTime
-	bytes, err := json.Marshal(stats)
-	if err != nil {
-		log.Failf("Could not marshal plant stats for plant %s: %s", plantkey, err.Error())
-		return
-	}
-	err = ioutil.WriteFile(plantkey+Statfilename, bytes, 0777)
-	if err != nil {
-		log.Failf("Could not write plant stats for plant %s: %s", plantkey, err.Error())
-		return
-	}
-}
-
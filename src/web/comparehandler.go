@@ -0,0 +1,144 @@
+package web
+
+import (
+	"controller"
+	"dataproviders"
+	"fmt"
+	"net/http"
+	"plantdata"
+	"sort"
+	"strings"
+	"time"
+)
+
+// One plant in the comparison.
+// Yields are specific yields in kWh/kWp, which is the same as Wh/Wp
+type plantComparison struct {
+	PlantKey     string
+	Name         string
+	Capacity     dataproviders.Watt // Wp
+	PowerAc      dataproviders.Watt
+	PowerPercent float32 // PowerAc in percent of Capacity
+	YieldToday   float32
+	YieldMonth   float32
+	YieldYear    float32
+	// 1 is the best. 0 if the plant could not be ranked
+	Rank  int
+	Error string `json:",omitempty"`
+}
+
+type compareReply struct {
+	RankedBy string
+	Plants   []*plantComparison
+}
+
+// Serves /compare?plants=key1,key2&rank=today
+// rank is one of today, month, year or power and defaults to today
+func CompareHandler(w http.ResponseWriter, r *http.Request,
+	c *controller.Controller, pg PlantDataGetter,
+	pvStore dataproviders.PvStore,
+	historyStore dataproviders.HistoryStore) {
+	q := r.URL.Query()
+	if q.Get("plants") == "" {
+		http.Error(w, "No plants to compare, use ?plants=key1,key2", http.StatusBadRequest)
+		return
+	}
+	rankBy := q.Get("rank")
+	if rankBy == "" {
+		rankBy = "today"
+	}
+	value, ok := rankValues[rankBy]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Cannot rank by %s, use today, month, year or power", rankBy),
+			http.StatusBadRequest)
+		return
+	}
+
+	reply := compareReply{RankedBy: rankBy, Plants: []*plantComparison{}}
+	for _, plantkey := range strings.Split(q.Get("plants"), ",") {
+		plant := pg.PlantData(plantkey)
+		if plant == nil {
+			http.Error(w, fmt.Sprintf("404: Plant %s not found", plantkey), http.StatusNotFound)
+			return
+		}
+		reply.Plants = append(reply.Plants, compare(c, plant, pvStore, historyStore))
+	}
+	rank(reply.Plants, value)
+	writeJson(w, reply)
+}
+
+func compare(c *controller.Controller, plant *plantdata.PlantData,
+	pvStore dataproviders.PvStore,
+	historyStore dataproviders.HistoryStore) *plantComparison {
+	pc := plantComparison{PlantKey: plant.PlantKey, Name: plant.Name, Capacity: plant.Capacity()}
+
+	// Start up the plant, so the next comparison will have live data
+	if c != nil {
+		if err := c.Provider(plant); err != nil {
+			pc.Error = err.Error()
+		}
+	}
+	pv := pvStore.Get(plant.PlantKey)
+	pc.PowerAc = pv.PowerAc
+	if pc.Capacity == 0 {
+		pc.Error = "No capacity known for plant"
+		return &pc
+	}
+	capacity := float32(pc.Capacity)
+	pc.PowerPercent = float32(pv.PowerAc) * 100 / capacity
+	// The energy today is only of today if the plant was updated today,
+	// else it is of a day that is in the history
+	today := midnight()
+	var energyToday float32
+	if pv.LatestUpdate != nil && !pv.LatestUpdate.Before(today) {
+		energyToday = float32(pv.EnergyToday)
+	}
+	pc.YieldToday = energyToday / capacity
+
+	if historyStore == nil {
+		return &pc
+	}
+	y, m, _ := time.Now().Date()
+	yearStart := time.Date(y, 1, 1, 0, 0, 0, 0, time.Local)
+	monthStart := time.Date(y, m, 1, 0, 0, 0, 0, time.Local)
+	// Today is taken from the live data
+	days, err := dataproviders.DailyEnergy(historyStore, plant.PlantKey, yearStart, today)
+	if err != nil {
+		pc.Error = err.Error()
+		return &pc
+	}
+	var month, year float32
+	monthKey := monthStart.Format(dataproviders.KeyDateFormat)
+	for key, energy := range days {
+		year += float32(energy)
+		if key >= monthKey {
+			month += float32(energy)
+		}
+	}
+	pc.YieldMonth = (month + energyToday) / capacity
+	pc.YieldYear = (year + energyToday) / capacity
+	return &pc
+}
+
+var rankValues = map[string]func(pc *plantComparison) float32{
+	"today": func(pc *plantComparison) float32 { return pc.YieldToday },
+	"month": func(pc *plantComparison) float32 { return pc.YieldMonth },
+	"year":  func(pc *plantComparison) float32 { return pc.YieldYear },
+	"power": func(pc *plantComparison) float32 { return pc.PowerPercent },
+}
+
+// Sort plants best first and set their rank.
+// Plants without capacity cannot be ranked and goes last.
+func rank(plants []*plantComparison, value func(pc *plantComparison) float32) {
+	sort.SliceStable(plants, func(i, j int) bool {
+		if (plants[i].Capacity == 0) != (plants[j].Capacity == 0) {
+			return plants[j].Capacity == 0
+		}
+		return value(plants[i]) > value(plants[j])
+	})
+	for i, pc := range plants {
+		if pc.Capacity > 0 {
+			pc.Rank = i + 1
+		}
+	}
+}
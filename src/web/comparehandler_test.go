@@ -0,0 +1,118 @@
+package web
+
+import (
+	"dataproviders"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"plantdata"
+	"testing"
+	"time"
+)
+
+type testPlants map[string]*plantdata.PlantData
+
+func (p testPlants) PlantData(plantkey string) *plantdata.PlantData {
+	return p[plantkey]
+}
+
+func (p testPlants) ToJson() []byte {
+	b, _ := json.Marshal(p)
+	return b
+}
+
+type testPvStore map[string]dataproviders.PvData
+
+func (s testPvStore) Set(plantkey string, pv *dataproviders.PvData) {
+	s[plantkey] = *pv
+}
+
+func (s testPvStore) Get(plantkey string) dataproviders.PvData {
+	return s[plantkey]
+}
+
+// A history store that keeps the daily energy, counting the calls
+type testDailyStore struct {
+	testHistoryStore
+	days  dataproviders.PvDataDaily
+	calls int
+}
+
+func (h *testDailyStore) DailyEnergy(plantkey string, from time.Time, to time.Time) (dataproviders.PvDataDaily, error) {
+	h.calls++
+	days := dataproviders.PvDataDaily{}
+	for key, energy := range h.days {
+		if key >= from.Format(dataproviders.KeyDateFormat) && key < to.Format(dataproviders.KeyDateFormat) {
+			days[key] = energy
+		}
+	}
+	return days, nil
+}
+
+func Test_compare(t *testing.T) {
+	plants := testPlants{
+		"small": &plantdata.PlantData{PlantKey: "small", InverterData: plantdata.InverterData{InverterCapacity: 1000}},
+		"big":   &plantdata.PlantData{PlantKey: "big", InverterData: plantdata.InverterData{InverterCapacity: 10000}},
+		"none":  &plantdata.PlantData{PlantKey: "none"},
+		"stale": &plantdata.PlantData{PlantKey: "stale", InverterData: plantdata.InverterData{InverterCapacity: 1000}},
+	}
+	now := time.Now()
+	yesterday := now.AddDate(0, 0, -1)
+	pvStore := testPvStore{
+		"small": dataproviders.PvData{PowerAc: 500, EnergyToday: 1000, LatestUpdate: &now},
+		"big":   dataproviders.PvData{PowerAc: 2000, EnergyToday: 20000, LatestUpdate: &now},
+		// Last updated yesterday, so its energy today is of yesterday, that is in the history
+		"stale": dataproviders.PvData{EnergyToday: 4000, LatestUpdate: &yesterday},
+	}
+	// Energy of the days before today, where a year ago is not in this year
+	today := midnight()
+	lastYear := today.AddDate(-1, 0, 0)
+	h := &testDailyStore{days: dataproviders.PvDataDaily{}}
+	h.days[lastYear.Format(dataproviders.KeyDateFormat)] = 50000
+	if today.Day() > 1 {
+		h.days[today.AddDate(0, 0, -1).Format(dataproviders.KeyDateFormat)] = 4000
+	}
+
+	w := httptest.NewRecorder()
+	CompareHandler(w, httptest.NewRequest("GET", "/compare?plants=big,stale,small,none&rank=month", nil),
+		nil, plants, pvStore, h)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected a comparison, got %d %s", w.Code, w.Body.String())
+	}
+	reply := compareReply{}
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(reply.Plants) != 4 || reply.Plants[3].PlantKey != "none" || reply.Plants[3].Rank != 0 {
+		t.Fatalf("Expected a plant without capacity last and unranked, %s", w.Body.String())
+	}
+	small := reply.Plants[0]
+	expected := float32(1)
+	if today.Day() > 1 {
+		expected = 5
+	}
+	if small.PlantKey != "small" || small.Rank != 1 || small.YieldToday != 1 || small.YieldMonth != expected {
+		t.Errorf("Expected small to be best this month, %s", w.Body.String())
+	}
+	if small.PowerPercent != 50 || small.YieldYear != expected {
+		t.Errorf("Compared small wrong, %s", w.Body.String())
+	}
+	stale := reply.Plants[1]
+	if stale.PlantKey != "stale" || stale.YieldToday != 0 || stale.YieldMonth != expected-1 || stale.YieldYear != expected-1 {
+		t.Errorf("Expected no energy today of a plant last updated yesterday, %s", w.Body.String())
+	}
+	if h.calls != 3 || h.ranges != 0 {
+		t.Errorf("Expected the daily energy to be used instead of the samples, %d calls and %d ranges", h.calls, h.ranges)
+	}
+
+	w = httptest.NewRecorder()
+	CompareHandler(w, httptest.NewRequest("GET", "/compare?plants=small&rank=best", nil), nil, plants, pvStore, h)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown rank to be rejected, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	CompareHandler(w, httptest.NewRequest("GET", "/compare?plants=small,nosuchplant", nil), nil, plants, pvStore, h)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown plant to be not found, got %d", w.Code)
+	}
+}
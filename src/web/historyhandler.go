@@ -0,0 +1,143 @@
+package web
+
+import (
+	"dataproviders"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const monthFormat = "2006-01"
+const dayFormat = "2006-01-02"
+
+type historyReply struct {
+	PlantKey   string
+	From       time.Time
+	To         time.Time
+	Resolution string
+	Samples    []dataproviders.PvSample
+}
+
+type dailyReply struct {
+	PlantKey string
+	Month    string
+	// Energy produced in Wh per day, key is YYYYMMDD
+	Days dataproviders.PvDataDaily
+}
+
+// The longest span a history request may cover, by resolution. The history
+// is read a day at a time, and raw samples are returned as they are.
+var maxHistorySpan = map[dataproviders.Resolution]time.Duration{
+	dataproviders.Raw:         2 * 24 * time.Hour,
+	dataproviders.FiveMinutes: 31 * 24 * time.Hour,
+	dataproviders.Hourly:      366 * 24 * time.Hour,
+	dataproviders.Daily:       366 * 24 * time.Hour,
+}
+
+// Serves /plant/{key}/history?from=&to=&resolution=
+// from and to are either RFC3339 or YYYY-MM-DD, and defaults to today.
+// resolution is raw, 5m, hourly or daily, see maxHistorySpan for how far
+// from and to may be apart.
+func HistoryHandler(w http.ResponseWriter, r *http.Request,
+	plantkey string, historyStore dataproviders.HistoryStore) {
+	if historyStore == nil {
+		http.Error(w, "No history is kept", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	from, err := parseTime(q.Get("from"), midnight())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseTime(q.Get("to"), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !from.Before(to) {
+		http.Error(w, fmt.Sprintf("from %s must be before to %s", from, to), http.StatusBadRequest)
+		return
+	}
+	resolution, err := dataproviders.ParseResolution(q.Get("resolution"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if max := maxHistorySpan[resolution]; to.Sub(from) > max {
+		http.Error(w, fmt.Sprintf("from and to must be at most %d days apart with resolution %s",
+			int(max.Hours()/24), resolutionName(q.Get("resolution"))), http.StatusBadRequest)
+		return
+	}
+
+	samples, err := historyStore.Range(plantkey, from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, historyReply{plantkey, from, to, resolutionName(q.Get("resolution")),
+		dataproviders.Downsample(samples, resolution)})
+}
+
+// Serves /plant/{key}/daily?month=YYYY-MM, month defaults to the current
+func DailyHandler(w http.ResponseWriter, r *http.Request,
+	plantkey string, historyStore dataproviders.HistoryStore) {
+	if historyStore == nil {
+		http.Error(w, "No history is kept", http.StatusNotFound)
+		return
+	}
+	month := r.URL.Query().Get("month")
+	if month == "" {
+		month = time.Now().Format(monthFormat)
+	}
+	start, err := time.ParseInLocation(monthFormat, month, time.Local)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Bad month %s, use YYYY-MM", month), http.StatusBadRequest)
+		return
+	}
+
+	days, err := dataproviders.DailyEnergy(historyStore, plantkey, start, start.AddDate(0, 1, 0))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, dailyReply{plantkey, month, days})
+}
+
+func parseTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err == nil {
+		return t, nil
+	}
+	t, err = time.ParseInLocation(dayFormat, s, time.Local)
+	if err != nil {
+		return t, fmt.Errorf("Bad time %s, use RFC3339 or YYYY-MM-DD", s)
+	}
+	return t, nil
+}
+
+func resolutionName(s string) string {
+	if s == "" {
+		return "raw"
+	}
+	return s
+}
+
+func midnight() time.Time {
+	y, m, d := time.Now().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
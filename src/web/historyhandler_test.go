@@ -0,0 +1,138 @@
+package web
+
+import (
+	"dataproviders"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+/*
+To run test export GOPATH=/Users/jbr/github/local/solarcompare
+then
+go test -test.v web
+*/
+
+// Serves the samples given, and counts the days asked for
+type testHistoryStore struct {
+	samples []dataproviders.PvSample
+	ranges  int
+}
+
+func (h *testHistoryStore) Append(plantkey string, sample dataproviders.PvSample) error {
+	h.samples = append(h.samples, sample)
+	return nil
+}
+
+func (h *testHistoryStore) Range(plantkey string, from time.Time, to time.Time) ([]dataproviders.PvSample, error) {
+	h.ranges++
+	samples := []dataproviders.PvSample{}
+	for _, s := range h.samples {
+		if !s.Time.Before(from) && s.Time.Before(to) {
+			samples = append(samples, s)
+		}
+	}
+	return samples, nil
+}
+
+func historyRequest(h *testHistoryStore, query string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	HistoryHandler(w, httptest.NewRequest("GET", "/plant/p/history?"+query, nil), "p", h)
+	return w
+}
+
+func Test_history(t *testing.T) {
+	day := time.Date(2015, 6, 1, 0, 0, 0, 0, time.Local)
+	h := &testHistoryStore{}
+	for i := 0; i < 24; i++ {
+		h.Append("p", dataproviders.PvSample{Time: day.Add(time.Duration(i) * time.Hour),
+			PowerAc: dataproviders.Watt(i * 100), EnergyToday: dataproviders.WattHour(i * 50)})
+	}
+
+	w := historyRequest(h, "from=2015-06-01&to=2015-06-02&resolution=raw")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the history, got %d %s", w.Code, w.Body.String())
+	}
+	reply := historyReply{}
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+		t.Fatal(err.Error())
+	}
+	if reply.PlantKey != "p" || reply.Resolution != "raw" || len(reply.Samples) != 24 || reply.Samples[23].PowerAc != 2300 {
+		t.Errorf("History replied wrong, %s", w.Body.String())
+	}
+
+	w = historyRequest(h, "from=2015-06-01&to=2015-06-02&resolution=daily")
+	reply = historyReply{}
+	json.Unmarshal(w.Body.Bytes(), &reply)
+	if w.Code != http.StatusOK || len(reply.Samples) != 1 {
+		t.Errorf("Expected one daily sample, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func Test_history_rejected(t *testing.T) {
+	h := &testHistoryStore{}
+	for _, query := range []string{
+		"from=yesterday",
+		"from=2015-06-02&to=2015-06-01",
+		"from=2015-06-01&to=2015-06-02&resolution=weekly",
+		// Would read a file per day since year 1
+		"from=0001-01-01&resolution=daily",
+		"from=2014-01-01&to=2015-06-01&resolution=hourly",
+		"from=2015-06-01&to=2015-08-01&resolution=5m",
+		"from=2015-06-01&to=2015-06-04",
+		"from=2015-06-01&to=2015-06-04&resolution=raw",
+	} {
+		if w := historyRequest(h, query); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be rejected, got %d %s", query, w.Code, w.Body.String())
+		}
+	}
+	if h.ranges != 0 {
+		t.Errorf("Expected no history to be read for a rejected request, was read %d times", h.ranges)
+	}
+
+	// The longest spans allowed
+	for _, query := range []string{
+		"from=2014-06-01&to=2015-06-01&resolution=daily",
+		"from=2015-06-01&to=2015-07-01&resolution=5m",
+		"from=2015-06-01&to=2015-06-03",
+	} {
+		if w := historyRequest(h, query); w.Code != http.StatusOK {
+			t.Errorf("Expected %s to be served, got %d %s", query, w.Code, w.Body.String())
+		}
+	}
+
+	w := httptest.NewRecorder()
+	HistoryHandler(w, httptest.NewRequest("GET", "/plant/p/history", nil), "p", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected no history without a store, got %d", w.Code)
+	}
+}
+
+func Test_daily(t *testing.T) {
+	h := &testHistoryStore{}
+	for _, day := range []int{1, 2, 30} {
+		t0 := time.Date(2015, 6, day, 12, 0, 0, 0, time.Local)
+		h.Append("p", dataproviders.PvSample{Time: t0, EnergyToday: dataproviders.WattHour(day * 1000)})
+		h.Append("p", dataproviders.PvSample{Time: t0.Add(time.Hour), EnergyToday: dataproviders.WattHour(day*1000 + 500)})
+	}
+	// Next month
+	h.Append("p", dataproviders.PvSample{Time: time.Date(2015, 7, 1, 12, 0, 0, 0, time.Local), EnergyToday: 7000})
+
+	w := httptest.NewRecorder()
+	DailyHandler(w, httptest.NewRequest("GET", "/plant/p/daily?month=2015-06", nil), "p", h)
+	reply := dailyReply{}
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+		t.Fatalf("Bad daily reply %d %s", w.Code, w.Body.String())
+	}
+	if len(reply.Days) != 3 || reply.Days["20150601"] != 1500 || reply.Days["20150630"] != 30500 {
+		t.Errorf("Daily replied wrong, %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	DailyHandler(w, httptest.NewRequest("GET", "/plant/p/daily?month=june", nil), "p", h)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a bad month to be rejected, got %d", w.Code)
+	}
+}
@@ -0,0 +1,248 @@
+package web
+
+import (
+	"controller"
+	"dataproviders"
+	"dataproviders/ingest"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"plantdata"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Largest body accepted from a logger
+const maxIngestBody = 16 * 1024
+
+// How far ahead of our clock the time of a reading may be, for loggers with a skewed clock
+const maxIngestAhead = 5 * time.Minute
+
+// How old a reading may be. Older readings are not live data,
+// and would set the energy of a day that has passed
+const maxIngestAge = time.Hour
+
+// Values posted by a logger, fields not posted are left as they are
+type ingestData struct {
+	PowerAc     *dataproviders.Watt
+	EnergyToday *dataproviders.WattHour
+	EnergyTotal *dataproviders.KiloWattHour
+	VoltDc      *float32
+	AmpereAc    *float32
+	State       *string
+	// Each DC input and AC phase, VoltDc and AmpereAc are taken from them if not posted
+	Strings     []dataproviders.StringData
+	Phases      []dataproviders.PhaseData
+	Frequency   *float32
+	Temperature *float32
+	// When the values were read, default now
+	Time *time.Time
+}
+
+// Receives data posted by the logger of a plant, for plants
+// with the ingest provider, on POST /ingest/{plantkey}, or for
+// an inverter with the ingest provider on POST /ingest/{plantkey}.{inverterkey}.
+// The logger authenticates with the token of the plant, either as
+// Authorization: Bearer {token} or as X-Pvoutput-Apikey: {token}.
+// The body is either PvData json, with Strings and Phases if the logger
+// knows them, or PVOutput addstatus parameters,
+// v1 energy today in Wh, or energy total if c1=1, v2 power in W,
+// v6 voltage in V, and d and t the date and time of the reading.
+// A reading more than 5 minutes ahead, or more than an hour old, is rejected.
+func IngestHandler(w http.ResponseWriter, r *http.Request,
+	c *controller.Controller, pg PlantDataGetter, devappserver bool) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if c == nil {
+		http.Error(w, "Controller not started", http.StatusInternalServerError)
+		return
+	}
+	// An inverter of a plant with more than one is posted to as plantkey.inverterkey
+	key := PlantKey(r.URL.String(), devappserver)
+	plantkey, inverterkey := key, ""
+	if i := strings.Index(key, dataproviders.SubKeySeparator); i >= 0 {
+		plantkey, inverterkey = key[:i], key[i+1:]
+	}
+	plant := pg.PlantData(plantkey)
+	if plant == nil || providerName(plant, inverterkey) != ingest.ProviderName {
+		http.Error(w, fmt.Sprintf("404: Plant %s does not accept posted data", key), http.StatusNotFound)
+		return
+	}
+	// Authorized, and the data checked, before the provider is started,
+	// so an unknown logger can not start it
+	initiateData, err := c.InitiateData(plant, inverterkey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ingest.Authorize(&initiateData, ingestToken(r)) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxIngestBody)
+	var data ingestData
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		err = json.NewDecoder(r.Body).Decode(&data)
+	} else {
+		data, err = parsePvOutput(r)
+	}
+	if err == nil {
+		err = data.checkTime(time.Now())
+	}
+	if err != nil {
+		http.Error(w, "Bad data: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err = c.Provider(plant); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	provider, ok := c.Live(plantkey)
+	if aggregate, isAggregate := provider.(*dataproviders.Aggregate); ok && isAggregate {
+		provider, ok = aggregate.Inverter(inverterkey)
+	}
+	pusher, isPusher := provider.(dataproviders.Pusher)
+	if !ok || !isPusher {
+		http.Error(w, "Provider not running", http.StatusServiceUnavailable)
+		return
+	}
+	if err = pusher.Push(data.apply); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// The provider of the plant, or of its inverter with the key
+func providerName(plant *plantdata.PlantData, inverterkey string) string {
+	if inverterkey == "" {
+		return plant.DataProvider
+	}
+	for _, inv := range plant.Inverters {
+		if inv.Key == inverterkey {
+			return inv.DataProvider
+		}
+	}
+	return ""
+}
+
+func ingestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return auth[len("Bearer "):]
+	}
+	return r.Header.Get("X-Pvoutput-Apikey")
+}
+
+// Parse the parameters of a PVOutput addstatus request
+func parsePvOutput(r *http.Request) (data ingestData, err error) {
+	if err = r.ParseForm(); err != nil {
+		return
+	}
+	number := func(name string) (f float64, ok bool) {
+		s := r.Form.Get(name)
+		if s == "" || err != nil {
+			return
+		}
+		f, err = strconv.ParseFloat(s, 64)
+		if err != nil || f < 0 {
+			err = fmt.Errorf("%s must be a positive number, was %s", name, s)
+			return 0, false
+		}
+		return f, true
+	}
+	if v1, ok := number("v1"); ok {
+		if r.Form.Get("c1") == "1" {
+			total := dataproviders.KiloWattHour(v1 / 1000)
+			data.EnergyTotal = &total
+		} else if today, terr := dataproviders.ToWattHour(v1); terr != nil {
+			err = fmt.Errorf("v1: %s", terr.Error())
+		} else {
+			data.EnergyToday = &today
+		}
+	}
+	if v2, ok := number("v2"); ok {
+		if power, perr := dataproviders.ToWatt(v2); perr != nil {
+			err = fmt.Errorf("v2: %s", perr.Error())
+		} else {
+			data.PowerAc = &power
+		}
+	}
+	if v6, ok := number("v6"); ok {
+		volt := float32(v6)
+		data.VoltDc = &volt
+	}
+	if err != nil {
+		return
+	}
+	if data.PowerAc == nil && data.EnergyToday == nil && data.EnergyTotal == nil {
+		err = fmt.Errorf("v1 or v2 is required")
+		return
+	}
+	if d := r.Form.Get("d"); d != "" {
+		t, perr := time.ParseInLocation("20060102 15:04", d+" "+r.Form.Get("t"), time.Local)
+		if perr != nil {
+			err = fmt.Errorf("Bad date and time %s %s", d, r.Form.Get("t"))
+			return
+		}
+		data.Time = &t
+	}
+	return
+}
+
+// A reading in the future, or too old, is rejected
+func (data *ingestData) checkTime(now time.Time) error {
+	if data.Time == nil {
+		return nil
+	}
+	if data.Time.After(now.Add(maxIngestAhead)) {
+		return fmt.Errorf("Time %s is in the future", data.Time.Format(time.RFC3339))
+	}
+	if data.Time.Before(now.Add(-maxIngestAge)) {
+		return fmt.Errorf("Time %s is more than %s old", data.Time.Format(time.RFC3339), maxIngestAge)
+	}
+	return nil
+}
+
+func (data *ingestData) apply(pv *dataproviders.PvData) error {
+	if data.PowerAc != nil {
+		pv.PowerAc = *data.PowerAc
+	}
+	if data.EnergyToday != nil {
+		pv.EnergyToday = *data.EnergyToday
+	}
+	if data.EnergyTotal != nil {
+		pv.EnergyTotal = *data.EnergyTotal
+	}
+	if data.Strings != nil {
+		pv.SetStrings(data.Strings)
+	}
+	if data.Phases != nil {
+		pv.SetPhases(data.Phases)
+	}
+	if data.Frequency != nil {
+		pv.Frequency = *data.Frequency
+	}
+	if data.Temperature != nil {
+		pv.Temperature = *data.Temperature
+	}
+	if data.VoltDc != nil {
+		pv.VoltDc = *data.VoltDc
+	}
+	if data.AmpereAc != nil {
+		pv.AmpereAc = *data.AmpereAc
+	}
+	if data.State != nil {
+		pv.State = *data.State
+	}
+	if data.Time != nil {
+		pv.LatestUpdate = data.Time
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package web
+
+import (
+	"context"
+	"controller"
+	"dataproviders"
+	"net/http"
+	"net/http/httptest"
+	"plantdata"
+	"strings"
+	"testing"
+	"time"
+)
+
+func ingestPlants() testPlants {
+	return testPlants{
+		"p": {PlantKey: "p", DataProvider: "ingest",
+			InitiateData: dataproviders.InitiateData{PlantKey: "p", Password: "TOKEN"}},
+		"polled": {PlantKey: "polled", DataProvider: "webtest",
+			InitiateData: dataproviders.InitiateData{PlantKey: "polled", Password: "TOKEN"}},
+		"multi": {PlantKey: "multi", Inverters: []plantdata.InverterSource{
+			{Key: "east", DataProvider: "ingest", InitiateData: dataproviders.InitiateData{PlantKey: "multi.east", Password: "EAST"}},
+			{Key: "west", DataProvider: "webtest"},
+		}},
+	}
+}
+
+func ingestRequest(c *controller.Controller, plants testPlants, url string,
+	header string, contentType string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", url, strings.NewReader(body))
+	if header != "" {
+		kv := strings.SplitN(header, ": ", 2)
+		r.Header.Set(kv[0], kv[1])
+	}
+	r.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	IngestHandler(w, r, c, plants, true)
+	return w
+}
+
+// Wait up to a second for the pushed data to be stored
+func waitPv(store *brokerStore, plantkey string, ok func(pv dataproviders.PvData) bool) dataproviders.PvData {
+	for i := 0; i < 100 && !ok(store.Get(plantkey)); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return store.Get(plantkey)
+}
+
+func Test_ingest_auth(t *testing.T) {
+	c := newTestController(newBrokerStore())
+	plants := ingestPlants()
+	body := `{"PowerAc": 100}`
+	for _, header := range []string{"", "Authorization: Bearer WRONG", "Authorization: TOKEN",
+		"X-Pvoutput-Apikey: TOKE", "Authorization: Bearer EAST"} {
+		w := ingestRequest(&c, plants, "/ingest/p", header, "application/json", body)
+		if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("Expected '%s' to be unauthorized, got %d", header, w.Code)
+		}
+	}
+	if w := ingestRequest(&c, plants, "/ingest/multi.east", "Authorization: Bearer TOKEN", "application/json", body); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected an inverter to take its own token only, got %d", w.Code)
+	}
+	// An unknown logger must not start the provider
+	if plants := c.LivePlants(); len(plants) != 0 {
+		t.Errorf("Expected no provider started by unauthorized requests, %v", plants)
+	}
+}
+
+func Test_ingest(t *testing.T) {
+	store := newBrokerStore()
+	c := newTestController(store)
+	plants := ingestPlants()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		c.Stop(ctx, "p")
+		c.Stop(ctx, "multi")
+	}()
+
+	at := time.Now().Add(-time.Minute).Truncate(time.Second)
+	w := ingestRequest(&c, plants, "/ingest/p", "Authorization: Bearer TOKEN", "application/json",
+		`{"PowerAc": 2451, "EnergyToday": 3000, "Phases": [{"VoltAc": 230, "AmpereAc": 3.5}], "Time": "`+at.Format(time.RFC3339)+`"}`)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected the json to be taken, got %d %s", w.Code, w.Body.String())
+	}
+	pv := waitPv(store, "p", func(pv dataproviders.PvData) bool { return pv.PowerAc == 2451 })
+	if pv.PowerAc != 2451 || pv.EnergyToday != 3000 || pv.AmpereAc != 3.5 ||
+		pv.LatestUpdate == nil || !pv.LatestUpdate.Equal(at) {
+		t.Errorf("Json not applied, pvdata is %s", pv.ToJson())
+	}
+
+	// PVOutput addstatus parameters, fields not posted are kept
+	at = time.Now().Truncate(time.Minute)
+	w = ingestRequest(&c, plants, "/ingest/p", "X-Pvoutput-Apikey: TOKEN", "application/x-www-form-urlencoded",
+		"v2=1200&v6=401.5&d="+at.Format("20060102")+"&t="+at.Format("15:04"))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected the addstatus to be taken, got %d %s", w.Code, w.Body.String())
+	}
+	pv = waitPv(store, "p", func(pv dataproviders.PvData) bool { return pv.PowerAc == 1200 })
+	if pv.PowerAc != 1200 || pv.VoltDc != 401.5 || pv.EnergyToday != 3000 || !pv.LatestUpdate.Equal(at) {
+		t.Errorf("Addstatus not applied, pvdata is %s", pv.ToJson())
+	}
+	w = ingestRequest(&c, plants, "/ingest/p", "X-Pvoutput-Apikey: TOKEN", "application/x-www-form-urlencoded",
+		"v1=12345000&c1=1")
+	pv = waitPv(store, "p", func(pv dataproviders.PvData) bool { return pv.EnergyTotal == 12345 })
+	if w.Code != http.StatusNoContent || pv.EnergyTotal != 12345 || pv.EnergyToday != 3000 {
+		t.Errorf("Expected v1 with c1=1 to be the energy total, got %d, pvdata is %s", w.Code, pv.ToJson())
+	}
+
+	// The inverter of a plant with more than one
+	w = ingestRequest(&c, plants, "/ingest/multi.east", "Authorization: Bearer EAST", "application/json", `{"PowerAc": 700}`)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected the inverter to take the json, got %d %s", w.Code, w.Body.String())
+	}
+	if pv = waitPv(store, "multi.east", func(pv dataproviders.PvData) bool { return pv.PowerAc == 700 }); pv.PowerAc != 700 {
+		t.Errorf("Json not applied to the inverter, pvdata is %s", pv.ToJson())
+	}
+}
+
+func Test_ingest_rejected(t *testing.T) {
+	c := newTestController(newBrokerStore())
+	plants := ingestPlants()
+	future := time.Now().Add(10 * time.Minute)
+	old := time.Now().Add(-2 * time.Hour)
+	for _, r := range []struct {
+		url, header, contentType, body string
+		code                           int
+		msg                            string
+	}{
+		{"/ingest/nosuchplant", "Authorization: Bearer TOKEN", "application/json", `{"PowerAc": 1}`, http.StatusNotFound, "does not accept"},
+		{"/ingest/polled", "Authorization: Bearer TOKEN", "application/json", `{"PowerAc": 1}`, http.StatusNotFound, "does not accept"},
+		{"/ingest/multi.west", "Authorization: Bearer TOKEN", "application/json", `{"PowerAc": 1}`, http.StatusNotFound, "does not accept"},
+		{"/ingest/multi.north", "Authorization: Bearer EAST", "application/json", `{"PowerAc": 1}`, http.StatusNotFound, "does not accept"},
+		{"/ingest/p", "Authorization: Bearer TOKEN", "application/json", `{"PowerAc": "many"}`, http.StatusBadRequest, "Bad data"},
+		{"/ingest/p", "Authorization: Bearer TOKEN", "application/json", `{"PowerAc": 1, "Phases": [` + strings.Repeat(`{"VoltAc": 230},`, maxIngestBody/10) + `{}]}`, http.StatusBadRequest, "Bad data"},
+		{"/ingest/p", "Authorization: Bearer TOKEN", "application/json", `{"PowerAc": 1, "Time": "` + future.Format(time.RFC3339) + `"}`, http.StatusBadRequest, "in the future"},
+		{"/ingest/p", "Authorization: Bearer TOKEN", "application/json", `{"PowerAc": 1, "Time": "` + old.Format(time.RFC3339) + `"}`, http.StatusBadRequest, "old"},
+		{"/ingest/p", "X-Pvoutput-Apikey: TOKEN", "application/x-www-form-urlencoded", "v6=230", http.StatusBadRequest, "v1 or v2 is required"},
+		{"/ingest/p", "X-Pvoutput-Apikey: TOKEN", "application/x-www-form-urlencoded", "v2=-5", http.StatusBadRequest, "v2 must be a positive number"},
+		{"/ingest/p", "X-Pvoutput-Apikey: TOKEN", "application/x-www-form-urlencoded", "v1=abc", http.StatusBadRequest, "v1 must be a positive number"},
+		{"/ingest/p", "X-Pvoutput-Apikey: TOKEN", "application/x-www-form-urlencoded", "v2=100&d=20150601&t=noon", http.StatusBadRequest, "Bad date and time"},
+		{"/ingest/p", "X-Pvoutput-Apikey: TOKEN", "application/x-www-form-urlencoded", "v2=100&d=" + old.Format("20060102") + "&t=" + old.Format("15:04"), http.StatusBadRequest, "old"},
+	} {
+		w := ingestRequest(&c, plants, r.url, r.header, r.contentType, r.body)
+		if w.Code != r.code || !strings.Contains(w.Body.String(), r.msg) {
+			t.Errorf("Expected %s %s to fail with %d %s, got %d %s",
+				r.url, r.body, r.code, r.msg, w.Code, w.Body.String())
+		}
+	}
+	if plants := c.LivePlants(); len(plants) != 0 {
+		t.Errorf("Expected no provider started by rejected requests, %v", plants)
+	}
+
+	w := httptest.NewRecorder()
+	IngestHandler(w, httptest.NewRequest("GET", "/ingest/p", nil), &c, plants, true)
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "POST" {
+		t.Errorf("Expected only POST to be allowed, got %d", w.Code)
+	}
+}
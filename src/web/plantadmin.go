@@ -0,0 +1,134 @@
+package web
+
+import (
+	"config"
+	"context"
+	"controller"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"plantdata"
+	"secrets"
+	"time"
+)
+
+// Largest plant config accepted
+const maxPlantBody = 64 * 1024
+
+// Serves the plant management api
+//   POST /plant/ registers a new plant
+//   PUT /plant/{key} updates or registers the plant
+//   DELETE /plant/{key} removes the plant
+// The body is a plant as written in the config file.
+// Requests must carry the header Authorization: Bearer {adminToken}.
+// If no adminToken is configured, the api is disabled.
+// Plants with credentials are refused if there is no master key to encrypt
+// them with, as they would be stored in plain text.
+func PlantAdminHandler(w http.ResponseWriter, r *http.Request,
+	c *controller.Controller, repo plantdata.Repository,
+	adminToken string, devappserver bool) {
+	if adminToken == "" {
+		http.Error(w, "Plant management is disabled, no admin token is configured", http.StatusForbidden)
+		return
+	}
+	auth := []byte(r.Header.Get("Authorization"))
+	if subtle.ConstantTimeCompare(auth, []byte("Bearer "+adminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if c == nil {
+		http.Error(w, "Controller not started", http.StatusInternalServerError)
+		return
+	}
+
+	plantkey := PlantKey(r.URL.String(), devappserver)
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	switch r.Method {
+	case "POST":
+		if plantkey != "" {
+			http.Error(w, "POST to /plant/ to register a plant, or PUT to /plant/{key}", http.StatusMethodNotAllowed)
+			return
+		}
+		putPlant(ctx, w, r, c, repo, "", false)
+	case "PUT":
+		if plantkey == "" {
+			http.Error(w, "No plant specified", http.StatusBadRequest)
+			return
+		}
+		putPlant(ctx, w, r, c, repo, plantkey, true)
+	case "DELETE":
+		old, err := repo.Delete(plantkey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if old == nil {
+			http.Error(w, fmt.Sprintf("404: Plant %s not found", plantkey), http.StatusNotFound)
+			return
+		}
+		log.Infof("Plant %s was removed", plantkey)
+		if err = c.PlantChanged(ctx, old, nil); err != nil {
+			log.Failf("Could not stop provider for plant %s: %s", plantkey, err.Error())
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST, PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func putPlant(ctx context.Context, w http.ResponseWriter, r *http.Request,
+	c *controller.Controller, repo plantdata.Repository,
+	plantkey string, replace bool) {
+	pc := config.PlantConfig{}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPlantBody)).Decode(&pc)
+	if err != nil {
+		http.Error(w, "Bad plant: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if plantkey == "" {
+		plantkey = pc.PlantKey
+	} else if pc.PlantKey == "" {
+		pc.PlantKey = plantkey
+	}
+	if pc.PlantKey != plantkey {
+		http.Error(w, fmt.Sprintf("PlantKey %s does not match the url", pc.PlantKey), http.StatusBadRequest)
+		return
+	}
+	if !replace && repo.PlantData(plantkey) != nil {
+		http.Error(w, fmt.Sprintf("Plant %s allready exists", plantkey), http.StatusConflict)
+		return
+	}
+	f := config.File{Plants: []config.PlantConfig{pc}}
+	if err = f.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	plant := f.PlantData()[plantkey]
+	if repo.PlainCredentials(&plant) {
+		http.Error(w, fmt.Sprintf("Plant %s has credentials, that would be stored in plain text. "+
+			"Configure a master key in %s or with -keyfile to store them", plantkey, secrets.KeyEnv),
+			http.StatusForbidden)
+		return
+	}
+
+	old, err := repo.Put(plant)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Infof("Plant %s was stored", plantkey)
+	if err = c.PlantChanged(ctx, old, &plant); err != nil {
+		log.Failf("Could not restart provider for plant %s: %s", plantkey, err.Error())
+	}
+
+	b, _ := plant.ToJson()
+	w.Header().Set("Content-Type", "application/json")
+	if old == nil {
+		w.WriteHeader(http.StatusCreated)
+	}
+	w.Write(b)
+}
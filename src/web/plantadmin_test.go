@@ -0,0 +1,230 @@
+package web
+
+import (
+	"bytes"
+	"controller"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"persistence"
+	"plantdata"
+	"secrets"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type testRepository struct {
+	lock   sync.Mutex
+	plants map[string]plantdata.PlantData
+	// Has no master key
+	plain bool
+}
+
+func (r *testRepository) PlainCredentials(plant *plantdata.PlantData) bool {
+	return r.plain && (plant.InitiateData.UserName != "" || plant.InitiateData.Password != "")
+}
+
+func (r *testRepository) PlantData(plantkey string) *plantdata.PlantData {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	p, ok := r.plants[plantkey]
+	if !ok {
+		return nil
+	}
+	return &p
+}
+
+func (r *testRepository) Put(plant plantdata.PlantData) (*plantdata.PlantData, error) {
+	old := r.PlantData(plant.PlantKey)
+	r.lock.Lock()
+	r.plants[plant.PlantKey] = plant
+	r.lock.Unlock()
+	return old, nil
+}
+
+func (r *testRepository) Delete(plantkey string) (*plantdata.PlantData, error) {
+	old := r.PlantData(plantkey)
+	r.lock.Lock()
+	delete(r.plants, plantkey)
+	r.lock.Unlock()
+	return old, nil
+}
+
+func adminRequest(c *controller.Controller, repo plantdata.Repository, token string,
+	method string, url string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	PlantAdminHandler(w, r, c, repo, "secret", true)
+	return w
+}
+
+func Test_plantadmin_auth(t *testing.T) {
+	c := newTestController(newBrokerStore())
+	repo := &testRepository{plants: map[string]plantdata.PlantData{}}
+	body := `{"PlantKey": "a", "Provider": "webtest"}`
+
+	w := httptest.NewRecorder()
+	PlantAdminHandler(w, httptest.NewRequest("POST", "/plant/", strings.NewReader(body)), &c, repo, "", true)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected the api to be disabled without a token, got %d", w.Code)
+	}
+	for _, token := range []string{"", "wrong", "secre"} {
+		if w = adminRequest(&c, repo, token, "POST", "/plant/", body); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected token '%s' to be unauthorized, got %d", token, w.Code)
+		}
+	}
+	if len(repo.plants) != 0 {
+		t.Errorf("Expected no plant stored by unauthorized requests, %v", repo.plants)
+	}
+}
+
+func Test_plantadmin(t *testing.T) {
+	c := newTestController(newBrokerStore())
+	repo := &testRepository{plants: map[string]plantdata.PlantData{}}
+
+	w := adminRequest(&c, repo, "secret", "POST", "/plant/",
+		`{"PlantKey": "a", "Name": "Roof", "Provider": "webtest", "InitiateData": {"Address": "10.0.0.1"}}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected the plant to be created, got %d %s", w.Code, w.Body.String())
+	}
+	plant := plantdata.PlantData{}
+	if err := json.Unmarshal(w.Body.Bytes(), &plant); err != nil || plant.PlantKey != "a" || plant.Name != "Roof" {
+		t.Errorf("Expected the stored plant in the reply, %s", w.Body.String())
+	}
+	if p := repo.PlantData("a"); p == nil || p.InitiateData.PlantKey != "a" {
+		t.Fatalf("Expected the plant to be stored with its key in the InitiateData, %v", p)
+	}
+
+	if w = adminRequest(&c, repo, "secret", "POST", "/plant/", `{"PlantKey": "a", "Provider": "webtest"}`); w.Code != http.StatusConflict {
+		t.Errorf("Expected a second POST of the plant to conflict, got %d", w.Code)
+	}
+
+	// A live plant is restarted when its provider changes
+	if err := c.Provider(repo.PlantData("a")); err != nil {
+		t.Fatal(err.Error())
+	}
+	before, _ := c.Live("a")
+	w = adminRequest(&c, repo, "secret", "PUT", "/plant/a",
+		`{"Name": "Roof", "Provider": "webtest", "InitiateData": {"Address": "10.0.0.2"}}`)
+	if w.Code != http.StatusOK || repo.PlantData("a").InitiateData.Address != "10.0.0.2" {
+		t.Fatalf("Expected the plant to be updated, got %d %s", w.Code, w.Body.String())
+	}
+	if after, ok := c.Live("a"); !ok || after == before {
+		t.Error("Expected the provider of the changed plant to be restarted")
+	}
+
+	if w = adminRequest(&c, repo, "secret", "DELETE", "/plant/a", ""); w.Code != http.StatusNoContent {
+		t.Errorf("Expected the plant to be deleted, got %d %s", w.Code, w.Body.String())
+	}
+	if _, ok := c.Live("a"); ok || repo.PlantData("a") != nil {
+		t.Error("Expected the deleted plant to be removed and its provider stopped")
+	}
+	if w = adminRequest(&c, repo, "secret", "DELETE", "/plant/a", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected deleting an unknown plant to be not found, got %d", w.Code)
+	}
+}
+
+func Test_plantadmin_rejected(t *testing.T) {
+	c := newTestController(newBrokerStore())
+	repo := &testRepository{plants: map[string]plantdata.PlantData{}}
+	for _, r := range []struct {
+		method, url, body string
+		code              int
+		msg               string
+	}{
+		{"POST", "/plant/", `{"PlantKey": "a", "Provider": `, http.StatusBadRequest, "Bad plant"},
+		{"POST", "/plant/", `{"PlantKey": "a", "Provider": "nosuchprovider"}`, http.StatusBadRequest, "Unknown provider 'nosuchprovider'"},
+		{"POST", "/plant/", `{"Provider": "webtest"}`, http.StatusBadRequest, "PlantKey is missing"},
+		{"POST", "/plant/", `{"PlantKey": "a.b", "Provider": "webtest"}`, http.StatusBadRequest, ""},
+		{"POST", "/plant/a", `{"PlantKey": "a", "Provider": "webtest"}`, http.StatusMethodNotAllowed, ""},
+		{"PUT", "/plant/a", `{"PlantKey": "b", "Provider": "webtest"}`, http.StatusBadRequest, "does not match the url"},
+		{"PUT", "/plant/", `{"PlantKey": "a", "Provider": "webtest"}`, http.StatusBadRequest, "No plant specified"},
+		{"PATCH", "/plant/a", `{}`, http.StatusMethodNotAllowed, ""},
+		{"PUT", "/plant/a", `{"PlantKey": "a", "Name": "` + strings.Repeat("x", maxPlantBody) + `"}`, http.StatusBadRequest, "Bad plant"},
+	} {
+		w := adminRequest(&c, repo, "secret", r.method, r.url, r.body)
+		if w.Code != r.code || !strings.Contains(w.Body.String(), r.msg) {
+			t.Errorf("Expected %s %s to fail with %d %s, got %d %s",
+				r.method, r.url, r.code, r.msg, w.Code, w.Body.String())
+		}
+	}
+	if len(repo.plants) != 0 {
+		t.Errorf("Expected no plant stored by rejected requests, %v", repo.plants)
+	}
+}
+
+func Test_plantadmin_plain_credentials(t *testing.T) {
+	c := newTestController(newBrokerStore())
+	repo := &testRepository{plants: map[string]plantdata.PlantData{}, plain: true}
+
+	w := adminRequest(&c, repo, "secret", "POST", "/plant/",
+		`{"PlantKey": "a", "Provider": "webtest", "InitiateData": {"UserName": "u", "Password": "p"}}`)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "plain text") {
+		t.Errorf("Expected plain credentials to be refused, got %d %s", w.Code, w.Body.String())
+	}
+	if repo.PlantData("a") != nil {
+		t.Error("Expected the plant not to be stored")
+	}
+	// A plant without credentials needs no key
+	w = adminRequest(&c, repo, "secret", "POST", "/plant/", `{"PlantKey": "a", "Provider": "webtest"}`)
+	if w.Code != http.StatusCreated {
+		t.Errorf("Expected a plant without credentials to be stored, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func Test_plantadmin_sealed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plantadmin")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "plants.json")
+	ioutil.WriteFile(path, []byte(`{"Plants": []}`), 0600)
+	keyring, err := secrets.NewKeyring(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	repo, err := persistence.NewFilePlantRepository(path, keyring)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	c := controller.NewController(func() *http.Client { return http.DefaultClient },
+		newBrokerStore(), nopStatsStore{}, nil, keyring)
+
+	body := `{"Name": "Roof", "Provider": "webtest", "InitiateData": {"UserName": "u", "Password": "p"}}`
+	if w := adminRequest(&c, repo, "secret", "PUT", "/plant/a", body); w.Code != http.StatusCreated {
+		t.Fatalf("Expected the plant to be created, got %d %s", w.Code, w.Body.String())
+	}
+	if p := repo.PlantData("a"); !secrets.IsSealed(p.InitiateData.Password) {
+		t.Fatalf("Expected the password to be sealed, was %s", p.InitiateData.Password)
+	}
+	if err = c.Provider(repo.PlantData("a")); err != nil {
+		t.Fatal(err.Error())
+	}
+	before, _ := c.Live("a")
+
+	// The same credentials again, and a change that is not of the provider
+	for _, body := range []string{body,
+		`{"Name": "Garage", "Provider": "webtest", "InitiateData": {"UserName": "u", "Password": "p"}}`} {
+		if w := adminRequest(&c, repo, "secret", "PUT", "/plant/a", body); w.Code != http.StatusOK {
+			t.Fatalf("Expected the plant to be updated, got %d %s", w.Code, w.Body.String())
+		}
+		if after, ok := c.Live("a"); !ok || after != before {
+			t.Errorf("Expected the provider to be left running for %s", body)
+		}
+	}
+
+	// New credentials restart it
+	w := adminRequest(&c, repo, "secret", "PUT", "/plant/a",
+		`{"Name": "Garage", "Provider": "webtest", "InitiateData": {"UserName": "u", "Password": "other"}}`)
+	if after, ok := c.Live("a"); w.Code != http.StatusOK || !ok || after == before {
+		t.Errorf("Expected the provider to be restarted with the new password, got %d", w.Code)
+	}
+}
@@ -1,14 +1,18 @@
 package web
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
 	"controller"
 	"plantdata"
 	"dataproviders"
+	"logger"
 )
 
+var log = logger.NewLogger(logger.INFO, "Web: ")
+
 type PlantDataGetter interface {
 	PlantData(plantkey string) *plantdata.PlantData
 	ToJson() []byte
@@ -17,6 +21,7 @@ type PlantDataGetter interface {
 func PlantHandler(w http.ResponseWriter, r *http.Request, 
 		c *controller.Controller, pg PlantDataGetter, 
 		pvStore dataproviders.PvStore,
+		historyStore dataproviders.HistoryStore,
 		devappserver bool) {
 	plantkey := PlantKey(r.URL.String(), devappserver)
 	if plantkey == "" {
@@ -39,6 +44,29 @@ func PlantHandler(w http.ResponseWriter, r *http.Request,
     	http.Error(w, err.Error(), http.StatusNotFound)
     	return
     }
+
+    action := PlantAction(r.URL.String(), devappserver)
+    switch action {
+    case "":
+    case "inverters":
+    	if len(plantdata.Inverters) == 0 {
+    		http.Error(w, fmt.Sprintf("404: Plant %s has no inverters", plantkey), http.StatusNotFound)
+    		return
+    	}
+    case "status":
+    	// Only tells about the provider, so it is not started
+    	writeJson(w, c.Status(plantkey))
+    	return
+    case "history":
+    	HistoryHandler(w, r, plantkey, historyStore)
+    	return
+    case "daily":
+    	DailyHandler(w, r, plantkey, historyStore)
+    	return
+    default:
+    	http.NotFound(w, r)
+    	return
+    }
     
     // Go to the controller with the plantdata
     // The controller will start up a plant service if its not allready live
@@ -50,6 +78,10 @@ func PlantHandler(w http.ResponseWriter, r *http.Request,
     }
     
 	w.Header().Set("Content-Type", "application/json")
+	if action == "inverters" {
+		w.Write(inverterJson(plantdata, pvStore))
+		return
+	}
 	pvdata := pvStore.Get(plantkey)
 	//pvdata, err := provider.PvData()
     if err != nil {
@@ -61,6 +93,22 @@ func PlantHandler(w http.ResponseWriter, r *http.Request,
     
 }
 
+// The pvdata of each inverter of the plant
+func inverterJson(plant *plantdata.PlantData, pvStore dataproviders.PvStore) []byte {
+	type inverter struct {
+		Key          string
+		DataProvider string
+		PvData       dataproviders.PvData
+	}
+	inverters := []inverter{}
+	for _, inv := range plant.Inverters {
+		inverters = append(inverters, inverter{inv.Key, inv.DataProvider,
+			pvStore.Get(dataproviders.SubKey(plant.PlantKey, inv.Key))})
+	}
+	b, _ := json.MarshalIndent(inverters, "", "  ")
+	return b
+}
+
 // List all known plants if no plantkey is given
 func listPlants(w http.ResponseWriter, pg PlantDataGetter) {
 	w.Header().Set("Content-Type", "application/json;  charset=utf-8")
@@ -68,13 +116,22 @@ func listPlants(w http.ResponseWriter, pg PlantDataGetter) {
 } 
 
 func PlantKey(url string, devappserver bool) string {
-	keypos := 2
+	return urlPart(url, 0, devappserver)
+}
+
+// The part of the url following the plantkey, eg. history in /plant/{key}/history
+func PlantAction(url string, devappserver bool) string {
+	return urlPart(url, 1, devappserver)
+}
+
+func urlPart(url string, offset int, devappserver bool) string {
+	keypos := 2 + offset
 	if !devappserver {
 		keypos += 2
 	} 
-	parts := strings.Split(url, "/")
+	parts := strings.Split(strings.Split(url, "?")[0], "/")
 	if len(parts) > keypos {
-		return strings.Split(parts[keypos], "?")[0]
+		return parts[keypos]
 	}
 	return ""
 }
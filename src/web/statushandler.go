@@ -0,0 +1,34 @@
+package web
+
+import (
+	"controller"
+	"dataproviders"
+	"net/http"
+)
+
+type PlantLister interface {
+	PlantKeys() []string
+}
+
+type statusReply struct {
+	// The number of plants in each state
+	States map[dataproviders.State]int
+	Plants []controller.PlantStatus
+}
+
+// Serves /status with the status of the provider of every plant,
+// and how many plants are in each state
+func StatusHandler(w http.ResponseWriter, r *http.Request,
+	c *controller.Controller, pl PlantLister) {
+	if c == nil {
+		http.Error(w, "Controller not started", http.StatusInternalServerError)
+		return
+	}
+	reply := statusReply{States: map[dataproviders.State]int{}, Plants: []controller.PlantStatus{}}
+	for _, plantkey := range pl.PlantKeys() {
+		s := c.Status(plantkey)
+		reply.States[s.State]++
+		reply.Plants = append(reply.Plants, s)
+	}
+	writeJson(w, reply)
+}
@@ -0,0 +1,104 @@
+package web
+
+import (
+	"controller"
+	"dataproviders"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"plantdata"
+	"strings"
+	"time"
+)
+
+// How often a comment is sent to keep proxies from closing the stream.
+// Also how often the providers are kicked, so they stay live while watched
+var keepAliveTime = 30 * time.Second
+
+// Serves /stream?plants=key1,key2 as Server-Sent Events.
+// An event named pvdata is sent with the current data of every plant when
+// the stream opens, and then every time new data is stored for one of them.
+func StreamHandler(w http.ResponseWriter, r *http.Request,
+	c *controller.Controller, pg PlantDataGetter,
+	pvStore dataproviders.PvStore) {
+	subscriber, ok := pvStore.(dataproviders.PvSubscriber)
+	if !ok {
+		http.Error(w, "Streaming is not supported by the store", http.StatusNotImplemented)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	if c == nil {
+		http.Error(w, "Controller not started", http.StatusInternalServerError)
+		return
+	}
+	keys := r.URL.Query().Get("plants")
+	if keys == "" {
+		http.Error(w, "No plants to stream, use ?plants=key1,key2", http.StatusBadRequest)
+		return
+	}
+	plants := []*plantdata.PlantData{}
+	for _, plantkey := range strings.Split(keys, ",") {
+		plant := pg.PlantData(plantkey)
+		if plant == nil {
+			http.Error(w, fmt.Sprintf("404: Plant %s not found", plantkey), http.StatusNotFound)
+			return
+		}
+		plants = append(plants, plant)
+	}
+
+	// Subscribe before starting the providers, so no update is missed
+	sub := subscriber.Subscribe(strings.Split(keys, ",")...)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	for _, plant := range plants {
+		if err := c.Provider(plant); err != nil {
+			log.Infof("Could not start provider for plant %s: %s", plant.PlantKey, err.Error())
+		}
+		pv := pvStore.Get(plant.PlantKey)
+		if err := writeEvent(w, dataproviders.PvUpdate{PlantKey: plant.PlantKey, PvData: pv}); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveTime)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case u, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if err := writeEvent(w, u); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			// Providers terminates after a while, start them again if watched
+			for _, plant := range plants {
+				c.Provider(plant)
+			}
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, u dataproviders.PvUpdate) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: pvdata\ndata: %s\n\n", b)
+	return err
+}
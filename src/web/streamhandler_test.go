@@ -0,0 +1,203 @@
+package web
+
+import (
+	"bufio"
+	"context"
+	"controller"
+	"dataproviders"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A PvStore that publishes every Set, like the one of the app
+type brokerStore struct {
+	lock sync.Mutex
+	pv   map[string]dataproviders.PvData
+	*dataproviders.Broker
+}
+
+func newBrokerStore() *brokerStore {
+	return &brokerStore{pv: map[string]dataproviders.PvData{}, Broker: dataproviders.NewBroker()}
+}
+
+func (s *brokerStore) Set(plantkey string, pv *dataproviders.PvData) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pv[plantkey] = *pv
+	s.Publish(plantkey, pv)
+}
+
+func (s *brokerStore) Get(plantkey string) dataproviders.PvData {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.pv[plantkey]
+}
+
+type nopStatsStore struct{}
+
+func (s nopStatsStore) LoadStats(plantkey string) dataproviders.PlantStats {
+	return dataproviders.PlantStats{}
+}
+func (s nopStatsStore) SaveStats(plantkey string, pv *dataproviders.PvData) {}
+
+// A provider that runs until it is stopped, without touching the store
+type idleProvider struct {
+	dataproviders.Lifecycle
+}
+
+func (p *idleProvider) Name() string {
+	return "Idle"
+}
+
+func (p *idleProvider) Capabilities() dataproviders.Capabilities {
+	return dataproviders.Capabilities{}
+}
+
+func (p *idleProvider) Start() error {
+	return p.Launch(func() {
+		p.SetState(dataproviders.Online)
+		<-p.Stopping()
+	})
+}
+
+func init() {
+	dataproviders.Register("webtest",
+		func(initiateData dataproviders.InitiateData,
+			term dataproviders.TerminateCallback,
+			client *http.Client,
+			pvStore dataproviders.PvStore,
+			statsStore dataproviders.PlantStatsStore,
+			historyStore dataproviders.HistoryStore) (dataproviders.DataProvider, error) {
+			return &idleProvider{}, nil
+		},
+		dataproviders.ConfigSchema{})
+}
+
+func newTestController(pvStore dataproviders.PvStore) controller.Controller {
+	return controller.NewController(func() *http.Client { return http.DefaultClient },
+		pvStore, nopStatsStore{}, nil, nil)
+}
+
+// Reads the next event or comment from the stream
+func readEvent(t *testing.T, r *bufio.Reader) []string {
+	lines := []string{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Stream ended, %s", err.Error())
+		}
+		if line == "\n" {
+			return lines
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+}
+
+func eventData(t *testing.T, lines []string) dataproviders.PvUpdate {
+	u := dataproviders.PvUpdate{}
+	if len(lines) != 2 || lines[0] != "event: pvdata" || !strings.HasPrefix(lines[1], "data: ") {
+		t.Fatalf("Expected a pvdata event, got %v", lines)
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &u); err != nil {
+		t.Fatal(err.Error())
+	}
+	return u
+}
+
+func Test_stream(t *testing.T) {
+	defer func(d time.Duration) { keepAliveTime = d }(keepAliveTime)
+	keepAliveTime = 50 * time.Millisecond
+
+	store := newBrokerStore()
+	store.Set("a", &dataproviders.PvData{PowerAc: 100})
+	c := newTestController(store)
+	plants := testPlants{
+		"a": {PlantKey: "a", DataProvider: "webtest"},
+		"b": {PlantKey: "b", DataProvider: "webtest"},
+	}
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		StreamHandler(w, r, &c, plants, store)
+		close(done)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequest("GET", server.URL+"/stream?plants=a,b", nil)
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Expected an event stream, got %s", resp.Header.Get("Content-Type"))
+	}
+	r := bufio.NewReader(resp.Body)
+
+	// The current data of each plant first
+	if u := eventData(t, readEvent(t, r)); u.PlantKey != "a" || u.PvData.PowerAc != 100 {
+		t.Errorf("Expected the current data of plant a, got %v", u)
+	}
+	if u := eventData(t, readEvent(t, r)); u.PlantKey != "b" {
+		t.Errorf("Expected the current data of plant b, got %v", u)
+	}
+	if _, ok := c.Live("b"); !ok {
+		t.Error("Expected the providers of the streamed plants to be started")
+	}
+
+	// Then every update, of the streamed plants only
+	store.Set("other", &dataproviders.PvData{PowerAc: 1})
+	store.Set("b", &dataproviders.PvData{PowerAc: 200})
+	for {
+		lines := readEvent(t, r)
+		if len(lines) == 1 && lines[0] == ": keepalive" {
+			continue
+		}
+		if u := eventData(t, lines); u.PlantKey != "b" || u.PvData.PowerAc != 200 {
+			t.Errorf("Expected the update of plant b, got %v", u)
+		}
+		break
+	}
+
+	// Kept alive while nothing happens
+	if lines := readEvent(t, r); len(lines) != 1 || lines[0] != ": keepalive" {
+		t.Errorf("Expected a keepalive comment, got %v", lines)
+	}
+
+	// The stream, and its subscription, ends with the request
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Expected the stream to end when the client goes away")
+	}
+}
+
+func Test_stream_rejected(t *testing.T) {
+	store := newBrokerStore()
+	c := newTestController(store)
+	plants := testPlants{"a": {PlantKey: "a", DataProvider: "webtest"}}
+	for query, code := range map[string]int{
+		"":                      http.StatusBadRequest,
+		"?plants=a,nosuchplant": http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		StreamHandler(w, httptest.NewRequest("GET", "/stream"+query, nil), &c, plants, store)
+		if w.Code != code {
+			t.Errorf("Expected %d for %s, got %d", code, query, w.Code)
+		}
+	}
+
+	// The store must be able to publish
+	w := httptest.NewRecorder()
+	StreamHandler(w, httptest.NewRequest("GET", "/stream?plants=a", nil), &c, plants, testPvStore{})
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("Expected a store without subscribers to be rejected, got %d", w.Code)
+	}
+}
@@ -0,0 +1,232 @@
+package web
+
+import (
+	"controller"
+	"dataproviders"
+	"encoding/json"
+	"net/http"
+	"time"
+	"websocket"
+)
+
+// How often provider status is checked for changes
+const statusCheckTime = 5 * time.Second
+
+// A command from the client, eg. {"Action":"subscribe","Plants":["jbr"]}
+type wsCommand struct {
+	Action string
+	Plants []string
+}
+
+// A message to the client.
+// Type is pvdata with the full PvData on subscribe, delta with only
+// the changed fields in Changes, where fields that are gone are null,
+// status when the provider status changed or error when a command
+// could not be handled.
+type wsMessage struct {
+	Type     string
+	PlantKey string                     `json:",omitempty"`
+	PvData   *dataproviders.PvData      `json:",omitempty"`
+	Changes  map[string]json.RawMessage `json:",omitempty"`
+	Status   dataproviders.State        `json:",omitempty"`
+	Error    string                     `json:",omitempty"`
+}
+
+// State of one websocket client
+type wsClient struct {
+	conn       *websocket.Conn
+	c          *controller.Controller
+	pg         PlantDataGetter
+	pvStore    dataproviders.PvStore
+	subscriber dataproviders.PvSubscriber
+	// Created on the first subscribe
+	sub *dataproviders.Subscription
+	// Last sent data and status per subscribed plant
+	sent   map[string]map[string]json.RawMessage
+	status map[string]wsMessage
+}
+
+// Serves /ws, where clients can subscribe and unsubscribe to plants
+// and receive their PvData deltas and provider status changes.
+func WebSocketHandler(w http.ResponseWriter, r *http.Request,
+	c *controller.Controller, pg PlantDataGetter,
+	pvStore dataproviders.PvStore) {
+	subscriber, ok := pvStore.(dataproviders.PvSubscriber)
+	if !ok {
+		http.Error(w, "Streaming is not supported by the store", http.StatusNotImplemented)
+		return
+	}
+	if c == nil {
+		http.Error(w, "Controller not started", http.StatusInternalServerError)
+		return
+	}
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		log.Infof("Websocket upgrade failed: %s", err.Error())
+		return
+	}
+	defer conn.Close()
+
+	client := wsClient{conn: conn, c: c, pg: pg, pvStore: pvStore,
+		subscriber: subscriber,
+		sent:       map[string]map[string]json.RawMessage{},
+		status:     map[string]wsMessage{}}
+	defer func() {
+		if client.sub != nil {
+			client.sub.Close()
+		}
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	commands := make(chan wsCommand)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			b, err := conn.ReadMessage()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			cmd := wsCommand{}
+			if err = json.Unmarshal(b, &cmd); err != nil {
+				client.send(wsMessage{Type: "error", Error: "Bad command: " + err.Error()})
+				continue
+			}
+			select {
+			case commands <- cmd:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	statusTick := time.NewTicker(statusCheckTime)
+	defer statusTick.Stop()
+	keepAlive := time.NewTicker(keepAliveTime)
+	defer keepAlive.Stop()
+	// Nil until the first subscribe, which blocks forever
+	var updates <-chan dataproviders.PvUpdate
+	for {
+		select {
+		case cmd := <-commands:
+			client.handle(cmd)
+			if client.sub != nil {
+				updates = client.sub.C
+			}
+		case u, ok := <-updates:
+			if !ok {
+				return
+			}
+			if _, subscribed := client.sent[u.PlantKey]; subscribed {
+				client.sendDelta(u.PlantKey, &u.PvData)
+			}
+		case <-statusTick.C:
+			client.checkStatus()
+		case <-keepAlive.C:
+			// Providers terminates after a while, start them again if watched
+			for plantkey := range client.sent {
+				if plant := pg.PlantData(plantkey); plant != nil {
+					c.Provider(plant)
+				}
+			}
+			if err := conn.Ping(); err != nil {
+				return
+			}
+		case err := <-readErr:
+			if err != websocket.ErrClosed {
+				log.Infof("Websocket read failed: %s", err.Error())
+			}
+			return
+		}
+	}
+}
+
+func (client *wsClient) handle(cmd wsCommand) {
+	switch cmd.Action {
+	case "subscribe":
+		for _, plantkey := range cmd.Plants {
+			plant := client.pg.PlantData(plantkey)
+			if plant == nil {
+				client.send(wsMessage{Type: "error", PlantKey: plantkey, Error: "Plant not found"})
+				continue
+			}
+			// Starts the provider the same way as the plant handler
+			if err := client.c.Provider(plant); err != nil {
+				client.send(wsMessage{Type: "error", PlantKey: plantkey, Error: err.Error()})
+				continue
+			}
+			if client.sub == nil {
+				client.sub = client.subscriber.Subscribe(plantkey)
+			} else {
+				client.sub.Add(plantkey)
+			}
+			pv := client.pvStore.Get(plantkey)
+			client.sent[plantkey] = fields(&pv)
+			client.send(wsMessage{Type: "pvdata", PlantKey: plantkey, PvData: &pv})
+		}
+		client.checkStatus()
+	case "unsubscribe":
+		if client.sub != nil {
+			client.sub.Remove(cmd.Plants...)
+		}
+		for _, plantkey := range cmd.Plants {
+			delete(client.sent, plantkey)
+			delete(client.status, plantkey)
+		}
+	default:
+		client.send(wsMessage{Type: "error", Error: "Unknown action " + cmd.Action})
+	}
+}
+
+// Send only the fields that changed since the last message for the plant
+func (client *wsClient) sendDelta(plantkey string, pv *dataproviders.PvData) {
+	last := client.sent[plantkey]
+	now := fields(pv)
+	changes := map[string]json.RawMessage{}
+	for k, v := range now {
+		if string(last[k]) != string(v) {
+			changes[k] = v
+		}
+	}
+	// Fields left out when empty, like Phases, are cleared by a null
+	for k := range last {
+		if _, ok := now[k]; !ok {
+			changes[k] = json.RawMessage("null")
+		}
+	}
+	client.sent[plantkey] = now
+	if len(changes) == 0 {
+		return
+	}
+	client.send(wsMessage{Type: "delta", PlantKey: plantkey, Changes: changes})
+}
+
+func (client *wsClient) checkStatus() {
+	for plantkey := range client.sent {
+		status := client.c.Status(plantkey)
+		msg := wsMessage{Type: "status", PlantKey: plantkey, Status: status.State, Error: status.LastError}
+		if last, ok := client.status[plantkey]; ok && last.Status == msg.Status && last.Error == msg.Error {
+			continue
+		}
+		client.status[plantkey] = msg
+		client.send(msg)
+	}
+}
+
+func (client *wsClient) send(msg wsMessage) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		log.Failf("Could not marshal websocket message: %s", err.Error())
+		return
+	}
+	// A failed write is seen by the reader as well, which ends the connection
+	client.conn.WriteMessage(b)
+}
+
+func fields(pv *dataproviders.PvData) map[string]json.RawMessage {
+	m := map[string]json.RawMessage{}
+	b, _ := json.Marshal(pv)
+	json.Unmarshal(b, &m)
+	return m
+}
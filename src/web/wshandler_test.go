@@ -0,0 +1,120 @@
+package web
+
+import (
+	"bufio"
+	"context"
+	"dataproviders"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Handshake with the server, and return the raw connection
+func wsDial(t *testing.T, server *httptest.Server) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: test\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected the connection to be upgraded, got %d", resp.StatusCode)
+	}
+	return conn, r
+}
+
+// Send a short text message, masked as clients must
+func wsSend(conn net.Conn, msg string) {
+	mask := []byte{1, 2, 3, 4}
+	b := []byte{0x81, 0x80 | byte(len(msg))}
+	b = append(b, mask...)
+	for i := range msg {
+		b = append(b, msg[i]^mask[i%4])
+	}
+	conn.Write(b)
+}
+
+// Read the next message of the given type, skipping the others
+func wsRead(t *testing.T, conn net.Conn, r *bufio.Reader, msgType string) wsMessage {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(r, header); err != nil {
+			t.Fatalf("Expected a %s message, %s", msgType, err.Error())
+		}
+		l := uint64(header[1] & 0x7f)
+		switch l {
+		case 126:
+			ext := make([]byte, 2)
+			io.ReadFull(r, ext)
+			l = uint64(binary.BigEndian.Uint16(ext))
+		case 127:
+			ext := make([]byte, 8)
+			io.ReadFull(r, ext)
+			l = binary.BigEndian.Uint64(ext)
+		}
+		payload := make([]byte, l)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			t.Fatalf("Expected a %s message, %s", msgType, err.Error())
+		}
+		if header[0]&0x0f != 1 {
+			continue
+		}
+		msg := wsMessage{}
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			t.Fatal(err.Error())
+		}
+		if msg.Type == msgType {
+			return msg
+		}
+	}
+}
+
+func Test_ws_delta(t *testing.T) {
+	store := newBrokerStore()
+	store.Set("a", &dataproviders.PvData{PowerAc: 100,
+		Phases: []dataproviders.PhaseData{{VoltAc: 230, AmpereAc: 0.5, PowerAc: 100}}})
+	c := newTestController(store)
+	plants := testPlants{"a": {PlantKey: "a", DataProvider: "webtest"}}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		c.Stop(ctx, "a")
+	}()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WebSocketHandler(w, r, &c, plants, store)
+	}))
+	defer server.Close()
+	conn, r := wsDial(t, server)
+	defer conn.Close()
+
+	wsSend(conn, `{"Action":"subscribe","Plants":["a"]}`)
+	if msg := wsRead(t, conn, r, "pvdata"); msg.PlantKey != "a" || msg.PvData == nil || len(msg.PvData.Phases) != 1 {
+		t.Fatalf("Expected the current data of plant a, got %v", msg)
+	}
+
+	// The phases are left out of the json once gone, the client must be told
+	store.Set("a", &dataproviders.PvData{PowerAc: 200})
+	msg := wsRead(t, conn, r, "delta")
+	if string(msg.Changes["PowerAc"]) != "200" {
+		t.Errorf("Expected the changed power, got %v", msg.Changes)
+	}
+	if phases, ok := msg.Changes["Phases"]; !ok || string(phases) != "null" {
+		t.Errorf("Expected the phases to be cleared, got %v", msg.Changes)
+	}
+	if _, ok := msg.Changes["VoltDc"]; ok {
+		t.Errorf("Expected only the changed fields, got %v", msg.Changes)
+	}
+}
@@ -0,0 +1,220 @@
+// Package websocket is a minimal server side implementation of RFC 6455.
+// It supports text messages, ping/pong and close, which is all
+// solarcompare needs. Fragmented messages are reassembled.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const acceptGuid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Largest message accepted from a client
+const MaxMessageSize = 64 * 1024
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+var ErrClosed = errors.New("websocket: connection closed")
+
+type Conn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+	// Locker for sync'ing writes, as pongs are written from the reader
+	writeLock sync.Mutex
+}
+
+// Upgrade the http request to a websocket connection.
+// On failure an http error has been written to w.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != "GET" ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "Expected a websocket upgrade", http.StatusBadRequest)
+		return nil, fmt.Errorf("websocket: not an upgrade request")
+	}
+	if r.Header.Get("Sec-Websocket-Version") != "13" {
+		w.Header().Set("Sec-Websocket-Version", "13")
+		http.Error(w, "Unsupported websocket version", http.StatusBadRequest)
+		return nil, fmt.Errorf("websocket: unsupported version")
+	}
+	key := r.Header.Get("Sec-Websocket-Key")
+	if key == "" {
+		http.Error(w, "Missing Sec-Websocket-Key", http.StatusBadRequest)
+		return nil, fmt.Errorf("websocket: missing key")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Websockets not supported", http.StatusInternalServerError)
+		return nil, fmt.Errorf("websocket: response cannot be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// Deadlines from the http server does not apply to a long lived connection
+	conn.SetDeadline(time.Time{})
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + AcceptKey(key) + "\r\n\r\n")
+	if err = rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Conn{conn: conn, rw: rw}, nil
+}
+
+// The Sec-WebSocket-Accept value for the given client key
+func AcceptKey(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+acceptGuid)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func headerContains(h http.Header, name string, value string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReadMessage blocks until a text or binary message is received.
+// Pings are answered, and ErrClosed is returned when the client closes.
+func (c *Conn) ReadMessage() ([]byte, error) {
+	var msg []byte
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case opPing:
+			if err = c.writeFrame(opPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			c.writeFrame(opClose, payload)
+			return nil, ErrClosed
+		case opText, opBinary, opContinuation:
+			msg = append(msg, payload...)
+			if len(msg) > MaxMessageSize {
+				return nil, fmt.Errorf("websocket: message too large")
+			}
+			if fin {
+				return msg, nil
+			}
+		default:
+			return nil, fmt.Errorf("websocket: unknown opcode %d", op)
+		}
+	}
+}
+
+func (c *Conn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(c.rw, header); err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	op = header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		b := make([]byte, 2)
+		if _, err = io.ReadFull(c.rw, b); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(b))
+	case 127:
+		b := make([]byte, 8)
+		if _, err = io.ReadFull(c.rw, b); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(b)
+	}
+	if length > MaxMessageSize {
+		err = fmt.Errorf("websocket: frame too large")
+		return
+	}
+	// Clients must mask everything they send
+	if !masked {
+		err = fmt.Errorf("websocket: unmasked frame from client")
+		return
+	}
+	mask := make([]byte, 4)
+	if _, err = io.ReadFull(c.rw, mask); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.rw, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+// WriteMessage sends a text message. Is safe to call from multiple go routines.
+func (c *Conn) WriteMessage(msg []byte) error {
+	return c.writeFrame(opText, msg)
+}
+
+func (c *Conn) writeFrame(op byte, payload []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	header := []byte{0x80 | op}
+	switch l := len(payload); {
+	case l < 126:
+		header = append(header, byte(l))
+	case l <= 0xffff:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(l))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(l))
+	}
+	if _, err := c.rw.Write(header); err != nil {
+		return err
+	}
+	if _, err := c.rw.Write(payload); err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+// Ping the client, the pong is swallowed by ReadMessage
+func (c *Conn) Ping() error {
+	return c.writeFrame(opPing, nil)
+}
+
+// Close sends a close frame and closes the connection
+func (c *Conn) Close() error {
+	c.writeFrame(opClose, []byte{0x03, 0xe8}) // 1000, normal closure
+	return c.conn.Close()
+}
@@ -0,0 +1,106 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Handshake against an echo server, and return the raw connection
+func dial(t *testing.T, srv *httptest.Server) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: test\r\n"+
+		"Upgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if resp.StatusCode != 101 {
+		t.Fatalf("Expected 101, got %d", resp.StatusCode)
+	}
+	// Example from RFC 6455
+	if resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Wrong accept key %s", resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+	return conn, r
+}
+
+func maskedFrame(op byte, payload []byte) []byte {
+	mask := []byte{1, 2, 3, 4}
+	b := []byte{0x80 | op, 0x80 | byte(len(payload))}
+	b = append(b, mask...)
+	for i, c := range payload {
+		b = append(b, c^mask[i%4])
+	}
+	return b
+}
+
+func readFrame(t *testing.T, r *bufio.Reader) (byte, []byte) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatal(err.Error())
+	}
+	payload := make([]byte, header[1]&0x7f)
+	io.ReadFull(r, payload)
+	return header[0] & 0x0f, payload
+}
+
+func Test_echo(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(msg)
+		}
+	}))
+	defer srv.Close()
+
+	conn, r := dial(t, srv)
+	defer conn.Close()
+
+	conn.Write(maskedFrame(opPing, []byte("hi")))
+	op, payload := readFrame(t, r)
+	if op != opPong || string(payload) != "hi" {
+		t.Errorf("Expected pong with hi, got %d %s", op, payload)
+	}
+
+	conn.Write(maskedFrame(opText, []byte("hello")))
+	op, payload = readFrame(t, r)
+	if op != opText || string(payload) != "hello" {
+		t.Errorf("Expected text hello, got %d %s", op, payload)
+	}
+
+	conn.Write(maskedFrame(opClose, nil))
+	op, _ = readFrame(t, r)
+	if op != opClose {
+		t.Errorf("Expected close, got %d", op)
+	}
+}
+
+func Test_not_upgrade(t *testing.T) {
+	w := httptest.NewRecorder()
+	_, err := Upgrade(w, httptest.NewRequest("GET", "/", nil))
+	if err == nil || w.Code != http.StatusBadRequest {
+		t.Errorf("Expected bad request, got %d", w.Code)
+	}
+	if !bytes.Contains(w.Body.Bytes(), []byte("upgrade")) {
+		t.Errorf("Unexpected body %s", w.Body.Bytes())
+	}
+}